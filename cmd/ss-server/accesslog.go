@@ -0,0 +1,26 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/qdm12/ss-server/internal/accesslog"
+	"github.com/qdm12/ss-server/internal/config"
+)
+
+// openAccessLog returns the writer of the access log, which
+// is standard output or a file rotated as configured.
+func openAccessLog(settings config.AccessLog) (writer io.WriteCloser, err error) {
+	if settings.Output == "stdout" {
+		return nopCloser{Writer: os.Stdout}, nil
+	}
+	const megabyte = 1 << 20
+	return accesslog.OpenFile(settings.Output, int64(*settings.MaxSize)*megabyte,
+		*settings.MaxAge, int(*settings.MaxBackups))
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
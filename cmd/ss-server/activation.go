@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/qdm12/ss-server/internal/activation"
+	"github.com/qdm12/ss-server/pkg/tcpudp"
+)
+
+var ErrSocketActivationWithPlugin = errors.New("systemd socket activation cannot be used with a plugin")
+
+// serveActivated serves on the sockets inherited from systemd, listening
+// on the address given for the TCP listener or UDP socket not inherited.
+func serveActivated(ctx context.Context, server *tcpudp.Server,
+	sockets activation.Sockets, address string, logger Logger) (err error) {
+	listenConfig := net.ListenConfig{}
+	if sockets.Listener == nil {
+		sockets.Listener, err = listenConfig.Listen(ctx, "tcp", address)
+		if err != nil {
+			sockets.Close()
+			return fmt.Errorf("listening TCP: %w", err)
+		}
+	} else {
+		logger.Info("using TCP listener from systemd on " + sockets.Listener.Addr().String())
+	}
+
+	if sockets.PacketConn == nil {
+		sockets.PacketConn, err = listenConfig.ListenPacket(ctx, "udp", address)
+		if err != nil {
+			sockets.Close()
+			return fmt.Errorf("listening UDP: %w", err)
+		}
+	} else {
+		logger.Info("using UDP socket from systemd on " + sockets.PacketConn.LocalAddr().String())
+	}
+
+	return server.Serve(ctx, sockets.Listener, sockets.PacketConn)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+
+	"github.com/qdm12/ss-server/internal/config"
+	"github.com/qdm12/ss-server/pkg/client"
+)
+
+// runClient runs the Shadowsocks client with its local SOCKS5 and
+// HTTP proxy servers, its tunnel in tunnel mode or its transparent
+// proxy in redir mode, proxying through the remote server configured.
+func runClient(ctx context.Context, settings config.Settings, logger Logger) error {
+	clientSettings := client.Settings{
+		Address:       settings.Address,
+		ServerAddress: settings.ServerAddress,
+		CipherName:    settings.CipherName,
+		Password:      settings.Password,
+		Key:           settings.Key,
+	}
+	switch settings.Mode {
+	case config.ModeClient:
+		clientSettings.HTTPAddress = settings.HTTPAddress
+	case config.ModeTunnel:
+		clientSettings.TunnelAddress = settings.TunnelAddress
+	case config.ModeRedir:
+		clientSettings.Redir = settings.RedirMethod
+	}
+	ssClient, err := client.New(clientSettings, logger)
+	if err != nil {
+		return err
+	}
+	return ssClient.Listen(ctx)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/qdm12/ss-server/internal/core"
+)
+
+// generateKey writes a random base64 encoded key for the cipher
+// given with the -cipher flag, to be used as KEY or as a Shadowsocks
+// 2022 pre-shared key.
+func generateKey(args []string, stdout io.Writer) (err error) {
+	flagSet := flag.NewFlagSet("genkey", flag.ContinueOnError)
+	cipherName := flagSet.String("cipher", core.Chacha20IetfPoly1305,
+		"cipher to generate the key for")
+	err = flagSet.Parse(args)
+	if err != nil {
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+
+	key, err := core.GenerateKey(*cipherName)
+	if err != nil {
+		return fmt.Errorf("generating key: %w", err)
+	}
+	_, err = fmt.Fprintln(stdout, key)
+	return err
+}
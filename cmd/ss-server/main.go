@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
@@ -13,8 +14,15 @@ import (
 	"github.com/qdm12/gosettings/reader/sources/env"
 	"github.com/qdm12/gosplash"
 	"github.com/qdm12/log"
+	"github.com/qdm12/ss-server/internal/accesslog"
+	"github.com/qdm12/ss-server/internal/activation"
 	"github.com/qdm12/ss-server/internal/config"
+	"github.com/qdm12/ss-server/internal/metrics"
+	"github.com/qdm12/ss-server/internal/plugin"
 	"github.com/qdm12/ss-server/internal/profiling"
+	"github.com/qdm12/ss-server/internal/quota"
+	"github.com/qdm12/ss-server/pkg/ratelimit"
+	"github.com/qdm12/ss-server/pkg/tcp"
 	"github.com/qdm12/ss-server/pkg/tcpudp"
 )
 
@@ -43,7 +51,7 @@ func main() {
 
 	errorCh := make(chan error)
 	go func() {
-		errorCh <- _main(ctx, buildInfo, logger, reader)
+		errorCh <- _main(ctx, buildInfo, os.Args, logger, reader)
 	}()
 
 	var err error
@@ -88,7 +96,11 @@ func main() {
 }
 
 func _main(ctx context.Context, buildInfo BuildInformation,
-	logger Logger, configReader *reader.Reader) error {
+	args []string, logger Logger, configReader *reader.Reader) error {
+	if len(args) > 1 && args[1] == "genkey" {
+		return generateKey(args[2:], os.Stdout)
+	}
+
 	splashSettings := gosplash.Settings{
 		User:       "qdm12",
 		Repository: "ss-server",
@@ -121,10 +133,110 @@ func _main(ctx context.Context, buildInfo BuildInformation,
 
 	logger.Info(settings.String())
 
+	if settings.ClientSide() {
+		return runClient(ctx, settings, logger)
+	}
+
+	sockets, err := activation.Read()
+	if err != nil {
+		return fmt.Errorf("reading systemd sockets: %w", err)
+	}
+	socketActivated := sockets.Listener != nil || sockets.PacketConn != nil
+	if socketActivated && settings.Plugin != "" {
+		sockets.Close()
+		return ErrSocketActivationWithPlugin
+	}
+
 	serverSettings := tcpudp.Settings{
-		Address:    settings.Address,
-		CipherName: settings.CipherName,
-		Password:   settings.Password,
+		Address:       settings.Address,
+		CipherName:    settings.CipherName,
+		Password:      settings.Password,
+		Key:           settings.Key,
+		TLSCertFile:   settings.TLSCertFile,
+		TLSKeyFile:    settings.TLSKeyFile,
+		UpstreamProxy: settings.UpstreamProxy,
+		Outbound: tcpudp.Outbound{
+			Address:    settings.Outbound.Address,
+			CipherName: settings.Outbound.CipherName,
+			Password:   settings.Outbound.Password,
+			Key:        settings.Outbound.Key,
+		},
+		TCP: tcp.Settings{
+			Obfs:          settings.Obfs,
+			WebSocketPath: settings.WebSocketPath,
+			WebSocketHost: settings.WebSocketHost,
+		},
+	}
+	for _, user := range settings.Users {
+		serverSettings.Users = append(serverSettings.Users, tcpudp.User{
+			Name:       user.Name,
+			CipherName: user.CipherName,
+			Password:   user.Password,
+		})
+	}
+
+	var serverMetrics *metrics.Metrics
+	if settings.MetricsAddress != "" {
+		serverMetrics = metrics.New()
+		serverSettings.TCP.Metrics = serverMetrics.ForTCP(*settings.Address)
+		serverSettings.UDP.Metrics = serverMetrics.ForUDP(*settings.Address)
+	}
+
+	if settings.AccessLog.Output != "" {
+		accessLogWriter, err := openAccessLog(settings.AccessLog)
+		if err != nil {
+			return fmt.Errorf("opening access log: %w", err)
+		}
+		defer accessLogWriter.Close()
+		onError := func(err error) { logger.Error(err.Error()) }
+		accessLogger, err := accesslog.New(accessLogWriter, settings.AccessLog.Format, onError)
+		if err != nil {
+			return fmt.Errorf("creating access logger: %w", err)
+		}
+		serverSettings.TCP.Accounting = accessLogger.ForTCP()
+		serverSettings.UDP.Accounting = accessLogger.ForUDP()
+	}
+
+	if settings.RateLimits != (config.RateLimits{}) {
+		serverSettings.RateLimiter = ratelimit.New(ratelimit.Settings{
+			Global:     settings.RateLimits.Global,
+			Connection: settings.RateLimits.Connection,
+			User:       settings.RateLimits.User,
+		})
+	}
+
+	var quotaManager *quota.Manager
+	if len(settings.Quota.Limits) > 0 {
+		quotaManager, err = quota.New(settings.Quota.Limits, settings.Quota.Period,
+			*settings.Quota.ResetDay, settings.Quota.StatePath)
+		if err != nil {
+			return fmt.Errorf("creating quota manager: %w", err)
+		}
+		serverSettings.Quota = quotaManager
+	}
+
+	var pluginSupervisor *plugin.Supervisor
+	var pluginListener net.Listener
+	if settings.Plugin != "" {
+		// The plugin listens on the listening address for TCP and forwards
+		// connections to the TCP server listening on a loopback address.
+		pluginListener, err = plugin.ListenLoopback(ctx)
+		if err != nil {
+			return fmt.Errorf("listening for plugin: %w", err)
+		}
+		defer pluginListener.Close()
+		localAddress := pluginListener.Addr().String()
+		serverSettings.TCP.Address = &localAddress
+		pluginSettings := plugin.Settings{
+			Path:          settings.Plugin,
+			Options:       settings.PluginOptions,
+			RemoteAddress: *settings.Address,
+			LocalAddress:  localAddress,
+		}
+		pluginSupervisor, err = plugin.New(pluginSettings, logger)
+		if err != nil {
+			return fmt.Errorf("creating plugin supervisor: %w", err)
+		}
 	}
 
 	server, err := tcpudp.NewServer(serverSettings, logger)
@@ -143,6 +255,50 @@ func _main(ctx context.Context, buildInfo BuildInformation,
 		}()
 	}
 
+	if serverMetrics != nil {
+		logger.Info("metrics server listening on " + settings.MetricsAddress)
+		onShutdownError := func(err error) { logger.Error(err.Error()) }
+		metricsServer := metrics.NewServer(settings.MetricsAddress, serverMetrics, onShutdownError)
+		go func() {
+			if err := metricsServer.Run(ctx); err != nil {
+				logger.Error(err.Error())
+			}
+		}()
+	}
+
+	if quotaManager != nil {
+		quotaCtx, quotaCancel := context.WithCancel(ctx)
+		quotaDone := make(chan struct{})
+		go func() {
+			defer close(quotaDone)
+			const savePeriod = time.Minute
+			onError := func(err error) { logger.Error("saving quota state: " + err.Error()) }
+			quotaManager.Run(quotaCtx, savePeriod, onError)
+		}()
+		defer func() {
+			quotaCancel()
+			<-quotaDone
+		}()
+	}
+
+	if pluginSupervisor != nil {
+		pluginCtx, pluginCancel := context.WithCancel(ctx)
+		pluginDone := make(chan struct{})
+		go func() {
+			defer close(pluginDone)
+			pluginSupervisor.Run(pluginCtx)
+		}()
+		defer func() {
+			pluginCancel()
+			<-pluginDone
+		}()
+	}
+
+	if socketActivated {
+		return serveActivated(ctx, server, sockets, *settings.Address, logger)
+	} else if pluginListener != nil {
+		return servePlugin(ctx, server, pluginListener, *settings.Address)
+	}
 	return server.Listen(ctx)
 }
 
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/qdm12/ss-server/pkg/tcpudp"
+)
+
+// servePlugin serves TCP connections forwarded by the plugin on the
+// loopback listener given, and UDP packets on the address given.
+func servePlugin(ctx context.Context, server *tcpudp.Server,
+	listener net.Listener, address string) (err error) {
+	listenConfig := net.ListenConfig{}
+	packetConnection, err := listenConfig.ListenPacket(ctx, "udp", address)
+	if err != nil {
+		return fmt.Errorf("listening UDP: %w", err)
+	}
+	return server.Serve(ctx, listener, packetConnection)
+}
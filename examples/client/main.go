@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/qdm12/ss-server/pkg/client"
+)
+
+func main() {
+	logger := &logger{}
+	password := "password"
+	address := "127.0.0.1:1080"
+	settings := client.Settings{
+		Address:       &address,
+		ServerAddress: "127.0.0.1:8388",
+		CipherName:    "aes-256-gcm",
+		Password:      &password,
+	}
+	ssClient, err := client.New(settings, logger)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	ctx := context.Background()
+	if err := ssClient.Listen(ctx); err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+type logger struct{}
+
+func (l *logger) Debug(s string) { fmt.Println("debug:", s) }
+func (l *logger) Info(s string)  { fmt.Println("info:", s) }
+func (l *logger) Error(s string) { fmt.Println("error:", s) }
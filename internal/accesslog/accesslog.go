@@ -0,0 +1,196 @@
+// Package accesslog implements an access log recording
+// each TCP and UDP session relayed by the servers.
+package accesslog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qdm12/ss-server/pkg/tcp"
+	"github.com/qdm12/ss-server/pkg/udp"
+)
+
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+var ErrFormatNotSupported = errors.New("access log format is not supported")
+
+// Logger writes a line for each session ended
+// to its writer, in JSON or logfmt format.
+type Logger struct {
+	writer  io.Writer
+	format  string
+	onError func(err error)
+	mutex   sync.Mutex
+	buffer  []byte
+}
+
+// New creates an access logger writing to the writer given in the
+// format given, which can be "json" or "logfmt". The onError function
+// is called if writing a line fails.
+func New(writer io.Writer, format string, onError func(err error)) (
+	logger *Logger, err error) {
+	switch format {
+	case FormatJSON, FormatLogfmt:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrFormatNotSupported, format)
+	}
+	return &Logger{
+		writer:  writer,
+		format:  format,
+		onError: onError,
+	}, nil
+}
+
+// ForTCP returns the accounting implementation
+// logging sessions of the TCP server.
+func (l *Logger) ForTCP() *TCP {
+	return &TCP{logger: l}
+}
+
+// ForUDP returns the accounting implementation
+// logging sessions of the UDP server.
+func (l *Logger) ForUDP() *UDP {
+	return &UDP{logger: l}
+}
+
+// TCP implements the accounting interface of the TCP server.
+type TCP struct {
+	logger *Logger
+}
+
+func (t *TCP) SessionEnded(session tcp.Session) {
+	t.logger.log(record{
+		Start:     session.Start,
+		Protocol:  "tcp",
+		Client:    session.ClientAddress.String(),
+		User:      session.User,
+		Target:    session.TargetAddress,
+		BytesUp:   session.BytesUp,
+		BytesDown: session.BytesDown,
+		Duration:  session.Duration,
+		Err:       session.Err,
+	})
+}
+
+// UDP implements the accounting interface of the UDP server.
+type UDP struct {
+	logger *Logger
+}
+
+func (u *UDP) SessionEnded(session udp.Session) {
+	u.logger.log(record{
+		Start:     session.Start,
+		Protocol:  "udp",
+		Client:    session.ClientAddress.String(),
+		User:      session.User,
+		Target:    strings.Join(session.TargetAddresses, ","),
+		BytesUp:   session.BytesUp,
+		BytesDown: session.BytesDown,
+		Duration:  session.Duration,
+		Err:       session.Err,
+	})
+}
+
+type record struct {
+	Start    time.Time
+	Protocol string
+	Client   string
+	User     string
+	// Target is the target address, or the comma separated
+	// target addresses for UDP sessions.
+	Target    string
+	BytesUp   int64
+	BytesDown int64
+	Duration  time.Duration
+	Err       error
+}
+
+func (l *Logger) log(r record) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	switch l.format {
+	case FormatJSON:
+		l.buffer = appendJSON(l.buffer[:0], r)
+	case FormatLogfmt:
+		l.buffer = appendLogfmt(l.buffer[:0], r)
+	}
+	l.buffer = append(l.buffer, '\n')
+
+	_, err := l.writer.Write(l.buffer)
+	if err != nil {
+		l.onError(fmt.Errorf("writing access log: %w", err))
+	}
+}
+
+func appendJSON(buffer []byte, r record) []byte {
+	jsonRecord := struct {
+		Start     string `json:"start"`
+		Protocol  string `json:"protocol"`
+		Client    string `json:"client"`
+		User      string `json:"user,omitempty"`
+		Target    string `json:"target"`
+		BytesUp   int64  `json:"bytes_up"`
+		BytesDown int64  `json:"bytes_down"`
+		Duration  string `json:"duration"`
+		Error     string `json:"error,omitempty"`
+	}{
+		Start:     r.Start.Format(time.RFC3339Nano),
+		Protocol:  r.Protocol,
+		Client:    r.Client,
+		User:      r.User,
+		Target:    r.Target,
+		BytesUp:   r.BytesUp,
+		BytesDown: r.BytesDown,
+		Duration:  formatDuration(r.Duration),
+	}
+	if r.Err != nil {
+		jsonRecord.Error = r.Err.Error()
+	}
+	// Marshaling cannot fail for this struct of strings and integers.
+	data, _ := json.Marshal(jsonRecord) //nolint:errchkjson
+	return append(buffer, data...)
+}
+
+func appendLogfmt(buffer []byte, r record) []byte {
+	buffer = appendLogfmtPair(buffer, "start", r.Start.Format(time.RFC3339Nano))
+	buffer = appendLogfmtPair(buffer, "protocol", r.Protocol)
+	buffer = appendLogfmtPair(buffer, "client", r.Client)
+	if r.User != "" {
+		buffer = appendLogfmtPair(buffer, "user", r.User)
+	}
+	buffer = appendLogfmtPair(buffer, "target", r.Target)
+	buffer = appendLogfmtPair(buffer, "bytes_up", strconv.FormatInt(r.BytesUp, 10))
+	buffer = appendLogfmtPair(buffer, "bytes_down", strconv.FormatInt(r.BytesDown, 10))
+	buffer = appendLogfmtPair(buffer, "duration", formatDuration(r.Duration))
+	if r.Err != nil {
+		buffer = appendLogfmtPair(buffer, "error", r.Err.Error())
+	}
+	return buffer
+}
+
+func appendLogfmtPair(buffer []byte, key, value string) []byte {
+	if len(buffer) > 0 {
+		buffer = append(buffer, ' ')
+	}
+	buffer = append(buffer, key...)
+	buffer = append(buffer, '=')
+	if value == "" || strings.ContainsAny(value, " =\"\\") ||
+		strings.IndexFunc(value, func(r rune) bool { return r < ' ' }) >= 0 {
+		return strconv.AppendQuote(buffer, value)
+	}
+	return append(buffer, value...)
+}
+
+func formatDuration(duration time.Duration) string {
+	return duration.Round(time.Millisecond).String()
+}
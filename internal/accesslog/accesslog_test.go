@@ -0,0 +1,107 @@
+package accesslog
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qdm12/ss-server/pkg/tcp"
+	"github.com/qdm12/ss-server/pkg/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ tcp.Accounting = (*TCP)(nil)
+	_ udp.Accounting = (*UDP)(nil)
+)
+
+func Test_Logger(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	clientAddress := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5000}
+
+	testCases := map[string]struct {
+		format     string
+		logSession func(logger *Logger)
+		line       string
+	}{
+		"json tcp": {
+			format: FormatJSON,
+			logSession: func(logger *Logger) {
+				logger.ForTCP().SessionEnded(tcp.Session{
+					ClientAddress: clientAddress,
+					User:          "alice",
+					TargetAddress: "example.com:443",
+					Start:         start,
+					Duration:      1500 * time.Millisecond,
+					BytesUp:       10,
+					BytesDown:     200,
+				})
+			},
+			line: `{"start":"2024-03-01T10:00:00Z","protocol":"tcp","client":"1.2.3.4:5000",` +
+				`"user":"alice","target":"example.com:443","bytes_up":10,"bytes_down":200,` +
+				`"duration":"1.5s"}` + "\n",
+		},
+		"json udp with error": {
+			format: FormatJSON,
+			logSession: func(logger *Logger) {
+				logger.ForUDP().SessionEnded(udp.Session{
+					ClientAddress:   clientAddress,
+					TargetAddresses: []string{"1.1.1.1:53", "8.8.8.8:53"},
+					Start:           start,
+					Duration:        time.Minute,
+					BytesUp:         1,
+					BytesDown:       2,
+					Err:             errors.New("test error"),
+				})
+			},
+			line: `{"start":"2024-03-01T10:00:00Z","protocol":"udp","client":"1.2.3.4:5000",` +
+				`"target":"1.1.1.1:53,8.8.8.8:53","bytes_up":1,"bytes_down":2,` +
+				`"duration":"1m0s","error":"test error"}` + "\n",
+		},
+		"logfmt tcp with error": {
+			format: FormatLogfmt,
+			logSession: func(logger *Logger) {
+				logger.ForTCP().SessionEnded(tcp.Session{
+					ClientAddress: clientAddress,
+					User:          "alice",
+					TargetAddress: "example.com:443",
+					Start:         start,
+					Err:           errors.New(`dial "x": refused`),
+				})
+			},
+			line: `start=2024-03-01T10:00:00Z protocol=tcp client=1.2.3.4:5000 user=alice ` +
+				`target=example.com:443 bytes_up=0 bytes_down=0 duration=0s ` +
+				`error="dial \"x\": refused"` + "\n",
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			buffer := bytes.NewBuffer(nil)
+			logger, err := New(buffer, testCase.format, func(err error) {
+				t.Error(err)
+			})
+			require.NoError(t, err)
+
+			testCase.logSession(logger)
+
+			assert.Equal(t, testCase.line, buffer.String())
+		})
+	}
+}
+
+func Test_New(t *testing.T) {
+	t.Parallel()
+
+	_, err := New(nil, "xml", nil)
+	require.ErrorIs(t, err, ErrFormatNotSupported)
+	assert.EqualError(t, err, "access log format is not supported: xml")
+}
@@ -0,0 +1,182 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the time format of the suffix
+// of rotated files, which sorts chronologically.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// File is a file writer rotating the file when its size would
+// exceed a maximum size, or when it was opened for longer than
+// a maximum age. Rotated files are renamed with their rotation
+// time as suffix, and only the most recent ones are kept.
+type File struct {
+	path string
+	// maxSize is the maximum size in bytes of the file,
+	// and 0 disables rotation by size.
+	maxSize int64
+	// maxAge is the maximum duration the same file is written to,
+	// and 0 disables rotation by age.
+	maxAge time.Duration
+	// maxBackups is the maximum number of rotated files to keep,
+	// and 0 keeps all rotated files.
+	maxBackups int
+	timeNow    func() time.Time
+	openFile   func(name string, flag int, perm os.FileMode) (*os.File, error)
+
+	mutex sync.Mutex
+	// file is nil if opening the file failed after a
+	// rotation, and opening it is then retried on Write.
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// OpenFile opens or creates the file at the path given in append mode,
+// to be rotated using the maximum size in bytes, maximum age and maximum
+// number of backups given. A zero value disables the corresponding limit.
+func OpenFile(path string, maxSize int64, maxAge time.Duration,
+	maxBackups int) (file *File, err error) {
+	file = &File{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		timeNow:    time.Now,
+		openFile:   os.OpenFile,
+	}
+	err = file.open()
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *File) open() (err error) {
+	const perms = 0o600
+	file, err := f.openFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, perms)
+	if err != nil {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("getting file size: %w", err)
+	}
+	f.file = file
+	f.size = stat.Size()
+	f.openedAt = f.timeNow()
+	return nil
+}
+
+// Write writes the data to the file, rotating the file
+// first if it is too old or if it would be too large.
+func (f *File) Write(data []byte) (n int, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		err = f.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	tooLarge := f.maxSize > 0 && f.size > 0 && f.size+int64(len(data)) > f.maxSize
+	tooOld := f.maxAge > 0 && f.timeNow().Sub(f.openedAt) >= f.maxAge
+	if tooLarge || tooOld {
+		err = f.rotate()
+		if err != nil {
+			return 0, fmt.Errorf("rotating file: %w", err)
+		}
+	}
+
+	n, err = f.file.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// rotate closes and renames the file, and opens a new file.
+// The file is left nil if an error occurs, for the next
+// Write to retry opening the file.
+func (f *File) rotate() (err error) {
+	err = f.file.Close()
+	f.file = nil
+	if err != nil {
+		return fmt.Errorf("closing file: %w", err)
+	}
+
+	extension := filepath.Ext(f.path)
+	prefix := strings.TrimSuffix(f.path, extension) + "-"
+	backupTime := f.timeNow().UTC()
+	backupPath := prefix + backupTime.Format(backupTimeFormat) + extension
+	for fileExists(backupPath) { // rotated more than once in the same millisecond
+		backupTime = backupTime.Add(time.Millisecond)
+		backupPath = prefix + backupTime.Format(backupTimeFormat) + extension
+	}
+	err = os.Rename(f.path, backupPath)
+	if err != nil {
+		return fmt.Errorf("renaming file: %w", err)
+	}
+
+	err = f.open()
+	if err != nil {
+		return err
+	}
+
+	return f.removeOldBackups(prefix, extension)
+}
+
+func (f *File) removeOldBackups(prefix, extension string) (err error) {
+	if f.maxBackups == 0 {
+		return nil
+	}
+
+	paths, err := filepath.Glob(prefix + "*" + extension)
+	if err != nil {
+		return fmt.Errorf("listing rotated files: %w", err)
+	}
+	backupPaths := make([]string, 0, len(paths))
+	for _, path := range paths {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(path, prefix), extension)
+		_, err := time.Parse(backupTimeFormat, suffix)
+		if err == nil { // ignore files not rotated by us
+			backupPaths = append(backupPaths, path)
+		}
+	}
+	if len(backupPaths) <= f.maxBackups {
+		return nil
+	}
+
+	sort.Strings(backupPaths)
+	for _, backupPath := range backupPaths[:len(backupPaths)-f.maxBackups] {
+		err = os.Remove(backupPath)
+		if err != nil {
+			return fmt.Errorf("removing rotated file: %w", err)
+		}
+	}
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
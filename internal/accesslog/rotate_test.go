@@ -0,0 +1,120 @@
+package accesslog
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_File(t *testing.T) {
+	t.Parallel()
+
+	directory := t.TempDir()
+	path := filepath.Join(directory, "access.log")
+	err := os.WriteFile(filepath.Join(directory, "access-other.log"), nil, 0o600)
+	require.NoError(t, err)
+
+	const maxSize, maxAge, maxBackups = 10, time.Hour, 2
+	file, err := OpenFile(path, maxSize, maxAge, maxBackups)
+	require.NoError(t, err)
+	defer file.Close()
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	file.timeNow = func() time.Time { return now }
+	file.openedAt = now
+
+	write := func(data string) {
+		t.Helper()
+		_, err := file.Write([]byte(data))
+		require.NoError(t, err)
+	}
+
+	write("12345")
+	write("67890") // exactly the maximum size
+	now = now.Add(time.Second)
+	write("abc") // rotated by size
+	now = now.Add(time.Hour)
+	write("def") // rotated by age
+	now = now.Add(time.Second)
+	write("0123456789")
+	write("ghi") // rotated by size in the same millisecond, the oldest backups are removed
+
+	entries, err := os.ReadDir(directory)
+	require.NoError(t, err)
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	expectedNames := []string{
+		"access-2024-03-01T11-00-02.000.log",
+		"access-2024-03-01T11-00-02.001.log",
+		"access-other.log",
+		"access.log",
+	}
+	assert.Equal(t, expectedNames, names)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "ghi", string(data))
+	data, err = os.ReadFile(filepath.Join(directory, "access-2024-03-01T11-00-02.000.log"))
+	require.NoError(t, err)
+	assert.Equal(t, "def", string(data))
+	data, err = os.ReadFile(filepath.Join(directory, "access-2024-03-01T11-00-02.001.log"))
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+}
+
+func Test_File_openFailure(t *testing.T) {
+	t.Parallel()
+
+	directory := t.TempDir()
+	path := filepath.Join(directory, "access.log")
+	const maxSize = 5
+	file, err := OpenFile(path, maxSize, 0, 0)
+	require.NoError(t, err)
+	defer file.Close()
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	file.timeNow = func() time.Time { return now }
+
+	_, err = file.Write([]byte("12345"))
+	require.NoError(t, err)
+
+	errTest := errors.New("test error")
+	file.openFile = func(string, int, os.FileMode) (*os.File, error) {
+		return nil, errTest
+	}
+
+	_, err = file.Write([]byte("abc")) // rotated by size
+	assert.ErrorIs(t, err, errTest)
+	assert.EqualError(t, err, "rotating file: opening file: test error")
+	assert.Nil(t, file.file)
+
+	_, err = file.Write([]byte("abc"))
+	assert.ErrorIs(t, err, errTest)
+	assert.EqualError(t, err, "opening file: test error")
+
+	file.openFile = os.OpenFile
+	_, err = file.Write([]byte("abc"))
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(data))
+	data, err = os.ReadFile(filepath.Join(directory, "access-2024-03-01T10-00-00.000.log"))
+	require.NoError(t, err)
+	assert.Equal(t, "12345", string(data))
+}
+
+func Test_File_Close_afterOpenFailure(t *testing.T) {
+	t.Parallel()
+
+	file := &File{}
+
+	err := file.Close()
+
+	assert.NoError(t, err)
+}
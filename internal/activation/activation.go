@@ -0,0 +1,142 @@
+// Package activation implements systemd socket activation,
+// to use TCP and UDP sockets inherited from systemd.
+package activation
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// firstFileDescriptor is the first file descriptor
+// passed by systemd, as defined by SD_LISTEN_FDS_START.
+const firstFileDescriptor = 3
+
+var (
+	ErrListenFDsNotValid       = errors.New("LISTEN_FDS is not valid")
+	ErrListenFDNamesCount      = errors.New("LISTEN_FDNAMES count does not match LISTEN_FDS")
+	ErrSocketTypeNotSupported  = errors.New("socket is neither a TCP listener nor a UDP socket")
+	ErrTCPListenerDuplicated   = errors.New("more than one TCP listener is inherited")
+	ErrUDPConnectionDuplicated = errors.New("more than one UDP socket is inherited")
+)
+
+// Sockets are the sockets inherited from systemd.
+type Sockets struct {
+	// Listener is the inherited TCP listener,
+	// and is nil if no TCP listener is inherited.
+	Listener net.Listener
+	// PacketConn is the inherited UDP socket,
+	// and is nil if no UDP socket is inherited.
+	PacketConn net.PacketConn
+}
+
+// Read returns the TCP listener and the UDP socket inherited from
+// systemd using the LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES
+// environment variables, and unsets these variables so they are not
+// inherited by child processes. It returns empty sockets if no socket
+// is passed to this process.
+func Read() (sockets Sockets, err error) {
+	defer func() {
+		for _, key := range [...]string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			_ = os.Unsetenv(key)
+		}
+	}()
+
+	names, err := parseEnv(os.Getpid(), os.Getenv("LISTEN_PID"),
+		os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"))
+	if err != nil {
+		return sockets, err
+	}
+
+	for i, name := range names {
+		file := os.NewFile(uintptr(firstFileDescriptor+i), name)
+		err = sockets.add(file)
+		// the file is duplicated by the net package
+		// so it can be closed in any case.
+		_ = file.Close()
+		if err != nil {
+			sockets.Close()
+			return Sockets{}, fmt.Errorf("socket %s: %w", name, err)
+		}
+	}
+	return sockets, nil
+}
+
+// parseEnv returns the names of the sockets passed to the process
+// with the pid given, given the values of the LISTEN_PID, LISTEN_FDS
+// and LISTEN_FDNAMES environment variables. Sockets without a name
+// are named after their file descriptor number.
+func parseEnv(pid int, listenPID, listenFDs, listenFDNames string) (
+	names []string, err error) {
+	if listenPID == "" || listenPID != strconv.Itoa(pid) {
+		// sockets are not passed to this process
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(listenFDs)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("%w: %q", ErrListenFDsNotValid, listenFDs)
+	}
+
+	names = make([]string, count)
+	if listenFDNames != "" {
+		fdNames := strings.Split(listenFDNames, ":")
+		if len(fdNames) != count {
+			return nil, fmt.Errorf("%w: %d names for %d file descriptors",
+				ErrListenFDNamesCount, len(fdNames), count)
+		}
+		copy(names, fdNames)
+	}
+	for i, name := range names {
+		if name == "" || name == "unknown" {
+			names[i] = "fd " + strconv.Itoa(firstFileDescriptor+i)
+		}
+	}
+	return names, nil
+}
+
+func (s *Sockets) add(file *os.File) (err error) {
+	listener, err := net.FileListener(file)
+	if err == nil {
+		_, isTCP := listener.(*net.TCPListener)
+		switch {
+		case !isTCP:
+			_ = listener.Close()
+			return ErrSocketTypeNotSupported
+		case s.Listener != nil:
+			_ = listener.Close()
+			return ErrTCPListenerDuplicated
+		}
+		s.Listener = listener
+		return nil
+	}
+
+	packetConnection, err := net.FilePacketConn(file)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSocketTypeNotSupported, err)
+	}
+	_, isUDP := packetConnection.(*net.UDPConn)
+	switch {
+	case !isUDP:
+		_ = packetConnection.Close()
+		return ErrSocketTypeNotSupported
+	case s.PacketConn != nil:
+		_ = packetConnection.Close()
+		return ErrUDPConnectionDuplicated
+	}
+	s.PacketConn = packetConnection
+	return nil
+}
+
+// Close closes the sockets.
+func (s *Sockets) Close() {
+	if s.Listener != nil {
+		_ = s.Listener.Close()
+	}
+	if s.PacketConn != nil {
+		_ = s.PacketConn.Close()
+	}
+}
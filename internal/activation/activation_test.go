@@ -0,0 +1,67 @@
+package activation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseEnv(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		listenPID     string
+		listenFDs     string
+		listenFDNames string
+		names         []string
+		errWrapped    error
+		errMessage    string
+	}{
+		"no socket activation": {},
+		"sockets for another process": {
+			listenPID: "2",
+			listenFDs: "1",
+		},
+		"invalid count": {
+			listenPID:  "1",
+			listenFDs:  "x",
+			errWrapped: ErrListenFDsNotValid,
+			errMessage: `LISTEN_FDS is not valid: "x"`,
+		},
+		"names count mismatch": {
+			listenPID:     "1",
+			listenFDs:     "2",
+			listenFDNames: "tcp",
+			errWrapped:    ErrListenFDNamesCount,
+			errMessage:    "LISTEN_FDNAMES count does not match LISTEN_FDS: 1 names for 2 file descriptors",
+		},
+		"sockets without names": {
+			listenPID: "1",
+			listenFDs: "2",
+			names:     []string{"fd 3", "fd 4"},
+		},
+		"sockets with names": {
+			listenPID:     "1",
+			listenFDs:     "2",
+			listenFDNames: "ss-tcp.socket:unknown",
+			names:         []string{"ss-tcp.socket", "fd 4"},
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			const pid = 1
+			names, err := parseEnv(pid, testCase.listenPID,
+				testCase.listenFDs, testCase.listenFDNames)
+
+			assert.ErrorIs(t, err, testCase.errWrapped)
+			if testCase.errWrapped != nil {
+				assert.EqualError(t, err, testCase.errMessage)
+			}
+			assert.Equal(t, testCase.names, names)
+		})
+	}
+}
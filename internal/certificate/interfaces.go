@@ -0,0 +1,6 @@
+package certificate
+
+type Logger interface {
+	Info(s string)
+	Error(s string)
+}
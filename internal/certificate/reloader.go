@@ -0,0 +1,117 @@
+// Package certificate provides a TLS certificate reloaded
+// from disk when its files change.
+package certificate
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader serves a TLS certificate and private key loaded from files,
+// and reloads them when the files change. The files are checked for
+// changes at most once per check period, during TLS handshakes.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	logger   Logger
+	timeNow  func() time.Time
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	certStat    fileStat
+	keyStat     fileStat
+	lastCheck   time.Time
+}
+
+// fileStat is the file information used to detect a file change.
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader creates a reloader for the certificate and key files
+// given, and loads them a first time.
+func NewReloader(certFile, keyFile string, logger Logger) (reloader *Reloader, err error) {
+	reloader = &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+		timeNow:  time.Now,
+	}
+	reloader.certStat, reloader.keyStat, err = reloader.stat()
+	if err != nil {
+		return nil, err
+	}
+	err = reloader.load()
+	if err != nil {
+		return nil, err
+	}
+	reloader.lastCheck = reloader.timeNow()
+	return reloader, nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if
+// its files changed. If the reload fails, the error is logged and the
+// previous certificate is returned, so a partially written certificate or
+// key file does not break new connections. It is meant to be used as the
+// GetCertificate field of a tls.Config.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	const checkPeriod = time.Second
+	now := r.timeNow()
+	if now.Sub(r.lastCheck) < checkPeriod {
+		return r.certificate, nil
+	}
+	r.lastCheck = now
+
+	certStat, keyStat, err := r.stat()
+	if err != nil {
+		r.logger.Error("checking TLS certificate files: " + err.Error())
+		return r.certificate, nil
+	} else if certStat == r.certStat && keyStat == r.keyStat {
+		return r.certificate, nil
+	}
+
+	err = r.load()
+	if err != nil {
+		r.logger.Error("reloading TLS certificate: " + err.Error())
+		return r.certificate, nil
+	}
+	r.certStat, r.keyStat = certStat, keyStat
+	r.logger.Info("TLS certificate reloaded from " + r.certFile)
+	return r.certificate, nil
+}
+
+func (r *Reloader) stat() (certStat, keyStat fileStat, err error) {
+	certStat, err = statFile(r.certFile)
+	if err != nil {
+		return certStat, keyStat, err
+	}
+	keyStat, err = statFile(r.keyFile)
+	if err != nil {
+		return certStat, keyStat, err
+	}
+	return certStat, keyStat, nil
+}
+
+func statFile(path string) (stat fileStat, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return stat, err
+	}
+	return fileStat{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+func (r *Reloader) load() (err error) {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading key pair: %w", err)
+	}
+	r.certificate = &certificate
+	return nil
+}
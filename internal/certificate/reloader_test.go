@@ -0,0 +1,110 @@
+package certificate
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testLogger struct {
+	infos  []string
+	errors []string
+}
+
+func (l *testLogger) Info(s string)  { l.infos = append(l.infos, s) }
+func (l *testLogger) Error(s string) { l.errors = append(l.errors, s) }
+
+// writeKeyPair writes a self signed certificate with the common name
+// given and its private key, and sets their modification time.
+func writeKeyPair(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template,
+		&privateKey.PublicKey, privateKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(privateKey)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	err = os.WriteFile(certFile, certPEM, 0o600)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	err = os.WriteFile(keyFile, keyPEM, 0o600)
+	require.NoError(t, err)
+
+	for _, path := range []string{certFile, keyFile} {
+		err = os.Chtimes(path, modTime, modTime)
+		require.NoError(t, err)
+	}
+}
+
+func commonNameOf(t *testing.T, reloader *Reloader) string {
+	t.Helper()
+	certificate, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	require.NoError(t, err)
+	return parsed.Subject.CommonName
+}
+
+func Test_Reloader(t *testing.T) {
+	t.Parallel()
+
+	directory := t.TempDir()
+	certFile := filepath.Join(directory, "cert.pem")
+	keyFile := filepath.Join(directory, "key.pem")
+	writeKeyPair(t, certFile, keyFile, "first", time.Unix(1, 0))
+
+	logger := &testLogger{}
+	reloader, err := NewReloader(certFile, keyFile, logger)
+	require.NoError(t, err)
+	now := time.Unix(100, 0)
+	reloader.timeNow = func() time.Time { return now }
+
+	assert.Equal(t, "first", commonNameOf(t, reloader))
+
+	// Changes are not checked before the check period elapses.
+	writeKeyPair(t, certFile, keyFile, "second", time.Unix(2, 0))
+	reloader.lastCheck = now
+	assert.Equal(t, "first", commonNameOf(t, reloader))
+
+	now = now.Add(time.Second)
+	assert.Equal(t, "second", commonNameOf(t, reloader))
+	assert.Equal(t, []string{"TLS certificate reloaded from " + certFile}, logger.infos)
+
+	// An invalid key file keeps the previous certificate.
+	err = os.WriteFile(keyFile, []byte("invalid"), 0o600)
+	require.NoError(t, err)
+	now = now.Add(time.Second)
+	assert.Equal(t, "second", commonNameOf(t, reloader))
+	require.Len(t, logger.errors, 1)
+	assert.Contains(t, logger.errors[0], "reloading TLS certificate: loading key pair: ")
+}
+
+func Test_NewReloader_missingFile(t *testing.T) {
+	t.Parallel()
+
+	directory := t.TempDir()
+	_, err := NewReloader(filepath.Join(directory, "cert.pem"),
+		filepath.Join(directory, "key.pem"), &testLogger{})
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
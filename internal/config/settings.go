@@ -1,43 +1,310 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"net"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/qdm12/gosettings"
 	"github.com/qdm12/gosettings/reader"
 	"github.com/qdm12/gosettings/validate"
 	"github.com/qdm12/gotree"
 	"github.com/qdm12/log"
+	"github.com/qdm12/ss-server/internal/accesslog"
+	"github.com/qdm12/ss-server/internal/core"
+	"github.com/qdm12/ss-server/internal/quota"
+	"github.com/qdm12/ss-server/internal/upstream"
+	"github.com/qdm12/ss-server/pkg/ratelimit"
 )
 
 type Settings struct {
+	Mode          string
+	ServerAddress string
+	HTTPAddress   string
+	TunnelAddress string
+	RedirMethod   string
+	CipherName    string
+	Password      *string
+	Key           *string
+	Users         []User
+	Address       *string
+	Plugin        string
+	PluginOptions string
+	Obfs          string
+	WebSocketPath string
+	WebSocketHost string
+	TLSCertFile   string
+	TLSKeyFile    string
+	UpstreamProxy string
+	Outbound      Outbound
+	LogLevel      string
+	Profiling     *bool
+	// MetricsAddress is the listening address of the Prometheus
+	// metrics HTTP server, which is disabled if empty.
+	MetricsAddress string
+	AccessLog      AccessLog
+	Quota          Quota
+	RateLimits     RateLimits
+}
+
+// RateLimits are the bandwidth limits in server mode,
+// where zero limits mean no limit.
+type RateLimits struct {
+	Global     ratelimit.Limits
+	Connection ratelimit.Limits
+	User       ratelimit.Limits
+}
+
+// Quota is the per user data quota configuration in server mode.
+type Quota struct {
+	// Limits maps user names to their quota in bytes,
+	// and quotas are disabled if it is empty.
+	Limits map[string]uint64
+	// Period is "daily", "weekly" or "monthly".
+	Period string
+	// ResetDay is the day of the month the monthly period starts.
+	ResetDay *int
+	// StatePath is the path of the file persisting the usage.
+	StatePath string
+}
+
+// AccessLog is the access log configuration in server mode.
+type AccessLog struct {
+	// Output is "stdout" or the path of the access log file,
+	// and the access log is disabled if empty.
+	Output string
+	// Format is "json" or "logfmt".
+	Format string
+	// MaxSize is the maximum size in megabytes of the access
+	// log file before rotation, and 0 disables it.
+	MaxSize *uint
+	// MaxAge is the maximum age of the access log file
+	// before rotation, and 0 disables it.
+	MaxAge *time.Duration
+	// MaxBackups is the maximum number of rotated
+	// files to keep, and 0 keeps all of them.
+	MaxBackups *uint
+}
+
+// User is a user with its own password, identified using
+// Shadowsocks 2022 extensible identity headers, or by trial
+// decryption for the other ciphers.
+type User struct {
+	Name       string
+	CipherName string
+	Password   string
+}
+
+// Outbound is the next Shadowsocks server to relay
+// connections and packets to in server mode.
+type Outbound struct {
+	Address    string
 	CipherName string
 	Password   *string
-	Address    *string
-	LogLevel   string
-	Profiling  *bool
+	Key        *string
+}
+
+const (
+	ModeServer = "server"
+	ModeClient = "client"
+	ModeTunnel = "tunnel"
+	ModeRedir  = "redir"
+)
+
+// ClientSide returns true if the mode is a client side
+// mode proxying through a remote Shadowsocks server.
+func (s *Settings) ClientSide() bool {
+	return s.Mode == ModeClient || s.Mode == ModeTunnel || s.Mode == ModeRedir
 }
 
 func (s *Settings) SetDefaults() {
+	s.Mode = gosettings.DefaultComparable(s.Mode, ModeServer)
 	s.CipherName = gosettings.DefaultComparable(s.CipherName, "chacha20-ietf-poly1305")
 	s.Password = gosettings.DefaultPointer(s.Password, "")
-	s.Address = gosettings.DefaultPointer(s.Address, ":8388")
+	s.Key = gosettings.DefaultPointer(s.Key, "")
+	defaultAddress := ":8388"
+	if s.ClientSide() {
+		defaultAddress = "127.0.0.1:1080"
+	}
+	s.Address = gosettings.DefaultPointer(s.Address, defaultAddress)
+	s.RedirMethod = gosettings.DefaultComparable(s.RedirMethod, "redirect")
+	s.Outbound.CipherName = gosettings.DefaultComparable(s.Outbound.CipherName, "chacha20-ietf-poly1305")
+	s.Outbound.Password = gosettings.DefaultPointer(s.Outbound.Password, "")
+	s.Outbound.Key = gosettings.DefaultPointer(s.Outbound.Key, "")
 	s.LogLevel = gosettings.DefaultComparable(s.LogLevel, "info")
 	s.Profiling = gosettings.DefaultPointer(s.Profiling, false)
+	s.AccessLog.Format = gosettings.DefaultComparable(s.AccessLog.Format, accesslog.FormatJSON)
+	const defaultMaxSize, defaultMaxAge, defaultMaxBackups = 100, 24 * time.Hour, 7
+	s.AccessLog.MaxSize = gosettings.DefaultPointer(s.AccessLog.MaxSize, defaultMaxSize)
+	s.AccessLog.MaxAge = gosettings.DefaultPointer(s.AccessLog.MaxAge, defaultMaxAge)
+	s.AccessLog.MaxBackups = gosettings.DefaultPointer(s.AccessLog.MaxBackups, defaultMaxBackups)
+	s.Quota.Period = gosettings.DefaultComparable(s.Quota.Period, quota.PeriodMonthly)
+	s.Quota.ResetDay = gosettings.DefaultPointer(s.Quota.ResetDay, 1)
+	s.Quota.StatePath = gosettings.DefaultComparable(s.Quota.StatePath, "quotas.json")
 }
 
+var (
+	ErrWebSocketWithObfs    = errors.New("WebSocket cannot be used with obfuscation")
+	ErrPathNotAbsolute      = errors.New("path is not absolute")
+	ErrTLSFileMissing       = errors.New("TLS certificate or key file is missing")
+	ErrServerAddressMissing = errors.New("server address is missing")
+	ErrTunnelAddressMissing = errors.New("tunnel address is missing")
+	ErrPluginWithObfs       = errors.New("plugin cannot be used with obfuscation")
+	ErrPluginWithWebSocket  = errors.New("plugin cannot be used with WebSocket")
+	ErrPluginWithTLS        = errors.New("plugin cannot be used with TLS")
+)
+
 func (s *Settings) Validate() (err error) {
-	err = validate.IsOneOf(s.CipherName, "chacha20-ietf-poly1305", "aes-256-gcm", "aes-128-gcm")
+	err = validate.IsOneOf(s.Mode, ModeServer, ModeClient, ModeTunnel, ModeRedir)
+	if err != nil {
+		return fmt.Errorf("mode: %w", err)
+	}
+
+	switch s.Mode {
+	case ModeTunnel:
+		if s.TunnelAddress == "" {
+			return ErrTunnelAddressMissing
+		}
+	case ModeRedir:
+		err = validate.IsOneOf(s.RedirMethod, "redirect", "tproxy")
+		if err != nil {
+			return fmt.Errorf("redir method: %w", err)
+		}
+	}
+
+	if s.ClientSide() {
+		if s.ServerAddress == "" {
+			return ErrServerAddressMissing
+		}
+		if s.Mode == ModeClient && s.HTTPAddress != "" {
+			err = validate.ListeningAddress(s.HTTPAddress, os.Geteuid())
+			if err != nil {
+				return fmt.Errorf("HTTP listening address: %w", err)
+			}
+		}
+		// Shadowsocks 2022 ciphers are only implemented server side.
+		err = validate.IsOneOf(s.CipherName, "chacha20-ietf-poly1305", "xchacha20-ietf-poly1305",
+			"aes-256-gcm", "aes-192-gcm", "aes-128-gcm")
+		if err != nil {
+			return fmt.Errorf("cipher for %s mode: %w", s.Mode, err)
+		}
+	}
+
+	err = validate.IsOneOf(s.CipherName, "chacha20-ietf-poly1305", "xchacha20-ietf-poly1305",
+		"aes-256-gcm", "aes-192-gcm", "aes-128-gcm",
+		"2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "2022-blake3-chacha20-poly1305")
 	if err != nil {
 		return fmt.Errorf("cipher: %w", err)
 	}
 
+	switch {
+	case *s.Key != "":
+		err = core.CheckPreSharedKey(*s.Key, s.CipherName)
+		if err != nil {
+			return fmt.Errorf("key: %w", err)
+		}
+	case core.Is2022(s.CipherName):
+		err = core.CheckPreSharedKey(*s.Password, s.CipherName)
+		if err != nil {
+			return fmt.Errorf("password: %w", err)
+		}
+	}
+
+	coreUsers := make([]core.User, len(s.Users))
+	for i, user := range s.Users {
+		coreUsers[i] = core.User{
+			Name:       user.Name,
+			CipherName: user.CipherName,
+			Password:   user.Password,
+		}
+	}
+	err = core.CheckUsers(s.CipherName, coreUsers)
+	if err != nil {
+		return fmt.Errorf("users: %w", err)
+	}
+
 	err = validate.ListeningAddress(*s.Address, os.Geteuid())
 	if err != nil {
 		return fmt.Errorf("listening address: %w", err)
 	}
 
+	if s.Obfs != "" {
+		err = validate.IsOneOf(s.Obfs, "http", "tls")
+		if err != nil {
+			return fmt.Errorf("obfs: %w", err)
+		}
+	}
+
+	if s.WebSocketPath != "" {
+		if s.Obfs != "" {
+			return ErrWebSocketWithObfs
+		}
+		if !strings.HasPrefix(s.WebSocketPath, "/") {
+			return fmt.Errorf("WebSocket path: %w: %s", ErrPathNotAbsolute, s.WebSocketPath)
+		}
+	}
+
+	if (s.TLSCertFile == "") != (s.TLSKeyFile == "") {
+		return fmt.Errorf("%w: certificate file %q and key file %q",
+			ErrTLSFileMissing, s.TLSCertFile, s.TLSKeyFile)
+	}
+
+	// The plugin forwards the Shadowsocks stream of its clients to
+	// the loopback listener of the server, so built-in transports
+	// would wait for a handshake the plugin never sends.
+	if s.Plugin != "" {
+		switch {
+		case s.Obfs != "":
+			return ErrPluginWithObfs
+		case s.WebSocketPath != "":
+			return ErrPluginWithWebSocket
+		case s.TLSCertFile != "":
+			return ErrPluginWithTLS
+		}
+	}
+
+	if s.Mode == ModeServer && s.UpstreamProxy != "" {
+		err = upstream.Check(s.UpstreamProxy, false)
+		if err != nil {
+			return fmt.Errorf("upstream proxy: %w", err)
+		}
+	}
+
+	if s.Mode == ModeServer && s.Outbound.Address != "" {
+		err = s.Outbound.validate()
+		if err != nil {
+			return fmt.Errorf("outbound: %w", err)
+		}
+	}
+
+	if s.Mode == ModeServer && s.MetricsAddress != "" {
+		err = validate.ListeningAddress(s.MetricsAddress, os.Geteuid())
+		if err != nil {
+			return fmt.Errorf("metrics listening address: %w", err)
+		}
+	}
+
+	if s.Mode == ModeServer && s.AccessLog.Output != "" {
+		err = validate.IsOneOf(s.AccessLog.Format, accesslog.FormatJSON, accesslog.FormatLogfmt)
+		if err != nil {
+			return fmt.Errorf("access log format: %w", err)
+		}
+	}
+
+	if s.Mode == ModeServer && len(s.Quota.Limits) > 0 {
+		err = s.Quota.validate(s.Users)
+		if err != nil {
+			return fmt.Errorf("quota: %w", err)
+		}
+	}
+
 	_, err = log.ParseLevel(s.LogLevel)
 	if err != nil {
 		return fmt.Errorf("log level: %w", err)
@@ -46,28 +313,392 @@ func (s *Settings) Validate() (err error) {
 	return nil
 }
 
+func (o *Outbound) validate() (err error) {
+	_, _, err = net.SplitHostPort(o.Address)
+	if err != nil {
+		return fmt.Errorf("address: %w", err)
+	}
+
+	// Shadowsocks 2022 ciphers are only implemented server side.
+	err = validate.IsOneOf(o.CipherName, "chacha20-ietf-poly1305", "xchacha20-ietf-poly1305",
+		"aes-256-gcm", "aes-192-gcm", "aes-128-gcm")
+	if err != nil {
+		return fmt.Errorf("cipher: %w", err)
+	}
+
+	if *o.Key != "" {
+		err = core.CheckPreSharedKey(*o.Key, o.CipherName)
+		if err != nil {
+			return fmt.Errorf("key: %w", err)
+		}
+	}
+	return nil
+}
+
+var ErrQuotaUserNotFound = errors.New("user with quota not found in users")
+
+func (q *Quota) validate(users []User) (err error) {
+	err = quota.CheckPeriod(q.Period, *q.ResetDay)
+	if err != nil {
+		return err
+	}
+	for name := range q.Limits {
+		found := false
+		for _, user := range users {
+			if user.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: %s", ErrQuotaUserNotFound, name)
+		}
+	}
+	return nil
+}
+
 func (s *Settings) ToLinesNode() *gotree.Node {
 	node := gotree.New("Settings summary:")
+	node.Appendf("Mode: " + s.Mode)
 	node.Appendf("Listening address: " + *s.Address)
+	switch s.Mode {
+	case ModeTunnel:
+		node.Appendf("Tunnel address: " + s.TunnelAddress)
+	case ModeRedir:
+		node.Appendf("Redir method: " + s.RedirMethod)
+	}
+	if s.ClientSide() {
+		node.Appendf("Server address: " + s.ServerAddress)
+		if s.Mode == ModeClient && s.HTTPAddress != "" {
+			node.Appendf("HTTP proxy listening address: " + s.HTTPAddress)
+		}
+	}
 	node.Appendf("Cipher name: " + s.CipherName)
-	node.Appendf("Password: " + gosettings.ObfuscateKey(*s.Password))
+	if *s.Key != "" {
+		node.Appendf("Key: " + gosettings.ObfuscateKey(*s.Key))
+	} else {
+		node.Appendf("Password: " + gosettings.ObfuscateKey(*s.Password))
+	}
+	if len(s.Users) > 0 {
+		usersNode := node.Appendf("Users:")
+		for _, user := range s.Users {
+			userNode := usersNode.Appendf(user.Name + ":")
+			if user.CipherName != "" {
+				userNode.Appendf("Cipher name: " + user.CipherName)
+			}
+			userNode.Appendf("Password: " + gosettings.ObfuscateKey(user.Password))
+		}
+	}
+	if s.Plugin != "" {
+		pluginNode := node.Appendf("Plugin: " + s.Plugin)
+		if s.PluginOptions != "" {
+			pluginNode.Appendf("Options: " + s.PluginOptions)
+		}
+	}
+	if s.Obfs != "" {
+		node.Appendf("Obfuscation: " + s.Obfs)
+	}
+	if s.TLSCertFile != "" {
+		tlsNode := node.Appendf("TLS:")
+		tlsNode.Appendf("Certificate file: " + s.TLSCertFile)
+		tlsNode.Appendf("Key file: " + s.TLSKeyFile)
+	}
+	if s.WebSocketPath != "" {
+		webSocketNode := node.Appendf("WebSocket path: " + s.WebSocketPath)
+		if s.WebSocketHost != "" {
+			webSocketNode.Appendf("Host: " + s.WebSocketHost)
+		}
+	}
+	if s.Mode == ModeServer && s.UpstreamProxy != "" {
+		node.Appendf("Upstream proxy: " + redactURL(s.UpstreamProxy))
+	}
+	if s.Mode == ModeServer && s.Outbound.Address != "" {
+		outboundNode := node.Appendf("Outbound server: " + s.Outbound.Address)
+		outboundNode.Appendf("Cipher name: " + s.Outbound.CipherName)
+		if *s.Outbound.Key != "" {
+			outboundNode.Appendf("Key: " + gosettings.ObfuscateKey(*s.Outbound.Key))
+		} else {
+			outboundNode.Appendf("Password: " + gosettings.ObfuscateKey(*s.Outbound.Password))
+		}
+	}
+	if s.Mode == ModeServer && s.RateLimits != (RateLimits{}) {
+		rateLimitsNode := node.Appendf("Rate limits:")
+		appendLimits(rateLimitsNode, "Global", s.RateLimits.Global)
+		appendLimits(rateLimitsNode, "Connection", s.RateLimits.Connection)
+		appendLimits(rateLimitsNode, "User", s.RateLimits.User)
+	}
+	if s.Mode == ModeServer && len(s.Quota.Limits) > 0 {
+		quotaNode := node.Appendf("Quotas:")
+		names := make([]string, 0, len(s.Quota.Limits))
+		for name := range s.Quota.Limits {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			quotaNode.Appendf("%s: %d bytes", name, s.Quota.Limits[name])
+		}
+		if s.Quota.Period == quota.PeriodMonthly {
+			quotaNode.Appendf("Period: %s, starting on day %d", s.Quota.Period, *s.Quota.ResetDay)
+		} else {
+			quotaNode.Appendf("Period: " + s.Quota.Period)
+		}
+		quotaNode.Appendf("State file: " + s.Quota.StatePath)
+	}
 	node.Appendf("Log level: " + s.LogLevel)
 	node.Appendf("Profiling: " + gosettings.BoolToYesNo(s.Profiling))
+	if s.Mode == ModeServer && s.MetricsAddress != "" {
+		node.Appendf("Metrics listening address: " + s.MetricsAddress)
+	}
+	if s.Mode == ModeServer && s.AccessLog.Output != "" {
+		accessLogNode := node.Appendf("Access log: " + s.AccessLog.Output)
+		accessLogNode.Appendf("Format: " + s.AccessLog.Format)
+		if s.AccessLog.Output != "stdout" {
+			accessLogNode.Appendf("Maximum size: %d MB", *s.AccessLog.MaxSize)
+			accessLogNode.Appendf("Maximum age: %s", *s.AccessLog.MaxAge)
+			accessLogNode.Appendf("Maximum backups: %d", *s.AccessLog.MaxBackups)
+		}
+	}
 	return node
 }
 
+func appendLimits(node *gotree.Node, name string, limits ratelimit.Limits) {
+	if limits == (ratelimit.Limits{}) {
+		return
+	}
+	limitsNode := node.Appendf(name + ":")
+	if limits.Up > 0 {
+		limitsNode.Appendf("Upload: %d bytes/s", limits.Up)
+	}
+	if limits.Down > 0 {
+		limitsNode.Appendf("Download: %d bytes/s", limits.Down)
+	}
+}
+
 func (s Settings) String() string {
 	return s.ToLinesNode().String()
 }
 
+// redactURL returns the URL with its password replaced by xxxxx.
+func redactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return parsed.Redacted()
+}
+
 func (s *Settings) Read(reader *reader.Reader) (err error) {
+	s.Mode = reader.String("MODE")
+	s.ServerAddress = reader.String("SERVER_ADDRESS")
+	s.HTTPAddress = reader.String("HTTP_LISTENING_ADDRESS")
+	s.TunnelAddress = reader.String("TUNNEL_ADDRESS")
+	s.RedirMethod = reader.String("REDIR_METHOD")
 	s.CipherName = reader.String("CIPHER")
 	s.Password = reader.Get("PASSWORD")
+	s.Key, err = readKey(reader)
+	if err != nil {
+		return fmt.Errorf("key: %w", err)
+	}
+	s.Users, err = readUsers(reader)
+	if err != nil {
+		return fmt.Errorf("users: %w", err)
+	}
 	s.Address = reader.Get("LISTENING_ADDRESS")
+	s.Plugin = reader.String("PLUGIN")
+	s.PluginOptions = reader.String("PLUGIN_OPTS")
+	s.Obfs = reader.String("OBFS")
+	s.WebSocketPath = reader.String("WEBSOCKET_PATH")
+	s.WebSocketHost = reader.String("WEBSOCKET_HOST")
+	s.TLSCertFile = reader.String("TLS_CERT_FILE")
+	s.TLSKeyFile = reader.String("TLS_KEY_FILE")
+	s.UpstreamProxy = reader.String("UPSTREAM_PROXY")
+	s.Outbound.Address = reader.String("OUTBOUND_ADDRESS")
+	s.Outbound.CipherName = reader.String("OUTBOUND_CIPHER")
+	s.Outbound.Password = reader.Get("OUTBOUND_PASSWORD")
+	s.Outbound.Key = reader.Get("OUTBOUND_KEY")
 	s.LogLevel = reader.String("LOG_LEVEL")
+	s.MetricsAddress = reader.String("METRICS_LISTENING_ADDRESS")
+	err = s.AccessLog.read(reader)
+	if err != nil {
+		return fmt.Errorf("access log: %w", err)
+	}
+	err = s.Quota.read(reader)
+	if err != nil {
+		return fmt.Errorf("quota: %w", err)
+	}
+	s.RateLimits, err = readRateLimits(reader)
+	if err != nil {
+		return fmt.Errorf("rate limits: %w", err)
+	}
 	s.Profiling, err = reader.BoolPtr("PROFILING")
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+func (a *AccessLog) read(reader *reader.Reader) (err error) {
+	a.Output = reader.String("ACCESS_LOG")
+	a.Format = reader.String("ACCESS_LOG_FORMAT")
+	a.MaxSize, err = reader.UintPtr("ACCESS_LOG_MAX_SIZE")
+	if err != nil {
+		return err
+	}
+	a.MaxAge, err = reader.DurationPtr("ACCESS_LOG_MAX_AGE")
+	if err != nil {
+		return err
+	}
+	a.MaxBackups, err = reader.UintPtr("ACCESS_LOG_MAX_BACKUPS")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (q *Quota) read(reader *reader.Reader) (err error) {
+	q.Limits, err = readQuotaLimits(reader)
+	if err != nil {
+		return err
+	}
+	q.Period = reader.String("QUOTA_PERIOD")
+	q.ResetDay, err = reader.IntPtr("QUOTA_RESET_DAY")
+	if err != nil {
+		return err
+	}
+	q.StatePath = reader.String("QUOTA_STATE_FILE")
+	return nil
+}
+
+// readRateLimits reads the global, connection and user rate limits
+// from the RATE_LIMIT_*_UP and RATE_LIMIT_*_DOWN values, each being
+// a number of bytes per second optionally suffixed with K, M, G or T
+// for powers of 1024.
+func readRateLimits(reader *reader.Reader) (settings RateLimits, err error) {
+	levels := [...]struct {
+		key    string
+		limits *ratelimit.Limits
+	}{
+		{key: "RATE_LIMIT_GLOBAL", limits: &settings.Global},
+		{key: "RATE_LIMIT_CONNECTION", limits: &settings.Connection},
+		{key: "RATE_LIMIT_USER", limits: &settings.User},
+	}
+	for _, level := range levels {
+		for _, direction := range [...]struct {
+			suffix string
+			limit  *uint64
+		}{
+			{suffix: "_UP", limit: &level.limits.Up},
+			{suffix: "_DOWN", limit: &level.limits.Down},
+		} {
+			key := level.key + direction.suffix
+			value := reader.String(key)
+			if value == "" {
+				continue
+			}
+			*direction.limit, err = parseSize(value)
+			if err != nil {
+				return settings, fmt.Errorf("%s: %w", key, err)
+			}
+		}
+	}
+	return settings, nil
+}
+
+var ErrQuotaFormatInvalid = errors.New("quota format is invalid")
+
+// readQuotaLimits reads quotas from the comma separated
+// USER_QUOTAS value, where each quota is in the format
+// `name:size`, and size is a number of bytes optionally
+// suffixed with K, M, G or T for powers of 1024.
+func readQuotaLimits(reader *reader.Reader) (limits map[string]uint64, err error) {
+	values := reader.CSV("USER_QUOTAS")
+	if len(values) == 0 {
+		return nil, nil
+	}
+	limits = make(map[string]uint64, len(values))
+	for _, value := range values {
+		name, size, ok := strings.Cut(value, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: %q does not contain a colon",
+				ErrQuotaFormatInvalid, value)
+		}
+		limits[name], err = parseSize(size)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q: %w", ErrQuotaFormatInvalid, value, err)
+		}
+	}
+	return limits, nil
+}
+
+var ErrSizeTooLarge = errors.New("size is too large")
+
+// parseSize parses a number of bytes optionally suffixed
+// with K, M, G or T for powers of 1024.
+func parseSize(value string) (size uint64, err error) {
+	s := value
+	shift := 0
+	const units = "KMGT"
+	if s != "" {
+		if i := strings.IndexByte(units, s[len(s)-1]); i >= 0 {
+			const bitsPerUnit = 10
+			shift = bitsPerUnit * (i + 1)
+			s = s[:len(s)-1]
+		}
+	}
+	size, err = strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if size > math.MaxUint64>>shift {
+		return 0, fmt.Errorf("%w: %s", ErrSizeTooLarge, value)
+	}
+	return size << shift, nil
+}
+
+// readKey reads the key from KEY, or from the file
+// at the path given by KEY_FILE if KEY is not set.
+func readKey(reader *reader.Reader) (key *string, err error) {
+	key = reader.Get("KEY")
+	if key != nil {
+		return key, nil
+	}
+
+	keyFilePath := reader.Get("KEY_FILE")
+	if keyFilePath == nil {
+		return nil, nil //nolint:nilnil
+	}
+	data, err := os.ReadFile(*keyFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+	trimmed := strings.TrimSpace(string(data))
+	return &trimmed, nil
+}
+
+var ErrUserFormatInvalid = errors.New("user format is invalid")
+
+// readUsers reads users from the comma separated
+// USERS value, where each user is in the format
+// `name:password` or `name:cipher:password`. The cipher
+// must be specified if the password contains a colon.
+func readUsers(reader *reader.Reader) (users []User, err error) {
+	values := reader.CSV("USERS")
+	if len(values) == 0 {
+		return nil, nil
+	}
+	users = make([]User, len(values))
+	for i, value := range values {
+		const maxFields = 3
+		fields := strings.SplitN(value, ":", maxFields)
+		switch len(fields) {
+		case 2: //nolint:gomnd
+			users[i] = User{Name: fields[0], Password: fields[1]}
+		case maxFields:
+			users[i] = User{Name: fields[0], CipherName: fields[1], Password: fields[2]}
+		default:
+			return nil, fmt.Errorf("%w: %q does not contain a colon",
+				ErrUserFormatInvalid, value)
+		}
+	}
+	return users, nil
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ptrTo[T any](x T) *T { return &x }
+
+// validServerSettings returns valid server settings with defaults set,
+// to be modified by tests.
+func validServerSettings() Settings {
+	settings := Settings{
+		Password: ptrTo("password"),
+		Address:  ptrTo(":8388"),
+	}
+	settings.SetDefaults()
+	return settings
+}
+
+func Test_Settings_Validate(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		modify     func(settings *Settings)
+		errWrapped error
+		errMessage string
+	}{
+		"valid": {
+			modify: func(*Settings) {},
+		},
+		"plugin": {
+			modify: func(settings *Settings) {
+				settings.Plugin = "v2ray-plugin"
+			},
+		},
+		"plugin with obfs": {
+			modify: func(settings *Settings) {
+				settings.Plugin = "v2ray-plugin"
+				settings.Obfs = "http"
+			},
+			errWrapped: ErrPluginWithObfs,
+			errMessage: "plugin cannot be used with obfuscation",
+		},
+		"plugin with WebSocket": {
+			modify: func(settings *Settings) {
+				settings.Plugin = "v2ray-plugin"
+				settings.WebSocketPath = "/ws"
+			},
+			errWrapped: ErrPluginWithWebSocket,
+			errMessage: "plugin cannot be used with WebSocket",
+		},
+		"plugin with TLS": {
+			modify: func(settings *Settings) {
+				settings.Plugin = "v2ray-plugin"
+				settings.TLSCertFile = "/cert.pem"
+				settings.TLSKeyFile = "/key.pem"
+			},
+			errWrapped: ErrPluginWithTLS,
+			errMessage: "plugin cannot be used with TLS",
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			settings := validServerSettings()
+			testCase.modify(&settings)
+
+			err := settings.Validate()
+
+			assert.ErrorIs(t, err, testCase.errWrapped)
+			if testCase.errWrapped != nil {
+				assert.EqualError(t, err, testCase.errMessage)
+			}
+		})
+	}
+}
+
+func Test_parseSize(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		value      string
+		size       uint64
+		errWrapped error
+		errMessage string
+	}{
+		"bytes": {
+			value: "1000",
+			size:  1000,
+		},
+		"kibibytes": {
+			value: "2K",
+			size:  2048,
+		},
+		"tebibytes": {
+			value: "3T",
+			size:  3 << 40,
+		},
+		"largest": {
+			value: "16777215T",
+			size:  math.MaxUint64 >> 40 << 40,
+		},
+		"overflow": {
+			value:      "16777216T",
+			errWrapped: ErrSizeTooLarge,
+			errMessage: "size is too large: 16777216T",
+		},
+		"gibibytes overflow": {
+			value:      "20000000000G",
+			errWrapped: ErrSizeTooLarge,
+			errMessage: "size is too large: 20000000000G",
+		},
+		"invalid": {
+			value:      "1P",
+			errWrapped: strconv.ErrSyntax,
+			errMessage: `strconv.ParseUint: parsing "1P": invalid syntax`,
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			size, err := parseSize(testCase.value)
+
+			assert.ErrorIs(t, err, testCase.errWrapped)
+			if testCase.errWrapped != nil {
+				assert.EqualError(t, err, testCase.errMessage)
+			}
+			assert.Equal(t, testCase.size, size)
+		})
+	}
+}
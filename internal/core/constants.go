@@ -1,7 +1,13 @@
 package core
 
 const (
-	AES128gcm            = "aes-128-gcm"
-	AES256gcm            = "aes-256-gcm"
-	Chacha20IetfPoly1305 = "chacha20-ietf-poly1305"
+	AES128gcm             = "aes-128-gcm"
+	AES192gcm             = "aes-192-gcm"
+	AES256gcm             = "aes-256-gcm"
+	Chacha20IetfPoly1305  = "chacha20-ietf-poly1305"
+	XChacha20IetfPoly1305 = "xchacha20-ietf-poly1305"
+	// Shadowsocks 2022 edition ciphers.
+	Blake3AES128gcm        = "2022-blake3-aes-128-gcm"
+	Blake3AES256gcm        = "2022-blake3-aes-256-gcm"
+	Blake3Chacha20Poly1305 = "2022-blake3-chacha20-poly1305"
 )
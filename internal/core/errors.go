@@ -0,0 +1,12 @@
+package core
+
+import "github.com/qdm12/ss-server/internal/shadowaead"
+
+var (
+	// ErrDecryption is wrapped by errors caused by data which
+	// cannot be authenticated and decrypted with the key(s).
+	ErrDecryption = shadowaead.ErrDecryption
+	// ErrRepeatedSalt is wrapped by errors caused by a salt
+	// already seen, which can be a replay attack.
+	ErrRepeatedSalt = shadowaead.ErrRepeatedSalt
+)
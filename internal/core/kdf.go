@@ -2,6 +2,8 @@ package core
 
 import (
 	"crypto/md5" //nolint:gosec
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"strings"
@@ -9,20 +11,100 @@ import (
 
 var ErrCipherNotSupported = errors.New("cipher is not supported")
 
-// Derives a key from the password with a size depending on the cipher chosen.
-func deriveKey(password, cipherName string) (key []byte, err error) {
-	var keySize int
+// Is2022 returns true if the cipher name given is a
+// Shadowsocks 2022 edition cipher.
+func Is2022(cipherName string) bool {
+	switch strings.ToLower(cipherName) {
+	case Blake3AES128gcm, Blake3AES256gcm, Blake3Chacha20Poly1305:
+		return true
+	default:
+		return false
+	}
+}
+
+func keySize(cipherName string) (size int, err error) {
 	switch strings.ToLower(cipherName) {
-	case AES128gcm:
-		keySize = 16
-	case Chacha20IetfPoly1305, AES256gcm:
-		keySize = 32
+	case AES128gcm, Blake3AES128gcm:
+		return 16, nil //nolint:gomnd
+	case AES192gcm:
+		return 24, nil //nolint:gomnd
+	case Chacha20IetfPoly1305, XChacha20IetfPoly1305, AES256gcm, Blake3AES256gcm, Blake3Chacha20Poly1305:
+		return 32, nil //nolint:gomnd
 	default:
-		return nil, fmt.Errorf("%w: %s", ErrCipherNotSupported, cipherName)
+		return 0, fmt.Errorf("%w: %s", ErrCipherNotSupported, cipherName)
+	}
+}
+
+// Derives a key from the password with a size depending on the cipher chosen.
+// For Shadowsocks 2022 ciphers, the password is the base64 encoded
+// pre-shared key and is decoded instead.
+func deriveKey(password, cipherName string) (key []byte, err error) {
+	keySize, err := keySize(cipherName)
+	if err != nil {
+		return nil, err
+	}
+	if Is2022(cipherName) {
+		return decodePreSharedKey(password, keySize)
 	}
 	return kdf(password, keySize)
 }
 
+// newKey returns the base64 decoded key if key is not empty, and
+// derives the key from the password for the cipher given otherwise.
+func newKey(password, key, cipherName string) (decoded []byte, err error) {
+	if key == "" {
+		return deriveKey(password, cipherName)
+	}
+	keySize, err := keySize(cipherName)
+	if err != nil {
+		return nil, err
+	}
+	return decodePreSharedKey(key, keySize)
+}
+
+// GenerateKey generates a random key of the key size of the
+// cipher given, and returns it base64 encoded.
+func GenerateKey(cipherName string) (key string, err error) {
+	keySize, err := keySize(cipherName)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, keySize)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("generating random bytes: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+var (
+	ErrPreSharedKeyDecode  = errors.New("cannot decode base64 pre-shared key")
+	ErrPreSharedKeyBadSize = errors.New("pre-shared key has a bad size")
+)
+
+// CheckPreSharedKey checks the base64 encoded pre-shared key given
+// is valid for the cipher given.
+func CheckPreSharedKey(preSharedKey, cipherName string) (err error) {
+	keySize, err := keySize(cipherName)
+	if err != nil {
+		return err
+	}
+	_, err = decodePreSharedKey(preSharedKey, keySize)
+	return err
+}
+
+func decodePreSharedKey(preSharedKey string, keySize int) (key []byte, err error) {
+	key, err = base64.StdEncoding.DecodeString(preSharedKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPreSharedKeyDecode, err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("%w: %d bytes instead of %d bytes",
+			ErrPreSharedKeyBadSize, len(key), keySize)
+	}
+	return key, nil
+}
+
 // key derivation function from the original Shadowsocks spec based on md5.
 func kdf(password string, length int) (key []byte, err error) {
 	var b, prev []byte
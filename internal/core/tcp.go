@@ -8,32 +8,68 @@ import (
 	"github.com/qdm12/ss-server/internal/shadowaead"
 )
 
-func NewTCPStreamCipher(name, password string, saltFilter SaltFilter) (
+// NewTCPStreamCipher creates a new cipher for the cipher name and password given.
+// If users are given with a Shadowsocks 2022 cipher, the password is the
+// identity pre-shared key and each user is identified with extensible
+// identity headers. If users are given with another cipher, the password
+// is not used and each user is identified by trial decryption.
+// If key is not empty, it is the base64 encoded key used instead of
+// the password.
+func NewTCPStreamCipher(name, password, key string, users []User, saltFilter SaltFilter) (
 	cipher *TCPStreamCipher, err error) {
-	key, err := deriveKey(password, name)
+	decodedKey, err := newKey(password, key, name)
 	if err != nil {
 		return nil, err
 	}
-	var aead *shadowaead.AEADCipherAdapter
+	cipher = &TCPStreamCipher{
+		saltFilter: saltFilter,
+	}
 	switch strings.ToLower(name) {
-	case Chacha20IetfPoly1305:
-		aead = shadowaead.Chacha20Poly1305(key)
-	case AES128gcm, AES256gcm:
-		aead = shadowaead.AESGCM(key)
+	case Chacha20IetfPoly1305, XChacha20IetfPoly1305,
+		AES128gcm, AES192gcm, AES256gcm:
+		cipher.aead, _ = newLegacyCipherAdapter(name, decodedKey)
+	case Blake3AES128gcm, Blake3AES256gcm:
+		cipher.aead2022, err = shadowaead.AESGCM2022(decodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("creating %s cipher: %w", name, err)
+		}
+	case Blake3Chacha20Poly1305:
+		cipher.aead2022, err = shadowaead.Chacha2022(decodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("creating %s cipher: %w", name, err)
+		}
 	default:
 		return nil, fmt.Errorf("%w: for TCP: %s", ErrCipherNotSupported, name)
 	}
-	return &TCPStreamCipher{
-		aead:       aead,
-		saltFilter: saltFilter,
-	}, nil
+
+	switch {
+	case len(users) == 0:
+	case cipher.aead2022 != nil:
+		err = addUsers(cipher.aead2022, name, users)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		cipher.users, err = newUserCiphers(name, users)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cipher, nil
 }
 
 type TCPStreamCipher struct {
 	aead       *shadowaead.AEADCipherAdapter
+	aead2022   *shadowaead.AEAD2022CipherAdapter
+	users      *shadowaead.UserCiphers
 	saltFilter SaltFilter
 }
 
 func (c *TCPStreamCipher) Shadow(connection net.Conn) net.Conn {
+	if c.aead2022 != nil {
+		return shadowaead.NewConn2022(connection, c.aead2022, c.saltFilter)
+	} else if c.users != nil {
+		return shadowaead.NewMultiUserConn(connection, c.users, c.saltFilter)
+	}
 	return shadowaead.NewConn(connection, c.aead, c.saltFilter)
 }
@@ -0,0 +1,153 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/qdm12/ss-server/internal/shadowaead"
+)
+
+// User is a user with its own password. For Shadowsocks 2022 ciphers,
+// the password is the base64 encoded user pre-shared key, and the
+// user is identified with extensible identity headers. For other
+// ciphers, the user has its own cipher and password, and is identified
+// by trial decryption.
+type User struct {
+	Name string
+	// CipherName is the cipher of the user, and defaults
+	// to the server cipher if left empty.
+	CipherName string
+	Password   string
+}
+
+var (
+	ErrUsersNotSupported   = errors.New("users are not supported")
+	ErrUserNameEmpty       = errors.New("user name is empty")
+	ErrUserNameDuplicate   = errors.New("user name is duplicated")
+	ErrUserCipherMismatch  = errors.New("user cipher does not match the server cipher")
+	ErrUserCipherNotLegacy = errors.New("user cipher is not a legacy AEAD cipher")
+)
+
+// CheckUsers checks the users given are valid for the cipher given.
+func CheckUsers(cipherName string, users []User) (err error) {
+	if len(users) == 0 {
+		return nil
+	}
+
+	is2022 := Is2022(cipherName)
+	if is2022 && !supportsIdentityHeaders(cipherName) {
+		return fmt.Errorf("%w: for cipher %s", ErrUsersNotSupported, cipherName)
+	}
+
+	names := make(map[string]struct{}, len(users))
+	for i, user := range users {
+		if user.Name == "" {
+			return fmt.Errorf("user %d of %d: %w", i+1, len(users), ErrUserNameEmpty)
+		}
+		_, exists := names[user.Name]
+		if exists {
+			return fmt.Errorf("%w: %s", ErrUserNameDuplicate, user.Name)
+		}
+		names[user.Name] = struct{}{}
+
+		if is2022 {
+			if user.CipherName != "" && !strings.EqualFold(user.CipherName, cipherName) {
+				return fmt.Errorf("user %s: %w: %s instead of %s",
+					user.Name, ErrUserCipherMismatch, user.CipherName, cipherName)
+			}
+			err = CheckPreSharedKey(user.Password, cipherName)
+			if err != nil {
+				return fmt.Errorf("user %s: password: %w", user.Name, err)
+			}
+			continue
+		}
+
+		userCipherName := userCipherName(user, cipherName)
+		_, err = keySize(userCipherName)
+		if err != nil {
+			return fmt.Errorf("user %s: %w", user.Name, err)
+		} else if Is2022(userCipherName) {
+			return fmt.Errorf("user %s: %w: %s",
+				user.Name, ErrUserCipherNotLegacy, userCipherName)
+		}
+	}
+	return nil
+}
+
+// userCipherName returns the cipher name of the user,
+// defaulting to the server cipher name given.
+func userCipherName(user User, serverCipherName string) string {
+	if user.CipherName == "" {
+		return serverCipherName
+	}
+	return user.CipherName
+}
+
+// newLegacyCipherAdapter returns the cipher adapter for the legacy AEAD
+// cipher name and key given, and false if the cipher is not a legacy one.
+func newLegacyCipherAdapter(cipherName string, key []byte) (
+	aead *shadowaead.AEADCipherAdapter, ok bool) {
+	switch strings.ToLower(cipherName) {
+	case Chacha20IetfPoly1305:
+		return shadowaead.Chacha20Poly1305(key), true
+	case XChacha20IetfPoly1305:
+		return shadowaead.XChacha20Poly1305(key), true
+	case AES128gcm, AES192gcm, AES256gcm:
+		return shadowaead.AESGCM(key), true
+	default:
+		return nil, false
+	}
+}
+
+// supportsIdentityHeaders returns true if the cipher given supports
+// Shadowsocks 2022 extensible identity headers.
+func supportsIdentityHeaders(cipherName string) bool {
+	switch strings.ToLower(cipherName) {
+	case Blake3AES128gcm, Blake3AES256gcm:
+		return true
+	default:
+		return false
+	}
+}
+
+// addUsers adds the users to the Shadowsocks 2022 cipher adapter given,
+// whose pre-shared key becomes the identity pre-shared key.
+func addUsers(aead *shadowaead.AEAD2022CipherAdapter,
+	cipherName string, users []User) (err error) {
+	for _, user := range users {
+		key, err := deriveKey(user.Password, cipherName)
+		if err != nil {
+			return fmt.Errorf("user %s: %w", user.Name, err)
+		}
+		err = aead.AddUser(user.Name, key)
+		if err != nil {
+			return fmt.Errorf("adding user %s: %w", user.Name, err)
+		}
+	}
+	return nil
+}
+
+// newUserCiphers creates the user ciphers for the legacy AEAD ciphers,
+// where each user cipher defaults to the server cipher name given.
+func newUserCiphers(serverCipherName string, users []User) (
+	userCiphers *shadowaead.UserCiphers, err error) {
+	userCiphers = shadowaead.NewUserCiphers()
+	for _, user := range users {
+		cipherName := userCipherName(user, serverCipherName)
+		key, err := deriveKey(user.Password, cipherName)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.Name, err)
+		}
+		aead, ok := newLegacyCipherAdapter(cipherName, key)
+		if !ok {
+			return nil, fmt.Errorf("user %s: %w: %s",
+				user.Name, ErrUserCipherNotLegacy, cipherName)
+		}
+		err = userCiphers.AddUser(user.Name, aead)
+		if err != nil {
+			return nil, fmt.Errorf("adding user %s: %w", user.Name, err)
+		}
+	}
+	return userCiphers, nil
+}
@@ -0,0 +1,40 @@
+// Package failure classifies network errors into
+// short reasons, to be used as metric labels.
+package failure
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+const (
+	ReasonTimeout     = "timeout"
+	ReasonRefused     = "refused"
+	ReasonUnreachable = "unreachable"
+	ReasonResolve     = "resolve"
+	ReasonCanceled    = "canceled"
+	ReasonOther       = "other"
+)
+
+// Reason returns the reason of the dial error given.
+func Reason(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ReasonCanceled
+	case errors.As(err, &dnsErr):
+		return ReasonResolve
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReasonRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return ReasonUnreachable
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ReasonTimeout
+	default:
+		return ReasonOther
+	}
+}
@@ -0,0 +1,62 @@
+package failure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Reason(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		err    error
+		reason string
+	}{
+		"canceled": {
+			err:    fmt.Errorf("dialing: %w", context.Canceled),
+			reason: ReasonCanceled,
+		},
+		"resolve": {
+			err:    &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "x"}},
+			reason: ReasonResolve,
+		},
+		"refused": {
+			err: &net.OpError{Op: "dial", Err: &os.SyscallError{
+				Syscall: "connect", Err: syscall.ECONNREFUSED,
+			}},
+			reason: ReasonRefused,
+		},
+		"unreachable": {
+			err: &net.OpError{Op: "dial", Err: &os.SyscallError{
+				Syscall: "connect", Err: syscall.EHOSTUNREACH,
+			}},
+			reason: ReasonUnreachable,
+		},
+		"timeout": {
+			err:    &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded},
+			reason: ReasonTimeout,
+		},
+		"other": {
+			err:    errors.New("test"),
+			reason: ReasonOther,
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			reason := Reason(testCase.err)
+
+			assert.Equal(t, testCase.reason, reason)
+		})
+	}
+}
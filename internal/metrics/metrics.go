@@ -0,0 +1,189 @@
+// Package metrics implements Prometheus metrics for
+// the TCP and UDP servers.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const (
+	protocolTCP = "tcp"
+	protocolUDP = "udp"
+
+	directionUp   = "up"
+	directionDown = "down"
+)
+
+// Metrics holds the Prometheus metrics of the servers, labelled
+// by listener, and by user if the servers have users.
+type Metrics struct {
+	registry            *prometheus.Registry
+	tcpConnectionsOpen  *prometheus.GaugeVec
+	tcpConnectionsTotal *prometheus.CounterVec
+	udpNATEntriesOpen   *prometheus.GaugeVec
+	udpNATEntriesTotal  *prometheus.CounterVec
+	bytes               *prometheus.CounterVec
+	dialFailures        *prometheus.CounterVec
+	decryptionFailures  *prometheus.CounterVec
+	repeatedSalts       *prometheus.CounterVec
+	relayDuration       *prometheus.HistogramVec
+}
+
+// New creates the metrics and registers them, together with
+// the Go runtime and process metrics, in a new registry.
+func New() *Metrics {
+	const namespace = "ss_server"
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		tcpConnectionsOpen: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "tcp_connections_active",
+			Help:      "Number of TCP connections currently relayed.",
+		}, []string{"listener", "user"}),
+		tcpConnectionsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tcp_connections_total",
+			Help:      "Total number of TCP connections relayed.",
+		}, []string{"listener", "user"}),
+		udpNATEntriesOpen: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "udp_nat_entries_active",
+			Help:      "Number of UDP NAT entries currently relaying packets.",
+		}, []string{"listener", "user"}),
+		udpNATEntriesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "udp_nat_entries_total",
+			Help:      "Total number of UDP NAT entries created.",
+		}, []string{"listener", "user"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bytes_total",
+			Help:      "Total number of payload bytes relayed, up being from clients to targets.",
+		}, []string{"listener", "user", "protocol", "direction"}),
+		dialFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dial_failures_total",
+			Help:      "Total number of failures to reach target addresses, by reason.",
+		}, []string{"listener", "user", "protocol", "reason"}),
+		decryptionFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "decryption_failures_total",
+			Help:      "Total number of client data which could not be authenticated and decrypted.",
+		}, []string{"listener", "protocol"}),
+		repeatedSalts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "repeated_salts_total",
+			Help:      "Total number of repeated client salts detected, which can be replay attacks.",
+		}, []string{"listener", "protocol"}),
+		relayDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "relay_duration_seconds",
+			Help:      "Duration of TCP connections and UDP NAT entries relayed.",
+			Buckets:   []float64{1, 5, 15, 60, 300, 900, 3600, 14400, 86400},
+		}, []string{"listener", "user", "protocol"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.tcpConnectionsOpen,
+		m.tcpConnectionsTotal,
+		m.udpNATEntriesOpen,
+		m.udpNATEntriesTotal,
+		m.bytes,
+		m.dialFailures,
+		m.decryptionFailures,
+		m.repeatedSalts,
+		m.relayDuration,
+	)
+	return m
+}
+
+// ForTCP returns the metrics for the TCP server
+// with the listener label given.
+func (m *Metrics) ForTCP(listener string) *TCP {
+	return &TCP{metrics: m, listener: listener}
+}
+
+// ForUDP returns the metrics for the UDP server
+// with the listener label given.
+func (m *Metrics) ForUDP(listener string) *UDP {
+	return &UDP{metrics: m, listener: listener}
+}
+
+// TCP implements the metrics interface of the TCP server.
+type TCP struct {
+	metrics  *Metrics
+	listener string
+}
+
+func (t *TCP) ConnectionStarted(user string) {
+	t.metrics.tcpConnectionsOpen.WithLabelValues(t.listener, user).Inc()
+	t.metrics.tcpConnectionsTotal.WithLabelValues(t.listener, user).Inc()
+}
+
+func (t *TCP) ConnectionEnded(user string, duration time.Duration) {
+	t.metrics.tcpConnectionsOpen.WithLabelValues(t.listener, user).Dec()
+	t.metrics.relayDuration.WithLabelValues(t.listener, user, protocolTCP).
+		Observe(duration.Seconds())
+}
+
+func (t *TCP) BytesUp(user string, n int) {
+	t.metrics.bytes.WithLabelValues(t.listener, user, protocolTCP, directionUp).Add(float64(n))
+}
+
+func (t *TCP) BytesDown(user string, n int) {
+	t.metrics.bytes.WithLabelValues(t.listener, user, protocolTCP, directionDown).Add(float64(n))
+}
+
+func (t *TCP) DialFailed(user, reason string) {
+	t.metrics.dialFailures.WithLabelValues(t.listener, user, protocolTCP, reason).Inc()
+}
+
+func (t *TCP) DecryptionFailed() {
+	t.metrics.decryptionFailures.WithLabelValues(t.listener, protocolTCP).Inc()
+}
+
+func (t *TCP) SaltRepeated() {
+	t.metrics.repeatedSalts.WithLabelValues(t.listener, protocolTCP).Inc()
+}
+
+// UDP implements the metrics interface of the UDP server.
+type UDP struct {
+	metrics  *Metrics
+	listener string
+}
+
+func (u *UDP) NATEntryAdded(user string) {
+	u.metrics.udpNATEntriesOpen.WithLabelValues(u.listener, user).Inc()
+	u.metrics.udpNATEntriesTotal.WithLabelValues(u.listener, user).Inc()
+}
+
+func (u *UDP) NATEntryRemoved(user string, duration time.Duration) {
+	u.metrics.udpNATEntriesOpen.WithLabelValues(u.listener, user).Dec()
+	u.metrics.relayDuration.WithLabelValues(u.listener, user, protocolUDP).
+		Observe(duration.Seconds())
+}
+
+func (u *UDP) BytesUp(user string, n int) {
+	u.metrics.bytes.WithLabelValues(u.listener, user, protocolUDP, directionUp).Add(float64(n))
+}
+
+func (u *UDP) BytesDown(user string, n int) {
+	u.metrics.bytes.WithLabelValues(u.listener, user, protocolUDP, directionDown).Add(float64(n))
+}
+
+func (u *UDP) DialFailed(user, reason string) {
+	u.metrics.dialFailures.WithLabelValues(u.listener, user, protocolUDP, reason).Inc()
+}
+
+func (u *UDP) DecryptionFailed() {
+	u.metrics.decryptionFailures.WithLabelValues(u.listener, protocolUDP).Inc()
+}
+
+func (u *UDP) SaltRepeated() {
+	u.metrics.repeatedSalts.WithLabelValues(u.listener, protocolUDP).Inc()
+}
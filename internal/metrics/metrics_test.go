@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/qdm12/ss-server/pkg/tcp"
+	"github.com/qdm12/ss-server/pkg/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ tcp.Metrics = (*TCP)(nil)
+	_ udp.Metrics = (*UDP)(nil)
+)
+
+func Test_Metrics(t *testing.T) {
+	t.Parallel()
+
+	metrics := New()
+	tcpMetrics := metrics.ForTCP(":8388")
+	udpMetrics := metrics.ForUDP(":8388")
+
+	tcpMetrics.ConnectionStarted("alice")
+	tcpMetrics.ConnectionStarted("alice")
+	tcpMetrics.BytesUp("alice", 10)
+	tcpMetrics.BytesDown("alice", 100)
+	tcpMetrics.ConnectionEnded("alice", 2*time.Second)
+	tcpMetrics.DialFailed("alice", "refused")
+	tcpMetrics.SaltRepeated()
+	udpMetrics.NATEntryAdded("bob")
+	udpMetrics.BytesUp("bob", 5)
+	udpMetrics.DecryptionFailed()
+
+	const expected = `
+# HELP ss_server_bytes_total Total number of payload bytes relayed, up being from clients to targets.
+# TYPE ss_server_bytes_total counter
+ss_server_bytes_total{direction="down",listener=":8388",protocol="tcp",user="alice"} 100
+ss_server_bytes_total{direction="up",listener=":8388",protocol="tcp",user="alice"} 10
+ss_server_bytes_total{direction="up",listener=":8388",protocol="udp",user="bob"} 5
+# HELP ss_server_decryption_failures_total Total number of client data which could not be authenticated and decrypted.
+# TYPE ss_server_decryption_failures_total counter
+ss_server_decryption_failures_total{listener=":8388",protocol="udp"} 1
+# HELP ss_server_dial_failures_total Total number of failures to reach target addresses, by reason.
+# TYPE ss_server_dial_failures_total counter
+ss_server_dial_failures_total{listener=":8388",protocol="tcp",reason="refused",user="alice"} 1
+# HELP ss_server_repeated_salts_total Total number of repeated client salts detected, which can be replay attacks.
+# TYPE ss_server_repeated_salts_total counter
+ss_server_repeated_salts_total{listener=":8388",protocol="tcp"} 1
+# HELP ss_server_tcp_connections_active Number of TCP connections currently relayed.
+# TYPE ss_server_tcp_connections_active gauge
+ss_server_tcp_connections_active{listener=":8388",user="alice"} 1
+# HELP ss_server_tcp_connections_total Total number of TCP connections relayed.
+# TYPE ss_server_tcp_connections_total counter
+ss_server_tcp_connections_total{listener=":8388",user="alice"} 2
+# HELP ss_server_udp_nat_entries_active Number of UDP NAT entries currently relaying packets.
+# TYPE ss_server_udp_nat_entries_active gauge
+ss_server_udp_nat_entries_active{listener=":8388",user="bob"} 1
+`
+	err := testutil.GatherAndCompare(metrics.registry, strings.NewReader(expected),
+		"ss_server_bytes_total", "ss_server_decryption_failures_total",
+		"ss_server_dial_failures_total", "ss_server_repeated_salts_total",
+		"ss_server_tcp_connections_active", "ss_server_tcp_connections_total",
+		"ss_server_udp_nat_entries_active")
+	require.NoError(t, err)
+
+	count, err := testutil.GatherAndCount(metrics.registry, "ss_server_relay_duration_seconds")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type Server struct {
+	httpServer      *http.Server
+	onShutdownError func(err error)
+}
+
+// NewServer creates an HTTP server serving the metrics
+// given on the /metrics path at the address given.
+func NewServer(address string, metrics *Metrics,
+	onShutdownError func(err error)) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}))
+	const timeout = 10 * time.Second
+	httpServer := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadTimeout:       timeout,
+		ReadHeaderTimeout: time.Second,
+		WriteTimeout:      timeout,
+	}
+	return &Server{
+		httpServer:      httpServer,
+		onShutdownError: onShutdownError,
+	}
+}
+
+func (s *Server) Run(ctx context.Context) error {
+	go func() { // shutdown goroutine blocked by ctx
+		<-ctx.Done()
+		const timeoutDuration = 10 * time.Millisecond
+		timeoutCtx, cancel := context.WithTimeout(context.Background(), timeoutDuration)
+		defer cancel()
+		if err := s.httpServer.Shutdown(timeoutCtx); err != nil { //nolint:contextcheck
+			s.onShutdownError(err)
+		}
+	}()
+	err := s.httpServer.ListenAndServe()
+	if ctx.Err() != nil && errors.Is(err, http.ErrServerClosed) {
+		return nil // ctx got canceled
+	}
+	return err
+}
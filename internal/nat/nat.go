@@ -0,0 +1,99 @@
+// Package nat implements a UDP NAT table shared by the
+// server and client side UDP relays.
+package nat
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	bufferSize = 64 * 1024
+	// HeadRoom is the number of bytes available in the buffer before
+	// each packet given to a Translator, and is large enough to hold
+	// a SOCKS5 UDP request header with a domain name address.
+	HeadRoom = 3 + 1 + 1 + 255 + 2
+)
+
+// Translator returns the packet to send to the peer, given the buffer
+// containing the packet of n bytes at buffer[HeadRoom:HeadRoom+n] read
+// from the source address. It can use the head room to prepend data
+// to the packet, and the packet returned can share memory with buffer.
+// The packet is dropped if the packet returned is nil.
+type Translator func(buffer []byte, n int, source net.Addr) (packet []byte, err error)
+
+// Map is a packet NAT table, mapping each peer address to
+// the packet connection used to relay its packets.
+type Map struct {
+	mu                      sync.RWMutex
+	peerAddressToConnection map[string]net.PacketConn
+	timeNow                 func() time.Time
+}
+
+func New(timeNow func() time.Time) *Map {
+	return &Map{
+		peerAddressToConnection: make(map[string]net.PacketConn),
+		timeNow:                 timeNow,
+	}
+}
+
+func (m *Map) Get(key string) net.PacketConn {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.peerAddressToConnection[key]
+}
+
+func (m *Map) Set(key string, packetConnection net.PacketConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peerAddressToConnection[key] = packetConnection
+}
+
+// Handle copies packets from src to the peer on dst, translating them
+// with translate, until reading from src fails or times out. It then
+// removes and closes the packet connection of the peer, and returns
+// the number of bytes read from src and relayed to the peer, together
+// with the error which stopped the copy.
+func (m *Map) Handle(peer net.Addr, dst, src net.PacketConn, translate Translator) (
+	bytesCopied int64, err error) {
+	bytesCopied, err = timedCopy(dst, peer, src, translate, m.timeNow)
+	key := peer.String()
+	m.mu.Lock()
+	packetConnection := m.peerAddressToConnection[key]
+	delete(m.peerAddressToConnection, key)
+	m.mu.Unlock()
+	if packetConnection != nil {
+		_ = packetConnection.Close()
+	}
+	return bytesCopied, err
+}
+
+// copy from src to dst at target with read timeout, and return the
+// number of bytes read from src and written to dst, excluding
+// dropped packets.
+func timedCopy(dst net.PacketConn, target net.Addr, src net.PacketConn,
+	translate Translator, timeNow func() time.Time) (bytesCopied int64, err error) {
+	const timeout = time.Minute
+	buffer := make([]byte, HeadRoom+bufferSize)
+	for {
+		if err := src.SetReadDeadline(timeNow().Add(timeout)); err != nil {
+			return bytesCopied, err
+		}
+		bytesRead, sourceAddress, err := src.ReadFrom(buffer[HeadRoom:])
+		if err != nil {
+			return bytesCopied, err
+		}
+
+		packet, err := translate(buffer, bytesRead, sourceAddress)
+		if err != nil {
+			return bytesCopied, err
+		} else if packet == nil {
+			continue
+		}
+		if _, err := dst.WriteTo(packet, target); err != nil {
+			return bytesCopied, err
+		}
+		bytesCopied += int64(bytesRead)
+	}
+}
@@ -0,0 +1,107 @@
+package obfs
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// NewHTTPServerConn wraps the connection given such that the simple-obfs
+// HTTP request header is removed from the data received, and an HTTP
+// response header is added before the first data sent.
+func NewHTTPServerConn(connection net.Conn) net.Conn {
+	return &httpServerConn{
+		Conn:    connection,
+		timeNow: time.Now,
+	}
+}
+
+type httpServerConn struct {
+	net.Conn
+	timeNow func() time.Time
+	// reader is set once the request header is read,
+	// and buffers the data following the request header.
+	reader *bufio.Reader
+	// responseWritten is only accessed by the writing goroutine.
+	responseWritten bool
+}
+
+var errRequestNotUpgrade = errors.New("HTTP request is not a websocket upgrade")
+
+func (c *httpServerConn) readRequestHeader() (err error) {
+	reader := bufio.NewReader(c.Conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return fmt.Errorf("reading HTTP request header: %w", err)
+	}
+	upgrade := request.Header.Get("Upgrade")
+	if !strings.EqualFold(upgrade, "websocket") {
+		return fmt.Errorf("%w: upgrade header is %q", errRequestNotUpgrade, upgrade)
+	}
+	// The request body is the first data sent by the client, and is
+	// read from the reader together with the rest of the stream.
+	c.reader = reader
+	return nil
+}
+
+func (c *httpServerConn) Read(b []byte) (n int, err error) {
+	if c.reader == nil {
+		err = c.readRequestHeader()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return c.reader.Read(b)
+}
+
+func (c *httpServerConn) Write(b []byte) (n int, err error) {
+	if c.responseWritten {
+		return c.Conn.Write(b)
+	}
+
+	header, err := c.responseHeader()
+	if err != nil {
+		return 0, fmt.Errorf("creating HTTP response header: %w", err)
+	}
+	_, err = c.Conn.Write(append(header, b...))
+	if err != nil {
+		return 0, err
+	}
+	c.responseWritten = true
+	return len(b), nil
+}
+
+// responseHeader returns an HTTP response header similar
+// to the one sent by the simple-obfs server.
+func (c *httpServerConn) responseHeader() (header []byte, err error) {
+	const maxNginxVersion = 12
+	nginxMinor, err := rand.Int(rand.Reader, big.NewInt(maxNginxVersion))
+	if err != nil {
+		return nil, err
+	}
+	nginxPatch, err := rand.Int(rand.Reader, big.NewInt(maxNginxVersion))
+	if err != nil {
+		return nil, err
+	}
+	const websocketKeySize = 16
+	websocketKey := make([]byte, websocketKeySize)
+	_, err = rand.Read(websocketKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Server: nginx/1." + nginxMinor.String() + "." + nginxPatch.String() + "\r\n" +
+		"Date: " + c.timeNow().UTC().Format(http.TimeFormat) + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(websocketKey) + "\r\n" +
+		"\r\n"), nil
+}
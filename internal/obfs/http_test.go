@@ -0,0 +1,85 @@
+package obfs
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_httpServerConn(t *testing.T) {
+	t.Parallel()
+
+	serverSide, clientSide := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientSide.Close()
+	})
+	serverConn := NewHTTPServerConn(serverSide)
+	serverConn.(*httpServerConn).timeNow = func() time.Time {
+		return time.Unix(0, 0)
+	}
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+	})
+
+	go func() {
+		_, _ = clientSide.Write([]byte("GET / HTTP/1.1\r\n" +
+			"Host: www.example.com\r\n" +
+			"User-Agent: curl/7.64.0\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello"))
+		_, _ = clientSide.Write([]byte("world"))
+	}()
+
+	data := make([]byte, len("helloworld"))
+	_, err := io.ReadFull(serverConn, data)
+	require.NoError(t, err)
+	assert.Equal(t, "helloworld", string(data))
+
+	go func() {
+		_, _ = serverConn.Write([]byte("first"))
+		_, _ = serverConn.Write([]byte("second"))
+	}()
+
+	reader := bufio.NewReader(clientSide)
+	response, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+	assert.Equal(t, "websocket", response.Header.Get("Upgrade"))
+	assert.Equal(t, "Thu, 01 Jan 1970 00:00:00 GMT", response.Header.Get("Date"))
+
+	data = make([]byte, len("firstsecond"))
+	_, err = io.ReadFull(reader, data)
+	require.NoError(t, err)
+	assert.Equal(t, "firstsecond", string(data))
+}
+
+func Test_httpServerConn_notUpgrade(t *testing.T) {
+	t.Parallel()
+
+	serverSide, clientSide := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientSide.Close()
+	})
+	serverConn := NewHTTPServerConn(serverSide)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+	})
+
+	go func() {
+		_, _ = clientSide.Write([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	}()
+
+	_, err := serverConn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, errRequestNotUpgrade)
+	assert.EqualError(t, err, `HTTP request is not a websocket upgrade: upgrade header is ""`)
+}
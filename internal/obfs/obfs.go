@@ -0,0 +1,31 @@
+// Package obfs implements the server side of the simple-obfs
+// http and tls obfuscation modes.
+package obfs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	HTTP = "http"
+	TLS  = "tls"
+)
+
+var ErrModeNotSupported = errors.New("obfuscation mode is not supported")
+
+// ServerConnWrapper returns the function wrapping server connections
+// for the obfuscation mode given, or nil if the mode is empty.
+func ServerConnWrapper(mode string) (wrap func(net.Conn) net.Conn, err error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case HTTP:
+		return NewHTTPServerConn, nil
+	case TLS:
+		return NewTLSServerConn, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrModeNotSupported, mode)
+	}
+}
@@ -0,0 +1,249 @@
+package obfs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	recordTypeChangeCipherSpec = 0x14
+	recordTypeHandshake        = 0x16
+	recordTypeApplicationData  = 0x17
+	recordHeaderSize           = 5
+	// maxRecordPayloadSize is the maximum payload size of
+	// the TLS records sent, as for real TLS records.
+	maxRecordPayloadSize     = 16384
+	handshakeTypeClientHello = 0x01
+	extensionSessionTicket   = 0x0023
+	sessionIDSize            = 32
+)
+
+// NewTLSServerConn wraps the connection given such that the data received
+// is extracted from the simple-obfs TLS client hello session ticket and
+// application data records, and the data sent is wrapped in a fake TLS
+// server handshake followed by application data records.
+func NewTLSServerConn(connection net.Conn) net.Conn {
+	return &tlsServerConn{
+		Conn:    connection,
+		timeNow: time.Now,
+	}
+}
+
+type tlsServerConn struct {
+	net.Conn
+	timeNow func() time.Time
+
+	// Fields only accessed by the reading goroutine.
+	clientHelloRead bool
+	// pending is the data from the client hello not yet read.
+	pending []byte
+	// recordLeft is the number of bytes left to read
+	// from the current application data record.
+	recordLeft int
+
+	// sessionID is the client hello session ID, set by the reading
+	// goroutine and echoed back in the server hello.
+	sessionIDMu sync.Mutex
+	sessionID   []byte
+
+	// serverHelloWritten is only accessed by the writing goroutine.
+	serverHelloWritten bool
+}
+
+var (
+	errRecordTypeUnexpected = errors.New("TLS record type is unexpected")
+	errClientHelloMalformed = errors.New("TLS client hello is malformed")
+	errSessionTicketMissing = errors.New("TLS client hello session ticket extension is missing")
+)
+
+// readClientHello reads the client hello record, and keeps the
+// data from its session ticket extension as pending data.
+func (c *tlsServerConn) readClientHello() (err error) {
+	record, err := c.readRecord(recordTypeHandshake)
+	if err != nil {
+		return fmt.Errorf("reading client hello: %w", err)
+	}
+
+	data := cryptobyte.String(record)
+	var handshakeType uint8
+	var clientHello, sessionID, extensions cryptobyte.String
+	const versionAndRandomSize = 2 + 32
+	if !data.ReadUint8(&handshakeType) || handshakeType != handshakeTypeClientHello ||
+		!data.ReadUint24LengthPrefixed(&clientHello) ||
+		!clientHello.Skip(versionAndRandomSize) ||
+		!clientHello.ReadUint8LengthPrefixed(&sessionID) ||
+		!clientHello.ReadUint16LengthPrefixed(new(cryptobyte.String)) || // cipher suites
+		!clientHello.ReadUint8LengthPrefixed(new(cryptobyte.String)) || // compression methods
+		!clientHello.ReadUint16LengthPrefixed(&extensions) {
+		return errClientHelloMalformed
+	}
+
+	for !extensions.Empty() {
+		var extensionType uint16
+		var extensionData cryptobyte.String
+		if !extensions.ReadUint16(&extensionType) ||
+			!extensions.ReadUint16LengthPrefixed(&extensionData) {
+			return errClientHelloMalformed
+		}
+		if extensionType != extensionSessionTicket {
+			continue
+		}
+		c.sessionIDMu.Lock()
+		c.sessionID = sessionID
+		c.sessionIDMu.Unlock()
+		c.pending = extensionData
+		c.clientHelloRead = true
+		return nil
+	}
+	return errSessionTicketMissing
+}
+
+// readRecord reads a full TLS record of the type given.
+func (c *tlsServerConn) readRecord(expectedType byte) (payload []byte, err error) {
+	header := make([]byte, recordHeaderSize)
+	_, err = io.ReadFull(c.Conn, header)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != expectedType {
+		return nil, fmt.Errorf("%w: 0x%x instead of 0x%x",
+			errRecordTypeUnexpected, header[0], expectedType)
+	}
+	payload = make([]byte, binary.BigEndian.Uint16(header[3:]))
+	_, err = io.ReadFull(c.Conn, payload)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func (c *tlsServerConn) Read(b []byte) (n int, err error) {
+	if !c.clientHelloRead {
+		err = c.readClientHello()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if len(c.pending) > 0 {
+		n = copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	for c.recordLeft == 0 {
+		header := make([]byte, recordHeaderSize)
+		_, err = io.ReadFull(c.Conn, header)
+		if err != nil {
+			return 0, err
+		}
+		if header[0] != recordTypeApplicationData {
+			return 0, fmt.Errorf("%w: 0x%x instead of 0x%x",
+				errRecordTypeUnexpected, header[0], recordTypeApplicationData)
+		}
+		c.recordLeft = int(binary.BigEndian.Uint16(header[3:]))
+	}
+
+	if len(b) > c.recordLeft {
+		b = b[:c.recordLeft]
+	}
+	n, err = c.Conn.Read(b)
+	c.recordLeft -= n
+	return n, err
+}
+
+func (c *tlsServerConn) Write(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	var buffer []byte
+	data := b
+	if !c.serverHelloWritten {
+		buffer, err = c.serverHandshake()
+		if err != nil {
+			return 0, fmt.Errorf("creating server handshake: %w", err)
+		}
+		// The first data is sent as the fake encrypted handshake message.
+		chunkSize := min(len(data), maxRecordPayloadSize)
+		buffer = appendRecord(buffer, recordTypeHandshake, data[:chunkSize])
+		data = data[chunkSize:]
+	}
+
+	for len(data) > 0 {
+		chunkSize := min(len(data), maxRecordPayloadSize)
+		buffer = appendRecord(buffer, recordTypeApplicationData, data[:chunkSize])
+		data = data[chunkSize:]
+	}
+
+	_, err = c.Conn.Write(buffer)
+	if err != nil {
+		return 0, err
+	}
+	c.serverHelloWritten = true
+	return len(b), nil
+}
+
+func appendRecord(buffer []byte, recordType byte, payload []byte) []byte {
+	buffer = append(buffer, recordType, 0x03, 0x03) //nolint:gomnd
+	buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(payload)))
+	return append(buffer, payload...)
+}
+
+// serverHandshake returns the server hello and change cipher spec
+// records, matching the ones sent by the simple-obfs server.
+func (c *tlsServerConn) serverHandshake() (handshake []byte, err error) {
+	random := make([]byte, 32) //nolint:gomnd
+	binary.BigEndian.PutUint32(random, uint32(c.timeNow().Unix()))
+	_, err = rand.Read(random[4:])
+	if err != nil {
+		return nil, err
+	}
+
+	c.sessionIDMu.Lock()
+	sessionID := c.sessionID
+	c.sessionIDMu.Unlock()
+	if len(sessionID) != sessionIDSize {
+		sessionID = make([]byte, sessionIDSize)
+		_, err = rand.Read(sessionID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var builder cryptobyte.Builder
+	builder.AddUint8(recordTypeHandshake)
+	builder.AddUint16(0x0301) //nolint:gomnd
+	builder.AddUint16LengthPrefixed(func(record *cryptobyte.Builder) {
+		const handshakeTypeServerHello = 0x02
+		record.AddUint8(handshakeTypeServerHello)
+		record.AddUint24LengthPrefixed(func(serverHello *cryptobyte.Builder) {
+			serverHello.AddUint16(0x0303) //nolint:gomnd
+			serverHello.AddBytes(random)
+			serverHello.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(sessionID)
+			})
+			const cipherSuite = 0xcca8 // TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+			serverHello.AddUint16(cipherSuite)
+			serverHello.AddUint8(0) // no compression
+			serverHello.AddUint16LengthPrefixed(func(extensions *cryptobyte.Builder) {
+				// Renegotiation info
+				extensions.AddBytes([]byte{0xff, 0x01, 0x00, 0x01, 0x00})
+				// Extended master secret
+				extensions.AddBytes([]byte{0x00, 0x17, 0x00, 0x00})
+				// EC point formats
+				extensions.AddBytes([]byte{0x00, 0x0b, 0x00, 0x02, 0x01, 0x00})
+			})
+		})
+	})
+	builder.AddBytes([]byte{recordTypeChangeCipherSpec, 0x03, 0x03, 0x00, 0x01, 0x01})
+	return builder.Bytes()
+}
@@ -0,0 +1,125 @@
+package obfs
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// makeClientHello returns a client hello record similar to the one
+// sent by the simple-obfs client, with the data given in the
+// session ticket extension.
+func makeClientHello(sessionID, data []byte) []byte {
+	var builder cryptobyte.Builder
+	builder.AddUint8(recordTypeHandshake)
+	builder.AddUint16(0x0301)
+	builder.AddUint16LengthPrefixed(func(record *cryptobyte.Builder) {
+		record.AddUint8(handshakeTypeClientHello)
+		record.AddUint24LengthPrefixed(func(clientHello *cryptobyte.Builder) {
+			clientHello.AddUint16(0x0303)
+			clientHello.AddBytes(make([]byte, 32)) // random
+			clientHello.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(sessionID)
+			})
+			clientHello.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(0xc02c)
+				b.AddUint16(0xc030)
+			})
+			clientHello.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8(0)
+			})
+			clientHello.AddUint16LengthPrefixed(func(extensions *cryptobyte.Builder) {
+				extensions.AddUint16(extensionSessionTicket)
+				extensions.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(data)
+				})
+				extensions.AddUint16(0x0000) // server name
+				extensions.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes([]byte{0x00, 0x0e, 0x00, 0x00, 0x0b})
+					b.AddBytes([]byte("example.com"))
+				})
+			})
+		})
+	})
+	return builder.BytesOrPanic()
+}
+
+func Test_tlsServerConn(t *testing.T) {
+	t.Parallel()
+
+	serverSide, clientSide := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientSide.Close()
+	})
+	serverConn := NewTLSServerConn(serverSide)
+	serverConn.(*tlsServerConn).timeNow = func() time.Time {
+		return time.Unix(1, 0)
+	}
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+	})
+
+	sessionID := make([]byte, sessionIDSize)
+	sessionID[0] = 1
+	go func() {
+		_, _ = clientSide.Write(makeClientHello(sessionID, []byte("hello")))
+		_, _ = clientSide.Write(appendRecord(nil, recordTypeApplicationData, []byte("world")))
+	}()
+
+	data := make([]byte, len("helloworld"))
+	_, err := io.ReadFull(serverConn, data)
+	require.NoError(t, err)
+	assert.Equal(t, "helloworld", string(data))
+
+	go func() {
+		_, _ = serverConn.Write([]byte("first"))
+		_, _ = serverConn.Write([]byte("second"))
+	}()
+
+	const serverHelloSize = 96
+	serverHello := make([]byte, serverHelloSize)
+	_, err = io.ReadFull(clientSide, serverHello)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{recordTypeHandshake, 0x03, 0x01, 0x00, 91}, serverHello[:5])
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(serverHello[11:15]))
+	assert.Equal(t, sessionID, serverHello[44:76])
+
+	changeCipherSpec := make([]byte, 6)
+	_, err = io.ReadFull(clientSide, changeCipherSpec)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{recordTypeChangeCipherSpec, 0x03, 0x03, 0x00, 0x01, 0x01}, changeCipherSpec)
+
+	expected := appendRecord(nil, recordTypeHandshake, []byte("first"))
+	expected = appendRecord(expected, recordTypeApplicationData, []byte("second"))
+	data = make([]byte, len(expected))
+	_, err = io.ReadFull(clientSide, data)
+	require.NoError(t, err)
+	assert.Equal(t, expected, data)
+}
+
+func Test_tlsServerConn_notClientHello(t *testing.T) {
+	t.Parallel()
+
+	serverSide, clientSide := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientSide.Close()
+	})
+	serverConn := NewTLSServerConn(serverSide)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+	})
+
+	go func() {
+		_, _ = clientSide.Write(appendRecord(nil, recordTypeApplicationData, []byte("data")))
+	}()
+
+	_, err := serverConn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, errRecordTypeUnexpected)
+	assert.EqualError(t, err, "reading client hello: TLS record type is unexpected: 0x17 instead of 0x16")
+}
@@ -0,0 +1,110 @@
+// Package outbound implements the relaying of connections and
+// packets to a next Shadowsocks server, to chain servers together.
+package outbound
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/qdm12/ss-server/internal/core"
+	"github.com/qdm12/ss-server/internal/socks"
+)
+
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+type PacketListener interface {
+	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
+// StreamDialer dials TCP connections to target addresses
+// through a next Shadowsocks server.
+type StreamDialer struct {
+	serverAddress string
+	shadower      *core.TCPStreamCipher
+	dialer        Dialer
+}
+
+// NewStreamDialer creates a dialer relaying connections to the
+// Shadowsocks server at the address given, encrypting them with
+// the shadower given and reaching the server with the dialer given.
+func NewStreamDialer(serverAddress string, shadower *core.TCPStreamCipher,
+	dialer Dialer) *StreamDialer {
+	return &StreamDialer{
+		serverAddress: serverAddress,
+		shadower:      shadower,
+		dialer:        dialer,
+	}
+}
+
+// DialContext dials the next Shadowsocks server and sends
+// it the target address given as its SOCKS address.
+func (d *StreamDialer) DialContext(ctx context.Context, _, address string) (
+	shadowedConnection net.Conn, err error) {
+	targetAddress, err := socks.ParseHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("parsing target address: %w", err)
+	}
+
+	serverConnection, err := d.dialer.DialContext(ctx, "tcp", d.serverAddress)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to next server: %w", err)
+	}
+	// Note closing the shadowed TCP connection closes the original
+	// TCP connection to the server.
+	shadowedConnection = d.shadower.Shadow(serverConnection)
+
+	_, err = shadowedConnection.Write(targetAddress)
+	if err != nil {
+		_ = shadowedConnection.Close()
+		return nil, fmt.Errorf("writing target address: %w", err)
+	}
+	return shadowedConnection, nil
+}
+
+// PacketRelayer creates packet connections sending UDP packets
+// to target addresses through a next Shadowsocks server.
+type PacketRelayer struct {
+	serverAddress  string
+	shadower       *core.UDPPacketCipher
+	packetListener PacketListener
+}
+
+// NewPacketRelayer creates a packet relayer relaying packets to the
+// Shadowsocks server at the address given, encrypting them with the
+// shadower given and reaching the server with packet connections
+// created by the packet listener given.
+func NewPacketRelayer(serverAddress string, shadower *core.UDPPacketCipher,
+	packetListener PacketListener) *PacketRelayer {
+	return &PacketRelayer{
+		serverAddress:  serverAddress,
+		shadower:       shadower,
+		packetListener: packetListener,
+	}
+}
+
+// ListenPacket returns a packet connection relaying packets through
+// the next Shadowsocks server. The network and address arguments are
+// ignored, and are only present for the method to be a drop-in
+// replacement of the net.ListenConfig ListenPacket method.
+func (p *PacketRelayer) ListenPacket(ctx context.Context, _, _ string) (
+	packetConnection net.PacketConn, err error) {
+	serverAddress, err := net.ResolveUDPAddr("udp", p.serverAddress)
+	if err != nil {
+		return nil, fmt.Errorf("resolving next server address: %w", err)
+	}
+
+	connection, err := p.packetListener.ListenPacket(ctx, "udp", "")
+	if err != nil {
+		return nil, fmt.Errorf("creating packet listener: %w", err)
+	}
+
+	return &shadowsocksPacketConn{
+		PacketConn: p.shadower.Shadow(&serverPacketConn{
+			PacketConn:    connection,
+			serverAddress: serverAddress,
+		}),
+	}, nil
+}
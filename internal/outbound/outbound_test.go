@@ -0,0 +1,200 @@
+// The test package is external since the servers
+// of pkg/tcp and pkg/udp import the outbound package.
+package outbound_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qdm12/ss-server/internal/core"
+	"github.com/qdm12/ss-server/internal/filter"
+	"github.com/qdm12/ss-server/internal/outbound"
+	"github.com/qdm12/ss-server/pkg/tcp"
+	"github.com/qdm12/ss-server/pkg/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ptrTo[T any](x T) *T { return &x }
+
+type noopLogger struct{}
+
+func (noopLogger) Debug(string) {}
+func (noopLogger) Info(string)  {}
+func (noopLogger) Error(string) {}
+
+// hop is a Shadowsocks server relaying to the next hop if next is set.
+type hop struct {
+	cipherName string
+	password   string
+	next       *hop
+	address    string
+}
+
+// listenTCPUDP listens on TCP and UDP on the same loopback port.
+func listenTCPUDP(t *testing.T) (listener net.Listener, packetConnection net.PacketConn) {
+	t.Helper()
+	const tries = 10
+	for i := 0; i < tries; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		packetConnection, err = net.ListenPacket("udp", listener.Addr().String())
+		if err == nil {
+			return listener, packetConnection
+		}
+		_ = listener.Close()
+	}
+	t.Fatal("cannot listen on the same TCP and UDP port")
+	return nil, nil
+}
+
+// start starts the TCP and UDP servers of the hop on
+// the same loopback port, and sets the hop address.
+func (h *hop) start(t *testing.T) {
+	t.Helper()
+	listener, packetConnection := listenTCPUDP(t)
+	h.address = listener.Addr().String()
+
+	tcpSettings := tcp.Settings{
+		CipherName: h.cipherName,
+		Password:   ptrTo(h.password),
+	}
+	udpSettings := udp.Settings{
+		CipherName: h.cipherName,
+		Password:   ptrTo(h.password),
+	}
+	if h.next != nil {
+		tcpSettings.Outbound = tcp.Outbound{
+			Address:    h.next.address,
+			CipherName: h.next.cipherName,
+			Password:   ptrTo(h.next.password),
+		}
+		udpSettings.Outbound = udp.Outbound{
+			Address:    h.next.address,
+			CipherName: h.next.cipherName,
+			Password:   ptrTo(h.next.password),
+		}
+	}
+	tcpServer, err := tcp.NewServer(tcpSettings, noopLogger{})
+	require.NoError(t, err)
+	udpServer, err := udp.NewServer(udpSettings, noopLogger{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tcpDone := make(chan struct{})
+	go func() {
+		defer close(tcpDone)
+		_ = tcpServer.Serve(ctx, listener)
+	}()
+	udpDone := make(chan struct{})
+	go func() {
+		defer close(udpDone)
+		_ = udpServer.ServePacket(ctx, packetConnection)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-tcpDone
+		<-udpDone
+	})
+}
+
+// startTwoHops starts the second hop, and the first
+// hop relaying to it, and returns the first hop.
+func startTwoHops(t *testing.T) (first *hop) {
+	t.Helper()
+	second := &hop{cipherName: core.Chacha20IetfPoly1305, password: "second"}
+	second.start(t)
+	first = &hop{cipherName: core.AES256gcm, password: "first", next: second}
+	first.start(t)
+	return first
+}
+
+func Test_StreamDialer_twoHops(t *testing.T) {
+	t.Parallel()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = echoListener.Close() })
+	go func() {
+		for {
+			connection, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer connection.Close()
+				_, _ = io.Copy(connection, connection)
+			}()
+		}
+	}()
+
+	first := startTwoHops(t)
+	shadower, err := core.NewTCPStreamCipher(first.cipherName, first.password, "",
+		nil, filter.NewBloomRing())
+	require.NoError(t, err)
+	dialer := outbound.NewStreamDialer(first.address, shadower, &net.Dialer{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	connection, err := dialer.DialContext(ctx, "tcp", echoListener.Addr().String())
+	require.NoError(t, err)
+	defer connection.Close()
+	err = connection.SetDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, err)
+
+	for _, message := range []string{"hello", "world"} {
+		_, err = connection.Write([]byte(message))
+		require.NoError(t, err)
+		response := make([]byte, len(message))
+		_, err = io.ReadFull(connection, response)
+		require.NoError(t, err)
+		assert.Equal(t, message, string(response))
+	}
+}
+
+func Test_PacketRelayer_twoHops(t *testing.T) {
+	t.Parallel()
+
+	echoConnection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = echoConnection.Close() })
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, address, err := echoConnection.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = echoConnection.WriteTo(buffer[:n], address)
+		}
+	}()
+
+	first := startTwoHops(t)
+	shadower, err := core.NewUDPPacketCipher(first.cipherName, first.password, "",
+		nil, filter.NewBloomRing())
+	require.NoError(t, err)
+	relayer := outbound.NewPacketRelayer(first.address, shadower, &net.ListenConfig{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	packetConnection, err := relayer.ListenPacket(ctx, "udp", "")
+	require.NoError(t, err)
+	defer packetConnection.Close()
+	err = packetConnection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, err)
+
+	for _, message := range []string{"hello", "world"} {
+		n, err := packetConnection.WriteTo([]byte(message), echoConnection.LocalAddr())
+		require.NoError(t, err)
+		assert.Equal(t, len(message), n)
+
+		buffer := make([]byte, 1024)
+		n, address, err := packetConnection.ReadFrom(buffer)
+		require.NoError(t, err)
+		assert.Equal(t, message, string(buffer[:n]))
+		assert.Equal(t, echoConnection.LocalAddr(), address)
+	}
+}
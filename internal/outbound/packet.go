@@ -0,0 +1,87 @@
+package outbound
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/qdm12/ss-server/internal/socks"
+)
+
+// shadowsocksPacketConn is a packet connection prepending the
+// SOCKS address of the target to each packet sent, and removing
+// the SOCKS address of the source from each packet received.
+// The underlying shadowed packet connection encrypts and decrypts
+// packets exchanged with the next Shadowsocks server.
+type shadowsocksPacketConn struct {
+	net.PacketConn
+	writeMutex  sync.Mutex
+	writeBuffer []byte
+}
+
+// WriteTo sends the packet to the address given through the
+// next server. The address is not resolved locally.
+func (s *shadowsocksPacketConn) WriteTo(packet []byte, address net.Addr) (n int, err error) {
+	targetAddress, err := socks.ParseAddress(address)
+	if err != nil {
+		return 0, fmt.Errorf("parsing target address: %w", err)
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.writeBuffer = append(s.writeBuffer[:0], targetAddress...)
+	s.writeBuffer = append(s.writeBuffer, packet...)
+	_, err = s.PacketConn.WriteTo(s.writeBuffer, nil)
+	if err != nil {
+		return 0, err
+	}
+	return len(packet), nil
+}
+
+// ReadFrom reads a packet from the next server, and returns its
+// payload and its source address. Invalid packets are ignored.
+func (s *shadowsocksPacketConn) ReadFrom(buffer []byte) (n int, address net.Addr, err error) {
+	for {
+		n, _, err = s.PacketConn.ReadFrom(buffer)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		sourceAddress, err := socks.ExtractAddress(buffer[:n])
+		if err != nil {
+			continue
+		}
+		// The source address is parsed before its bytes are overwritten.
+		address = sourceAddress.UDPAddr()
+		n = copy(buffer, buffer[len(sourceAddress):n])
+		return n, address, nil
+	}
+}
+
+// serverPacketConn is a packet connection writing
+// to and reading from the next server only.
+type serverPacketConn struct {
+	net.PacketConn
+	serverAddress *net.UDPAddr
+}
+
+// WriteTo writes the packet to the server, ignoring the address given.
+func (s *serverPacketConn) WriteTo(packet []byte, _ net.Addr) (int, error) {
+	return s.PacketConn.WriteTo(packet, s.serverAddress)
+}
+
+// ReadFrom reads a packet from the server, ignoring
+// packets received from other addresses.
+func (s *serverPacketConn) ReadFrom(buffer []byte) (n int, address net.Addr, err error) {
+	for {
+		n, address, err = s.PacketConn.ReadFrom(buffer)
+		if err != nil {
+			return n, address, err
+		}
+		udpAddress, ok := address.(*net.UDPAddr)
+		if ok && udpAddress.IP.Equal(s.serverAddress.IP) &&
+			udpAddress.Port == s.serverAddress.Port {
+			return n, address, nil
+		}
+	}
+}
@@ -0,0 +1,6 @@
+package plugin
+
+type Logger interface {
+	Info(s string)
+	Error(s string)
+}
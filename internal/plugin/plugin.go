@@ -0,0 +1,148 @@
+// Package plugin runs and supervises a SIP003 plugin process.
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+type Settings struct {
+	// Path is the path or name of the plugin executable.
+	Path string
+	// Options is the plugin options string passed to
+	// the plugin as SS_PLUGIN_OPTIONS.
+	Options string
+	// RemoteAddress is the public address the plugin listens on.
+	RemoteAddress string
+	// LocalAddress is the address the Shadowsocks TCP server listens on,
+	// and where the plugin forwards its connections to.
+	LocalAddress string
+}
+
+type Supervisor struct {
+	path        string
+	environment []string
+	logger      Logger
+	// minBackoff is the first restart delay, doubled on each
+	// restart up to maxBackoff.
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// healthyDuration is the duration after which a plugin
+	// process is considered healthy, resetting the backoff.
+	healthyDuration time.Duration
+	// stopTimeout is the duration to wait for the plugin to exit
+	// after sending it SIGTERM, before killing it.
+	stopTimeout time.Duration
+}
+
+// New creates a supervisor for the plugin described by the settings given.
+func New(settings Settings, logger Logger) (supervisor *Supervisor, err error) {
+	path, err := exec.LookPath(settings.Path)
+	if err != nil {
+		return nil, fmt.Errorf("finding plugin executable: %w", err)
+	}
+
+	remoteHost, remotePort, err := net.SplitHostPort(settings.RemoteAddress)
+	if err != nil {
+		return nil, fmt.Errorf("splitting remote address: %w", err)
+	}
+	if remoteHost == "" {
+		remoteHost = "0.0.0.0"
+	}
+	localHost, localPort, err := net.SplitHostPort(settings.LocalAddress)
+	if err != nil {
+		return nil, fmt.Errorf("splitting local address: %w", err)
+	}
+
+	environment := append(os.Environ(),
+		"SS_REMOTE_HOST="+remoteHost,
+		"SS_REMOTE_PORT="+remotePort,
+		"SS_LOCAL_HOST="+localHost,
+		"SS_LOCAL_PORT="+localPort,
+		"SS_PLUGIN_OPTIONS="+settings.Options,
+	)
+
+	return &Supervisor{
+		path:            path,
+		environment:     environment,
+		logger:          logger,
+		minBackoff:      time.Second,
+		maxBackoff:      time.Minute,
+		healthyDuration: time.Minute,
+		stopTimeout:     3 * time.Second, //nolint:gomnd
+	}, nil
+}
+
+// Run runs the plugin process and restarts it with an exponential
+// backoff each time it exits, until the context is canceled. The
+// plugin process is then stopped and Run returns.
+func (s *Supervisor) Run(ctx context.Context) {
+	backoff := s.minBackoff
+	for {
+		start := time.Now()
+		err := s.runOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(start) > s.healthyDuration {
+			backoff = s.minBackoff
+		}
+		s.logger.Error(fmt.Sprintf("plugin exited: %s, restarting in %s", err, backoff))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+var errExited = errors.New("plugin process exited")
+
+func (s *Supervisor) runOnce(ctx context.Context) (err error) {
+	cmd := exec.CommandContext(ctx, s.path)
+	cmd.Env = s.environment
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Stop the plugin gracefully on shutdown, and kill it
+	// if it is still running after the wait delay.
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = s.stopTimeout
+
+	s.logger.Info("starting plugin " + s.path)
+	err = cmd.Run()
+	if err != nil {
+		return err
+	}
+	return errExited
+}
+
+// ListenLoopback listens on a loopback address with a free
+// TCP port, for the Shadowsocks server to serve on behind the
+// plugin. The listener is kept open and handed to the server,
+// so the port cannot be taken by another process before the
+// plugin connects to it.
+func ListenLoopback(ctx context.Context) (listener net.Listener, err error) {
+	listenConfig := net.ListenConfig{}
+	listener, err = listenConfig.Listen(ctx, "tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("listening on free port: %w", err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,201 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain runs the test binary as a fake plugin process if it is started
+// by a supervisor, which is detected with the SS_PLUGIN_OPTIONS variable.
+// The options are of the form "mode=<mode>;file=<path>", where each start
+// and graceful stop of the fake plugin is recorded as a line in the file.
+func TestMain(m *testing.M) {
+	options := os.Getenv("SS_PLUGIN_OPTIONS")
+	if options == "" {
+		os.Exit(m.Run())
+	}
+	os.Exit(runFakePlugin(options))
+}
+
+func runFakePlugin(options string) (exitCode int) {
+	values := make(map[string]string)
+	for _, option := range strings.Split(options, ";") {
+		key, value, _ := strings.Cut(option, "=")
+		values[key] = value
+	}
+	record := func(line string) {
+		file, err := os.OpenFile(values["file"], os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			panic(err)
+		}
+		defer file.Close()
+		_, _ = fmt.Fprintln(file, line)
+	}
+
+	switch values["mode"] {
+	case "exit":
+		record("started")
+		return 1
+	case "graceful":
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM)
+		record("started " + os.Getenv("SS_LOCAL_HOST") + ":" + os.Getenv("SS_LOCAL_PORT"))
+		<-signals
+		record("terminated")
+		return 0
+	case "ignore":
+		signal.Ignore(syscall.SIGTERM)
+		record("started")
+		time.Sleep(time.Hour)
+		return 0
+	}
+	return 2 //nolint:gomnd
+}
+
+type recordingLogger struct {
+	mu     sync.Mutex
+	errors []string
+}
+
+func (l *recordingLogger) Info(string) {}
+
+func (l *recordingLogger) Error(s string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, s)
+}
+
+func (l *recordingLogger) getErrors() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.errors...)
+}
+
+func newTestSupervisor(t *testing.T, mode string) (supervisor *Supervisor,
+	logger *recordingLogger, recordPath string) {
+	t.Helper()
+	recordPath = filepath.Join(t.TempDir(), "record")
+	logger = &recordingLogger{}
+	settings := Settings{
+		Path:          os.Args[0],
+		Options:       "mode=" + mode + ";file=" + recordPath,
+		RemoteAddress: ":8388",
+		LocalAddress:  "127.0.0.1:9000",
+	}
+	supervisor, err := New(settings, logger)
+	require.NoError(t, err)
+	return supervisor, logger, recordPath
+}
+
+func readRecord(path string) (lines []string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(strings.ReplaceAll(string(data), " ", "_"))
+}
+
+func Test_Supervisor_Run_restart(t *testing.T) {
+	t.Parallel()
+
+	supervisor, logger, recordPath := newTestSupervisor(t, "exit")
+	supervisor.minBackoff = 10 * time.Millisecond
+	supervisor.maxBackoff = 40 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		supervisor.Run(ctx)
+	}()
+
+	const starts = 5
+	require.Eventually(t, func() bool {
+		return len(readRecord(recordPath)) >= starts
+	}, 10*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	messages := logger.getErrors()
+	require.GreaterOrEqual(t, len(messages), starts-1)
+	expectedBackoffs := []string{"10ms", "20ms", "40ms", "40ms"}
+	for i, backoff := range expectedBackoffs {
+		assert.Equal(t, "plugin exited: exit status 1, restarting in "+backoff, messages[i])
+	}
+}
+
+func Test_Supervisor_Run_gracefulStop(t *testing.T) {
+	t.Parallel()
+
+	supervisor, logger, recordPath := newTestSupervisor(t, "graceful")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		supervisor.Run(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		return len(readRecord(recordPath)) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(supervisor.stopTimeout):
+		t.Fatal("supervisor did not stop before the stop timeout")
+	}
+	assert.Equal(t, []string{"started_127.0.0.1:9000", "terminated"}, readRecord(recordPath))
+	assert.Empty(t, logger.getErrors())
+}
+
+func Test_Supervisor_Run_killAfterStopTimeout(t *testing.T) {
+	t.Parallel()
+
+	supervisor, _, recordPath := newTestSupervisor(t, "ignore")
+	supervisor.stopTimeout = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		supervisor.Run(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		return len(readRecord(recordPath)) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not kill the plugin")
+	}
+}
+
+func Test_ListenLoopback(t *testing.T) {
+	t.Parallel()
+
+	listener, err := ListenLoopback(context.Background())
+	require.NoError(t, err)
+	defer listener.Close()
+	assert.True(t, strings.HasPrefix(listener.Addr().String(), "127.0.0.1:"))
+
+	// the port stays reserved until the listener is closed
+	_, err = net.Listen("tcp", listener.Addr().String())
+	assert.Error(t, err)
+}
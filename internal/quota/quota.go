@@ -0,0 +1,234 @@
+// Package quota implements per user data quotas, reset
+// periodically and persisted to a state file.
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	PeriodDaily   = "daily"
+	PeriodWeekly  = "weekly"
+	PeriodMonthly = "monthly"
+)
+
+var (
+	ErrPeriodNotSupported = errors.New("quota period is not supported")
+	ErrResetDayNotValid   = errors.New("quota reset day is not valid")
+)
+
+// Manager tracks the bytes relayed for each user with a quota,
+// across TCP and UDP, and resets them at the start of each period.
+// Users without a quota are not limited.
+type Manager struct {
+	// limits maps each user name to its quota in bytes.
+	limits map[string]uint64
+	period string
+	// resetDay is the day of the month the monthly period starts.
+	resetDay  int
+	statePath string
+	timeNow   func() time.Time
+
+	mutex       sync.Mutex
+	periodStart time.Time
+	usage       map[string]uint64
+	// saved is false if the usage changed since the last save.
+	saved bool
+	// sessions maps each user name with a quota to the close
+	// functions of its active sessions, by session identifier.
+	sessions      map[string]map[uint64]func()
+	lastSessionID uint64
+}
+
+// New creates a quota manager with the limits given in bytes for
+// each user name, reset at the start of each period, which can be
+// "daily", "weekly" (starting on Monday) or "monthly" starting on
+// the reset day given, from 1 to 28. Periods start at midnight in
+// the local time zone. The usage is loaded from the state file at
+// the path given, if it exists and is for the current period.
+func New(limits map[string]uint64, period string, resetDay int,
+	statePath string) (manager *Manager, err error) {
+	err = CheckPeriod(period, resetDay)
+	if err != nil {
+		return nil, err
+	}
+
+	manager = &Manager{
+		limits:    limits,
+		period:    period,
+		resetDay:  resetDay,
+		statePath: statePath,
+		timeNow:   time.Now,
+		usage:     make(map[string]uint64, len(limits)),
+		saved:     true,
+		sessions:  make(map[string]map[uint64]func()),
+	}
+	manager.periodStart = manager.currentPeriodStart()
+
+	err = manager.load()
+	if err != nil {
+		return nil, fmt.Errorf("loading state: %w", err)
+	}
+	return manager, nil
+}
+
+// CheckPeriod returns an error if the period or
+// the reset day of the month is not valid.
+func CheckPeriod(period string, resetDay int) error {
+	switch period {
+	case PeriodDaily, PeriodWeekly, PeriodMonthly:
+	default:
+		return fmt.Errorf("%w: %s", ErrPeriodNotSupported, period)
+	}
+	const maxResetDay = 28 // present in all months
+	if resetDay < 1 || resetDay > maxResetDay {
+		return fmt.Errorf("%w: %d must be between 1 and %d",
+			ErrResetDayNotValid, resetDay, maxResetDay)
+	}
+	return nil
+}
+
+// Exceeded returns true if the user has a quota
+// and has used all of it for the current period.
+func (m *Manager) Exceeded(user string) bool {
+	limit, ok := m.limits[user]
+	if !ok {
+		return false
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.resetIfNewPeriod()
+	return m.usage[user] >= limit
+}
+
+// Consume adds n bytes to the usage of the user, and returns
+// false if the user has a quota and has used all of it. In this
+// case, all the active sessions of the user are closed.
+func (m *Manager) Consume(user string, n int) (ok bool) {
+	limit, ok := m.limits[user]
+	if !ok {
+		return true
+	}
+	m.mutex.Lock()
+	m.resetIfNewPeriod()
+	m.usage[user] += uint64(n)
+	m.saved = false
+	ok = m.usage[user] < limit
+	var sessions map[uint64]func()
+	if !ok {
+		sessions = m.sessions[user]
+		delete(m.sessions, user)
+	}
+	m.mutex.Unlock()
+
+	// Sessions are closed with the mutex unlocked, since
+	// closing a session can call methods of the manager.
+	for _, closeSession := range sessions {
+		closeSession()
+	}
+	return ok
+}
+
+// Track registers an active session of the user, to be closed with
+// the closeSession function given once the user exceeds its quota.
+// The closeSession function is called right away if the user already
+// exceeded its quota. The untrack function returned must be called
+// once the session ends.
+func (m *Manager) Track(user string, closeSession func()) (untrack func()) {
+	limit, ok := m.limits[user]
+	if !ok {
+		return func() {}
+	}
+	m.mutex.Lock()
+	m.resetIfNewPeriod()
+	if m.usage[user] >= limit {
+		m.mutex.Unlock()
+		closeSession()
+		return func() {}
+	}
+	m.lastSessionID++
+	id := m.lastSessionID
+	if m.sessions[user] == nil {
+		m.sessions[user] = make(map[uint64]func())
+	}
+	m.sessions[user][id] = closeSession
+	m.mutex.Unlock()
+
+	return func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		delete(m.sessions[user], id)
+		if len(m.sessions[user]) == 0 {
+			delete(m.sessions, user)
+		}
+	}
+}
+
+// Usage returns the number of bytes used by the
+// user in the current period, and its quota.
+func (m *Manager) Usage(user string) (used, limit uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.resetIfNewPeriod()
+	return m.usage[user], m.limits[user]
+}
+
+// Run saves the usage to the state file every save period, and
+// once more when the context is canceled. Errors saving the state
+// file are given to the onError function.
+func (m *Manager) Run(ctx context.Context, savePeriod time.Duration,
+	onError func(err error)) {
+	ticker := time.NewTicker(savePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			err := m.save()
+			if err != nil {
+				onError(err)
+			}
+			return
+		case <-ticker.C:
+			err := m.save()
+			if err != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// resetIfNewPeriod resets the usage of all users if a new period
+// started. It must be called with the mutex locked.
+func (m *Manager) resetIfNewPeriod() {
+	periodStart := m.currentPeriodStart()
+	if periodStart.Equal(m.periodStart) {
+		return
+	}
+	m.periodStart = periodStart
+	clear(m.usage)
+	m.saved = false
+}
+
+// currentPeriodStart returns the start time of the current period.
+func (m *Manager) currentPeriodStart() time.Time {
+	now := m.timeNow()
+	year, month, day := now.Date()
+	location := now.Location()
+	switch m.period {
+	case PeriodDaily:
+		return time.Date(year, month, day, 0, 0, 0, 0, location)
+	case PeriodWeekly:
+		const daysPerWeek = 7
+		daysSinceMonday := (int(now.Weekday()) + daysPerWeek - 1) % daysPerWeek
+		return time.Date(year, month, day-daysSinceMonday, 0, 0, 0, 0, location)
+	default: // monthly
+		if day < m.resetDay {
+			month--
+		}
+		return time.Date(year, month, m.resetDay, 0, 0, 0, 0, location)
+	}
+}
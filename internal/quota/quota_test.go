@@ -0,0 +1,194 @@
+package quota
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Manager_currentPeriodStart(t *testing.T) {
+	t.Parallel()
+
+	// Wednesday 6 March 2024
+	now := time.Date(2024, 3, 6, 15, 4, 5, 0, time.UTC)
+
+	testCases := map[string]struct {
+		period   string
+		resetDay int
+		now      time.Time
+		start    time.Time
+	}{
+		"daily": {
+			period:   PeriodDaily,
+			resetDay: 1,
+			now:      now,
+			start:    time.Date(2024, 3, 6, 0, 0, 0, 0, time.UTC),
+		},
+		"weekly": {
+			period:   PeriodWeekly,
+			resetDay: 1,
+			now:      now,
+			start:    time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC),
+		},
+		"weekly on sunday": {
+			period:   PeriodWeekly,
+			resetDay: 1,
+			now:      time.Date(2024, 3, 10, 23, 0, 0, 0, time.UTC),
+			start:    time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC),
+		},
+		"monthly after reset day": {
+			period:   PeriodMonthly,
+			resetDay: 5,
+			now:      now,
+			start:    time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC),
+		},
+		"monthly before reset day in january": {
+			period:   PeriodMonthly,
+			resetDay: 15,
+			now:      time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC),
+			start:    time.Date(2023, 12, 15, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			manager := &Manager{
+				period:   testCase.period,
+				resetDay: testCase.resetDay,
+				timeNow:  func() time.Time { return testCase.now },
+			}
+
+			start := manager.currentPeriodStart()
+
+			assert.Equal(t, testCase.start, start)
+		})
+	}
+}
+
+func Test_CheckPeriod(t *testing.T) {
+	t.Parallel()
+
+	err := CheckPeriod("yearly", 1)
+	assert.ErrorIs(t, err, ErrPeriodNotSupported)
+	err = CheckPeriod(PeriodMonthly, 31)
+	assert.ErrorIs(t, err, ErrResetDayNotValid)
+	err = CheckPeriod(PeriodMonthly, 28)
+	assert.NoError(t, err)
+}
+
+func Test_Manager(t *testing.T) {
+	t.Parallel()
+
+	statePath := filepath.Join(t.TempDir(), "quotas.json")
+	limits := map[string]uint64{"alice": 100}
+	now := time.Date(2024, 3, 6, 15, 0, 0, 0, time.UTC)
+	timeNow := func() time.Time { return now }
+
+	manager, err := New(limits, PeriodDaily, 1, statePath)
+	require.NoError(t, err)
+	manager.timeNow = timeNow
+	manager.periodStart = manager.currentPeriodStart()
+
+	assert.True(t, manager.Consume("bob", 1000), "user without quota")
+	assert.False(t, manager.Exceeded("bob"))
+
+	assert.True(t, manager.Consume("alice", 60))
+	assert.False(t, manager.Exceeded("alice"))
+	assert.False(t, manager.Consume("alice", 60))
+	assert.True(t, manager.Exceeded("alice"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	manager.Run(ctx, time.Hour, func(err error) { t.Error(err) })
+
+	// Usage is restored from the state file in the same period.
+	restored, err := New(limits, PeriodDaily, 1, statePath)
+	require.NoError(t, err)
+	restored.timeNow = timeNow
+	restored.periodStart = restored.currentPeriodStart()
+	err = restored.load()
+	require.NoError(t, err)
+	used, limit := restored.Usage("alice")
+	assert.Equal(t, uint64(120), used)
+	assert.Equal(t, uint64(100), limit)
+	assert.True(t, restored.Exceeded("alice"))
+
+	// Usage is reset the next day.
+	now = now.Add(12 * time.Hour)
+	assert.False(t, restored.Exceeded("alice"))
+	used, _ = restored.Usage("alice")
+	assert.Zero(t, used)
+}
+
+func Test_Manager_Track(t *testing.T) {
+	t.Parallel()
+
+	limits := map[string]uint64{"alice": 100, "bob": 100}
+	manager, err := New(limits, PeriodDaily, 1, filepath.Join(t.TempDir(), "quotas.json"))
+	require.NoError(t, err)
+
+	closed := make(map[string]int)
+	track := func(user, session string) (untrack func()) {
+		return manager.Track(user, func() { closed[session]++ })
+	}
+
+	track("alice", "alice 1")
+	untrackAlice2 := track("alice", "alice 2")
+	track("bob", "bob 1")
+	untrackCarol := track("carol", "carol 1") // user without quota
+	untrackAlice2()
+	untrackCarol()
+
+	assert.True(t, manager.Consume("alice", 99))
+	assert.Empty(t, closed)
+
+	assert.False(t, manager.Consume("alice", 1))
+	assert.Equal(t, map[string]int{"alice 1": 1}, closed)
+
+	// sessions are closed only once
+	assert.False(t, manager.Consume("alice", 1))
+	assert.Equal(t, map[string]int{"alice 1": 1}, closed)
+
+	// sessions started once the quota is exceeded are closed right away
+	untrack := track("alice", "alice 3")
+	assert.Equal(t, map[string]int{"alice 1": 1, "alice 3": 1}, closed)
+	untrack()
+
+	assert.True(t, manager.Consume("carol", 1000))
+	assert.Equal(t, map[string]int{"alice 1": 1, "alice 3": 1}, closed)
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	assert.Len(t, manager.sessions, 1)
+	assert.Len(t, manager.sessions["bob"], 1)
+}
+
+func Test_Manager_exactLimit(t *testing.T) {
+	t.Parallel()
+
+	limits := map[string]uint64{"alice": 100}
+	manager, err := New(limits, PeriodDaily, 1, filepath.Join(t.TempDir(), "quotas.json"))
+	require.NoError(t, err)
+
+	var closed int
+	manager.Track("alice", func() { closed++ })
+
+	assert.True(t, manager.Consume("alice", 99))
+	assert.False(t, manager.Exceeded("alice"))
+	assert.Zero(t, closed)
+
+	// the usage lands exactly on the limit
+	assert.False(t, manager.Consume("alice", 1))
+	assert.True(t, manager.Exceeded("alice"))
+	assert.Equal(t, 1, closed)
+
+	manager.Track("alice", func() { closed++ })
+	assert.Equal(t, 2, closed)
+}
@@ -0,0 +1,96 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type state struct {
+	PeriodStart time.Time         `json:"period_start"`
+	Usage       map[string]uint64 `json:"usage"`
+}
+
+// load loads the usage from the state file, if the file
+// exists and its usage is for the current period.
+func (m *Manager) load() (err error) {
+	data, err := os.ReadFile(m.statePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("reading state file: %w", err)
+	}
+
+	var fileState state
+	err = json.Unmarshal(data, &fileState)
+	if err != nil {
+		return fmt.Errorf("decoding state file: %w", err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !fileState.PeriodStart.Equal(m.periodStart) {
+		// usage of a previous period
+		m.saved = false
+		return nil
+	}
+	for user, used := range fileState.Usage {
+		m.usage[user] = used
+	}
+	return nil
+}
+
+// save writes the usage to the state file if it changed
+// since the last save. The file is written atomically.
+func (m *Manager) save() (err error) {
+	m.mutex.Lock()
+	if m.saved {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.resetIfNewPeriod()
+	data, err := json.Marshal(state{
+		PeriodStart: m.periodStart,
+		Usage:       m.usage,
+	})
+	m.saved = err == nil
+	m.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("encoding state: %w", err)
+	}
+
+	err = writeFileAtomic(m.statePath, data)
+	if err != nil {
+		m.mutex.Lock()
+		m.saved = false
+		m.mutex.Unlock()
+		return fmt.Errorf("writing state file: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes the data to a temporary file in the
+// same directory, and renames it to the path given, so the file
+// at the path given is never partially written.
+func writeFileAtomic(path string, data []byte) (err error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
@@ -0,0 +1,100 @@
+// Package relay copies data bidirectionally between two connections.
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// WriteHooks are functions called for each write to a connection,
+// where an error returned by any of them stops the relay. Each of
+// them can be left nil.
+type WriteHooks struct {
+	// Before is called with the number of bytes to write, and can
+	// block to limit the bandwidth until the context is canceled.
+	Before func(ctx context.Context, n int) error
+	// After is called with the number of bytes written.
+	After func(n int) error
+}
+
+// Copy copies between left and right connections bidirectionally,
+// and returns the number of bytes written to the right and left
+// connections. The rightHooks and leftHooks are called for each
+// write to the right and left connections respectively, and the
+// relay stops if they return an error. The first non-nil error is
+// returned, since the error of the other copy is usually the deadline
+// error caused by the first copy ending, and would otherwise hide a
+// decryption or hook error of the first copy. The context given to the Before hooks is canceled
+// once the context given is canceled or once either copy ends.
+func Copy(ctx context.Context, left, right net.Conn, timeNow func() time.Time,
+	rightHooks, leftHooks WriteHooks) (rightWritten, leftWritten int64, err error) {
+	parentCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error)
+	defer close(errs)
+
+	copyFn := func(a, b net.Conn, hooks WriteHooks, written *int64, errs chan error) {
+		var writer io.Writer = a
+		if hooks.Before != nil || hooks.After != nil {
+			writer = &hookedWriter{ctx: ctx, writer: a, hooks: hooks}
+		}
+		var copyErr error
+		*written, copyErr = io.Copy(writer, b)
+		// wake up the other goroutine blocking in a Before hook
+		cancel()
+		// wake up the other goroutine blocking on side a
+		if err := a.SetDeadline(timeNow()); err != nil {
+			errs <- err
+		} else {
+			errs <- copyErr
+		}
+	}
+
+	go copyFn(right, left, rightHooks, &rightWritten, errs)
+	go copyFn(left, right, leftHooks, &leftWritten, errs)
+
+	// Collect eventual errors
+	for i := 0; i < 2; i++ {
+		copyErr := <-errs
+		if errors.Is(copyErr, context.Canceled) && parentCtx.Err() == nil {
+			// the other side stopped waiting in a Before
+			// hook since the first side ended.
+			continue
+		}
+		if err == nil {
+			// the other side error is usually a deadline
+			// error caused by the first side ending.
+			err = copyErr
+		}
+	}
+	return rightWritten, leftWritten, err
+}
+
+// hookedWriter calls its hooks before and after each write,
+// and fails if any of them returns an error.
+type hookedWriter struct {
+	ctx    context.Context //nolint:containedctx
+	writer io.Writer
+	hooks  WriteHooks
+}
+
+func (w *hookedWriter) Write(b []byte) (n int, err error) {
+	if w.hooks.Before != nil {
+		err = w.hooks.Before(w.ctx, len(b))
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err = w.writer.Write(b)
+	if w.hooks.After != nil {
+		afterErr := w.hooks.After(n)
+		if err == nil {
+			err = afterErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,162 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Copy(t *testing.T) {
+	t.Parallel()
+
+	leftPeer, left := net.Pipe()
+	right, rightPeer := net.Pipe()
+
+	var rightAfter, leftAfter int
+	rightHooks := WriteHooks{
+		After: func(n int) error {
+			rightAfter += n
+			return nil
+		},
+	}
+	leftHooks := WriteHooks{
+		Before: func(context.Context, int) error { return nil },
+		After: func(n int) error {
+			leftAfter += n
+			return nil
+		},
+	}
+
+	type result struct {
+		rightWritten, leftWritten int64
+		err                       error
+	}
+	done := make(chan result)
+	go func() {
+		var r result
+		r.rightWritten, r.leftWritten, r.err = Copy(context.Background(), left, right, time.Now, rightHooks, leftHooks)
+		done <- r
+	}()
+
+	_, err := leftPeer.Write([]byte("hello"))
+	require.NoError(t, err)
+	buffer := make([]byte, 5)
+	_, err = io.ReadFull(rightPeer, buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buffer))
+
+	_, err = rightPeer.Write([]byte("hi"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(leftPeer, buffer[:2])
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(buffer[:2]))
+
+	err = leftPeer.Close()
+	require.NoError(t, err)
+
+	r := <-done
+	assert.Equal(t, int64(5), r.rightWritten)
+	assert.Equal(t, int64(2), r.leftWritten)
+	assert.Equal(t, 5, rightAfter)
+	assert.Equal(t, 2, leftAfter)
+	// the right to left copy is woken up when the left to right copy ends,
+	// and fails since the left connection is closed.
+	assert.Error(t, r.err)
+}
+
+func Test_Copy_hookError(t *testing.T) {
+	t.Parallel()
+
+	leftPeer, left := net.Pipe()
+	right, rightPeer := net.Pipe()
+	defer rightPeer.Close()
+
+	errTest := errors.New("test error")
+	rightHooks := WriteHooks{
+		Before: func(context.Context, int) error { return errTest },
+	}
+
+	done := make(chan error)
+	go func() {
+		_, _, err := Copy(context.Background(), left, right, time.Now, rightHooks, WriteHooks{})
+		done <- err
+	}()
+
+	_, err := leftPeer.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	err = <-done
+	assert.ErrorIs(t, err, errTest)
+}
+
+// readErrorConn is a connection failing to read with its error.
+type readErrorConn struct {
+	net.Conn
+	err error
+}
+
+func (c *readErrorConn) Read([]byte) (int, error) { return 0, c.err }
+
+func Test_Copy_firstErrorReturned(t *testing.T) {
+	t.Parallel()
+
+	_, leftPipe := net.Pipe()
+	right, rightPeer := net.Pipe()
+	defer rightPeer.Close()
+
+	// The left to right copy fails first, and the right to left copy
+	// then fails with a deadline error once woken up.
+	errTest := errors.New("test error")
+	left := &readErrorConn{Conn: leftPipe, err: errTest}
+
+	_, _, err := Copy(context.Background(), left, right, time.Now,
+		WriteHooks{}, WriteHooks{})
+
+	assert.ErrorIs(t, err, errTest)
+}
+
+func Test_Copy_beforeHookCanceled(t *testing.T) {
+	t.Parallel()
+
+	leftPeer, left := net.Pipe()
+	right, rightPeer := net.Pipe()
+	defer rightPeer.Close()
+
+	waiting := make(chan struct{})
+	leftHooks := WriteHooks{
+		Before: func(ctx context.Context, _ int) error {
+			close(waiting)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+
+	done := make(chan error)
+	go func() {
+		_, _, err := Copy(context.Background(), left, right, time.Now, WriteHooks{}, leftHooks)
+		done <- err
+	}()
+
+	_, err := rightPeer.Write([]byte("hi"))
+	require.NoError(t, err)
+	<-waiting
+
+	// the left to right copy ends, and the right
+	// to left copy stops waiting in its hook.
+	err = leftPeer.Close()
+	require.NoError(t, err)
+
+	select {
+	case err = <-done:
+		// the error is from the closed pipe
+		assert.NotErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not stop waiting in the before hook")
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/sha1" //nolint: gosec
+	"errors"
+	"fmt"
 	"io"
 
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/hkdf"
+	"lukechampine.com/blake3"
 )
 
 type AEADCipherAdapter struct {
@@ -43,7 +46,16 @@ func Chacha20Poly1305(preSharedKey []byte) *AEADCipherAdapter {
 	}
 }
 
-// AESGCM creates a new Cipher with a pre-shared key of 16 or 32 bytes.
+// XChacha20Poly1305 creates a new Cipher with a pre-shared key of 32 bytes,
+// using 24 bytes nonces.
+func XChacha20Poly1305(preSharedKey []byte) *AEADCipherAdapter {
+	return &AEADCipherAdapter{
+		preSharedKey:  preSharedKey,
+		newAEADCipher: chacha20poly1305.NewX,
+	}
+}
+
+// AESGCM creates a new Cipher with a pre-shared key of 16, 24 or 32 bytes.
 func AESGCM(preSharedKey []byte) *AEADCipherAdapter {
 	return &AEADCipherAdapter{
 		preSharedKey:  preSharedKey,
@@ -58,3 +70,140 @@ func newAESGCM(key []byte) (cipher.AEAD, error) {
 	}
 	return cipher.NewGCM(block)
 }
+
+// AEAD2022CipherAdapter is the cipher adapter for the Shadowsocks 2022
+// edition ciphers, where session subkeys are derived using BLAKE3.
+type AEAD2022CipherAdapter struct {
+	preSharedKey  []byte
+	newAEADCipher func(key []byte) (cipher.AEAD, error)
+	// block is the block cipher using the pre-shared key directly,
+	// used to encrypt UDP separate headers. It is nil for ciphers
+	// not using a separate header.
+	block cipher.Block
+	// packetAEAD is the AEAD cipher using the pre-shared key directly,
+	// used to encrypt whole UDP packets for ciphers without a separate
+	// header. It is nil for ciphers using a separate header.
+	packetAEAD cipher.AEAD
+	// users maps the first 16 bytes of the BLAKE3 hash of each user
+	// pre-shared key to its user, when the pre-shared key of the adapter
+	// is an identity pre-shared key for extensible identity headers.
+	users map[[aes.BlockSize]byte]*user2022
+}
+
+// user2022 is a user identified with an extensible identity header.
+type user2022 struct {
+	name string
+	aead *AEAD2022CipherAdapter
+}
+
+var errIdentityHeadersNotSupported = errors.New("extensible identity headers are not supported")
+
+// AddUser adds a user with its own pre-shared key, such that the pre-shared
+// key of the adapter is used as identity pre-shared key for extensible
+// identity headers. It is only supported for AES based ciphers.
+func (c *AEAD2022CipherAdapter) AddUser(name string, preSharedKey []byte) (err error) {
+	if c.block == nil {
+		return fmt.Errorf("%w: for this cipher", errIdentityHeadersNotSupported)
+	}
+	aead, err := AESGCM2022(preSharedKey)
+	if err != nil {
+		return err
+	}
+	if c.users == nil {
+		c.users = make(map[[aes.BlockSize]byte]*user2022)
+	}
+	c.users[identityHash(preSharedKey)] = &user2022{
+		name: name,
+		aead: aead,
+	}
+	return nil
+}
+
+// identityHash returns the first 16 bytes of the BLAKE3
+// hash of the user pre-shared key given.
+func identityHash(preSharedKey []byte) (hash [aes.BlockSize]byte) {
+	sum := blake3.Sum512(preSharedKey)
+	copy(hash[:], sum[:])
+	return hash
+}
+
+var errUserNotFound = errors.New("user not found")
+
+// lookupUser returns the user matching the decrypted identity header given.
+func (c *AEAD2022CipherAdapter) lookupUser(identityHeader []byte) (user *user2022, err error) {
+	var hash [aes.BlockSize]byte
+	copy(hash[:], identityHeader)
+	user, ok := c.users[hash]
+	if !ok {
+		return nil, fmt.Errorf("%w: %w: for identity header", ErrDecryption, errUserNotFound)
+	}
+	return user, nil
+}
+
+// identitySubkeyBlock returns a block cipher using the identity subkey
+// derived from the pre-shared key and the salt given.
+func (c *AEAD2022CipherAdapter) identitySubkeyBlock(salt []byte) (cipher.Block, error) {
+	keyMaterial := make([]byte, len(c.preSharedKey)+len(salt))
+	copy(keyMaterial, c.preSharedKey)
+	copy(keyMaterial[len(c.preSharedKey):], salt)
+	subkey := make([]byte, len(c.preSharedKey))
+	const context = "shadowsocks 2022 identity subkey"
+	blake3.DeriveKey(subkey, context, keyMaterial)
+	return aes.NewCipher(subkey)
+}
+
+func (c *AEAD2022CipherAdapter) keySize() int {
+	return len(c.preSharedKey)
+}
+
+// GetSaltSize returns the salt size, which is the key size
+// for Shadowsocks 2022 ciphers.
+func (c *AEAD2022CipherAdapter) GetSaltSize() int {
+	return c.keySize()
+}
+
+// Crypt derives a session subkey from the pre-shared key and the
+// salt given, and returns an AEAD cipher using this subkey.
+// For UDP, the salt is the 8 bytes session ID.
+func (c *AEAD2022CipherAdapter) Crypt(salt []byte) (cipher.AEAD, error) {
+	return c.newAEADCipher(deriveSessionSubkey(c.preSharedKey, salt))
+}
+
+func deriveSessionSubkey(preSharedKey, salt []byte) (subkey []byte) {
+	keyMaterial := make([]byte, len(preSharedKey)+len(salt))
+	copy(keyMaterial, preSharedKey)
+	copy(keyMaterial[len(preSharedKey):], salt)
+	subkey = make([]byte, len(preSharedKey))
+	const context = "shadowsocks 2022 session subkey"
+	blake3.DeriveKey(subkey, context, keyMaterial)
+	return subkey
+}
+
+// AESGCM2022 creates a new Shadowsocks 2022 Cipher with a pre-shared
+// key of 16 or 32 bytes.
+func AESGCM2022(preSharedKey []byte) (*AEAD2022CipherAdapter, error) {
+	block, err := aes.NewCipher(preSharedKey)
+	if err != nil {
+		return nil, err
+	}
+	return &AEAD2022CipherAdapter{
+		preSharedKey:  preSharedKey,
+		newAEADCipher: newAESGCM,
+		block:         block,
+	}, nil
+}
+
+// Chacha2022 creates a new Shadowsocks 2022 ChaCha20-Poly1305 Cipher
+// with a pre-shared key of 32 bytes. UDP packets are encrypted with
+// XChaCha20-Poly1305 using the pre-shared key and a random nonce.
+func Chacha2022(preSharedKey []byte) (*AEAD2022CipherAdapter, error) {
+	packetAEAD, err := chacha20poly1305.NewX(preSharedKey)
+	if err != nil {
+		return nil, err
+	}
+	return &AEAD2022CipherAdapter{
+		preSharedKey:  preSharedKey,
+		newAEADCipher: chacha20poly1305.New,
+		packetAEAD:    packetAEAD,
+	}, nil
+}
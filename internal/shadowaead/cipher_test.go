@@ -0,0 +1,120 @@
+package shadowaead
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_AEADCipherAdapter_roundTrip(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		newAdapter func(preSharedKey []byte) *AEADCipherAdapter
+		keySize    int
+		saltSize   int
+		nonceSize  int
+	}{
+		"chacha20-ietf-poly1305": {
+			newAdapter: Chacha20Poly1305,
+			keySize:    32,
+			saltSize:   32,
+			nonceSize:  12,
+		},
+		"xchacha20-ietf-poly1305": {
+			newAdapter: XChacha20Poly1305,
+			keySize:    32,
+			saltSize:   32,
+			nonceSize:  24,
+		},
+		"aes-128-gcm": {
+			newAdapter: AESGCM,
+			keySize:    16,
+			saltSize:   16,
+			nonceSize:  12,
+		},
+		"aes-192-gcm": {
+			newAdapter: AESGCM,
+			keySize:    24,
+			saltSize:   24,
+			nonceSize:  12,
+		},
+		"aes-256-gcm": {
+			newAdapter: AESGCM,
+			keySize:    32,
+			saltSize:   32,
+			nonceSize:  12,
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			adapter := testCase.newAdapter(bytes.Repeat([]byte{1}, testCase.keySize))
+			assert.Equal(t, testCase.saltSize, adapter.GetSaltSize())
+			aead, err := adapter.Crypt(make([]byte, testCase.saltSize))
+			require.NoError(t, err)
+			assert.Equal(t, testCase.nonceSize, aead.NonceSize())
+
+			t.Run("stream", func(t *testing.T) {
+				t.Parallel()
+				clientConn := newBufferConn(nil)
+				client := NewConn(clientConn, adapter, newMapSaltFilter())
+				largePayload := bytes.Repeat([]byte{7}, 2*payloadSizeMask+100)
+				_, err := client.Write([]byte("hello"))
+				require.NoError(t, err)
+				_, err = client.Write(largePayload)
+				require.NoError(t, err)
+
+				server := NewConn(newBufferConn(clientConn.written.Bytes()),
+					adapter, newMapSaltFilter())
+				plaintext, err := io.ReadAll(server)
+				require.NoError(t, err)
+				assert.Equal(t, append([]byte("hello"), largePayload...), plaintext)
+
+				wrongKey := bytes.Repeat([]byte{2}, testCase.keySize)
+				server = NewConn(newBufferConn(clientConn.written.Bytes()),
+					testCase.newAdapter(wrongKey), newMapSaltFilter())
+				_, err = server.Read(make([]byte, 100))
+				assert.ErrorIs(t, err, ErrDecryption)
+			})
+
+			t.Run("packet", func(t *testing.T) {
+				t.Parallel()
+				address := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+				clientPacketConn := &queuePacketConn{}
+				client := NewPacketConn(clientPacketConn, adapter, newMapSaltFilter())
+				_, err := client.WriteTo([]byte("hello"), address)
+				require.NoError(t, err)
+				require.Len(t, clientPacketConn.written, 1)
+				sealed := clientPacketConn.written[0].data
+				assert.Len(t, sealed, testCase.saltSize+len("hello")+aead.Overhead())
+
+				serverPacketConn := &queuePacketConn{}
+				server := NewPacketConn(serverPacketConn, adapter, newMapSaltFilter())
+				serverPacketConn.push(sealed, address)
+				buffer := make([]byte, 1024)
+				n, _, err := server.ReadFrom(buffer)
+				require.NoError(t, err)
+				assert.Equal(t, "hello", string(buffer[:n]))
+
+				// replayed packet
+				serverPacketConn.push(sealed, address)
+				_, _, err = server.ReadFrom(buffer)
+				assert.ErrorIs(t, err, ErrRepeatedSalt)
+
+				wrongKey := bytes.Repeat([]byte{2}, testCase.keySize)
+				server = NewPacketConn(serverPacketConn, testCase.newAdapter(wrongKey), newMapSaltFilter())
+				serverPacketConn.push(sealed, address)
+				_, _, err = server.ReadFrom(buffer)
+				assert.ErrorIs(t, err, ErrDecryption)
+			})
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package shadowaead
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// bufferConn is a net.Conn reading from reader and
+// writing to the written buffer.
+type bufferConn struct {
+	net.Conn
+	reader        io.Reader
+	written       bytes.Buffer
+	remoteAddress net.Addr
+}
+
+func newBufferConn(data []byte) *bufferConn {
+	return &bufferConn{
+		reader:        bytes.NewReader(data),
+		remoteAddress: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000},
+	}
+}
+
+func (c *bufferConn) Read(b []byte) (int, error)  { return c.reader.Read(b) }
+func (c *bufferConn) Write(b []byte) (int, error) { return c.written.Write(b) }
+func (c *bufferConn) RemoteAddr() net.Addr        { return c.remoteAddress }
+
+// queuePacketConn is a net.PacketConn reading packets
+// from a queue and recording the packets written.
+type queuePacketConn struct {
+	net.PacketConn
+	mu      sync.Mutex
+	packets []queuedPacket
+	written []queuedPacket
+}
+
+type queuedPacket struct {
+	data    []byte
+	address net.Addr
+}
+
+func (c *queuePacketConn) push(data []byte, address net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.packets = append(c.packets, queuedPacket{
+		data:    append([]byte(nil), data...),
+		address: address,
+	})
+}
+
+func (c *queuePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.packets) == 0 {
+		return 0, nil, io.EOF
+	}
+	packet := c.packets[0]
+	c.packets = c.packets[1:]
+	return copy(b, packet.data), packet.address, nil
+}
+
+func (c *queuePacketConn) WriteTo(b []byte, address net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written = append(c.written, queuedPacket{
+		data:    append([]byte(nil), b...),
+		address: address,
+	})
+	return len(b), nil
+}
+
+// mapSaltFilter is an exact salt filter.
+type mapSaltFilter struct {
+	mu    sync.Mutex
+	salts map[string]struct{}
+}
+
+func newMapSaltFilter() *mapSaltFilter {
+	return &mapSaltFilter{salts: make(map[string]struct{})}
+}
+
+func (f *mapSaltFilter) AddSalt(b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.salts[string(b)] = struct{}{}
+}
+
+func (f *mapSaltFilter) IsSaltRepeated(b []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.salts[string(b)]
+	return ok
+}
+
+// chunkSealer seals chunks with an AEAD using a little endian
+// counter nonce, as done by a Shadowsocks client.
+type chunkSealer struct {
+	aead    cipher.AEAD
+	counter uint64
+}
+
+func (s *chunkSealer) nonce() []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce, s.counter)
+	s.counter++
+	return nonce
+}
+
+func (s *chunkSealer) seal(plaintext []byte) []byte {
+	return s.aead.Seal(nil, s.nonce(), plaintext, nil)
+}
+
+func (s *chunkSealer) open(t *testing.T, reader io.Reader, size int) []byte {
+	t.Helper()
+	ciphertext := make([]byte, size+s.aead.Overhead())
+	_, err := io.ReadFull(reader, ciphertext)
+	require.NoError(t, err)
+	plaintext, err := s.aead.Open(nil, s.nonce(), ciphertext, nil)
+	require.NoError(t, err)
+	return plaintext
+}
+
+func testNewAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
 )
 
 //nolint:gochecknoglobals
@@ -18,6 +19,21 @@ type cipherPacketConn struct {
 	saltFilter SaltFilter
 	mu         sync.Mutex
 	buffer     []byte // write lock
+
+	// Fields only set for multiple users
+	users         *UserCiphers
+	readMu        sync.Mutex
+	readBuffer    []byte // read lock
+	addressesMu   sync.Mutex
+	userByAddress map[string]*addressUser
+	lastPrune     time.Time
+	timeNow       func() time.Time
+}
+
+// addressUser is the user identified for a client address.
+type addressUser struct {
+	user     *legacyUser
+	lastSeen time.Time
 }
 
 // NewPacketConn wraps a net.PacketConn with a cipher.
@@ -31,11 +47,36 @@ func NewPacketConn(connection net.PacketConn, aead aeadCipher, saltFilter SaltFi
 	}
 }
 
+// NewMultiUserPacketConn wraps a net.PacketConn with the cipher of the user
+// identified by trial decryption for each client address.
+func NewMultiUserPacketConn(connection net.PacketConn, users *UserCiphers,
+	saltFilter SaltFilter) net.PacketConn {
+	const maxUDPPacketSize = 64 * 1024
+	return &cipherPacketConn{
+		PacketConn:    connection,
+		buffer:        make([]byte, maxUDPPacketSize),
+		saltFilter:    saltFilter,
+		users:         users,
+		readBuffer:    make([]byte, maxUDPPacketSize),
+		userByAddress: make(map[string]*addressUser),
+		timeNow:       time.Now,
+	}
+}
+
 // WriteTo encrypts b and write to addr using the embedded PacketConn.
 func (c *cipherPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	aead := c.aead
+	if c.users != nil {
+		user := c.getAddressUser(addr.String())
+		if user == nil {
+			return 0, fmt.Errorf("%w: for address %s", errUserNotIdentified, addr)
+		}
+		aead = user.aead
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	buf, err := c.pack(c.buffer, b)
+	buf, err := c.pack(c.buffer, b, aead)
 	if err != nil {
 		return 0, err
 	}
@@ -49,6 +90,10 @@ func (c *cipherPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	if err != nil {
 		return n, address, err
 	}
+	if c.users != nil {
+		n, err = c.unpackMultiUser(b, b[:n], address)
+		return n, address, err
+	}
 	bb, err := c.unpack(b[c.aead.GetSaltSize():], b[:n])
 	if err != nil {
 		return n, address, err
@@ -59,14 +104,14 @@ func (c *cipherPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
 
 // pack encrypts a plaintext using the cipher provided, with a randomly generated salt and
 // returns a slice of dst containing the encrypted packet.
-func (c *cipherPacketConn) pack(dst, plaintext []byte) ([]byte, error) {
-	saltSize := c.aead.GetSaltSize()
+func (c *cipherPacketConn) pack(dst, plaintext []byte, aeadCipher aeadCipher) ([]byte, error) {
+	saltSize := aeadCipher.GetSaltSize()
 	salt := dst[:saltSize]
 	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
 		return nil, err
 	}
 
-	aead, err := c.aead.Crypt(salt)
+	aead, err := aeadCipher.Crypt(salt)
 	if err != nil {
 		return nil, err
 	}
@@ -81,7 +126,12 @@ func (c *cipherPacketConn) pack(dst, plaintext []byte) ([]byte, error) {
 
 var (
 	errPacketTooShort = errors.New("packet is too short")
-	errRepeatedSalt   = errors.New("repeated salt detected")
+	// ErrRepeatedSalt is wrapped by errors caused by a salt
+	// already seen, which can be a replay attack.
+	ErrRepeatedSalt = errors.New("repeated salt detected")
+	// ErrDecryption is wrapped by errors caused by data which
+	// cannot be authenticated and decrypted with the key(s).
+	ErrDecryption = errors.New("decryption failed")
 )
 
 // unpack decrypts a packet using the cipher provided and returns a slice of dst containing
@@ -94,7 +144,7 @@ func (c *cipherPacketConn) unpack(dst, packet []byte) (plaintext []byte, err err
 	}
 	salt := packet[:saltSize]
 	if c.saltFilter.IsSaltRepeated(salt) {
-		return nil, fmt.Errorf("%w: possible replay attack, dropping the packet", errRepeatedSalt)
+		return nil, fmt.Errorf("%w: possible replay attack, dropping the packet", ErrRepeatedSalt)
 	}
 	aead, err := c.aead.Crypt(salt)
 	if err != nil {
@@ -108,5 +158,74 @@ func (c *cipherPacketConn) unpack(dst, packet []byte) (plaintext []byte, err err
 	if saltSize+len(dst)+aead.Overhead() < len(packet) {
 		return nil, io.ErrShortBuffer
 	}
-	return aead.Open(dst[:0], zeroNonce[:aead.NonceSize()], packet[saltSize:], nil)
+	plaintext, err = aead.Open(dst[:0], zeroNonce[:aead.NonceSize()], packet[saltSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryption, err)
+	}
+	return plaintext, nil
+}
+
+var errUserNotIdentified = errors.New("user not identified")
+
+// unpackMultiUser identifies the user of the packet by trial decryption,
+// and copies the decrypted packet to dst, which can overlap the packet.
+// The packet is decrypted into the shared read buffer, so the copy to dst
+// is done with the read lock held.
+func (c *cipherPacketConn) unpackMultiUser(dst, packet []byte, address net.Addr) (
+	n int, err error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	user, plaintext, err := c.users.identifyPacketUser(address, c.readBuffer, packet)
+	if err != nil {
+		return 0, fmt.Errorf("identifying user: %w", err)
+	}
+	salt := packet[:user.aead.GetSaltSize()]
+	if c.saltFilter.IsSaltRepeated(salt) {
+		return 0, fmt.Errorf("%w: possible replay attack, dropping the packet", ErrRepeatedSalt)
+	}
+	c.saltFilter.AddSalt(salt)
+	c.setAddressUser(address.String(), user)
+	return copy(dst, plaintext), nil
+}
+
+// User returns the name of the user identified for the client address
+// given, or the empty string if no user is identified.
+func (c *cipherPacketConn) User(address net.Addr) string {
+	if c.users == nil {
+		return ""
+	}
+	user := c.getAddressUser(address.String())
+	if user == nil {
+		return ""
+	}
+	return user.name
+}
+
+func (c *cipherPacketConn) getAddressUser(address string) (user *legacyUser) {
+	c.addressesMu.Lock()
+	defer c.addressesMu.Unlock()
+	entry, ok := c.userByAddress[address]
+	if !ok {
+		return nil
+	}
+	return entry.user
+}
+
+func (c *cipherPacketConn) setAddressUser(address string, user *legacyUser) {
+	now := c.timeNow()
+	c.addressesMu.Lock()
+	defer c.addressesMu.Unlock()
+	c.userByAddress[address] = &addressUser{
+		user:     user,
+		lastSeen: now,
+	}
+	if now.Sub(c.lastPrune) < udpSessionPruneRate {
+		return
+	}
+	c.lastPrune = now
+	for address, entry := range c.userByAddress {
+		if now.Sub(entry.lastSeen) > udpSessionTimeout {
+			delete(c.userByAddress, address)
+		}
+	}
 }
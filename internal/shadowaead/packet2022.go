@@ -0,0 +1,369 @@
+package shadowaead
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	sessionIDSize       = 8
+	packetIDSize        = 8
+	separateHeaderSize  = sessionIDSize + packetIDSize
+	udpSessionTimeout   = 5 * time.Minute
+	udpSessionPruneRate = time.Minute
+)
+
+// NewPacketConn2022 wraps a net.PacketConn with a Shadowsocks 2022 cipher,
+// for the server side of the connection.
+func NewPacketConn2022(connection net.PacketConn, aead *AEAD2022CipherAdapter) net.PacketConn {
+	const maxUDPPacketSize = 64 * 1024
+	return &packet2022Conn{
+		PacketConn:  connection,
+		aead:        aead,
+		defaultUser: &user2022{aead: aead},
+		timeNow:     time.Now,
+		sessions:    make(map[string]*udpSession),
+		buffer:      make([]byte, maxUDPPacketSize),
+	}
+}
+
+type packet2022Conn struct {
+	net.PacketConn
+	aead *AEAD2022CipherAdapter
+	// defaultUser is the unnamed user using the adapter
+	// pre-shared key, if users are not identified.
+	defaultUser *user2022
+	timeNow     func() time.Time
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*udpSession // keyed by client address
+	lastPrune  time.Time
+
+	writeMu sync.Mutex
+	buffer  []byte
+}
+
+// udpSession contains the state of a Shadowsocks 2022 UDP session
+// with a client.
+type udpSession struct {
+	// user is the user of the session, with its name set
+	// if identified with an extensible identity header.
+	user            *user2022
+	clientSessionID []byte
+	clientAEAD      cipher.AEAD
+	serverSessionID []byte
+	serverAEAD      cipher.AEAD
+	lastSeen        time.Time
+
+	mu             sync.Mutex
+	window         slidingWindow
+	serverPacketID uint64
+}
+
+func newUDPSession(user *user2022, clientSessionID []byte) (
+	session *udpSession, err error) {
+	aead := user.aead
+	session = &udpSession{
+		user:            user,
+		clientSessionID: make([]byte, sessionIDSize),
+		serverSessionID: make([]byte, sessionIDSize),
+	}
+	copy(session.clientSessionID, clientSessionID)
+	if _, err := io.ReadFull(rand.Reader, session.serverSessionID); err != nil {
+		return nil, err
+	}
+	if aead.block == nil {
+		// packets are encrypted with the pre-shared key directly
+		return session, nil
+	}
+	session.clientAEAD, err = aead.Crypt(session.clientSessionID)
+	if err != nil {
+		return nil, err
+	}
+	session.serverAEAD, err = aead.Crypt(session.serverSessionID)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// WriteTo encrypts b and write to addr using the embedded PacketConn.
+func (c *packet2022Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	session := c.getSession(addr.String())
+	if session == nil {
+		return 0, fmt.Errorf("%w: for address %s", errSessionNotFound, addr)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	buf, err := c.pack(c.buffer, b, session)
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.PacketConn.WriteTo(buf, addr)
+	return len(b), err
+}
+
+// ReadFrom reads from the embedded PacketConn and decrypts into b.
+func (c *packet2022Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, address, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, address, err
+	}
+	plaintext, err := c.unpack(b[:n], address.String())
+	if err != nil {
+		return n, address, err
+	}
+	copy(b, plaintext)
+	return len(plaintext), address, nil
+}
+
+var errSessionNotFound = errors.New("session not found")
+
+// User returns the name of the user of the session for the client address
+// given, if the user was identified with an extensible identity header.
+// It returns the empty string otherwise.
+func (c *packet2022Conn) User(address net.Addr) string {
+	session := c.getSession(address.String())
+	if session == nil {
+		return ""
+	}
+	return session.user.name
+}
+
+func (c *packet2022Conn) getSession(address string) (session *udpSession) {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	return c.sessions[address]
+}
+
+func (c *packet2022Conn) setSession(address string, session *udpSession, now time.Time) {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	c.sessions[address] = session
+	if now.Sub(c.lastPrune) < udpSessionPruneRate {
+		return
+	}
+	c.lastPrune = now
+	for address, session := range c.sessions {
+		session.mu.Lock()
+		expired := now.Sub(session.lastSeen) > udpSessionTimeout
+		session.mu.Unlock()
+		if expired {
+			delete(c.sessions, address)
+		}
+	}
+}
+
+// pack encrypts a plaintext using the session given and returns a slice
+// of dst containing the encrypted packet.
+func (c *packet2022Conn) pack(dst, plaintext []byte, session *udpSession) ([]byte, error) {
+	session.mu.Lock()
+	packetID := session.serverPacketID
+	session.serverPacketID++
+	session.mu.Unlock()
+
+	if session.user.aead.block == nil {
+		return c.packWithNonce(dst, plaintext, session, packetID)
+	}
+	return c.packWithSeparateHeader(dst, plaintext, session, packetID)
+}
+
+const serverMessageHeaderSize = 1 + 8 + sessionIDSize + 2
+
+// packWithSeparateHeader encrypts the packet with the session server AEAD,
+// using an AES encrypted separate header containing the session ID and
+// packet ID.
+func (c *packet2022Conn) packWithSeparateHeader(dst, plaintext []byte,
+	session *udpSession, packetID uint64) ([]byte, error) {
+	aead := session.serverAEAD
+	if len(dst) < separateHeaderSize+serverMessageHeaderSize+len(plaintext)+aead.Overhead() {
+		return nil, io.ErrShortBuffer
+	}
+
+	separateHeader := dst[:separateHeaderSize]
+	copy(separateHeader, session.serverSessionID)
+	binary.BigEndian.PutUint64(separateHeader[sessionIDSize:], packetID)
+
+	body := dst[separateHeaderSize : separateHeaderSize+serverMessageHeaderSize+len(plaintext)]
+	c.putServerMessageHeader(body, session)
+	copy(body[serverMessageHeaderSize:], plaintext)
+
+	nonce := separateHeader[4:]
+	sealed := aead.Seal(body[:0], nonce, body, nil)
+	session.user.aead.block.Encrypt(separateHeader, separateHeader)
+	return dst[:separateHeaderSize+len(sealed)], nil
+}
+
+// packWithNonce encrypts the whole packet with the pre-shared key AEAD,
+// using a random nonce prepended to the packet.
+func (c *packet2022Conn) packWithNonce(dst, plaintext []byte,
+	session *udpSession, packetID uint64) ([]byte, error) {
+	aead := session.user.aead.packetAEAD
+	nonceSize := aead.NonceSize()
+	if len(dst) < nonceSize+separateHeaderSize+serverMessageHeaderSize+len(plaintext)+aead.Overhead() {
+		return nil, io.ErrShortBuffer
+	}
+
+	nonce := dst[:nonceSize]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	body := dst[nonceSize : nonceSize+separateHeaderSize+serverMessageHeaderSize+len(plaintext)]
+	copy(body, session.serverSessionID)
+	binary.BigEndian.PutUint64(body[sessionIDSize:], packetID)
+	c.putServerMessageHeader(body[separateHeaderSize:], session)
+	copy(body[separateHeaderSize+serverMessageHeaderSize:], plaintext)
+
+	sealed := aead.Seal(body[:0], nonce, body, nil)
+	return dst[:nonceSize+len(sealed)], nil
+}
+
+// putServerMessageHeader writes the server message header to the start of b,
+// without any padding.
+func (c *packet2022Conn) putServerMessageHeader(b []byte, session *udpSession) {
+	b[0] = headerTypeServer
+	binary.BigEndian.PutUint64(b[1:], uint64(c.timeNow().Unix()))
+	copy(b[9:], session.clientSessionID)
+	b[9+sessionIDSize], b[9+sessionIDSize+1] = 0, 0 // no padding
+}
+
+var errPacketReplayed = errors.New("packet ID already received")
+
+// unpack decrypts a packet in place and returns a slice of the packet
+// containing the decrypted target address and payload.
+func (c *packet2022Conn) unpack(packet []byte, address string) (plaintext []byte, err error) {
+	var sessionID, body []byte
+	var packetID uint64
+	var user *user2022
+	if c.aead.block == nil {
+		sessionID, packetID, body, err = c.openWithNonce(packet)
+		user = c.defaultUser
+	} else {
+		sessionID, packetID, user, body, err = c.openSeparateHeader(packet)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session := c.getSession(address)
+	isNewSession := session == nil ||
+		string(session.clientSessionID) != string(sessionID) ||
+		session.user.aead != user.aead
+	if isNewSession {
+		session, err = newUDPSession(user, sessionID)
+		if err != nil {
+			return nil, fmt.Errorf("creating session: %w", err)
+		}
+	}
+
+	if c.aead.block != nil { // body is encrypted with the session client AEAD
+		nonce := packet[4:separateHeaderSize]
+		body, err = session.clientAEAD.Open(body[:0], nonce, body, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrDecryption, err)
+		}
+	}
+
+	now := c.timeNow()
+	plaintext, err = parseClientMessageHeader(body, now)
+	if err != nil {
+		return nil, err
+	}
+
+	session.mu.Lock()
+	if !session.window.isValid(packetID) {
+		session.mu.Unlock()
+		return nil, fmt.Errorf("%w: %d, possible replay attack, dropping the packet",
+			errPacketReplayed, packetID)
+	}
+	session.window.add(packetID)
+	session.lastSeen = now
+	session.mu.Unlock()
+
+	if isNewSession {
+		c.setSession(address, session, now)
+	}
+	return plaintext, nil
+}
+
+// openSeparateHeader decrypts in place the separate header at the start of
+// the packet, and returns the session ID and packet ID it contains, the user
+// and the encrypted body. If the adapter has users, the user is identified
+// using the extensible identity header following the separate header.
+func (c *packet2022Conn) openSeparateHeader(packet []byte) (sessionID []byte,
+	packetID uint64, user *user2022, encryptedBody []byte, err error) {
+	headerSize := separateHeaderSize
+	if c.aead.users != nil {
+		headerSize += aes.BlockSize
+	}
+	if len(packet) < headerSize {
+		return nil, 0, nil, nil, fmt.Errorf("%w: %d bytes", errPacketTooShort, len(packet))
+	}
+	separateHeader := packet[:separateHeaderSize]
+	c.aead.block.Decrypt(separateHeader, separateHeader)
+	sessionID = separateHeader[:sessionIDSize]
+	packetID = binary.BigEndian.Uint64(separateHeader[sessionIDSize:])
+
+	user = c.defaultUser
+	if c.aead.users != nil {
+		identityHeader := packet[separateHeaderSize:headerSize]
+		c.aead.block.Decrypt(identityHeader, identityHeader)
+		subtle.XORBytes(identityHeader, identityHeader, separateHeader)
+		user, err = c.aead.lookupUser(identityHeader)
+		if err != nil {
+			return nil, 0, nil, nil, err
+		}
+	}
+	return sessionID, packetID, user, packet[headerSize:], nil
+}
+
+// openWithNonce decrypts in place the packet using the nonce at the start
+// of the packet, and returns the session ID, packet ID and the rest of the
+// decrypted body.
+func (c *packet2022Conn) openWithNonce(packet []byte) (
+	sessionID []byte, packetID uint64, body []byte, err error) {
+	aead := c.aead.packetAEAD
+	nonceSize := aead.NonceSize()
+	if len(packet) < nonceSize+aead.Overhead() {
+		return nil, 0, nil, fmt.Errorf("%w: %d bytes", errPacketTooShort, len(packet))
+	}
+	nonce := packet[:nonceSize]
+	body, err = aead.Open(packet[nonceSize:nonceSize], nonce, packet[nonceSize:], nil)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("%w: %w", ErrDecryption, err)
+	}
+	if len(body) < separateHeaderSize {
+		return nil, 0, nil, fmt.Errorf("%w: %d bytes decrypted",
+			errPacketTooShort, len(body))
+	}
+	sessionID = body[:sessionIDSize]
+	packetID = binary.BigEndian.Uint64(body[sessionIDSize:])
+	return sessionID, packetID, body[separateHeaderSize:], nil
+}
+
+// parseClientMessageHeader parses the client message header at the start
+// of body and returns the rest of the body, containing the target address
+// and the payload.
+func parseClientMessageHeader(body []byte, now time.Time) (rest []byte, err error) {
+	const minSize = 1 + 8
+	if len(body) < minSize {
+		return nil, fmt.Errorf("%w: message header is %d bytes instead of minimum %d bytes",
+			errPacketTooShort, len(body), minSize)
+	}
+	err = checkHeader(body[0], headerTypeClient, body[1:9], now)
+	if err != nil {
+		return nil, err
+	}
+	return stripPadding(body[minSize:])
+}
@@ -0,0 +1,448 @@
+package shadowaead
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// packet2022 is a Shadowsocks 2022 UDP client packet as sent by a client.
+type packet2022 struct {
+	newAEAD      func(key []byte) (cipher.AEAD, error)
+	preSharedKey []byte
+	// identityPreSharedKey, if set, is used to encrypt the separate header
+	// and to write an extensible identity header after it, such that
+	// preSharedKey is the user key.
+	identityPreSharedKey []byte
+	sessionID            []byte
+	packetID             uint64
+	headerType           byte
+	timestamp            time.Time
+	padding              int
+	// payload contains the SOCKS target address and the payload.
+	payload []byte
+}
+
+// seal returns the encrypted packet, using an AES encrypted
+// separate header, followed by an extensible identity header
+// if the identity pre-shared key is set.
+func (p packet2022) seal(t *testing.T) (sealed []byte) {
+	t.Helper()
+	separateHeader := p.separateHeader()
+	body := p.body()
+
+	headerKey := p.preSharedKey
+	if p.identityPreSharedKey != nil {
+		headerKey = p.identityPreSharedKey
+	}
+	block, err := aes.NewCipher(headerKey)
+	require.NoError(t, err)
+	sealed = make([]byte, len(separateHeader))
+	block.Encrypt(sealed, separateHeader)
+
+	if p.identityPreSharedKey != nil {
+		identityHeader := make([]byte, aes.BlockSize)
+		subtle.XORBytes(identityHeader, testIdentityHash(p.preSharedKey), separateHeader)
+		block.Encrypt(identityHeader, identityHeader)
+		sealed = append(sealed, identityHeader...)
+	}
+
+	aead := testSessionAEAD(t, p.newAEAD, p.preSharedKey, p.sessionID)
+	return aead.Seal(sealed, separateHeader[4:], body, nil)
+}
+
+// sealWithNonce returns the packet encrypted as a whole with
+// XChaCha20-Poly1305, using the pre-shared key and a random nonce.
+func (p packet2022) sealWithNonce(t *testing.T) (sealed []byte) {
+	t.Helper()
+	aead, err := chacha20poly1305.NewX(p.preSharedKey)
+	require.NoError(t, err)
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	require.NoError(t, err)
+	plaintext := append(p.separateHeader(), p.body()...)
+	return aead.Seal(nonce, nonce, plaintext, nil)
+}
+
+func (p packet2022) separateHeader() []byte {
+	separateHeader := append([]byte(nil), p.sessionID...)
+	return binary.BigEndian.AppendUint64(separateHeader, p.packetID)
+}
+
+func (p packet2022) body() []byte {
+	body := []byte{p.headerType}
+	body = binary.BigEndian.AppendUint64(body, uint64(p.timestamp.Unix()))
+	body = binary.BigEndian.AppendUint16(body, uint16(p.padding))
+	body = append(body, make([]byte, p.padding)...)
+	return append(body, p.payload...)
+}
+
+// serverPacket2022 is a decrypted Shadowsocks 2022 UDP server packet.
+type serverPacket2022 struct {
+	sessionID       []byte
+	packetID        uint64
+	headerType      byte
+	timestamp       time.Time
+	clientSessionID []byte
+	payload         []byte
+}
+
+// openServerPacket2022 decrypts a server packet using an AES
+// encrypted separate header.
+func openServerPacket2022(t *testing.T, newAEAD func(key []byte) (cipher.AEAD, error),
+	preSharedKey, sealed []byte) (packet serverPacket2022) {
+	t.Helper()
+	block, err := aes.NewCipher(preSharedKey)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(sealed), separateHeaderSize)
+	separateHeader := make([]byte, separateHeaderSize)
+	block.Decrypt(separateHeader, sealed[:separateHeaderSize])
+	packet.sessionID = separateHeader[:8]
+	packet.packetID = binary.BigEndian.Uint64(separateHeader[8:])
+
+	aead := testSessionAEAD(t, newAEAD, preSharedKey, packet.sessionID)
+	body, err := aead.Open(nil, separateHeader[4:], sealed[separateHeaderSize:], nil)
+	require.NoError(t, err)
+	parseServerMessage2022(t, body, &packet)
+	return packet
+}
+
+// openServerPacketWithNonce decrypts a server packet encrypted as
+// a whole with XChaCha20-Poly1305 and a random nonce.
+func openServerPacketWithNonce(t *testing.T, preSharedKey, sealed []byte) (
+	packet serverPacket2022) {
+	t.Helper()
+	aead, err := chacha20poly1305.NewX(preSharedKey)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(sealed), aead.NonceSize())
+	nonce := sealed[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], nil)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(plaintext), separateHeaderSize)
+	packet.sessionID = plaintext[:8]
+	packet.packetID = binary.BigEndian.Uint64(plaintext[8:])
+	parseServerMessage2022(t, plaintext[separateHeaderSize:], &packet)
+	return packet
+}
+
+func parseServerMessage2022(t *testing.T, body []byte, packet *serverPacket2022) {
+	t.Helper()
+	require.GreaterOrEqual(t, len(body), 1+8+8+2)
+	packet.headerType = body[0]
+	packet.timestamp = time.Unix(int64(binary.BigEndian.Uint64(body[1:])), 0)
+	packet.clientSessionID = body[9:17]
+	paddingLength := int(binary.BigEndian.Uint16(body[17:]))
+	packet.payload = body[19+paddingLength:]
+}
+
+func Test_packet2022Conn_roundTrip(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	clientAddress := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+
+	keySizes := map[string]int{
+		"2022-blake3-aes-128-gcm": 16,
+		"2022-blake3-aes-256-gcm": 32,
+	}
+	for name, keySize := range keySizes {
+		keySize := keySize
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			preSharedKey := bytes.Repeat([]byte{1}, keySize)
+			adapter, err := AESGCM2022(preSharedKey)
+			require.NoError(t, err)
+			packetConn := &queuePacketConn{}
+			conn := NewPacketConn2022(packetConn, adapter).(*packet2022Conn)
+			conn.timeNow = func() time.Time { return now }
+
+			clientSessionID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+			for packetID, padding := range []int{0, 20} {
+				packet := packet2022{
+					newAEAD:      testNewAESGCM,
+					preSharedKey: preSharedKey,
+					sessionID:    clientSessionID,
+					packetID:     uint64(packetID),
+					headerType:   headerTypeClient,
+					timestamp:    now.Add(time.Second),
+					padding:      padding,
+					payload:      []byte("target and payload"),
+				}
+				packetConn.push(packet.seal(t), clientAddress)
+
+				buffer := make([]byte, 1024)
+				n, address, err := conn.ReadFrom(buffer)
+				require.NoError(t, err)
+				assert.Equal(t, clientAddress, address)
+				assert.Equal(t, "target and payload", string(buffer[:n]))
+			}
+
+			for packetID := uint64(0); packetID < 2; packetID++ {
+				_, err = conn.WriteTo([]byte("response"), clientAddress)
+				require.NoError(t, err)
+				require.Len(t, packetConn.written, int(packetID)+1)
+				assert.Equal(t, clientAddress, packetConn.written[packetID].address)
+
+				packet := openServerPacket2022(t, testNewAESGCM, preSharedKey,
+					packetConn.written[packetID].data)
+				assert.NotEqual(t, clientSessionID, packet.sessionID)
+				assert.Equal(t, packetID, packet.packetID)
+				assert.Equal(t, byte(headerTypeServer), packet.headerType)
+				assert.Equal(t, now, packet.timestamp)
+				assert.Equal(t, clientSessionID, packet.clientSessionID)
+				assert.Equal(t, "response", string(packet.payload))
+			}
+		})
+	}
+}
+
+func Test_packet2022Conn_WriteTo_noSession(t *testing.T) {
+	t.Parallel()
+
+	adapter, err := AESGCM2022(bytes.Repeat([]byte{1}, 16))
+	require.NoError(t, err)
+	conn := NewPacketConn2022(&queuePacketConn{}, adapter)
+
+	_, err = conn.WriteTo([]byte("response"), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000})
+	assert.ErrorIs(t, err, errSessionNotFound)
+}
+
+func Test_packet2022Conn_rejections(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	preSharedKey := bytes.Repeat([]byte{1}, 16)
+	validPacket := packet2022{
+		newAEAD:      testNewAESGCM,
+		preSharedKey: preSharedKey,
+		sessionID:    []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		headerType:   headerTypeClient,
+		timestamp:    now,
+		payload:      []byte("payload"),
+	}
+
+	testCases := map[string]struct {
+		modify func(packet *packet2022)
+		errIs  error
+	}{
+		"stale timestamp": {
+			modify: func(packet *packet2022) {
+				packet.timestamp = now.Add(-maxTimestampDifference - time.Second)
+			},
+			errIs: errTimestampInvalid,
+		},
+		"future timestamp": {
+			modify: func(packet *packet2022) {
+				packet.timestamp = now.Add(maxTimestampDifference + time.Second)
+			},
+			errIs: errTimestampInvalid,
+		},
+		"server header type": {
+			modify: func(packet *packet2022) {
+				packet.headerType = headerTypeServer
+			},
+			errIs: errHeaderTypeUnexpected,
+		},
+		"wrong pre-shared key": {
+			modify: func(packet *packet2022) {
+				packet.preSharedKey = bytes.Repeat([]byte{2}, 16)
+			},
+			errIs: ErrDecryption,
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			packet := validPacket
+			testCase.modify(&packet)
+
+			adapter, err := AESGCM2022(preSharedKey)
+			require.NoError(t, err)
+			packetConn := &queuePacketConn{}
+			conn := NewPacketConn2022(packetConn, adapter).(*packet2022Conn)
+			conn.timeNow = func() time.Time { return now }
+			packetConn.push(packet.seal(t), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000})
+
+			_, _, err = conn.ReadFrom(make([]byte, 1024))
+			assert.ErrorIs(t, err, testCase.errIs)
+		})
+	}
+}
+
+func Test_packet2022Conn_replayedPacketID(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	preSharedKey := bytes.Repeat([]byte{1}, 32)
+	adapter, err := AESGCM2022(preSharedKey)
+	require.NoError(t, err)
+	packetConn := &queuePacketConn{}
+	conn := NewPacketConn2022(packetConn, adapter).(*packet2022Conn)
+	conn.timeNow = func() time.Time { return now }
+	clientAddress := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+
+	packet := packet2022{
+		newAEAD:      testNewAESGCM,
+		preSharedKey: preSharedKey,
+		sessionID:    []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		packetID:     7,
+		headerType:   headerTypeClient,
+		timestamp:    now,
+		payload:      []byte("payload"),
+	}
+	sealed := packet.seal(t)
+	packetConn.push(sealed, clientAddress)
+	packetConn.push(sealed, clientAddress)
+
+	_, _, err = conn.ReadFrom(make([]byte, 1024))
+	require.NoError(t, err)
+	_, _, err = conn.ReadFrom(make([]byte, 1024))
+	assert.ErrorIs(t, err, errPacketReplayed)
+}
+
+func Test_packet2022Conn_xchacha20(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	preSharedKey := bytes.Repeat([]byte{1}, chacha20poly1305.KeySize)
+	adapter, err := Chacha2022(preSharedKey)
+	require.NoError(t, err)
+	packetConn := &queuePacketConn{}
+	conn := NewPacketConn2022(packetConn, adapter).(*packet2022Conn)
+	conn.timeNow = func() time.Time { return now }
+	clientAddress := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	clientSessionID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	readPacket := func(sessionID []byte, packetID uint64) (payload string, err error) {
+		packet := packet2022{
+			preSharedKey: preSharedKey,
+			sessionID:    sessionID,
+			packetID:     packetID,
+			headerType:   headerTypeClient,
+			timestamp:    now,
+			padding:      int(packetID),
+			payload:      []byte("payload"),
+		}
+		packetConn.push(packet.sealWithNonce(t), clientAddress)
+		buffer := make([]byte, 1024)
+		n, _, err := conn.ReadFrom(buffer)
+		return string(buffer[:n]), err
+	}
+
+	payload, err := readPacket(clientSessionID, 5)
+	require.NoError(t, err)
+	assert.Equal(t, "payload", payload)
+
+	// out of order packet ID within the window
+	_, err = readPacket(clientSessionID, 3)
+	require.NoError(t, err)
+
+	_, err = readPacket(clientSessionID, 3)
+	assert.ErrorIs(t, err, errPacketReplayed)
+	_, err = readPacket(clientSessionID, 5)
+	assert.ErrorIs(t, err, errPacketReplayed)
+
+	// a new client session starts with a new window
+	newSessionID := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	_, err = readPacket(newSessionID, 3)
+	require.NoError(t, err)
+
+	for packetID := uint64(0); packetID < 2; packetID++ {
+		_, err = conn.WriteTo([]byte("response"), clientAddress)
+		require.NoError(t, err)
+		packet := openServerPacketWithNonce(t, preSharedKey, packetConn.written[packetID].data)
+		assert.Equal(t, packetID, packet.packetID)
+		assert.Equal(t, byte(headerTypeServer), packet.headerType)
+		assert.Equal(t, now, packet.timestamp)
+		assert.Equal(t, newSessionID, packet.clientSessionID)
+		assert.Equal(t, "response", string(packet.payload))
+	}
+	assert.NotEqual(t, packetConn.written[0].data[:24], packetConn.written[1].data[:24],
+		"nonces must be random")
+
+	// tampered packet
+	packet := packet2022{
+		preSharedKey: preSharedKey,
+		sessionID:    newSessionID,
+		packetID:     10,
+		headerType:   headerTypeClient,
+		timestamp:    now,
+	}
+	sealed := packet.sealWithNonce(t)
+	sealed[0] ^= 1
+	packetConn.push(sealed, clientAddress)
+	_, _, err = conn.ReadFrom(make([]byte, 1024))
+	assert.ErrorIs(t, err, ErrDecryption)
+}
+
+func Test_packet2022Conn_identityHeader(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	identityPreSharedKey := bytes.Repeat([]byte{1}, 32)
+	alicePreSharedKey := bytes.Repeat([]byte{2}, 32)
+	bobPreSharedKey := bytes.Repeat([]byte{3}, 32)
+	adapter, err := AESGCM2022(identityPreSharedKey)
+	require.NoError(t, err)
+	err = adapter.AddUser("alice", alicePreSharedKey)
+	require.NoError(t, err)
+	err = adapter.AddUser("bob", bobPreSharedKey)
+	require.NoError(t, err)
+
+	packetConn := &queuePacketConn{}
+	conn := NewPacketConn2022(packetConn, adapter).(*packet2022Conn)
+	conn.timeNow = func() time.Time { return now }
+	aliceAddress := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	bobAddress := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}
+
+	readPacket := func(userPreSharedKey []byte, address net.Addr) (payload string, err error) {
+		packet := packet2022{
+			newAEAD:              testNewAESGCM,
+			preSharedKey:         userPreSharedKey,
+			identityPreSharedKey: identityPreSharedKey,
+			sessionID:            []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			headerType:           headerTypeClient,
+			timestamp:            now,
+			payload:              []byte("payload"),
+		}
+		packetConn.push(packet.seal(t), address)
+		buffer := make([]byte, 1024)
+		n, _, err := conn.ReadFrom(buffer)
+		return string(buffer[:n]), err
+	}
+
+	payload, err := readPacket(alicePreSharedKey, aliceAddress)
+	require.NoError(t, err)
+	assert.Equal(t, "payload", payload)
+	payload, err = readPacket(bobPreSharedKey, bobAddress)
+	require.NoError(t, err)
+	assert.Equal(t, "payload", payload)
+
+	assert.Equal(t, "alice", conn.User(aliceAddress))
+	assert.Equal(t, "bob", conn.User(bobAddress))
+	assert.Empty(t, conn.User(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 5000}))
+
+	// the response is encrypted with the user pre-shared key
+	_, err = conn.WriteTo([]byte("response"), bobAddress)
+	require.NoError(t, err)
+	packet := openServerPacket2022(t, testNewAESGCM, bobPreSharedKey, packetConn.written[0].data)
+	assert.Equal(t, "response", string(packet.payload))
+
+	_, err = readPacket(bytes.Repeat([]byte{4}, 32), aliceAddress)
+	assert.ErrorIs(t, err, errUserNotFound)
+	assert.ErrorIs(t, err, ErrDecryption)
+}
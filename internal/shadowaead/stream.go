@@ -17,6 +17,12 @@ type writer struct {
 	cipher   cipher.AEAD
 	buffer   []byte
 	nonce    []byte
+	// pending is written as is before the first chunk,
+	// and is cleared once written.
+	pending []byte
+	// headerPrefix is sealed together with the payload size
+	// of the first chunk, and is cleared once written.
+	headerPrefix []byte
 }
 
 func newWriter(ioWriter io.Writer, aeadCipher cipher.AEAD) *writer {
@@ -28,6 +34,18 @@ func newWriter(ioWriter io.Writer, aeadCipher cipher.AEAD) *writer {
 	}
 }
 
+// newWriterWithHeader returns a writer writing the pending bytes
+// before the first chunk, and sealing the header prefix together
+// with the payload size of the first chunk.
+func newWriterWithHeader(ioWriter io.Writer, aeadCipher cipher.AEAD,
+	pending, headerPrefix []byte) *writer {
+	w := newWriter(ioWriter, aeadCipher)
+	w.pending = pending
+	w.headerPrefix = headerPrefix
+	w.buffer = make([]byte, len(pending)+len(headerPrefix)+len(w.buffer))
+	return w
+}
+
 // Write encrypts b and writes to the writer w.
 func (w *writer) Write(b []byte) (int, error) {
 	n, err := w.ReadFrom(bytes.NewBuffer(b))
@@ -40,16 +58,21 @@ func (w *writer) ReadFrom(reader io.Reader) (n int64, err error) {
 	cipherOverhead := w.cipher.Overhead()
 	for {
 		buf := w.buffer
-		payloadBuf := buf[2+cipherOverhead : 2+cipherOverhead+payloadSizeMask]
+		sizeChunkStart := len(w.pending)
+		payloadStart := sizeChunkStart + len(w.headerPrefix) + 2 + cipherOverhead
+		payloadBuf := buf[payloadStart : payloadStart+payloadSizeMask]
 		bytesRead, readErr := reader.Read(payloadBuf)
 
 		if bytesRead > 0 {
 			n += int64(bytesRead)
-			buf = buf[:2+cipherOverhead+bytesRead+cipherOverhead]
+			buf = buf[:payloadStart+bytesRead+cipherOverhead]
 			payloadBuf = payloadBuf[:bytesRead]
+			copy(buf, w.pending)
+			sizeChunk := buf[sizeChunkStart:payloadStart]
+			sizeIndex := copy(sizeChunk, w.headerPrefix)
 			// big-endian payload size
-			buf[0], buf[1] = byte(bytesRead>>8), byte(bytesRead) //nolint:gomnd
-			w.cipher.Seal(buf[:0], w.nonce, buf[:2], nil)
+			sizeChunk[sizeIndex], sizeChunk[sizeIndex+1] = byte(bytesRead>>8), byte(bytesRead) //nolint:gomnd
+			w.cipher.Seal(sizeChunk[:0], w.nonce, sizeChunk[:sizeIndex+2], nil)
 			increment(w.nonce)
 			w.cipher.Seal(payloadBuf[:0], w.nonce, payloadBuf, nil)
 			increment(w.nonce)
@@ -58,6 +81,8 @@ func (w *writer) ReadFrom(reader io.Reader) (n int64, err error) {
 				err = ew
 				break
 			}
+			w.pending = nil
+			w.headerPrefix = nil
 		}
 
 		if readErr != nil {
@@ -78,41 +103,46 @@ type reader struct {
 	buffer   []byte
 	nonce    []byte
 	leftOver []byte
+	sizeMask int
 }
 
-func newReader(ioReader io.Reader, cipher cipher.AEAD) *reader {
+func newReader(ioReader io.Reader, cipher cipher.AEAD, sizeMask int) *reader {
 	return &reader{
-		reader: ioReader,
-		cipher: cipher,
-		buffer: make([]byte, cipher.Overhead()+payloadSizeMask),
-		nonce:  make([]byte, cipher.NonceSize()),
+		reader:   ioReader,
+		cipher:   cipher,
+		buffer:   make([]byte, cipher.Overhead()+sizeMask),
+		nonce:    make([]byte, cipher.NonceSize()),
+		sizeMask: sizeMask,
 	}
 }
 
-func (r *reader) read() (bytesRead int, err error) {
-	cipherOverhead := r.cipher.Overhead()
-
-	// decrypt payload size
-	buf := r.buffer[:2+cipherOverhead]
+// readChunk reads and decrypts a chunk of the given plaintext size,
+// and returns the plaintext slice of the reader buffer.
+func (r *reader) readChunk(size int) (plaintext []byte, err error) {
+	buf := r.buffer[:size+r.cipher.Overhead()]
 	if _, err := io.ReadFull(r.reader, buf); err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	_, err = r.cipher.Open(buf[:0], r.nonce, buf, nil)
+	plaintext, err = r.cipher.Open(buf[:0], r.nonce, buf, nil)
 	increment(r.nonce)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryption, err)
+	}
+	return plaintext, nil
+}
+
+func (r *reader) read() (bytesRead int, err error) {
+	// decrypt payload size
+	buf, err := r.readChunk(2) //nolint:gomnd
 	if err != nil {
 		return 0, err
 	}
 
-	size := (int(buf[0])<<8 + int(buf[1])) & payloadSizeMask
+	size := (int(buf[0])<<8 + int(buf[1])) & r.sizeMask
 
 	// decrypt payload
-	buf = r.buffer[:size+cipherOverhead]
-	if _, err := io.ReadFull(r.reader, buf); err != nil {
-		return 0, err
-	}
-	_, err = r.cipher.Open(buf[:0], r.nonce, buf, nil)
-	increment(r.nonce)
+	_, err = r.readChunk(size)
 	if err != nil {
 		return 0, err
 	}
@@ -186,21 +216,39 @@ func NewConn(connection net.Conn, aead aeadCipher, saltFilter SaltFilter) net.Co
 	}
 }
 
+// NewMultiUserConn wraps a stream net.Conn connection with the cipher
+// of the user identified by trial decryption of the first length chunk.
+func NewMultiUserConn(connection net.Conn, users *UserCiphers, saltFilter SaltFilter) net.Conn {
+	return &streamConn{
+		Conn:       connection,
+		users:      users,
+		saltFilter: saltFilter,
+	}
+}
+
 type streamConn struct {
 	net.Conn
+	// aead is the cipher adapter, which is set to the user
+	// cipher adapter once the user is identified.
 	aead       aeadCipher
+	users      *UserCiphers
+	user       string
 	saltFilter SaltFilter
 	reader     *reader
 	writer     *writer
 }
 
 func (c *streamConn) initReader() error {
+	if c.users != nil {
+		return c.initMultiUserReader()
+	}
+
 	salt := make([]byte, c.aead.GetSaltSize())
 	if _, err := io.ReadFull(c.Conn, salt); err != nil {
 		return err
 	}
 	if c.saltFilter.IsSaltRepeated(salt) {
-		return fmt.Errorf("%w: possible replay attack, dropping the packet", errRepeatedSalt)
+		return fmt.Errorf("%w: possible replay attack, dropping the packet", ErrRepeatedSalt)
 	}
 	aead, err := c.aead.Crypt(salt)
 	if err != nil {
@@ -208,10 +256,41 @@ func (c *streamConn) initReader() error {
 	}
 	c.saltFilter.AddSalt(salt)
 
-	c.reader = newReader(c.Conn, aead)
+	c.reader = newReader(c.Conn, aead, payloadSizeMask)
 	return nil
 }
 
+// initMultiUserReader reads the salt and the first length chunk for the
+// largest user header size, and identifies the user by trial decryption.
+func (c *streamConn) initMultiUserReader() error {
+	header := make([]byte, c.users.maxHeaderSize)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return err
+	}
+	user, salt, aead, err := c.users.identifyStreamUser(c.Conn.RemoteAddr(), header)
+	if err != nil {
+		return fmt.Errorf("identifying user: %w", err)
+	}
+	if c.saltFilter.IsSaltRepeated(salt) {
+		return fmt.Errorf("%w: possible replay attack, dropping the packet", ErrRepeatedSalt)
+	}
+	c.saltFilter.AddSalt(salt)
+	c.user = user.name
+	c.aead = user.aead
+
+	// The first length chunk and any bytes read after it
+	// are read again by the reader.
+	ioReader := io.MultiReader(bytes.NewReader(header[len(salt):]), c.Conn)
+	c.reader = newReader(ioReader, aead, payloadSizeMask)
+	return nil
+}
+
+// User returns the name of the user of the connection if the user was
+// identified by trial decryption. It returns the empty string otherwise.
+func (c *streamConn) User() string {
+	return c.user
+}
+
 func (c *streamConn) Read(b []byte) (int, error) {
 	if c.reader == nil {
 		if err := c.initReader(); err != nil {
@@ -231,6 +310,10 @@ func (c *streamConn) WriteTo(writer io.Writer) (int64, error) {
 }
 
 func (c *streamConn) initWriter() error {
+	if c.aead == nil {
+		return fmt.Errorf("%w: request must be read before writing the response",
+			errUserNotIdentified)
+	}
 	salt := make([]byte, c.aead.GetSaltSize())
 	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
 		return err
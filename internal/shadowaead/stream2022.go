@@ -0,0 +1,246 @@
+package shadowaead
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/qdm12/ss-server/internal/socks"
+)
+
+const (
+	payloadSizeMask2022 = 0xFFFF // 64KB - 1 maximum size in bytes of payload
+	// maxTimestampDifference is the maximum difference allowed
+	// between the timestamp of a header and the current time.
+	maxTimestampDifference = 30 * time.Second
+)
+
+// Shadowsocks 2022 header types.
+const (
+	headerTypeClient = 0
+	headerTypeServer = 1
+)
+
+// NewConn2022 wraps a stream net.Conn connection with a Shadowsocks 2022
+// cipher, for the server side of the connection.
+func NewConn2022(connection net.Conn, aead *AEAD2022CipherAdapter, saltFilter SaltFilter) net.Conn {
+	return &stream2022Conn{
+		Conn:       connection,
+		aead:       aead,
+		saltFilter: saltFilter,
+		timeNow:    time.Now,
+	}
+}
+
+type stream2022Conn struct {
+	net.Conn
+	// aead is the cipher adapter, which is replaced by the user
+	// cipher adapter once the user is identified.
+	aead        *AEAD2022CipherAdapter
+	user        string
+	saltFilter  SaltFilter
+	timeNow     func() time.Time
+	requestSalt []byte
+	reader      *reader
+	writer      *writer
+}
+
+var (
+	errHeaderTypeUnexpected = errors.New("header type is unexpected")
+	errTimestampInvalid     = errors.New("timestamp is invalid")
+	errPaddingTooLong       = errors.New("padding is too long")
+)
+
+// initReader reads the salt, the fixed length request header and the
+// variable length request header. The target address and the initial
+// payload from the variable length header are kept as left over bytes
+// for the next read, so the padding is transparent to the caller.
+func (c *stream2022Conn) initReader() error {
+	salt := make([]byte, c.aead.GetSaltSize())
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	if c.saltFilter.IsSaltRepeated(salt) {
+		return fmt.Errorf("%w: possible replay attack, dropping the packet", ErrRepeatedSalt)
+	}
+	if c.aead.users != nil {
+		err := c.identifyUser(salt)
+		if err != nil {
+			return fmt.Errorf("identifying user: %w", err)
+		}
+	}
+	aead, err := c.aead.Crypt(salt)
+	if err != nil {
+		return err
+	}
+	reader := newReader(c.Conn, aead, payloadSizeMask2022)
+
+	const fixedHeaderSize = 1 + 8 + 2
+	fixedHeader, err := reader.readChunk(fixedHeaderSize)
+	if err != nil {
+		return fmt.Errorf("reading fixed length header: %w", err)
+	}
+	c.saltFilter.AddSalt(salt)
+
+	err = checkHeader(fixedHeader[0], headerTypeClient,
+		fixedHeader[1:9], c.timeNow())
+	if err != nil {
+		return err
+	}
+	variableHeaderSize := int(binary.BigEndian.Uint16(fixedHeader[9:]))
+
+	variableHeader, err := reader.readChunk(variableHeaderSize)
+	if err != nil {
+		return fmt.Errorf("reading variable length header: %w", err)
+	}
+	targetAddress, err := socks.ExtractAddress(variableHeader)
+	if err != nil {
+		return fmt.Errorf("extracting target address: %w", err)
+	}
+	payload, err := stripPadding(variableHeader[len(targetAddress):])
+	if err != nil {
+		return err
+	}
+	// keep the target address and initial payload contiguous
+	// in the reader buffer so they are read by the next read.
+	n := len(targetAddress)
+	n += copy(variableHeader[n:], payload)
+	reader.leftOver = variableHeader[:n]
+
+	c.requestSalt = salt
+	c.reader = reader
+	return nil
+}
+
+// identifyUser reads the extensible identity header following the salt,
+// and sets the user and its cipher adapter for the rest of the connection.
+func (c *stream2022Conn) identifyUser(salt []byte) (err error) {
+	identityHeader := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(c.Conn, identityHeader); err != nil {
+		return err
+	}
+	block, err := c.aead.identitySubkeyBlock(salt)
+	if err != nil {
+		return err
+	}
+	block.Decrypt(identityHeader, identityHeader)
+	user, err := c.aead.lookupUser(identityHeader)
+	if err != nil {
+		return err
+	}
+	c.user = user.name
+	c.aead = user.aead
+	return nil
+}
+
+// User returns the name of the user of the connection, if the user
+// was identified with an extensible identity header. It returns the
+// empty string otherwise.
+func (c *stream2022Conn) User() string {
+	return c.user
+}
+
+// checkHeader checks the header type is the one expected and that
+// the big endian encoded Unix timestamp given is close enough to now.
+func checkHeader(headerType, expectedHeaderType byte,
+	timestamp []byte, now time.Time) (err error) {
+	if headerType != expectedHeaderType {
+		return fmt.Errorf("%w: %d instead of %d",
+			errHeaderTypeUnexpected, headerType, expectedHeaderType)
+	}
+	unixTime := int64(binary.BigEndian.Uint64(timestamp))
+	difference := now.Sub(time.Unix(unixTime, 0))
+	if difference > maxTimestampDifference || difference < -maxTimestampDifference {
+		return fmt.Errorf("%w: %s differs from now by %s",
+			errTimestampInvalid, time.Unix(unixTime, 0).UTC(), difference)
+	}
+	return nil
+}
+
+// stripPadding removes the big endian padding length and padding
+// at the start of b, and returns the rest of b.
+func stripPadding(b []byte) (rest []byte, err error) {
+	const paddingLengthSize = 2
+	if len(b) < paddingLengthSize {
+		return nil, fmt.Errorf("%w: %d bytes left instead of minimum %d bytes",
+			errPacketTooShort, len(b), paddingLengthSize)
+	}
+	paddingLength := int(binary.BigEndian.Uint16(b))
+	b = b[paddingLengthSize:]
+	if paddingLength > len(b) {
+		return nil, fmt.Errorf("%w: %d bytes for %d bytes left",
+			errPaddingTooLong, paddingLength, len(b))
+	}
+	return b[paddingLength:], nil
+}
+
+func (c *stream2022Conn) Read(b []byte) (int, error) {
+	if c.reader == nil {
+		if err := c.initReader(); err != nil {
+			return 0, err
+		}
+	}
+	return c.reader.Read(b)
+}
+
+func (c *stream2022Conn) WriteTo(writer io.Writer) (int64, error) {
+	if c.reader == nil {
+		if err := c.initReader(); err != nil {
+			return 0, err
+		}
+	}
+	return c.reader.WriteTo(writer)
+}
+
+var errRequestSaltMissing = errors.New("request salt is missing")
+
+// initWriter prepares the writer such that the salt and the response
+// fixed length header are written together with the first chunk.
+func (c *stream2022Conn) initWriter() error {
+	if c.requestSalt == nil {
+		return fmt.Errorf("%w: request must be read before writing the response",
+			errRequestSaltMissing)
+	}
+	salt := make([]byte, c.aead.GetSaltSize())
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	aead, err := c.aead.Crypt(salt)
+	if err != nil {
+		return err
+	}
+	c.saltFilter.AddSalt(salt)
+
+	// The payload size of the first chunk is appended to the
+	// header prefix by the writer.
+	headerPrefix := make([]byte, 1+8+len(c.requestSalt))
+	headerPrefix[0] = headerTypeServer
+	binary.BigEndian.PutUint64(headerPrefix[1:], uint64(c.timeNow().Unix()))
+	copy(headerPrefix[9:], c.requestSalt)
+
+	c.writer = newWriterWithHeader(c.Conn, aead, salt, headerPrefix)
+	return nil
+}
+
+func (c *stream2022Conn) Write(data []byte) (int, error) {
+	if c.writer == nil {
+		if err := c.initWriter(); err != nil {
+			return 0, err
+		}
+	}
+	return c.writer.Write(data)
+}
+
+func (c *stream2022Conn) ReadFrom(reader io.Reader) (int64, error) {
+	if c.writer == nil {
+		if err := c.initWriter(); err != nil {
+			return 0, err
+		}
+	}
+	return c.writer.ReadFrom(reader)
+}
@@ -0,0 +1,352 @@
+package shadowaead
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/qdm12/ss-server/internal/socks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/blake3"
+)
+
+// testCipher2022 is a Shadowsocks 2022 cipher with its adapter constructor
+// and its AEAD constructor for the client side used in tests.
+type testCipher2022 struct {
+	name       string
+	keySize    int
+	newAdapter func(preSharedKey []byte) (*AEAD2022CipherAdapter, error)
+	newAEAD    func(key []byte) (cipher.AEAD, error)
+}
+
+func testCiphers2022() []testCipher2022 {
+	return []testCipher2022{
+		{name: "2022-blake3-aes-128-gcm", keySize: 16, newAdapter: AESGCM2022, newAEAD: testNewAESGCM},
+		{name: "2022-blake3-aes-256-gcm", keySize: 32, newAdapter: AESGCM2022, newAEAD: testNewAESGCM},
+		{name: "2022-blake3-chacha20-poly1305", keySize: 32, newAdapter: Chacha2022, newAEAD: chacha20poly1305.New},
+	}
+}
+
+// testDeriveKey derives a key of the size of the pre-shared key using
+// BLAKE3 in key derivation mode with the pre-shared key and salt as
+// key material, as described in the SIP022 specification.
+func testDeriveKey(context string, preSharedKey, salt []byte) []byte {
+	keyMaterial := append(append([]byte(nil), preSharedKey...), salt...)
+	key := make([]byte, len(preSharedKey))
+	blake3.DeriveKey(key, context, keyMaterial)
+	return key
+}
+
+func testSessionAEAD(t *testing.T, newAEAD func(key []byte) (cipher.AEAD, error),
+	preSharedKey, salt []byte) cipher.AEAD {
+	t.Helper()
+	aead, err := newAEAD(testDeriveKey("shadowsocks 2022 session subkey", preSharedKey, salt))
+	require.NoError(t, err)
+	return aead
+}
+
+// testIdentityHash returns the first 16 bytes of the BLAKE3 hash
+// of the user pre-shared key given.
+func testIdentityHash(userPreSharedKey []byte) []byte {
+	hash := blake3.Sum256(userPreSharedKey)
+	return hash[:aes.BlockSize]
+}
+
+// request2022 is a Shadowsocks 2022 TCP request as sent by a client.
+type request2022 struct {
+	newAEAD      func(key []byte) (cipher.AEAD, error)
+	preSharedKey []byte
+	// identityPreSharedKey, if set, is used to write an extensible identity
+	// header after the salt, such that preSharedKey is the user key.
+	identityPreSharedKey []byte
+	salt                 []byte
+	headerType           byte
+	timestamp            time.Time
+	target               []byte
+	padding              int
+	payload              []byte
+}
+
+// seal returns the encrypted request, and the chunk sealer to seal
+// the following chunks of the request.
+func (r request2022) seal(t *testing.T) (sealed []byte, sealer *chunkSealer) {
+	t.Helper()
+	sealed = append(sealed, r.salt...)
+
+	if r.identityPreSharedKey != nil {
+		identitySubkey := testDeriveKey("shadowsocks 2022 identity subkey",
+			r.identityPreSharedKey, r.salt)
+		block, err := aes.NewCipher(identitySubkey)
+		require.NoError(t, err)
+		identityHeader := make([]byte, aes.BlockSize)
+		block.Encrypt(identityHeader, testIdentityHash(r.preSharedKey))
+		sealed = append(sealed, identityHeader...)
+	}
+
+	variableHeader := append([]byte(nil), r.target...)
+	variableHeader = binary.BigEndian.AppendUint16(variableHeader, uint16(r.padding))
+	variableHeader = append(variableHeader, make([]byte, r.padding)...)
+	variableHeader = append(variableHeader, r.payload...)
+
+	fixedHeader := []byte{r.headerType}
+	fixedHeader = binary.BigEndian.AppendUint64(fixedHeader, uint64(r.timestamp.Unix()))
+	fixedHeader = binary.BigEndian.AppendUint16(fixedHeader, uint16(len(variableHeader)))
+
+	sealer = &chunkSealer{aead: testSessionAEAD(t, r.newAEAD, r.preSharedKey, r.salt)}
+	sealed = append(sealed, sealer.seal(fixedHeader)...)
+	sealed = append(sealed, sealer.seal(variableHeader)...)
+	return sealed, sealer
+}
+
+// sealChunk returns the encrypted length chunk and payload chunk.
+func (s *chunkSealer) sealChunk(payload []byte) (sealed []byte) {
+	sealed = s.seal(binary.BigEndian.AppendUint16(nil, uint16(len(payload))))
+	return append(sealed, s.seal(payload)...)
+}
+
+// openResponse2022 reads and checks the Shadowsocks 2022 response header
+// and returns the payload of the first chunk of the response.
+func openResponse2022(t *testing.T, newAEAD func(key []byte) (cipher.AEAD, error),
+	preSharedKey, requestSalt []byte, reader io.Reader, now time.Time) (payload []byte) {
+	t.Helper()
+	salt := make([]byte, len(preSharedKey))
+	_, err := io.ReadFull(reader, salt)
+	require.NoError(t, err)
+	sealer := &chunkSealer{aead: testSessionAEAD(t, newAEAD, preSharedKey, salt)}
+
+	header := sealer.open(t, reader, 1+8+len(requestSalt)+2)
+	assert.Equal(t, byte(headerTypeServer), header[0])
+	assert.Equal(t, uint64(now.Unix()), binary.BigEndian.Uint64(header[1:]))
+	assert.Equal(t, requestSalt, header[9:9+len(requestSalt)])
+	length := int(binary.BigEndian.Uint16(header[9+len(requestSalt):]))
+
+	return sealer.open(t, reader, length)
+}
+
+func Test_stream2022Conn_roundTrip(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	target, err := socks.ParseHostPort("example.com:443")
+	require.NoError(t, err)
+
+	for _, testCipher := range testCiphers2022() {
+		for _, padding := range []int{0, 37} {
+			testCipher, padding := testCipher, padding
+			t.Run(fmt.Sprintf("%s padding %d", testCipher.name, padding), func(t *testing.T) {
+				t.Parallel()
+
+				preSharedKey := bytes.Repeat([]byte{1}, testCipher.keySize)
+				adapter, err := testCipher.newAdapter(preSharedKey)
+				require.NoError(t, err)
+
+				request := request2022{
+					newAEAD:      testCipher.newAEAD,
+					preSharedKey: preSharedKey,
+					salt:         bytes.Repeat([]byte{2}, testCipher.keySize),
+					headerType:   headerTypeClient,
+					timestamp:    now.Add(-10 * time.Second),
+					target:       target,
+					padding:      padding,
+					payload:      []byte("hello"),
+				}
+				sealed, sealer := request.seal(t)
+				sealed = append(sealed, sealer.sealChunk([]byte(" world"))...)
+
+				bufferConn := newBufferConn(sealed)
+				conn := NewConn2022(bufferConn, adapter, newMapSaltFilter()).(*stream2022Conn)
+				conn.timeNow = func() time.Time { return now }
+
+				_, err = conn.Write([]byte("early"))
+				require.ErrorIs(t, err, errRequestSaltMissing)
+
+				plaintext, err := io.ReadAll(conn)
+				require.NoError(t, err)
+				expected := append(append([]byte(nil), target...), "hello world"...)
+				assert.Equal(t, expected, plaintext)
+
+				_, err = conn.Write([]byte("response"))
+				require.NoError(t, err)
+				payload := openResponse2022(t, testCipher.newAEAD, preSharedKey,
+					request.salt, &bufferConn.written, now)
+				assert.Equal(t, "response", string(payload))
+			})
+		}
+	}
+}
+
+func Test_stream2022Conn_rejections(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	preSharedKey := bytes.Repeat([]byte{1}, 32)
+	target, err := socks.ParseHostPort("1.2.3.4:80")
+	require.NoError(t, err)
+	validRequest := request2022{
+		newAEAD:      testNewAESGCM,
+		preSharedKey: preSharedKey,
+		salt:         bytes.Repeat([]byte{2}, 32),
+		headerType:   headerTypeClient,
+		timestamp:    now,
+		target:       target,
+		payload:      []byte("hello"),
+	}
+
+	testCases := map[string]struct {
+		modify func(request *request2022)
+		errIs  error
+	}{
+		"stale timestamp": {
+			modify: func(request *request2022) {
+				request.timestamp = now.Add(-maxTimestampDifference - time.Second)
+			},
+			errIs: errTimestampInvalid,
+		},
+		"future timestamp": {
+			modify: func(request *request2022) {
+				request.timestamp = now.Add(maxTimestampDifference + time.Second)
+			},
+			errIs: errTimestampInvalid,
+		},
+		"server header type": {
+			modify: func(request *request2022) {
+				request.headerType = headerTypeServer
+			},
+			errIs: errHeaderTypeUnexpected,
+		},
+		"wrong pre-shared key": {
+			modify: func(request *request2022) {
+				request.preSharedKey = bytes.Repeat([]byte{3}, 32)
+			},
+			errIs: ErrDecryption,
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			request := validRequest
+			testCase.modify(&request)
+			sealed, _ := request.seal(t)
+
+			adapter, err := AESGCM2022(preSharedKey)
+			require.NoError(t, err)
+			conn := NewConn2022(newBufferConn(sealed), adapter, newMapSaltFilter()).(*stream2022Conn)
+			conn.timeNow = func() time.Time { return now }
+
+			_, err = conn.Read(make([]byte, 100))
+			assert.ErrorIs(t, err, testCase.errIs)
+		})
+	}
+}
+
+func Test_stream2022Conn_replayedSalt(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	preSharedKey := bytes.Repeat([]byte{1}, 16)
+	target, err := socks.ParseHostPort("1.2.3.4:80")
+	require.NoError(t, err)
+	request := request2022{
+		newAEAD:      testNewAESGCM,
+		preSharedKey: preSharedKey,
+		salt:         bytes.Repeat([]byte{2}, 16),
+		headerType:   headerTypeClient,
+		timestamp:    now,
+		target:       target,
+	}
+	sealed, _ := request.seal(t)
+
+	adapter, err := AESGCM2022(preSharedKey)
+	require.NoError(t, err)
+	saltFilter := newMapSaltFilter()
+
+	conn := NewConn2022(newBufferConn(sealed), adapter, saltFilter).(*stream2022Conn)
+	conn.timeNow = func() time.Time { return now }
+	_, err = conn.Read(make([]byte, 100))
+	require.NoError(t, err)
+
+	conn = NewConn2022(newBufferConn(sealed), adapter, saltFilter).(*stream2022Conn)
+	conn.timeNow = func() time.Time { return now }
+	_, err = conn.Read(make([]byte, 100))
+	assert.ErrorIs(t, err, ErrRepeatedSalt)
+}
+
+func Test_stream2022Conn_identityHeader(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	identityPreSharedKey := bytes.Repeat([]byte{1}, 16)
+	alicePreSharedKey := bytes.Repeat([]byte{2}, 16)
+	bobPreSharedKey := bytes.Repeat([]byte{3}, 16)
+	target, err := socks.ParseHostPort("1.2.3.4:80")
+	require.NoError(t, err)
+
+	newAdapter := func() *AEAD2022CipherAdapter {
+		adapter, err := AESGCM2022(identityPreSharedKey)
+		require.NoError(t, err)
+		err = adapter.AddUser("alice", alicePreSharedKey)
+		require.NoError(t, err)
+		err = adapter.AddUser("bob", bobPreSharedKey)
+		require.NoError(t, err)
+		return adapter
+	}
+
+	request := request2022{
+		newAEAD:              testNewAESGCM,
+		preSharedKey:         bobPreSharedKey,
+		identityPreSharedKey: identityPreSharedKey,
+		salt:                 bytes.Repeat([]byte{4}, 16),
+		headerType:           headerTypeClient,
+		timestamp:            now,
+		target:               target,
+		payload:              []byte("hello"),
+	}
+	sealed, _ := request.seal(t)
+
+	bufferConn := newBufferConn(sealed)
+	conn := NewConn2022(bufferConn, newAdapter(), newMapSaltFilter()).(*stream2022Conn)
+	conn.timeNow = func() time.Time { return now }
+	plaintext, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, append(append([]byte(nil), target...), "hello"...), plaintext)
+	assert.Equal(t, "bob", conn.User())
+
+	// the response is encrypted with the user pre-shared key
+	_, err = conn.Write([]byte("response"))
+	require.NoError(t, err)
+	payload := openResponse2022(t, testNewAESGCM, bobPreSharedKey,
+		request.salt, &bufferConn.written, now)
+	assert.Equal(t, "response", string(payload))
+
+	request.preSharedKey = bytes.Repeat([]byte{5}, 16)
+	sealed, _ = request.seal(t)
+	conn = NewConn2022(newBufferConn(sealed), newAdapter(), newMapSaltFilter()).(*stream2022Conn)
+	conn.timeNow = func() time.Time { return now }
+	_, err = conn.Read(make([]byte, 100))
+	assert.ErrorIs(t, err, errUserNotFound)
+	assert.Empty(t, conn.User())
+}
+
+func Test_AEAD2022CipherAdapter_AddUser(t *testing.T) {
+	t.Parallel()
+
+	adapter, err := Chacha2022(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	err = adapter.AddUser("alice", bytes.Repeat([]byte{2}, 32))
+	assert.ErrorIs(t, err, errIdentityHeadersNotSupported)
+
+	adapter, err = AESGCM2022(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	err = adapter.AddUser("alice", bytes.Repeat([]byte{2}, 17))
+	assert.Error(t, err)
+}
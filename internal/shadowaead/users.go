@@ -0,0 +1,157 @@
+package shadowaead
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// UserCiphers is a set of users each with their own cipher, where the user
+// of a connection or packet is identified by trial decryption. The last user
+// matched for a client IP address is tried first, so the common case of a
+// client reconnecting is fast.
+type UserCiphers struct {
+	users []*legacyUser
+	// maxHeaderSize is the maximum size of the salt and
+	// encrypted length chunk for all the users.
+	maxHeaderSize int
+
+	mu             sync.Mutex
+	lastUserByHost map[string]*legacyUser
+}
+
+type legacyUser struct {
+	name string
+	aead *AEADCipherAdapter
+}
+
+// NewUserCiphers creates an empty set of user ciphers.
+func NewUserCiphers() *UserCiphers {
+	return &UserCiphers{
+		lastUserByHost: make(map[string]*legacyUser),
+	}
+}
+
+// AddUser adds a user with its cipher adapter.
+func (u *UserCiphers) AddUser(name string, aead *AEADCipherAdapter) (err error) {
+	saltSize := aead.GetSaltSize()
+	aeadCipher, err := aead.Crypt(make([]byte, saltSize))
+	if err != nil {
+		return err
+	}
+	headerSize := saltSize + 2 + aeadCipher.Overhead()
+	if headerSize > u.maxHeaderSize {
+		u.maxHeaderSize = headerSize
+	}
+	u.users = append(u.users, &legacyUser{
+		name: name,
+		aead: aead,
+	})
+	return nil
+}
+
+// orderedUsers returns the users to try for the client address given,
+// starting with the last user matched for the client host, if any.
+func (u *UserCiphers) orderedUsers(clientAddress net.Addr) (users []*legacyUser) {
+	host := addressHost(clientAddress)
+	u.mu.Lock()
+	lastUser := u.lastUserByHost[host]
+	u.mu.Unlock()
+	if lastUser == nil {
+		return u.users
+	}
+	users = make([]*legacyUser, 0, len(u.users))
+	users = append(users, lastUser)
+	for _, user := range u.users {
+		if user != lastUser {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// maxCachedHosts limits the memory used by the last user cache,
+// which is fine to clear since it is only used to speed up the
+// user lookup.
+const maxCachedHosts = 10000
+
+// setLastUser records the user given as the last user matched
+// for the client address given.
+func (u *UserCiphers) setLastUser(clientAddress net.Addr, user *legacyUser) {
+	host := addressHost(clientAddress)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.lastUserByHost) >= maxCachedHosts {
+		u.lastUserByHost = make(map[string]*legacyUser)
+	}
+	u.lastUserByHost[host] = user
+}
+
+func addressHost(address net.Addr) (host string) {
+	switch typedAddress := address.(type) {
+	case *net.TCPAddr:
+		return typedAddress.IP.String()
+	case *net.UDPAddr:
+		return typedAddress.IP.String()
+	}
+	host, _, err := net.SplitHostPort(address.String())
+	if err != nil {
+		return address.String()
+	}
+	return host
+}
+
+var errNoUserMatched = errors.New("no user matched")
+
+// identifyStreamUser returns the user whose cipher successfully decrypts the
+// first length chunk of a stream, given the header containing the salt and
+// the encrypted length chunk for the largest user header size. It returns
+// the user, its salt and its stream AEAD cipher.
+func (u *UserCiphers) identifyStreamUser(clientAddress net.Addr, header []byte) (
+	user *legacyUser, salt []byte, aead cipher.AEAD, err error) {
+	var plaintext [2]byte
+	for _, user := range u.orderedUsers(clientAddress) {
+		saltSize := user.aead.GetSaltSize()
+		salt = header[:saltSize]
+		aead, err = user.aead.Crypt(salt)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		lengthChunk := header[saltSize : saltSize+2+aead.Overhead()]
+		_, err = aead.Open(plaintext[:0], zeroNonce[:aead.NonceSize()], lengthChunk, nil)
+		if err != nil {
+			continue
+		}
+		u.setLastUser(clientAddress, user)
+		return user, salt, aead, nil
+	}
+	return nil, nil, nil, fmt.Errorf("%w: %w: out of %d users", ErrDecryption, errNoUserMatched, len(u.users))
+}
+
+// identifyPacketUser returns the user whose cipher successfully decrypts
+// the packet given, together with the plaintext decrypted into dst.
+func (u *UserCiphers) identifyPacketUser(clientAddress net.Addr, dst, packet []byte) (
+	user *legacyUser, plaintext []byte, err error) {
+	for _, user := range u.orderedUsers(clientAddress) {
+		saltSize := user.aead.GetSaltSize()
+		if len(packet) < saltSize {
+			continue
+		}
+		aead, err := user.aead.Crypt(packet[:saltSize])
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(packet) < saltSize+aead.Overhead() || len(dst) < len(packet)-saltSize {
+			continue
+		}
+		plaintext, err = aead.Open(dst[:0], zeroNonce[:aead.NonceSize()], packet[saltSize:], nil)
+		if err != nil {
+			continue
+		}
+		u.setLastUser(clientAddress, user)
+		return user, plaintext, nil
+	}
+	return nil, nil, fmt.Errorf("%w: %w: out of %d users", ErrDecryption, errNoUserMatched, len(u.users))
+}
@@ -0,0 +1,247 @@
+package shadowaead
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestUserCiphers(t *testing.T) (users *UserCiphers,
+	alice, bob *AEADCipherAdapter) {
+	t.Helper()
+	alice = AESGCM(bytes.Repeat([]byte{1}, 16))
+	bob = Chacha20Poly1305(bytes.Repeat([]byte{2}, 32))
+	users = NewUserCiphers()
+	err := users.AddUser("alice", alice)
+	require.NoError(t, err)
+	err = users.AddUser("bob", bob)
+	require.NoError(t, err)
+	return users, alice, bob
+}
+
+func Test_NewMultiUserConn(t *testing.T) {
+	t.Parallel()
+
+	users, alice, bob := newTestUserCiphers(t)
+
+	for name, aead := range map[string]*AEADCipherAdapter{"alice": alice, "bob": bob} {
+		clientConn := newBufferConn(nil)
+		client := NewConn(clientConn, aead, newMapSaltFilter())
+		_, err := client.Write([]byte("request"))
+		require.NoError(t, err)
+
+		serverConn := newBufferConn(clientConn.written.Bytes())
+		server := NewMultiUserConn(serverConn, users, newMapSaltFilter())
+		request := make([]byte, len("request"))
+		_, err = io.ReadFull(server, request)
+		require.NoError(t, err)
+		assert.Equal(t, "request", string(request))
+		assert.Equal(t, name, server.(*streamConn).User())
+
+		_, err = server.Write([]byte("response"))
+		require.NoError(t, err)
+		clientConn.reader = &serverConn.written
+		response, err := io.ReadAll(client)
+		require.NoError(t, err)
+		assert.Equal(t, "response", string(response))
+	}
+}
+
+func Test_NewMultiUserConn_wrongPassword(t *testing.T) {
+	t.Parallel()
+
+	users, _, _ := newTestUserCiphers(t)
+
+	clientConn := newBufferConn(nil)
+	client := NewConn(clientConn, AESGCM(bytes.Repeat([]byte{3}, 16)), newMapSaltFilter())
+	_, err := client.Write([]byte("request"))
+	require.NoError(t, err)
+
+	server := NewMultiUserConn(newBufferConn(clientConn.written.Bytes()),
+		users, newMapSaltFilter())
+	_, err = server.Read(make([]byte, 100))
+	assert.ErrorIs(t, err, ErrDecryption)
+	assert.ErrorIs(t, err, errNoUserMatched)
+	assert.Empty(t, server.(*streamConn).User())
+
+	_, err = server.Write([]byte("response"))
+	assert.ErrorIs(t, err, errUserNotIdentified)
+}
+
+func Test_NewMultiUserPacketConn(t *testing.T) {
+	t.Parallel()
+
+	users, alice, bob := newTestUserCiphers(t)
+	serverPacketConn := &queuePacketConn{}
+	server := NewMultiUserPacketConn(serverPacketConn, users, newMapSaltFilter()).(*cipherPacketConn)
+	serverAddress := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 100), Port: 8388}
+
+	clients := map[string]struct {
+		aead    *AEADCipherAdapter
+		address net.Addr
+	}{
+		"alice": {aead: alice, address: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}},
+		"bob":   {aead: bob, address: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}},
+	}
+	for name, client := range clients {
+		clientPacketConn := &queuePacketConn{}
+		clientConn := NewPacketConn(clientPacketConn, client.aead, newMapSaltFilter())
+		_, err := clientConn.WriteTo([]byte("request "+name), serverAddress)
+		require.NoError(t, err)
+		serverPacketConn.push(clientPacketConn.written[0].data, client.address)
+
+		buffer := make([]byte, 1024)
+		n, address, err := server.ReadFrom(buffer)
+		require.NoError(t, err)
+		assert.Equal(t, client.address, address)
+		assert.Equal(t, "request "+name, string(buffer[:n]))
+		assert.Equal(t, name, server.User(client.address))
+
+		_, err = server.WriteTo([]byte("response "+name), client.address)
+		require.NoError(t, err)
+		written := serverPacketConn.written[len(serverPacketConn.written)-1]
+		clientPacketConn.push(written.data, serverAddress)
+		n, _, err = clientConn.ReadFrom(buffer)
+		require.NoError(t, err)
+		assert.Equal(t, "response "+name, string(buffer[:n]))
+	}
+
+	unknownAddress := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 5000}
+	assert.Empty(t, server.User(unknownAddress))
+	_, err := server.WriteTo([]byte("response"), unknownAddress)
+	assert.ErrorIs(t, err, errUserNotIdentified)
+}
+
+func Test_NewMultiUserPacketConn_wrongPassword(t *testing.T) {
+	t.Parallel()
+
+	users, _, _ := newTestUserCiphers(t)
+	serverPacketConn := &queuePacketConn{}
+	server := NewMultiUserPacketConn(serverPacketConn, users, newMapSaltFilter())
+
+	clientPacketConn := &queuePacketConn{}
+	clientConn := NewPacketConn(clientPacketConn,
+		AESGCM(bytes.Repeat([]byte{3}, 16)), newMapSaltFilter())
+	_, err := clientConn.WriteTo([]byte("request"), &net.UDPAddr{})
+	require.NoError(t, err)
+	serverPacketConn.push(clientPacketConn.written[0].data,
+		&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000})
+
+	_, _, err = server.ReadFrom(make([]byte, 1024))
+	assert.ErrorIs(t, err, ErrDecryption)
+	assert.ErrorIs(t, err, errNoUserMatched)
+}
+
+func Test_NewMultiUserPacketConn_concurrentReads(t *testing.T) {
+	t.Parallel()
+
+	users, alice, bob := newTestUserCiphers(t)
+	serverPacketConn := &queuePacketConn{}
+	server := NewMultiUserPacketConn(serverPacketConn, users, newMapSaltFilter())
+
+	const packets = 200
+	for i := 0; i < packets; i++ {
+		aead := alice
+		if i%2 == 1 {
+			aead = bob
+		}
+		clientPacketConn := &queuePacketConn{}
+		clientConn := NewPacketConn(clientPacketConn, aead, newMapSaltFilter())
+		payload := fmt.Sprintf("packet %03d", i) + strings.Repeat("x", 100*i)
+		_, err := clientConn.WriteTo([]byte(payload), &net.UDPAddr{})
+		require.NoError(t, err)
+		serverPacketConn.push(clientPacketConn.written[0].data,
+			&net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i%2)), Port: 5000})
+	}
+
+	const readers = 4
+	var wg sync.WaitGroup
+	errs := make(chan error, packets)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := make([]byte, 64*1024)
+			for {
+				n, _, err := server.ReadFrom(buffer)
+				if err == io.EOF {
+					return
+				} else if err != nil {
+					errs <- err
+					return
+				}
+				var index int
+				_, err = fmt.Sscanf(string(buffer[:len("packet 000")]), "packet %03d", &index)
+				if err != nil {
+					errs <- err
+					return
+				}
+				expected := fmt.Sprintf("packet %03d", index) + strings.Repeat("x", 100*index)
+				if string(buffer[:n]) != expected {
+					errs <- fmt.Errorf("got %q instead of %q", buffer[:n], expected)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+}
+
+func Test_UserCiphers_lastUserCache(t *testing.T) {
+	t.Parallel()
+
+	users, alice, bob := newTestUserCiphers(t)
+	clientAddress := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+
+	ordered := users.orderedUsers(clientAddress)
+	require.Len(t, ordered, 2)
+	assert.Equal(t, alice, ordered[0].aead)
+
+	// reconnecting from another port of the same host
+	// tries the last user matched first.
+	users.setLastUser(clientAddress, users.users[1])
+	ordered = users.orderedUsers(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6000})
+	require.Len(t, ordered, 2)
+	assert.Equal(t, bob, ordered[0].aead)
+	assert.Equal(t, alice, ordered[1].aead)
+
+	// the cache is cleared once full
+	for i := 1; len(users.lastUserByHost) < maxCachedHosts; i++ {
+		users.setLastUser(&net.TCPAddr{IP: net.IPv4(10, 1, byte(i>>8), byte(i))}, users.users[1])
+	}
+	otherAddress := &net.TCPAddr{IP: net.IPv4(10, 2, 0, 1)}
+	users.setLastUser(otherAddress, users.users[1])
+	assert.Len(t, users.lastUserByHost, 1)
+	assert.Equal(t, alice, users.orderedUsers(clientAddress)[0].aead)
+	assert.Equal(t, bob, users.orderedUsers(otherAddress)[0].aead)
+}
+
+func Test_cipherPacketConn_addressUserPruning(t *testing.T) {
+	t.Parallel()
+
+	users, _, _ := newTestUserCiphers(t)
+	conn := NewMultiUserPacketConn(&queuePacketConn{}, users, newMapSaltFilter()).(*cipherPacketConn)
+	now := time.Unix(1700000000, 0)
+	conn.timeNow = func() time.Time { return now }
+
+	oldAddress := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	conn.setAddressUser(oldAddress.String(), users.users[0])
+	assert.Equal(t, "alice", conn.User(oldAddress))
+
+	now = now.Add(udpSessionTimeout + time.Second)
+	newAddress := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}
+	conn.setAddressUser(newAddress.String(), users.users[1])
+	assert.Empty(t, conn.User(oldAddress))
+	assert.Equal(t, "bob", conn.User(newAddress))
+}
@@ -0,0 +1,48 @@
+package shadowaead
+
+const (
+	slidingWindowBlockBits = 64
+	slidingWindowBlocks    = 64
+	slidingWindowSize      = (slidingWindowBlocks - 1) * slidingWindowBlockBits
+)
+
+// slidingWindow is a packet ID replay filter based on a sliding
+// window bitmap, as recommended for Shadowsocks 2022 UDP sessions.
+// It is not thread safe.
+type slidingWindow struct {
+	last   uint64
+	blocks [slidingWindowBlocks]uint64
+}
+
+// isValid returns true if the packet ID has not been seen yet
+// and is not too old.
+func (w *slidingWindow) isValid(packetID uint64) bool {
+	if packetID > w.last {
+		return true
+	}
+	if w.last-packetID >= slidingWindowSize {
+		return false
+	}
+	blockIndex := (packetID / slidingWindowBlockBits) % slidingWindowBlocks
+	bit := uint64(1) << (packetID % slidingWindowBlockBits)
+	return w.blocks[blockIndex]&bit == 0
+}
+
+// add marks the packet ID as seen, sliding the window if needed.
+// It should only be called after isValid returned true.
+func (w *slidingWindow) add(packetID uint64) {
+	blockIndex := packetID / slidingWindowBlockBits
+	if packetID > w.last {
+		lastBlockIndex := w.last / slidingWindowBlockBits
+		blocksToClear := blockIndex - lastBlockIndex
+		if blocksToClear > slidingWindowBlocks {
+			blocksToClear = slidingWindowBlocks
+		}
+		for i := uint64(1); i <= blocksToClear; i++ {
+			w.blocks[(lastBlockIndex+i)%slidingWindowBlocks] = 0
+		}
+		w.last = packetID
+	}
+	bit := uint64(1) << (packetID % slidingWindowBlockBits)
+	w.blocks[blockIndex%slidingWindowBlocks] |= bit
+}
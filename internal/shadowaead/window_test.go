@@ -0,0 +1,32 @@
+package shadowaead
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_slidingWindow(t *testing.T) {
+	t.Parallel()
+
+	var window slidingWindow
+
+	assert.True(t, window.isValid(0))
+	window.add(0)
+	assert.False(t, window.isValid(0))
+
+	// out of order packet IDs
+	assert.True(t, window.isValid(2))
+	window.add(2)
+	assert.True(t, window.isValid(1))
+	window.add(1)
+	assert.False(t, window.isValid(1))
+	assert.False(t, window.isValid(2))
+
+	// slide the window far ahead
+	window.add(slidingWindowSize + 100)
+	assert.False(t, window.isValid(99), "too old")
+	assert.True(t, window.isValid(101))
+	assert.False(t, window.isValid(slidingWindowSize+100))
+	assert.True(t, window.isValid(slidingWindowSize+101))
+}
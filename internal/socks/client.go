@@ -0,0 +1,99 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrVersionNotSupported    = errors.New("socks version is not supported")
+	ErrNoAcceptableMethod     = errors.New("no acceptable authentication method")
+	ErrAuthenticationFailed   = errors.New("authentication failed")
+	ErrRequestFailed          = errors.New("socks request failed")
+	ErrCredentialsTooLong     = errors.New("username or password is longer than 255 bytes")
+	errAuthMethodNotSupported = errors.New("authentication method is not supported")
+)
+
+// ClientHandshake performs the SOCKS5 client handshake on the read writer
+// given, authenticating with the username and password if the username is
+// not empty, and requesting the command for the address given. It returns
+// the address bound by the SOCKS5 server, which is the address of the UDP
+// relay for the UDP associate command.
+func ClientHandshake(readWriter io.ReadWriter, command byte, address Address,
+	username, password string) (boundAddress Address, err error) {
+	// Read RFC 1928 and RFC 1929 for request and reply structure and sizes.
+	const (
+		methodNoAuthentication   = 0
+		methodUsernamePassword   = 2
+		methodNoAcceptableMethod = 0xff
+	)
+	// write VER NMETHODS METHODS
+	greeting := []byte{5, 1, methodNoAuthentication}
+	if username != "" {
+		greeting = []byte{5, 2, methodNoAuthentication, methodUsernamePassword}
+	}
+	if _, err := readWriter.Write(greeting); err != nil {
+		return nil, err
+	}
+	// read VER METHOD
+	buffer := make([]byte, maxSocksAddrressLength)
+	if _, err := io.ReadFull(readWriter, buffer[:2]); err != nil {
+		return nil, err
+	}
+	if buffer[0] != 5 { //nolint:gomnd
+		return nil, fmt.Errorf("%w: %d", ErrVersionNotSupported, buffer[0])
+	}
+	switch buffer[1] {
+	case methodNoAuthentication:
+	case methodUsernamePassword:
+		err = authenticate(readWriter, username, password)
+		if err != nil {
+			return nil, err
+		}
+	case methodNoAcceptableMethod:
+		return nil, ErrNoAcceptableMethod
+	default:
+		return nil, fmt.Errorf("%w: %d", errAuthMethodNotSupported, buffer[1])
+	}
+
+	// write VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := append([]byte{5, command, 0}, address...)
+	if _, err := readWriter.Write(request); err != nil {
+		return nil, err
+	}
+	// read VER REP RSV ATYP BND.ADDR BND.PORT
+	if _, err := io.ReadFull(readWriter, buffer[:3]); err != nil {
+		return nil, err
+	}
+	if reply := buffer[1]; reply != 0 {
+		return nil, fmt.Errorf("%w: reply code %d", ErrRequestFailed, reply)
+	}
+	return readAddress(readWriter, buffer)
+}
+
+// authenticate performs the RFC 1929 username and password authentication.
+func authenticate(readWriter io.ReadWriter, username, password string) (err error) {
+	const maxLength = 255
+	if len(username) > maxLength || len(password) > maxLength {
+		return ErrCredentialsTooLong
+	}
+	// write VER ULEN UNAME PLEN PASSWD
+	request := make([]byte, 0, 1+1+len(username)+1+len(password))
+	request = append(request, 1, byte(len(username)))
+	request = append(request, username...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+	if _, err := readWriter.Write(request); err != nil {
+		return err
+	}
+	// read VER STATUS
+	reply := make([]byte, 2) //nolint:gomnd
+	if _, err := io.ReadFull(readWriter, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("%w: status %d", ErrAuthenticationFailed, reply[1])
+	}
+	return nil
+}
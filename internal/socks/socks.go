@@ -44,6 +44,31 @@ func (a Address) String() string {
 	return net.JoinHostPort(host, port)
 }
 
+// UDPAddr returns the UDP address of the SOCKS address without any
+// DNS resolution. It is a *net.UDPAddr holding a copy of the IP address
+// for IPv4 and IPv6 addresses, and an UnresolvedUDPAddress otherwise.
+func (a Address) UDPAddr() net.Addr {
+	var ip net.IP
+	switch a[0] { // address type
+	case addressTypeIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case addressTypeIPv6:
+		ip = make(net.IP, net.IPv6len)
+	default:
+		return UnresolvedUDPAddress(a.String())
+	}
+	copy(ip, a[1:])
+	port := (int(a[1+len(ip)]) << 8) | int(a[1+len(ip)+1]) //nolint:gomnd
+	return &net.UDPAddr{IP: ip, Port: port}
+}
+
+// UnresolvedUDPAddress is a UDP address with a domain name,
+// to be resolved by the upstream proxy or the next server.
+type UnresolvedUDPAddress string
+
+func (u UnresolvedUDPAddress) Network() string { return "udp" }
+func (u UnresolvedUDPAddress) String() string  { return string(u) }
+
 func readAddress(reader io.Reader, buffer []byte) (socksAddress Address, err error) {
 	if len(buffer) < maxSocksAddrressLength {
 		return nil, io.ErrShortBuffer
@@ -108,8 +133,12 @@ var (
 
 // ParseAddress parses the SOCKS address from a network address.
 func ParseAddress(remoteAddress net.Addr) (socksAddress Address, err error) {
-	s := remoteAddress.String()
-	host, portStr, err := net.SplitHostPort(s)
+	return ParseHostPort(remoteAddress.String())
+}
+
+// ParseHostPort parses a host:port string to a SOCKS address.
+func ParseHostPort(hostPort string) (socksAddress Address, err error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
 	if err != nil {
 		return nil, err
 	}
@@ -152,45 +181,60 @@ var (
 	ErrSocksCommandNotSupported = errors.New("socks command is not supported")
 )
 
-// Handshake fast-tracks SOCKS initialization to get target address to connect.
-func Handshake(readWriter io.ReadWriter) (targetAddress Address, err error) {
+// SOCKS5 commands.
+const (
+	CommandConnect      = 1
+	CommandBind         = 2 // not supported
+	CommandUDPAssociate = 3
+)
+
+// Handshake performs the SOCKS5 handshake on the read writer given and
+// returns the command and target address requested. The UDP associate
+// command is only supported if udpAddress is not nil, and udpAddress is
+// then sent to the client as the address of the UDP relay.
+func Handshake(readWriter io.ReadWriter, udpAddress Address) (
+	command byte, targetAddress Address, err error) {
 	// Read RFC 1928 for request and reply structure and sizes.
 	buffer := make([]byte, maxSocksAddrressLength)
 	// read VER, NMETHODS, METHODS
 	if _, err := io.ReadFull(readWriter, buffer[:2]); err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	nmethods := buffer[1]
 	if _, err := io.ReadFull(readWriter, buffer[:nmethods]); err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	// write VER METHOD
 	if _, err := readWriter.Write([]byte{5, 0}); err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	// read VER CMD RSV ATYP DST.ADDR DST.PORT
 	if _, err := io.ReadFull(readWriter, buffer[:3]); err != nil {
-		return nil, err
+		return 0, nil, err
 	}
+	// keep the command since the buffer is reused for the address
+	command = buffer[1]
 	targetAddress, err = readAddress(readWriter, buffer)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 
-	const (
-		CommandConnect      = 1
-		CommandBind         = 2 // not supported
-		CommandUDPAssociate = 3 // not supported
-	)
-	switch buffer[1] {
-	case CommandConnect:
-		replySuccess := []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
-		_, err = readWriter.Write(replySuccess)
-		if err != nil {
-			return nil, err
-		}
+	// write VER REP RSV ATYP BND.ADDR BND.PORT
+	var reply []byte
+	switch {
+	case command == CommandConnect:
+		reply = []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	case command == CommandUDPAssociate && udpAddress != nil:
+		reply = append([]byte{5, 0, 0}, udpAddress...)
 	default:
-		return nil, fmt.Errorf("%w: %b", ErrSocksCommandNotSupported, buffer[1])
+		const replyCommandNotSupported = 7
+		reply = []byte{5, replyCommandNotSupported, 0, 1, 0, 0, 0, 0, 0, 0}
+		_, _ = readWriter.Write(reply)
+		return 0, nil, fmt.Errorf("%w: %b", ErrSocksCommandNotSupported, command)
+	}
+	_, err = readWriter.Write(reply)
+	if err != nil {
+		return 0, nil, err
 	}
-	return targetAddress, nil // skip VER, CMD, RSV fields
+	return command, targetAddress, nil
 }
@@ -0,0 +1,241 @@
+package socks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type readWriter struct {
+	*bytes.Reader
+	written bytes.Buffer
+}
+
+func (rw *readWriter) Write(b []byte) (int, error) {
+	return rw.written.Write(b)
+}
+
+func Test_Handshake(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		request       []byte
+		udpAddress    Address
+		command       byte
+		targetAddress Address
+		written       []byte
+		errWrapped    error
+		errMessage    string
+	}{
+		"connect IPv4": {
+			request: []byte{
+				5, 1, 0, // VER NMETHODS METHODS
+				5, 1, 0, addressTypeIPv4, 1, 2, 3, 4, 0, 80,
+			},
+			command:       CommandConnect,
+			targetAddress: Address{addressTypeIPv4, 1, 2, 3, 4, 0, 80},
+			written:       []byte{5, 0, 5, 0, 0, 1, 0, 0, 0, 0, 0, 0},
+		},
+		"connect domain name": {
+			request: []byte{
+				5, 1, 0, // VER NMETHODS METHODS
+				5, 1, 0, addressTypeDomainName, 1, 'a', 1, 187,
+			},
+			command:       CommandConnect,
+			targetAddress: Address{addressTypeDomainName, 1, 'a', 1, 187},
+			written:       []byte{5, 0, 5, 0, 0, 1, 0, 0, 0, 0, 0, 0},
+		},
+		"UDP associate": {
+			request: []byte{
+				5, 1, 0, // VER NMETHODS METHODS
+				5, 3, 0, addressTypeIPv4, 0, 0, 0, 0, 0, 0,
+			},
+			udpAddress:    Address{addressTypeIPv4, 127, 0, 0, 1, 4, 56},
+			command:       CommandUDPAssociate,
+			targetAddress: Address{addressTypeIPv4, 0, 0, 0, 0, 0, 0},
+			written:       []byte{5, 0, 5, 0, 0, addressTypeIPv4, 127, 0, 0, 1, 4, 56},
+		},
+		"UDP associate not supported": {
+			request: []byte{
+				5, 1, 0, // VER NMETHODS METHODS
+				5, 3, 0, addressTypeIPv4, 0, 0, 0, 0, 0, 0,
+			},
+			written:    []byte{5, 0, 5, 7, 0, 1, 0, 0, 0, 0, 0, 0},
+			errWrapped: ErrSocksCommandNotSupported,
+			errMessage: "socks command is not supported: 11",
+		},
+		"bind not supported": {
+			request: []byte{
+				5, 1, 0, // VER NMETHODS METHODS
+				5, 2, 0, addressTypeIPv4, 1, 2, 3, 4, 0, 80,
+			},
+			written:    []byte{5, 0, 5, 7, 0, 1, 0, 0, 0, 0, 0, 0},
+			errWrapped: ErrSocksCommandNotSupported,
+			errMessage: "socks command is not supported: 10",
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			readWriter := &readWriter{Reader: bytes.NewReader(testCase.request)}
+
+			command, targetAddress, err := Handshake(readWriter, testCase.udpAddress)
+
+			assert.ErrorIs(t, err, testCase.errWrapped)
+			if testCase.errWrapped != nil {
+				assert.EqualError(t, err, testCase.errMessage)
+			}
+			assert.Equal(t, testCase.command, command)
+			assert.Equal(t, testCase.targetAddress, targetAddress)
+			assert.Equal(t, testCase.written, readWriter.written.Bytes())
+		})
+	}
+}
+
+func Test_ClientHandshake(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		reply        []byte
+		command      byte
+		address      Address
+		username     string
+		password     string
+		written      []byte
+		boundAddress Address
+		errWrapped   error
+		errMessage   string
+	}{
+		"connect without authentication": {
+			reply: []byte{
+				5, 0, // VER METHOD
+				5, 0, 0, addressTypeIPv4, 0, 0, 0, 0, 0, 0,
+			},
+			command: CommandConnect,
+			address: Address{addressTypeIPv4, 1, 2, 3, 4, 0, 80},
+			written: []byte{
+				5, 1, 0, // VER NMETHODS METHODS
+				5, 1, 0, addressTypeIPv4, 1, 2, 3, 4, 0, 80,
+			},
+			boundAddress: Address{addressTypeIPv4, 0, 0, 0, 0, 0, 0},
+		},
+		"UDP associate with authentication": {
+			reply: []byte{
+				5, 2, // VER METHOD
+				1, 0, // VER STATUS
+				5, 0, 0, addressTypeIPv4, 127, 0, 0, 1, 4, 56,
+			},
+			command:  CommandUDPAssociate,
+			address:  Address{addressTypeIPv4, 0, 0, 0, 0, 0, 0},
+			username: "u",
+			password: "pw",
+			written: []byte{
+				5, 2, 0, 2, // VER NMETHODS METHODS
+				1, 1, 'u', 2, 'p', 'w', // VER ULEN UNAME PLEN PASSWD
+				5, 3, 0, addressTypeIPv4, 0, 0, 0, 0, 0, 0,
+			},
+			boundAddress: Address{addressTypeIPv4, 127, 0, 0, 1, 4, 56},
+		},
+		"authentication failed": {
+			reply: []byte{
+				5, 2, // VER METHOD
+				1, 1, // VER STATUS
+			},
+			command:  CommandConnect,
+			address:  Address{addressTypeIPv4, 1, 2, 3, 4, 0, 80},
+			username: "u",
+			written: []byte{
+				5, 2, 0, 2, // VER NMETHODS METHODS
+				1, 1, 'u', 0, // VER ULEN UNAME PLEN PASSWD
+			},
+			errWrapped: ErrAuthenticationFailed,
+			errMessage: "authentication failed: status 1",
+		},
+		"no acceptable method": {
+			reply:      []byte{5, 0xff},
+			command:    CommandConnect,
+			address:    Address{addressTypeIPv4, 1, 2, 3, 4, 0, 80},
+			written:    []byte{5, 1, 0},
+			errWrapped: ErrNoAcceptableMethod,
+			errMessage: "no acceptable authentication method",
+		},
+		"request failed": {
+			reply: []byte{
+				5, 0, // VER METHOD
+				5, 5, 0, addressTypeIPv4, 0, 0, 0, 0, 0, 0,
+			},
+			command: CommandConnect,
+			address: Address{addressTypeIPv4, 1, 2, 3, 4, 0, 80},
+			written: []byte{
+				5, 1, 0, // VER NMETHODS METHODS
+				5, 1, 0, addressTypeIPv4, 1, 2, 3, 4, 0, 80,
+			},
+			errWrapped: ErrRequestFailed,
+			errMessage: "socks request failed: reply code 5",
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			readWriter := &readWriter{Reader: bytes.NewReader(testCase.reply)}
+
+			boundAddress, err := ClientHandshake(readWriter, testCase.command,
+				testCase.address, testCase.username, testCase.password)
+
+			assert.ErrorIs(t, err, testCase.errWrapped)
+			if testCase.errWrapped != nil {
+				assert.EqualError(t, err, testCase.errMessage)
+			}
+			assert.Equal(t, testCase.boundAddress, boundAddress)
+			assert.Equal(t, testCase.written, readWriter.written.Bytes())
+		})
+	}
+}
+
+func Test_Address_UDPAddr(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		address Address
+		udpAddr net.Addr
+	}{
+		"IPv4": {
+			address: Address{addressTypeIPv4, 1, 2, 3, 4, 0, 80},
+			udpAddr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 80},
+		},
+		"IPv6": {
+			address: Address{addressTypeIPv6, 0x20, 0x01, 0x0d, 0xb8, 16: 1, 1, 187},
+			udpAddr: &net.UDPAddr{IP: net.IP{0x20, 0x01, 0x0d, 0xb8, 15: 1}, Port: 443},
+		},
+		"domain name": {
+			address: Address{addressTypeDomainName, 3, 'a', '.', 'b', 0, 53},
+			udpAddr: UnresolvedUDPAddress("a.b:53"),
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			udpAddr := testCase.address.UDPAddr()
+
+			assert.Equal(t, testCase.udpAddr, udpAddr)
+			assert.Equal(t, "udp", udpAddr.Network())
+		})
+	}
+
+	// the IP address does not share the bytes of the SOCKS address
+	address := Address{addressTypeIPv4, 1, 2, 3, 4, 0, 80}
+	udpAddr := address.UDPAddr()
+	address[1] = 9
+	assert.Equal(t, "1.2.3.4:80", udpAddr.String())
+}
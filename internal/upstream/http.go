@@ -0,0 +1,65 @@
+package upstream
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+var ErrConnectFailed = errors.New("CONNECT request failed")
+
+// connectHTTP sends a CONNECT request for the address given on the
+// connection to the HTTP proxy, and closes the connection on error.
+func (p *Proxy) connectHTTP(connection net.Conn, address string) (
+	tunnel net.Conn, err error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if p.username != "" {
+		request.SetBasicAuth(p.username, p.password)
+		request.Header.Set("Proxy-Authorization", request.Header.Get("Authorization"))
+		request.Header.Del("Authorization")
+	}
+
+	err = request.Write(connection)
+	if err != nil {
+		_ = connection.Close()
+		return nil, fmt.Errorf("writing CONNECT request: %w", err)
+	}
+
+	reader := bufio.NewReader(connection)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		_ = connection.Close()
+		return nil, fmt.Errorf("reading CONNECT response: %w", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		_ = connection.Close()
+		return nil, fmt.Errorf("%w: %s", ErrConnectFailed, response.Status)
+	}
+
+	if reader.Buffered() == 0 {
+		return connection, nil
+	}
+	// Data sent by the target right after the CONNECT
+	// response is already buffered by the reader.
+	return &bufferedConn{Conn: connection, reader: reader}, nil
+}
+
+// bufferedConn is a connection reading from
+// its reader instead of the connection directly.
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (n int, err error) {
+	return b.reader.Read(p)
+}
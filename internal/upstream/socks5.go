@@ -0,0 +1,160 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/qdm12/ss-server/internal/socks"
+)
+
+// connectSOCKS5 requests a connection to the address given on the
+// connection to the SOCKS5 proxy, and closes the connection on error.
+func (p *Proxy) connectSOCKS5(connection net.Conn, address string) (
+	tunnel net.Conn, err error) {
+	targetAddress, err := socks.ParseHostPort(address)
+	if err != nil {
+		_ = connection.Close()
+		return nil, fmt.Errorf("parsing target address: %w", err)
+	}
+
+	_, err = socks.ClientHandshake(connection, socks.CommandConnect,
+		targetAddress, p.username, p.password)
+	if err != nil {
+		_ = connection.Close()
+		return nil, err
+	}
+	return connection, nil
+}
+
+// ListenPacket returns a packet connection sending and receiving UDP
+// packets through a SOCKS5 UDP association. The network and address
+// arguments are ignored, and are only present for the method to be a
+// drop-in replacement of the net.ListenConfig ListenPacket method.
+func (p *Proxy) ListenPacket(ctx context.Context, _, _ string) (
+	packetConnection net.PacketConn, err error) {
+	if p.scheme != SchemeSOCKS5 {
+		return nil, fmt.Errorf("%w: %s", ErrUDPNotSupported, p.scheme)
+	}
+
+	controlConnection, err := p.dialer.DialContext(ctx, "tcp", p.address)
+	if err != nil {
+		return nil, fmt.Errorf("dialing proxy: %w", err)
+	}
+
+	// The client address and port are not known yet, so
+	// an all zeros IPv4 address is sent as per RFC 1928.
+	unspecifiedAddress := socks.Address{1, 0, 0, 0, 0, 0, 0}
+	boundAddress, err := socks.ClientHandshake(controlConnection, socks.CommandUDPAssociate,
+		unspecifiedAddress, p.username, p.password)
+	if err != nil {
+		_ = controlConnection.Close()
+		return nil, fmt.Errorf("socks5 proxy handshake: %w", err)
+	}
+
+	relayAddress, err := udpRelayAddress(boundAddress, controlConnection.RemoteAddr())
+	if err != nil {
+		_ = controlConnection.Close()
+		return nil, err
+	}
+
+	udpConnection, err := p.packetListener.ListenPacket(ctx, "udp", "")
+	if err != nil {
+		_ = controlConnection.Close()
+		return nil, fmt.Errorf("creating packet listener: %w", err)
+	}
+
+	return &socks5PacketConn{
+		PacketConn:        udpConnection,
+		controlConnection: controlConnection,
+		relayAddress:      relayAddress,
+	}, nil
+}
+
+// udpRelayAddress returns the UDP relay address from the bound address
+// replied by the SOCKS5 proxy, using the proxy IP address if the bound
+// address IP is unspecified.
+func udpRelayAddress(boundAddress socks.Address, proxyAddress net.Addr) (
+	relayAddress *net.UDPAddr, err error) {
+	relayAddress, err = net.ResolveUDPAddr("udp", boundAddress.String())
+	if err != nil {
+		return nil, fmt.Errorf("resolving UDP relay address: %w", err)
+	}
+	tcpProxyAddress, ok := proxyAddress.(*net.TCPAddr)
+	if ok && relayAddress.IP.IsUnspecified() {
+		relayAddress.IP = tcpProxyAddress.IP
+	}
+	return relayAddress, nil
+}
+
+// socks5PacketConn is a packet connection sending and receiving
+// packets through the UDP relay of a SOCKS5 proxy. The UDP association
+// lasts as long as its TCP control connection is open.
+type socks5PacketConn struct {
+	net.PacketConn
+	controlConnection net.Conn
+	relayAddress      *net.UDPAddr
+	writeMutex        sync.Mutex
+	writeBuffer       []byte
+}
+
+// socksUDPHeaderSize is the size of the RSV and FRAG fields
+// of the SOCKS5 UDP request header.
+const socksUDPHeaderSize = 3
+
+// WriteTo sends the packet to the address given through the UDP relay.
+func (s *socks5PacketConn) WriteTo(packet []byte, address net.Addr) (n int, err error) {
+	targetAddress, err := socks.ParseAddress(address)
+	if err != nil {
+		return 0, fmt.Errorf("parsing target address: %w", err)
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.writeBuffer = append(s.writeBuffer[:0], 0, 0, 0)
+	s.writeBuffer = append(s.writeBuffer, targetAddress...)
+	s.writeBuffer = append(s.writeBuffer, packet...)
+	_, err = s.PacketConn.WriteTo(s.writeBuffer, s.relayAddress)
+	if err != nil {
+		return 0, err
+	}
+	return len(packet), nil
+}
+
+// ReadFrom reads a packet from the UDP relay, and returns its payload
+// and its source address. Packets not coming from the UDP relay
+// and fragmented packets are ignored.
+func (s *socks5PacketConn) ReadFrom(buffer []byte) (n int, address net.Addr, err error) {
+	for {
+		n, address, err = s.PacketConn.ReadFrom(buffer)
+		if err != nil {
+			return 0, nil, err
+		}
+		udpAddress, ok := address.(*net.UDPAddr)
+		if !ok || !udpAddress.IP.Equal(s.relayAddress.IP) || udpAddress.Port != s.relayAddress.Port ||
+			n < socksUDPHeaderSize || buffer[2] != 0 {
+			continue
+		}
+
+		sourceAddress, err := socks.ExtractAddress(buffer[socksUDPHeaderSize:n])
+		if err != nil {
+			continue
+		}
+		// The source address is parsed before its bytes are overwritten.
+		address = sourceAddress.UDPAddr()
+		headerSize := socksUDPHeaderSize + len(sourceAddress)
+		n = copy(buffer, buffer[headerSize:n])
+		return n, address, nil
+	}
+}
+
+// Close closes the UDP connection and the TCP control connection.
+func (s *socks5PacketConn) Close() error {
+	controlErr := s.controlConnection.Close()
+	err := s.PacketConn.Close()
+	if err != nil {
+		return err
+	}
+	return controlErr
+}
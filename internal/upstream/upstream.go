@@ -0,0 +1,140 @@
+// Package upstream implements the egress of connections and
+// packets through an upstream SOCKS5 or HTTP CONNECT proxy.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+const (
+	SchemeSOCKS5 = "socks5"
+	SchemeHTTP   = "http"
+)
+
+var (
+	ErrSchemeNotSupported = errors.New("proxy scheme is not supported")
+	ErrUDPNotSupported    = errors.New("UDP is not supported by the proxy scheme")
+	ErrNetworkNotTCP      = errors.New("network is not TCP")
+)
+
+// Check checks the proxy URL given is valid, and that its
+// scheme supports UDP if udp is true.
+func Check(proxyURL string, udp bool) (err error) {
+	_, err = parse(proxyURL)
+	if err != nil {
+		return err
+	}
+	if udp && !SupportsUDP(proxyURL) {
+		return fmt.Errorf("%w: %s", ErrUDPNotSupported, SchemeHTTP)
+	}
+	return nil
+}
+
+// SupportsUDP returns true if the proxy URL
+// given is for a proxy supporting UDP.
+func SupportsUDP(proxyURL string) bool {
+	parsedURL, err := url.Parse(proxyURL)
+	return err == nil && parsedURL.Scheme == SchemeSOCKS5
+}
+
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+type PacketListener interface {
+	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
+// Proxy is an upstream proxy to dial TCP connections,
+// and to listen for UDP packets for SOCKS5 proxies.
+type Proxy struct {
+	scheme         string
+	address        string
+	username       string
+	password       string
+	dialer         Dialer
+	packetListener PacketListener
+}
+
+// New creates an upstream proxy from its URL, in the form
+// socks5://[username:password@]host:port or
+// http://[username:password@]host:port. The dialer given is used
+// to connect to the proxy, and the packet listener given is used
+// to exchange UDP packets with the proxy UDP relay.
+func New(proxyURL string, dialer Dialer, packetListener PacketListener) (
+	proxy *Proxy, err error) {
+	proxy, err = parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	proxy.dialer = dialer
+	proxy.packetListener = packetListener
+	return proxy, nil
+}
+
+func parse(proxyURL string) (proxy *Proxy, err error) {
+	parsedURL, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing proxy URL: %w", err)
+	}
+
+	switch parsedURL.Scheme {
+	case SchemeSOCKS5, SchemeHTTP:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrSchemeNotSupported, parsedURL.Scheme)
+	}
+
+	_, _, err = net.SplitHostPort(parsedURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("proxy address: %w", err)
+	}
+
+	proxy = &Proxy{
+		scheme:  parsedURL.Scheme,
+		address: parsedURL.Host,
+	}
+	if parsedURL.User != nil {
+		proxy.username = parsedURL.User.Username()
+		proxy.password, _ = parsedURL.User.Password()
+	}
+	return proxy, nil
+}
+
+// DialContext dials the TCP address given through the proxy.
+func (p *Proxy) DialContext(ctx context.Context, network, address string) (
+	connection net.Conn, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrNetworkNotTCP, network)
+	}
+
+	connection, err = p.dialer.DialContext(ctx, "tcp", p.address)
+	if err != nil {
+		return nil, fmt.Errorf("dialing proxy: %w", err)
+	}
+
+	// Abort the handshake if the context is canceled.
+	stop := context.AfterFunc(ctx, func() {
+		_ = connection.Close()
+	})
+	defer stop()
+
+	switch p.scheme {
+	case SchemeSOCKS5:
+		connection, err = p.connectSOCKS5(connection, address)
+	default:
+		connection, err = p.connectHTTP(connection, address)
+	}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return nil, fmt.Errorf("%s proxy handshake: %w", p.scheme, err)
+	}
+	return connection, nil
+}
@@ -0,0 +1,362 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/qdm12/ss-server/internal/socks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startEchoTCPServer starts a TCP server echoing back
+// data received, and returns its listening address.
+func startEchoTCPServer(t *testing.T) (address string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer connection.Close()
+				_, _ = io.Copy(connection, connection)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// startEchoUDPServer starts a UDP server echoing back
+// packets received, and returns its listening address.
+func startEchoUDPServer(t *testing.T) (address *net.UDPAddr) {
+	t.Helper()
+	packetConnection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = packetConnection.Close() })
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, address, err := packetConnection.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = packetConnection.WriteTo(buffer[:n], address)
+		}
+	}()
+	return packetConnection.LocalAddr().(*net.UDPAddr) //nolint:forcetypeassert
+}
+
+// serve accepts connections on the listener given and handles
+// them with the handle function given, until the test ends.
+func serve(t *testing.T, listener net.Listener, handle func(connection net.Conn)) {
+	t.Helper()
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer connection.Close()
+				handle(connection)
+			}()
+		}
+	}()
+}
+
+// pipe copies data between the two connections until one of them is closed.
+func pipe(a net.Conn, aReader io.Reader, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(b, aReader)
+		_ = b.Close()
+		close(done)
+	}()
+	_, _ = io.Copy(a, b)
+	_ = a.Close()
+	<-done
+}
+
+// startHTTPProxy starts an HTTP CONNECT proxy, requiring the
+// Proxy-Authorization header given if it is not empty.
+func startHTTPProxy(t *testing.T, authorization string) (address string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serve(t, listener, func(connection net.Conn) {
+		reader := bufio.NewReader(connection)
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		if authorization != "" && request.Header.Get("Proxy-Authorization") != authorization {
+			_, _ = io.WriteString(connection, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+		target, err := net.Dial("tcp", request.Host)
+		if err != nil {
+			_, _ = io.WriteString(connection, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		_, err = io.WriteString(connection, "HTTP/1.1 200 Connection established\r\n\r\n")
+		if err != nil {
+			_ = target.Close()
+			return
+		}
+		pipe(connection, reader, target)
+	})
+	return listener.Addr().String()
+}
+
+// startSOCKS5Proxy starts a SOCKS5 proxy supporting the CONNECT and
+// UDP ASSOCIATE commands. Its UDP relay replies an unspecified IP
+// address, to be replaced by the proxy IP address by the client.
+func startSOCKS5Proxy(t *testing.T) (address string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = relay.Close() })
+	outgoing, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = outgoing.Close() })
+	go relayUDP(relay, outgoing)
+
+	relayPort := relay.LocalAddr().(*net.UDPAddr).Port //nolint:forcetypeassert
+	udpAddress := socks.Address{1, 0, 0, 0, 0, byte(relayPort >> 8), byte(relayPort)}
+	serve(t, listener, func(connection net.Conn) {
+		command, targetAddress, err := socks.Handshake(connection, udpAddress)
+		if err != nil {
+			return
+		}
+		if command == socks.CommandUDPAssociate {
+			// the association lasts as long as the control connection
+			_, _ = io.Copy(io.Discard, connection)
+			return
+		}
+		target, err := net.Dial("tcp", targetAddress.String())
+		if err != nil {
+			return
+		}
+		pipe(connection, connection, target)
+	})
+	return listener.Addr().String()
+}
+
+// relayUDP relays packets of a single client between the relay
+// packet connection and the outgoing packet connection.
+func relayUDP(relay, outgoing net.PacketConn) {
+	clientAddress := make(chan net.Addr, 1)
+	go func() {
+		client := <-clientAddress
+		buffer := make([]byte, 1024)
+		for {
+			n, source, err := outgoing.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			sourceAddress, err := socks.ParseAddress(source)
+			if err != nil {
+				continue
+			}
+			packet := append([]byte{0, 0, 0}, sourceAddress...)
+			packet = append(packet, buffer[:n]...)
+			_, _ = relay.WriteTo(packet, client)
+		}
+	}()
+
+	buffer := make([]byte, 1024)
+	for first := true; ; first = false {
+		n, client, err := relay.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if first {
+			clientAddress <- client
+		}
+		targetAddress, err := socks.ExtractAddress(buffer[socksUDPHeaderSize:n])
+		if err != nil {
+			continue
+		}
+		headerSize := socksUDPHeaderSize + len(targetAddress)
+		_, _ = outgoing.WriteTo(buffer[headerSize:n], targetAddress.UDPAddr())
+	}
+}
+
+func newTestProxy(t *testing.T, proxyURL string) *Proxy {
+	t.Helper()
+	proxy, err := New(proxyURL, &net.Dialer{}, &net.ListenConfig{})
+	require.NoError(t, err)
+	return proxy
+}
+
+func Test_Proxy_DialContext(t *testing.T) {
+	t.Parallel()
+
+	echoAddress := startEchoTCPServer(t)
+	basicAuthorization := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+
+	testCases := map[string]struct {
+		proxyURL   func(t *testing.T) string
+		errWrapped error
+		errMessage string
+	}{
+		"http without authentication": {
+			proxyURL: func(t *testing.T) string {
+				return "http://" + startHTTPProxy(t, "")
+			},
+		},
+		"http with authentication": {
+			proxyURL: func(t *testing.T) string {
+				return "http://user:pass@" + startHTTPProxy(t, basicAuthorization)
+			},
+		},
+		"http with wrong authentication": {
+			proxyURL: func(t *testing.T) string {
+				return "http://user:wrong@" + startHTTPProxy(t, basicAuthorization)
+			},
+			errWrapped: ErrConnectFailed,
+			errMessage: "http proxy handshake: CONNECT request failed: 407 Proxy Authentication Required",
+		},
+		"http without required authentication": {
+			proxyURL: func(t *testing.T) string {
+				return "http://" + startHTTPProxy(t, basicAuthorization)
+			},
+			errWrapped: ErrConnectFailed,
+			errMessage: "http proxy handshake: CONNECT request failed: 407 Proxy Authentication Required",
+		},
+		"socks5": {
+			proxyURL: func(t *testing.T) string {
+				return "socks5://" + startSOCKS5Proxy(t)
+			},
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			proxy := newTestProxy(t, testCase.proxyURL(t))
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			connection, err := proxy.DialContext(ctx, "tcp", echoAddress)
+
+			assert.ErrorIs(t, err, testCase.errWrapped)
+			if testCase.errWrapped != nil {
+				assert.EqualError(t, err, testCase.errMessage)
+				assert.Nil(t, connection)
+				return
+			}
+			require.NoError(t, err)
+			defer connection.Close()
+
+			_, err = connection.Write([]byte("hello"))
+			require.NoError(t, err)
+			response := make([]byte, len("hello"))
+			_, err = io.ReadFull(connection, response)
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(response))
+		})
+	}
+}
+
+func Test_Proxy_ListenPacket(t *testing.T) {
+	t.Parallel()
+
+	echoAddress := startEchoUDPServer(t)
+	proxy := newTestProxy(t, "socks5://"+startSOCKS5Proxy(t))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	packetConnection, err := proxy.ListenPacket(ctx, "udp", "")
+	require.NoError(t, err)
+	defer packetConnection.Close()
+	err = packetConnection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, err)
+
+	for _, payload := range []string{"hello", "world"} {
+		n, err := packetConnection.WriteTo([]byte(payload), echoAddress)
+		require.NoError(t, err)
+		assert.Equal(t, len(payload), n)
+
+		buffer := make([]byte, 1024)
+		n, address, err := packetConnection.ReadFrom(buffer)
+		require.NoError(t, err)
+		assert.Equal(t, payload, string(buffer[:n]))
+		assert.Equal(t, echoAddress, address)
+	}
+}
+
+func Test_Proxy_ListenPacket_httpNotSupported(t *testing.T) {
+	t.Parallel()
+
+	proxy := newTestProxy(t, "http://127.0.0.1:8080")
+
+	packetConnection, err := proxy.ListenPacket(context.Background(), "udp", "")
+
+	assert.ErrorIs(t, err, ErrUDPNotSupported)
+	assert.EqualError(t, err, "UDP is not supported by the proxy scheme: http")
+	assert.Nil(t, packetConnection)
+}
+
+func Test_socks5PacketConn_ReadFrom(t *testing.T) {
+	t.Parallel()
+
+	newPacketConn := func(t *testing.T) net.PacketConn {
+		t.Helper()
+		packetConnection, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = packetConnection.Close() })
+		return packetConnection
+	}
+	client, relay, other := newPacketConn(t), newPacketConn(t), newPacketConn(t)
+	connection := &socks5PacketConn{
+		PacketConn:   client,
+		relayAddress: relay.LocalAddr().(*net.UDPAddr), //nolint:forcetypeassert
+	}
+
+	domainSource := []byte{3, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0, 53}
+	packets := []struct {
+		sender net.PacketConn
+		packet []byte
+	}{
+		{sender: other, packet: append([]byte{0, 0, 0}, append(domainSource, "not relay"...)...)},
+		{sender: relay, packet: append([]byte{0, 0, 1}, append(domainSource, "fragment"...)...)},
+		{sender: relay, packet: []byte{0, 0}},
+		{sender: relay, packet: []byte{0, 0, 0, 9, 1, 2}},
+		{sender: relay, packet: append([]byte{0, 0, 0}, append(domainSource, "domain"...)...)},
+		{sender: relay, packet: []byte{0, 0, 0, 1, 10, 0, 0, 1, 0, 80, 'i', 'p'}},
+	}
+	for _, packet := range packets {
+		_, err := packet.sender.WriteTo(packet.packet, client.LocalAddr())
+		require.NoError(t, err)
+	}
+	err := client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, err)
+
+	buffer := make([]byte, 1024)
+	n, address, err := connection.ReadFrom(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "domain", string(buffer[:n]))
+	assert.Equal(t, socks.UnresolvedUDPAddress("example.com:53"), address)
+
+	n, address, err = connection.ReadFrom(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "ip", string(buffer[:n]))
+	assert.Equal(t, &net.UDPAddr{IP: net.IP{10, 0, 0, 1}, Port: 80}, address)
+}
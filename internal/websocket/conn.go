@@ -0,0 +1,198 @@
+// Package websocket implements a server net.Conn adapter carrying a
+// stream in WebSocket binary frames, compatible with v2ray-plugin.
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	opcodeContinuation = 0x0
+	opcodeText         = 0x1
+	opcodeBinary       = 0x2
+	opcodeClose        = 0x8
+	opcodePing         = 0x9
+	opcodePong         = 0xa
+
+	finalBit               = 0x80
+	maskBit                = 0x80
+	maxControlPayloadSize  = 125
+	payloadSize16BitsValue = 126
+	payloadSize64BitsValue = 127
+)
+
+// NewServerConn wraps the connection given such that the WebSocket
+// handshake is done on the first read, and the data is then read from
+// and written to WebSocket binary frames. The HTTP upgrade request
+// must have the path given and, if host is not empty, the host given.
+func NewServerConn(connection net.Conn, path, host string) net.Conn {
+	return &serverConn{
+		Conn:   connection,
+		path:   path,
+		host:   host,
+		reader: bufio.NewReader(connection),
+	}
+}
+
+type serverConn struct {
+	net.Conn
+	path string
+	host string
+
+	// Fields only accessed by the reading goroutine.
+	reader        *bufio.Reader
+	handshakeDone bool
+	// frameLeft is the number of payload bytes left
+	// to read from the current data frame.
+	frameLeft  uint64
+	maskKey    [4]byte
+	maskOffset int
+
+	// writeMu prevents concurrent writes of data frames
+	// and of control frames answered by the reading goroutine.
+	writeMu sync.Mutex
+}
+
+var (
+	errFrameNotMasked      = errors.New("client frame is not masked")
+	errControlFrameTooLong = errors.New("control frame payload is too long")
+	errOpcodeUnknown       = errors.New("frame opcode is unknown")
+)
+
+func (c *serverConn) Read(b []byte) (n int, err error) {
+	if !c.handshakeDone {
+		err = c.handshake()
+		if err != nil {
+			return 0, fmt.Errorf("WebSocket handshake: %w", err)
+		}
+		c.handshakeDone = true
+	}
+
+	for c.frameLeft == 0 {
+		err = c.readFrameHeader()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > c.frameLeft {
+		b = b[:c.frameLeft]
+	}
+	n, err = c.reader.Read(b)
+	c.unmask(b[:n])
+	c.frameLeft -= uint64(n)
+	return n, err
+}
+
+// readFrameHeader reads the next frame header, setting the frame
+// fields for data frames, and answering control frames.
+func (c *serverConn) readFrameHeader() (err error) {
+	var header [2]byte
+	_, err = io.ReadFull(c.reader, header[:])
+	if err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f //nolint:gomnd
+	if header[1]&maskBit == 0 {
+		return errFrameNotMasked
+	}
+
+	payloadSize := uint64(header[1] &^ maskBit)
+	switch payloadSize {
+	case payloadSize16BitsValue:
+		var size [2]byte
+		_, err = io.ReadFull(c.reader, size[:])
+		payloadSize = uint64(binary.BigEndian.Uint16(size[:]))
+	case payloadSize64BitsValue:
+		var size [8]byte
+		_, err = io.ReadFull(c.reader, size[:])
+		payloadSize = binary.BigEndian.Uint64(size[:])
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(c.reader, c.maskKey[:])
+	if err != nil {
+		return err
+	}
+	c.maskOffset = 0
+
+	switch opcode {
+	case opcodeContinuation, opcodeText, opcodeBinary:
+		c.frameLeft = payloadSize
+		return nil
+	case opcodeClose, opcodePing, opcodePong:
+	default:
+		return fmt.Errorf("%w: 0x%x", errOpcodeUnknown, opcode)
+	}
+
+	if payloadSize > maxControlPayloadSize {
+		return fmt.Errorf("%w: %d bytes", errControlFrameTooLong, payloadSize)
+	}
+	payload := make([]byte, payloadSize)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return err
+	}
+	c.unmask(payload)
+
+	switch opcode {
+	case opcodeClose:
+		// Echo the close status code back and end the stream.
+		_ = c.writeFrame(opcodeClose, payload)
+		return io.EOF
+	case opcodePing:
+		return c.writeFrame(opcodePong, payload)
+	default: // pong
+		return nil
+	}
+}
+
+// unmask unmasks b in place, continuing from the current mask offset.
+func (c *serverConn) unmask(b []byte) {
+	for i := range b {
+		b[i] ^= c.maskKey[c.maskOffset%len(c.maskKey)]
+		c.maskOffset++
+	}
+}
+
+func (c *serverConn) Write(b []byte) (n int, err error) {
+	err = c.writeFrame(opcodeBinary, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame writes a final unmasked frame with the opcode and payload given.
+func (c *serverConn) writeFrame(opcode byte, payload []byte) (err error) {
+	const maxHeaderSize = 2 + 8
+	frame := make([]byte, 0, maxHeaderSize+len(payload))
+	frame = append(frame, finalBit|opcode)
+	switch {
+	case len(payload) < payloadSize16BitsValue:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff: //nolint:gomnd
+		frame = append(frame, payloadSize16BitsValue)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, payloadSize64BitsValue)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	return c.writeRaw(frame)
+}
+
+func (c *serverConn) writeRaw(b []byte) (err error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.Conn.Write(b)
+	return err
+}
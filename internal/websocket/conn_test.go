@@ -0,0 +1,148 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeClientFrame returns a final masked client frame.
+func makeClientFrame(opcode byte, payload []byte) []byte {
+	maskKey := [4]byte{1, 2, 3, 4}
+	frame := []byte{finalBit | opcode}
+	if len(payload) < payloadSize16BitsValue {
+		frame = append(frame, maskBit|byte(len(payload)))
+	} else {
+		frame = append(frame, maskBit|payloadSize16BitsValue)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	frame = append(frame, maskKey[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^maskKey[i%len(maskKey)])
+	}
+	return frame
+}
+
+const upgradeRequest = "GET /path HTTP/1.1\r\n" +
+	"Host: example.com\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n" +
+	"\r\n"
+
+func Test_serverConn(t *testing.T) {
+	t.Parallel()
+
+	serverSide, clientSide := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientSide.Close()
+	})
+	serverConn := NewServerConn(serverSide, "/path", "example.com")
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+	})
+
+	longPayload := make([]byte, 300)
+	for i := range longPayload {
+		longPayload[i] = byte(i)
+	}
+
+	clientReader := bufio.NewReader(clientSide)
+	clientErrCh := make(chan error)
+	go func() {
+		_, err := clientSide.Write([]byte(upgradeRequest))
+		if err != nil {
+			clientErrCh <- err
+			return
+		}
+		response, err := http.ReadResponse(clientReader, nil)
+		if err != nil {
+			clientErrCh <- err
+			return
+		}
+		if response.StatusCode != http.StatusSwitchingProtocols ||
+			response.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+			clientErrCh <- io.ErrUnexpectedEOF
+			return
+		}
+		_, err = clientSide.Write(makeClientFrame(opcodeBinary, []byte("hello")))
+		if err != nil {
+			clientErrCh <- err
+			return
+		}
+		_, err = clientSide.Write(makeClientFrame(opcodePing, []byte("ping")))
+		if err != nil {
+			clientErrCh <- err
+			return
+		}
+		_, err = clientSide.Write(makeClientFrame(opcodeBinary, longPayload))
+		clientErrCh <- err
+	}()
+
+	data := make([]byte, len("hello"))
+	_, err := io.ReadFull(serverConn, data)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// The ping is answered while reading the next frame.
+	readErrCh := make(chan error)
+	data = make([]byte, len(longPayload))
+	go func() {
+		_, err := io.ReadFull(serverConn, data)
+		readErrCh <- err
+	}()
+
+	pong := make([]byte, 2+len("ping"))
+	_, err = io.ReadFull(clientReader, pong)
+	require.NoError(t, err)
+	assert.Equal(t, append([]byte{finalBit | opcodePong, 4}, "ping"...), pong)
+
+	require.NoError(t, <-clientErrCh)
+	require.NoError(t, <-readErrCh)
+	assert.Equal(t, longPayload, data)
+
+	go func() {
+		_, _ = serverConn.Write([]byte("response"))
+	}()
+	frame := make([]byte, 2+len("response"))
+	_, err = io.ReadFull(clientReader, frame)
+	require.NoError(t, err)
+	assert.Equal(t, append([]byte{finalBit | opcodeBinary, 8}, "response"...), frame)
+}
+
+func Test_serverConn_pathMismatch(t *testing.T) {
+	t.Parallel()
+
+	serverSide, clientSide := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientSide.Close()
+	})
+	serverConn := NewServerConn(serverSide, "/other", "")
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+	})
+
+	go func() {
+		_, _ = clientSide.Write([]byte(upgradeRequest))
+	}()
+	responseCh := make(chan *http.Response)
+	go func() {
+		response, _ := http.ReadResponse(bufio.NewReader(clientSide), nil)
+		responseCh <- response
+	}()
+
+	_, err := serverConn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, errPathMismatch)
+	assert.EqualError(t, err, "WebSocket handshake: HTTP request path does not match: /path instead of /other")
+
+	response := <-responseCh
+	require.NotNil(t, response)
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+}
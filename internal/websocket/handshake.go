@@ -0,0 +1,104 @@
+package websocket
+
+import (
+	"crypto/sha1" //nolint:gosec
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	errRequestNotUpgrade   = errors.New("HTTP request is not a WebSocket upgrade")
+	errVersionNotSupported = errors.New("WebSocket version is not supported")
+	errPathMismatch        = errors.New("HTTP request path does not match")
+	errHostMismatch        = errors.New("HTTP request host does not match")
+)
+
+// handshake reads the HTTP upgrade request and writes the HTTP response.
+// If the request does not match the settings, an HTTP error response is
+// written so the server looks like a regular HTTP server.
+func (c *serverConn) handshake() (err error) {
+	request, err := http.ReadRequest(c.reader)
+	if err != nil {
+		return fmt.Errorf("reading HTTP request: %w", err)
+	}
+
+	err = c.checkRequest(request)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errPathMismatch) || errors.Is(err, errHostMismatch) {
+			status = http.StatusNotFound
+		}
+		_ = c.writeRaw([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n"+
+			"Content-Length: 0\r\n"+
+			"Connection: close\r\n"+
+			"\r\n", status, http.StatusText(status))))
+		return err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(request.Header.Get("Sec-WebSocket-Key")) + "\r\n" +
+		"\r\n"
+	err = c.writeRaw([]byte(response))
+	if err != nil {
+		return fmt.Errorf("writing HTTP response: %w", err)
+	}
+	return nil
+}
+
+func (c *serverConn) checkRequest(request *http.Request) (err error) {
+	if request.URL.Path != c.path {
+		return fmt.Errorf("%w: %s instead of %s", errPathMismatch, request.URL.Path, c.path)
+	}
+
+	if c.host != "" {
+		host := request.Host
+		if hostOnly, _, err := net.SplitHostPort(host); err == nil {
+			host = hostOnly
+		}
+		if !strings.EqualFold(host, c.host) {
+			return fmt.Errorf("%w: %s instead of %s", errHostMismatch, request.Host, c.host)
+		}
+	}
+
+	if request.Method != http.MethodGet ||
+		!headerHasToken(request.Header, "Connection", "upgrade") ||
+		!headerHasToken(request.Header, "Upgrade", "websocket") ||
+		request.Header.Get("Sec-WebSocket-Key") == "" {
+		return errRequestNotUpgrade
+	}
+
+	const supportedVersion = "13"
+	version := request.Header.Get("Sec-WebSocket-Version")
+	if version != supportedVersion {
+		return fmt.Errorf("%w: %q", errVersionNotSupported, version)
+	}
+
+	return nil
+}
+
+// headerHasToken returns true if the comma separated
+// header values contain the token, case insensitively.
+func headerHasToken(header http.Header, key, token string) bool {
+	for _, value := range header.Values(key) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptKey returns the Sec-WebSocket-Accept value
+// for the Sec-WebSocket-Key value given.
+func acceptKey(key string) string {
+	const magic = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	hash := sha1.Sum([]byte(key + magic)) //nolint:gosec
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
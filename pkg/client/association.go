@@ -0,0 +1,96 @@
+package client
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// udpAssociations holds the active SOCKS5 UDP associations, so the
+// UDP relay only relays packets from the clients which made them.
+type udpAssociations struct {
+	mu           sync.Mutex
+	associations map[*udpAssociation]struct{}
+}
+
+// udpAssociation is a SOCKS5 UDP association, lasting as long
+// as the TCP connection of the client which made it.
+type udpAssociation struct {
+	// clientIP is the IP address of the TCP connection of the client.
+	clientIP net.IP
+	// clientPort is the UDP port the client sends packets from,
+	// and is zero if the client did not give it in its request.
+	clientPort int
+	// connections are the packet connections to the
+	// server relaying the packets of the association.
+	connections []io.Closer
+}
+
+func newUDPAssociations() *udpAssociations {
+	return &udpAssociations{
+		associations: make(map[*udpAssociation]struct{}),
+	}
+}
+
+// add adds and returns an association for the client IP address and
+// the client UDP port, which can be zero to accept any port.
+func (u *udpAssociations) add(clientIP net.IP, clientPort int) *udpAssociation {
+	association := &udpAssociation{
+		clientIP:   clientIP,
+		clientPort: clientPort,
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.associations[association] = struct{}{}
+	return association
+}
+
+// remove removes the association and closes its packet connections
+// to the server, which also removes them from the NAT map.
+func (u *udpAssociations) remove(association *udpAssociation) {
+	u.mu.Lock()
+	delete(u.associations, association)
+	connections := association.connections
+	association.connections = nil
+	u.mu.Unlock()
+	for _, connection := range connections {
+		_ = connection.Close()
+	}
+}
+
+// allowed returns true if the client address belongs to an association.
+func (u *udpAssociations) allowed(clientAddress net.Addr) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.find(clientAddress) != nil
+}
+
+// attach attaches the packet connection to the server to the
+// association of the client address, so it is closed when the
+// association ends. It returns false if there is no association.
+func (u *udpAssociations) attach(clientAddress net.Addr, connection io.Closer) (ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	association := u.find(clientAddress)
+	if association == nil {
+		return false
+	}
+	association.connections = append(association.connections, connection)
+	return true
+}
+
+// find returns the association of the client address, or nil if
+// there is none. It must be called with the mutex locked.
+func (u *udpAssociations) find(clientAddress net.Addr) *udpAssociation {
+	udpAddress, ok := clientAddress.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	for association := range u.associations {
+		if association.clientIP.Equal(udpAddress.IP) &&
+			(association.clientPort == 0 || association.clientPort == udpAddress.Port) {
+			return association
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/qdm12/ss-server/internal/core"
+	"github.com/qdm12/ss-server/internal/filter"
+	"github.com/qdm12/ss-server/internal/socks"
+)
+
+// New creates a Shadowsocks client running a local SOCKS5 server,
+// and optionally a local HTTP proxy server, proxying each SOCKS5 TCP
+// connection and UDP association and each HTTP request through the
+// remote server. If the tunnel address is set, it instead forwards
+// TCP connections and UDP packets to the tunnel address through the
+// remote server. If redir is set, it instead forwards TCP connections
+// and UDP packets redirected by the firewall to their original
+// destination through the remote server.
+func New(settings Settings, logger Logger) (c *Client, err error) {
+	settings.SetDefaults()
+
+	tcpStreamCipher, err := core.NewTCPStreamCipher(settings.CipherName,
+		*settings.Password, *settings.Key, nil, filter.NewBloomRing())
+	if err != nil {
+		return nil, err
+	}
+	udpPacketCipher, err := core.NewUDPPacketCipher(settings.CipherName,
+		*settings.Password, *settings.Key, nil, filter.NewBloomRing())
+	if err != nil {
+		return nil, err
+	}
+	mode := "SOCKS5"
+	var tunnelAddress socks.Address
+	switch {
+	case settings.TunnelAddress != "":
+		mode = "tunnel"
+		tunnelAddress, err = socks.ParseHostPort(settings.TunnelAddress)
+		if err != nil {
+			return nil, fmt.Errorf("parsing tunnel address: %w", err)
+		}
+	case settings.Redir != "":
+		mode = "redir"
+	}
+	return &Client{
+		mode:           mode,
+		address:        *settings.Address,
+		tunnelAddress:  tunnelAddress,
+		redir:          settings.Redir,
+		httpAddress:    settings.HTTPAddress,
+		serverAddress:  settings.ServerAddress,
+		logAddresses:   *settings.LogAddresses,
+		logger:         logger,
+		timeNow:        time.Now,
+		shadower:       tcpStreamCipher,
+		packetShadower: udpPacketCipher,
+		associations:   newUDPAssociations(),
+	}, nil
+}
+
+type Client struct {
+	// mode is "SOCKS5", "tunnel" if tunnelAddress is set
+	// or "redir" if redir is set.
+	mode    string
+	address string
+	// tunnelAddress is the fixed target address of all TCP connections
+	// and UDP packets in tunnel mode, and is nil otherwise.
+	tunnelAddress socks.Address
+	// redir is the redirection method in redir mode,
+	// and is the empty string otherwise.
+	redir          string
+	httpAddress    string
+	serverAddress  string
+	logAddresses   bool
+	logger         Logger
+	timeNow        func() time.Time
+	shadower       *core.TCPStreamCipher
+	packetShadower *core.UDPPacketCipher
+	// associations are the active SOCKS5 UDP associations.
+	associations *udpAssociations
+}
+
+// Listen listens for incoming SOCKS5 connections on TCP, and for
+// SOCKS5 UDP packets of UDP associations on UDP, as well as for
+// HTTP proxy requests if the HTTP address is set. In tunnel mode,
+// it listens for TCP connections and UDP packets forwarded as they
+// are to the tunnel address. In redir mode, it listens for TCP
+// connections, and UDP packets for TPROXY, redirected by the firewall
+// and forwarded to their original destination. It returns nil
+// once the context is canceled.
+func (c *Client) Listen(parentCtx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	var closers []io.Closer
+	closeAll := func() {
+		for _, closer := range closers {
+			if err := closer.Close(); err != nil {
+				c.logger.Error(err.Error())
+			}
+		}
+	}
+
+	listenConfig := net.ListenConfig{}
+	if c.redir == RedirTProxy {
+		listenConfig.Control = transparentControl
+	}
+
+	var packetConnection net.PacketConn
+	var udpAddress net.Addr
+	// UDP cannot be redirected with REDIRECT.
+	if c.redir != RedirRedirect {
+		packetConnection, err = listenConfig.ListenPacket(ctx, "udp", c.address)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, packetConnection)
+		udpAddress = packetConnection.LocalAddr()
+	}
+	listener, err := listenConfig.Listen(ctx, "tcp", c.address)
+	if err != nil {
+		closeAll()
+		return err
+	}
+	closers = append(closers, listener)
+	var httpListener net.Listener
+	if c.httpAddress != "" {
+		httpListener, err = listenConfig.Listen(ctx, "tcp", c.httpAddress)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		closers = append(closers, httpListener)
+	}
+	go func() {
+		<-ctx.Done()
+		closeAll()
+	}()
+
+	udpDone := make(chan struct{})
+	go func() {
+		defer close(udpDone)
+		switch {
+		case packetConnection == nil:
+		case c.redir != "":
+			c.serveRedirUDP(ctx, packetConnection)
+		default:
+			c.serveUDP(ctx, packetConnection)
+		}
+	}()
+
+	httpDone := make(chan struct{})
+	go func() {
+		defer close(httpDone)
+		if httpListener != nil {
+			c.serveHTTP(ctx, httpListener)
+		}
+	}()
+
+	err = c.serveTCP(ctx, listener, udpAddress)
+	cancel()
+	<-udpDone
+	<-httpDone
+	if parentCtx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func closeConnection(name string, conn io.Closer, errs *[]error) {
+	err := conn.Close()
+	if err != nil {
+		err = fmt.Errorf("closing %s: %w", name, err)
+		*errs = append(*errs, err)
+	}
+}
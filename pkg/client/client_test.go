@@ -0,0 +1,493 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/qdm12/ss-server/internal/core"
+	"github.com/qdm12/ss-server/internal/socks"
+	"github.com/qdm12/ss-server/pkg/tcp"
+	"github.com/qdm12/ss-server/pkg/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type noopLogger struct{}
+
+func (noopLogger) Debug(string) {}
+func (noopLogger) Info(string)  {}
+func (noopLogger) Error(string) {}
+
+const (
+	testCipherName = core.AES256gcm
+	testPassword   = "password"
+)
+
+// startEchoTCPServer starts a TCP server echoing back
+// data received, and returns its listening address.
+func startEchoTCPServer(t *testing.T) (address net.Addr) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serveTCPEcho(t, listener)
+	return listener.Addr()
+}
+
+// startEchoUDPServer starts a UDP server echoing back
+// packets received, and returns its listening address.
+func startEchoUDPServer(t *testing.T) (address net.Addr) {
+	t.Helper()
+	packetConnection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serveUDPEcho(t, packetConnection)
+	return packetConnection.LocalAddr()
+}
+
+func serveTCPEcho(t *testing.T, listener net.Listener) {
+	t.Helper()
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer connection.Close()
+				_, _ = io.Copy(connection, connection)
+			}()
+		}
+	}()
+}
+
+func serveUDPEcho(t *testing.T, packetConnection net.PacketConn) {
+	t.Helper()
+	t.Cleanup(func() { _ = packetConnection.Close() })
+	go func() {
+		buffer := make([]byte, bufferSize)
+		for {
+			n, address, err := packetConnection.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = packetConnection.WriteTo(buffer[:n], address)
+		}
+	}()
+}
+
+// listenTCPUDP listens on TCP and UDP on the same loopback port.
+func listenTCPUDP(t *testing.T) (listener net.Listener, packetConnection net.PacketConn) {
+	t.Helper()
+	const tries = 10
+	for i := 0; i < tries; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		packetConnection, err = net.ListenPacket("udp", listener.Addr().String())
+		if err == nil {
+			return listener, packetConnection
+		}
+		_ = listener.Close()
+	}
+	t.Fatal("cannot listen on the same TCP and UDP port")
+	return nil, nil
+}
+
+// startServer starts a Shadowsocks TCP and UDP server on a
+// loopback address and returns its listening address.
+func startServer(t *testing.T) (address string) {
+	t.Helper()
+	listener, packetConnection := listenTCPUDP(t)
+
+	tcpSettings := tcp.Settings{
+		CipherName: testCipherName,
+		Password:   ptrTo(testPassword),
+	}
+	tcpServer, err := tcp.NewServer(tcpSettings, noopLogger{})
+	require.NoError(t, err)
+	udpSettings := udp.Settings{
+		CipherName: testCipherName,
+		Password:   ptrTo(testPassword),
+	}
+	udpServer, err := udp.NewServer(udpSettings, noopLogger{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tcpDone := make(chan struct{})
+	go func() {
+		defer close(tcpDone)
+		_ = tcpServer.Serve(ctx, listener)
+	}()
+	udpDone := make(chan struct{})
+	go func() {
+		defer close(udpDone)
+		_ = udpServer.ServePacket(ctx, packetConnection)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-tcpDone
+		<-udpDone
+	})
+	return listener.Addr().String()
+}
+
+// startClient starts the client serving TCP on a loopback
+// address, and returns its listening address.
+func startClient(t *testing.T, settings Settings) (address net.Addr) {
+	t.Helper()
+	address, _ = serveClient(t, settings, false)
+	return address
+}
+
+// serveClient starts the client serving TCP, and UDP on the same port
+// if withUDP is true, on a loopback address, and returns its TCP and
+// UDP listening addresses.
+func serveClient(t *testing.T, settings Settings, withUDP bool) (
+	tcpAddress, udpAddress net.Addr) {
+	t.Helper()
+	settings.CipherName = testCipherName
+	settings.Password = ptrTo(testPassword)
+	client, err := New(settings, noopLogger{})
+	require.NoError(t, err)
+
+	var listener net.Listener
+	var packetConnection net.PacketConn
+	if withUDP {
+		listener, packetConnection = listenTCPUDP(t)
+		udpAddress = packetConnection.LocalAddr()
+	} else {
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tcpDone := make(chan struct{})
+	go func() {
+		defer close(tcpDone)
+		_ = client.serveTCP(ctx, listener, udpAddress)
+	}()
+	udpDone := make(chan struct{})
+	go func() {
+		defer close(udpDone)
+		if packetConnection != nil {
+			client.serveUDP(ctx, packetConnection)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		_ = listener.Close()
+		if packetConnection != nil {
+			_ = packetConnection.Close()
+		}
+		<-tcpDone
+		<-udpDone
+	})
+	return listener.Addr(), udpAddress
+}
+
+func Test_Client_socksConnect(t *testing.T) {
+	t.Parallel()
+
+	echoAddress := startEchoTCPServer(t)
+	serverAddress := startServer(t)
+	clientAddress := startClient(t, Settings{ServerAddress: serverAddress})
+
+	connection, err := net.Dial("tcp", clientAddress.String())
+	require.NoError(t, err)
+	defer connection.Close()
+
+	targetAddress, err := socks.ParseAddress(echoAddress)
+	require.NoError(t, err)
+	_, err = socks.ClientHandshake(connection, socks.CommandConnect, targetAddress, "", "")
+	require.NoError(t, err)
+
+	for _, message := range []string{"hello", "world"} {
+		_, err = connection.Write([]byte(message))
+		require.NoError(t, err)
+		echoed := make([]byte, len(message))
+		_, err = io.ReadFull(connection, echoed)
+		require.NoError(t, err)
+		assert.Equal(t, message, string(echoed))
+	}
+}
+
+func Test_Client_socksUDPAssociateNotSupported(t *testing.T) {
+	t.Parallel()
+
+	serverAddress := startServer(t)
+	clientAddress := startClient(t, Settings{ServerAddress: serverAddress})
+
+	connection, err := net.Dial("tcp", clientAddress.String())
+	require.NoError(t, err)
+	defer connection.Close()
+
+	_, err = socks.ClientHandshake(connection, socks.CommandUDPAssociate,
+		socks.Address{1, 0, 0, 0, 0, 0, 0}, "", "")
+	assert.ErrorIs(t, err, socks.ErrRequestFailed)
+}
+
+func Test_Client_socksUDPAssociate(t *testing.T) {
+	t.Parallel()
+
+	echoAddress := startEchoUDPServer(t)
+	serverAddress := startServer(t)
+	clientAddress, _ := serveClient(t, Settings{ServerAddress: serverAddress}, true)
+
+	connection, err := net.Dial("tcp", clientAddress.String())
+	require.NoError(t, err)
+	defer connection.Close()
+	relayAddress, err := socks.ClientHandshake(connection, socks.CommandUDPAssociate,
+		socks.Address{1, 0, 0, 0, 0, 0, 0}, "", "")
+	require.NoError(t, err)
+
+	udpConnection, err := net.Dial("udp", relayAddress.String())
+	require.NoError(t, err)
+	defer udpConnection.Close()
+
+	targetAddress, err := socks.ParseAddress(echoAddress)
+	require.NoError(t, err)
+	header := append([]byte{0, 0, 0}, targetAddress...)
+	for _, message := range []string{"hello", "world"} {
+		_, err = udpConnection.Write(append(header, message...))
+		require.NoError(t, err)
+
+		err = udpConnection.SetReadDeadline(time.Now().Add(5 * time.Second))
+		require.NoError(t, err)
+		buffer := make([]byte, bufferSize)
+		n, err := udpConnection.Read(buffer)
+		require.NoError(t, err)
+		// the reply starts with the SOCKS5 UDP header
+		// containing the source address of the reply.
+		assert.Equal(t, append(header, message...), buffer[:n])
+	}
+
+	// fragmented packets are dropped
+	_, err = udpConnection.Write(append([]byte{0, 0, 1}, append(targetAddress, "x"...)...))
+	require.NoError(t, err)
+	err = udpConnection.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	require.NoError(t, err)
+	_, err = udpConnection.Read(make([]byte, bufferSize))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+}
+
+// socksUDPEcho sends the message in a SOCKS5 UDP request to the
+// target address through the relay, and returns true if the echo
+// reply is received before a short timeout.
+func socksUDPEcho(t *testing.T, packetConnection net.PacketConn,
+	relayAddress net.Addr, targetAddress socks.Address, message string) (echoed bool) {
+	t.Helper()
+	request := append(append([]byte{0, 0, 0}, targetAddress...), message...)
+	_, err := packetConnection.WriteTo(request, relayAddress)
+	require.NoError(t, err)
+
+	err = packetConnection.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	require.NoError(t, err)
+	buffer := make([]byte, bufferSize)
+	n, _, err := packetConnection.ReadFrom(buffer)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	require.NoError(t, err)
+	assert.Equal(t, request, buffer[:n])
+	return true
+}
+
+func Test_Client_socksUDPAssociateRestricted(t *testing.T) {
+	t.Parallel()
+
+	echoAddress := startEchoUDPServer(t)
+	serverAddress := startServer(t)
+	clientAddress, udpAddress := serveClient(t, Settings{ServerAddress: serverAddress}, true)
+	targetAddress, err := socks.ParseAddress(echoAddress)
+	require.NoError(t, err)
+
+	listenUDP := func(address string) net.PacketConn {
+		packetConnection, err := net.ListenPacket("udp", address)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = packetConnection.Close() })
+		return packetConnection
+	}
+	associated := listenUDP("127.0.0.1:0")
+	otherPort := listenUDP("127.0.0.1:0")
+	otherIP := listenUDP("127.0.0.2:0")
+
+	// no association yet
+	assert.False(t, socksUDPEcho(t, associated, udpAddress, targetAddress, "hello"))
+
+	connection, err := net.Dial("tcp", clientAddress.String())
+	require.NoError(t, err)
+	defer connection.Close()
+	associatedAddress, err := socks.ParseAddress(associated.LocalAddr())
+	require.NoError(t, err)
+	_, err = socks.ClientHandshake(connection, socks.CommandUDPAssociate,
+		associatedAddress, "", "")
+	require.NoError(t, err)
+
+	assert.True(t, socksUDPEcho(t, associated, udpAddress, targetAddress, "hello"))
+	assert.False(t, socksUDPEcho(t, otherPort, udpAddress, targetAddress, "hello"))
+	assert.False(t, socksUDPEcho(t, otherIP, udpAddress, targetAddress, "hello"))
+
+	// the association ends with the TCP connection
+	err = connection.Close()
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return !socksUDPEcho(t, associated, udpAddress, targetAddress, "world")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// startHTTPClient starts the client HTTP proxy on a loopback
+// address, and returns its listening address.
+func startHTTPClient(t *testing.T, settings Settings) (address net.Addr) {
+	t.Helper()
+	settings.CipherName = testCipherName
+	settings.Password = ptrTo(testPassword)
+	client, err := New(settings, noopLogger{})
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.serveHTTP(ctx, listener)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		_ = listener.Close()
+		<-done
+	})
+	return listener.Addr()
+}
+
+func Test_Client_httpConnect(t *testing.T) {
+	t.Parallel()
+
+	echoAddress := startEchoTCPServer(t)
+	serverAddress := startServer(t)
+	proxyAddress := startHTTPClient(t, Settings{ServerAddress: serverAddress})
+
+	connection, err := net.Dial("tcp", proxyAddress.String())
+	require.NoError(t, err)
+	defer connection.Close()
+
+	// the first payload is sent together with the CONNECT request,
+	// to check data buffered while reading the request is relayed.
+	_, err = fmt.Fprintf(connection, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nhello",
+		echoAddress, echoAddress)
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(connection)
+	response, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	echoed := make([]byte, len("hello"))
+	_, err = io.ReadFull(reader, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(echoed))
+
+	_, err = connection.Write([]byte("world"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(reader, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(echoed))
+}
+
+func Test_Client_httpPlain(t *testing.T) {
+	t.Parallel()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s %s proxy-connection=%q",
+			r.Method, r.URL.Path, r.Header.Get("Proxy-Connection"))
+	})
+	httpServer := httptest.NewServer(handler)
+	t.Cleanup(httpServer.Close)
+	serverAddress := startServer(t)
+	proxyAddress := startHTTPClient(t, Settings{ServerAddress: serverAddress})
+
+	proxyURL, err := url.Parse("http://" + proxyAddress.String())
+	require.NoError(t, err)
+	httpClient := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   5 * time.Second,
+	}
+	request, err := http.NewRequest(http.MethodGet, httpServer.URL+"/path", nil)
+	require.NoError(t, err)
+	request.Header.Set("Proxy-Connection", "keep-alive")
+	response, err := httpClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, `GET /path proxy-connection=""`, string(body))
+}
+
+func Test_Client_httpBadRequest(t *testing.T) {
+	t.Parallel()
+
+	serverAddress := startServer(t)
+	proxyAddress := startHTTPClient(t, Settings{ServerAddress: serverAddress})
+
+	connection, err := net.Dial("tcp", proxyAddress.String())
+	require.NoError(t, err)
+	defer connection.Close()
+
+	_, err = io.WriteString(connection, "GET /path HTTP/1.1\r\nHost: a\r\n\r\n")
+	require.NoError(t, err)
+	response, err := http.ReadResponse(bufio.NewReader(connection), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+}
+
+func Test_Client_tunnel(t *testing.T) {
+	t.Parallel()
+
+	echoListener, echoPacketConnection := listenTCPUDP(t)
+	serveTCPEcho(t, echoListener)
+	serveUDPEcho(t, echoPacketConnection)
+	serverAddress := startServer(t)
+	settings := Settings{
+		ServerAddress: serverAddress,
+		TunnelAddress: echoListener.Addr().String(),
+	}
+	tcpAddress, udpAddress := serveClient(t, settings, true)
+
+	connection, err := net.Dial("tcp", tcpAddress.String())
+	require.NoError(t, err)
+	defer connection.Close()
+	_, err = connection.Write([]byte("hello"))
+	require.NoError(t, err)
+	echoed := make([]byte, len("hello"))
+	_, err = io.ReadFull(connection, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(echoed))
+
+	udpConnection, err := net.Dial("udp", udpAddress.String())
+	require.NoError(t, err)
+	defer udpConnection.Close()
+	for _, message := range []string{"hello", "world"} {
+		_, err = udpConnection.Write([]byte(message))
+		require.NoError(t, err)
+		err = udpConnection.SetReadDeadline(time.Now().Add(5 * time.Second))
+		require.NoError(t, err)
+		buffer := make([]byte, bufferSize)
+		n, err := udpConnection.Read(buffer)
+		require.NoError(t, err)
+		// the reply is the raw payload without the source address
+		assert.Equal(t, message, string(buffer[:n]))
+	}
+}
@@ -0,0 +1,3 @@
+package client
+
+const bufferSize = 64 * 1024
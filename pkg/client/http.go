@@ -0,0 +1,155 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/qdm12/ss-server/internal/relay"
+	"github.com/qdm12/ss-server/internal/socks"
+)
+
+func (c *Client) serveHTTP(ctx context.Context, listener net.Listener) {
+	c.logger.Info("listening HTTP proxy on " + listener.Addr().String())
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.logger.Error("cannot accept connection on HTTP proxy listener: " + err.Error())
+			continue
+		}
+		go c.handleHTTPConnectionAsync(ctx, connection)
+	}
+}
+
+func (c *Client) handleHTTPConnectionAsync(ctx context.Context, connection net.Conn) {
+	errs := c.handleHTTPConnection(ctx, connection)
+	for _, err := range errs {
+		c.logger.Error(fmt.Sprintf("HTTP connection from %s: %s", connection.RemoteAddr(), err))
+	}
+}
+
+func (c *Client) handleHTTPConnection(ctx context.Context, connection net.Conn) (errs []error) {
+	defer closeConnection("HTTP connection", connection, &errs)
+
+	reader := bufio.NewReader(connection)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("reading HTTP request: %w", err))
+		return errs
+	}
+
+	targetAddress, err := httpTargetAddress(request)
+	if err != nil {
+		errs = append(errs, err)
+		writeHTTPStatus(connection, http.StatusBadRequest, &errs)
+		return errs
+	}
+
+	shadowedConnection, err := c.dialServer(ctx, targetAddress)
+	if err != nil {
+		errs = append(errs, err)
+		writeHTTPStatus(connection, http.StatusBadGateway, &errs)
+		return errs
+	}
+	defer closeConnection("shadowed TCP connection", shadowedConnection, &errs)
+
+	if c.logAddresses {
+		c.logger.Info("HTTP proxying " + connection.RemoteAddr().String() +
+			" to " + targetAddress.String())
+	}
+
+	if request.Method == http.MethodConnect {
+		_, err = io.WriteString(connection, "HTTP/1.1 200 Connection established\r\n\r\n")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("writing CONNECT response: %w", err))
+			return errs
+		}
+	} else {
+		// The connection to the target is only used for this request,
+		// since following requests on the connection may be for other hosts.
+		removeProxyHeaders(request.Header)
+		request.Close = true
+		err = request.Write(shadowedConnection)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("writing HTTP request: %w", err))
+			return errs
+		}
+	}
+
+	// Data already buffered by the reader must be relayed as well.
+	bufferedConnection := &bufferedConn{Conn: connection, reader: reader}
+	_, _, err = relay.Copy(ctx, bufferedConnection, shadowedConnection, c.timeNow,
+		relay.WriteHooks{}, relay.WriteHooks{})
+	if err != nil {
+		var netErr net.Error
+		if ok := errors.As(err, &netErr); ok && netErr.Timeout() {
+			c.logger.Debug("HTTP relay error: " + err.Error())
+			return errs // ignore i/o timeout
+		}
+		errs = append(errs, fmt.Errorf("HTTP relay error: %w", err))
+	}
+
+	return errs
+}
+
+var ErrURINotAbsolute = errors.New("request URI is not absolute")
+
+// httpTargetAddress returns the target SOCKS address of the CONNECT
+// request or of the plain HTTP request with an absolute URI given.
+func httpTargetAddress(request *http.Request) (targetAddress socks.Address, err error) {
+	var hostPort string
+	switch {
+	case request.Method == http.MethodConnect:
+		hostPort = request.Host
+	case request.URL.IsAbs():
+		hostPort = request.URL.Host
+		if request.URL.Port() == "" {
+			defaultPort := "80"
+			if request.URL.Scheme == "https" {
+				defaultPort = "443"
+			}
+			hostPort = net.JoinHostPort(request.URL.Hostname(), defaultPort)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrURINotAbsolute, request.RequestURI)
+	}
+
+	targetAddress, err = socks.ParseHostPort(hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("parsing target address: %w", err)
+	}
+	return targetAddress, nil
+}
+
+// removeProxyHeaders removes headers only meant for the proxy.
+func removeProxyHeaders(header http.Header) {
+	for _, key := range [...]string{"Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization"} {
+		header.Del(key)
+	}
+}
+
+func writeHTTPStatus(connection net.Conn, status int, errs *[]error) {
+	_, err := fmt.Fprintf(connection, "HTTP/1.1 %d %s\r\nConnection: close\r\n\r\n",
+		status, http.StatusText(status))
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("writing HTTP response: %w", err))
+	}
+}
+
+// bufferedConn is a connection reading from
+// its reader instead of the connection directly.
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (n int, err error) {
+	return b.reader.Read(p)
+}
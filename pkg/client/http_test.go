@@ -0,0 +1,63 @@
+package client
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/qdm12/ss-server/internal/socks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_httpTargetAddress(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		request       string
+		targetAddress socks.Address
+		errWrapped    error
+		errMessage    string
+	}{
+		"CONNECT request": {
+			request:       "CONNECT 1.2.3.4:443 HTTP/1.1\r\nHost: 1.2.3.4:443\r\n\r\n",
+			targetAddress: socks.Address{1, 1, 2, 3, 4, 1, 187},
+		},
+		"absolute URI without port": {
+			request:       "GET http://a/path HTTP/1.1\r\nHost: a\r\n\r\n",
+			targetAddress: socks.Address{3, 1, 'a', 0, 80},
+		},
+		"absolute URI with port": {
+			request:       "GET http://[::1]:8080/ HTTP/1.1\r\nHost: [::1]:8080\r\n\r\n",
+			targetAddress: socks.Address{4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 31, 144},
+		},
+		"relative URI": {
+			request:    "GET /path HTTP/1.1\r\nHost: a\r\n\r\n",
+			errWrapped: ErrURINotAbsolute,
+			errMessage: "request URI is not absolute: /path",
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			request, err := readRequest(testCase.request)
+			require.NoError(t, err)
+
+			targetAddress, err := httpTargetAddress(request)
+
+			assert.ErrorIs(t, err, testCase.errWrapped)
+			if testCase.errWrapped != nil {
+				assert.EqualError(t, err, testCase.errMessage)
+			}
+			assert.Equal(t, testCase.targetAddress, targetAddress)
+		})
+	}
+}
+
+func readRequest(s string) (*http.Request, error) {
+	return http.ReadRequest(bufio.NewReader(strings.NewReader(s)))
+}
@@ -0,0 +1,7 @@
+package client
+
+type Logger interface {
+	Debug(s string)
+	Info(s string)
+	Error(s string)
+}
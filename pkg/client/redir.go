@@ -0,0 +1,208 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/qdm12/ss-server/internal/nat"
+	"github.com/qdm12/ss-server/internal/socks"
+)
+
+const (
+	// RedirRedirect is the redir method for TCP connections redirected
+	// with the iptables REDIRECT target, where the original destination
+	// is obtained with the SO_ORIGINAL_DST socket option.
+	// UDP is not supported with this method.
+	RedirRedirect = "redirect"
+	// RedirTProxy is the redir method for TCP connections and UDP packets
+	// redirected with the iptables TPROXY target, where the original
+	// destination is the local address of the transparent TCP connection,
+	// or obtained with the IP_RECVORIGDSTADDR socket option for UDP.
+	RedirTProxy = "tproxy"
+)
+
+var ErrRedirNotSupported = errors.New("redir mode is only supported on Linux")
+
+// redirTargetAddress returns the SOCKS address of the original
+// destination of the redirected TCP connection given.
+func redirTargetAddress(connection net.Conn, method string) (
+	targetAddress socks.Address, err error) {
+	destination, err := originalDestination(connection, method)
+	if err != nil {
+		return nil, fmt.Errorf("getting original destination: %w", err)
+	}
+	targetAddress, err = socks.ParseAddress(destination)
+	if err != nil {
+		return nil, fmt.Errorf("parsing original destination: %w", err)
+	}
+	return targetAddress, nil
+}
+
+var ErrPacketConnNotUDP = errors.New("packet connection is not UDP")
+
+// serveRedirUDP relays UDP packets redirected with TPROXY to the
+// remote server with their original destination, and replies from
+// the remote server back to the local clients, sent from the source
+// address of each reply.
+func (c *Client) serveRedirUDP(ctx context.Context, packetConnection net.PacketConn) {
+	udpConnection, ok := packetConnection.(*net.UDPConn)
+	if !ok {
+		c.logger.Error(fmt.Sprintf("%s: %T", ErrPacketConnNotUDP, packetConnection))
+		return
+	}
+
+	natMap := nat.New(c.timeNow)
+
+	// The original destination address is prepended in
+	// the buffer to the packet read.
+	const headRoom = 1 + net.IPv6len + 2
+	buffer := make([]byte, headRoom+bufferSize)
+	const oobSize = 1024
+	oob := make([]byte, oobSize)
+
+	c.logger.Info("listening " + c.mode + " UDP on " + packetConnection.LocalAddr().String())
+	for {
+		bytesRead, oobRead, _, clientAddress, err := udpConnection.ReadMsgUDP(buffer[headRoom:], oob)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			err = fmt.Errorf("reading packet: %w", err)
+			if clientAddress != nil {
+				err = fmt.Errorf("connection from %s: %w", clientAddress, err)
+			}
+			c.logger.Error(err.Error())
+			continue
+		}
+
+		err = c.handleRedirUDPPacket(packetConnection, clientAddress,
+			oob[:oobRead], buffer[:headRoom+bytesRead], headRoom, natMap)
+		if err != nil {
+			c.logger.Error(fmt.Sprintf("connection from %s: %s", clientAddress, err))
+		}
+	}
+}
+
+func (c *Client) handleRedirUDPPacket(packetConnection net.PacketConn,
+	clientAddress *net.UDPAddr, oob, buffer []byte, headRoom int,
+	natMap *nat.Map) (err error) {
+	destination, err := parseOriginalDestination(oob)
+	if err != nil {
+		return fmt.Errorf("getting original destination: %w", err)
+	}
+	targetAddress, err := socks.ParseAddress(destination)
+	if err != nil {
+		return fmt.Errorf("parsing original destination: %w", err)
+	}
+	start := headRoom - len(targetAddress)
+	copy(buffer[start:], targetAddress)
+	payload := buffer[start:]
+
+	connection := natMap.Get(clientAddress.String())
+	if connection == nil {
+		if c.logAddresses {
+			c.logger.Info("UDP proxying " + clientAddress.String() +
+				" to " + targetAddress.String())
+		}
+
+		serverConnection, err := c.listenServerUDP()
+		if err != nil {
+			return err
+		}
+		replier := &transparentReplier{
+			PacketConn: packetConnection,
+			sockets:    make(map[string]net.PacketConn),
+		}
+		connection = &redirPacketConn{
+			PacketConn: serverConnection,
+			replier:    replier,
+		}
+		natMap.Set(clientAddress.String(), connection)
+		// Replies from the server are kept with their source
+		// address, for the replier to send them from it.
+		go natMap.Handle(clientAddress, replier, connection, keepSourceAddress)
+	}
+
+	_, err = connection.WriteTo(payload, nil)
+	if err != nil {
+		return fmt.Errorf("writing payload to server: %w", err)
+	}
+
+	return nil
+}
+
+func keepSourceAddress(buffer []byte, n int, _ net.Addr) (packet []byte, err error) {
+	return buffer[nat.HeadRoom : nat.HeadRoom+n], nil
+}
+
+// redirPacketConn is the shadowed packet connection to the server
+// of a local client, closing its transparent replier on close.
+type redirPacketConn struct {
+	net.PacketConn
+	replier *transparentReplier
+}
+
+func (r *redirPacketConn) Close() error {
+	replierErr := r.replier.Close()
+	err := r.PacketConn.Close()
+	if err != nil {
+		return err
+	}
+	return replierErr
+}
+
+// transparentReplier sends replies to a local client from the
+// original source address of each reply, using transparent sockets.
+// Its other methods are the ones of the redir UDP listener.
+type transparentReplier struct {
+	net.PacketConn
+	mutex   sync.Mutex
+	sockets map[string]net.PacketConn
+}
+
+// WriteTo writes the payload of the packet to the client, from the
+// source address found at the start of the packet.
+func (t *transparentReplier) WriteTo(packet []byte, client net.Addr) (n int, err error) {
+	sourceAddress, err := socks.ExtractAddress(packet)
+	if err != nil {
+		return 0, fmt.Errorf("extracting SOCKS source address: %w", err)
+	}
+	payload := packet[len(sourceAddress):]
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	key := sourceAddress.String()
+	socket, ok := t.sockets[key]
+	if !ok {
+		listenConfig := net.ListenConfig{Control: transparentControl}
+		socket, err = listenConfig.ListenPacket(context.Background(), "udp", key)
+		if err != nil {
+			return 0, fmt.Errorf("creating transparent socket for %s: %w", key, err)
+		}
+		t.sockets[key] = socket
+	}
+
+	_, err = socket.WriteTo(payload, client)
+	if err != nil {
+		return 0, err
+	}
+	return len(packet), nil
+}
+
+// Close closes the transparent sockets, but not the redir UDP listener.
+func (t *transparentReplier) Close() (err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for key, socket := range t.sockets {
+		closeErr := socket.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(t.sockets, key)
+	}
+	return err
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// transparentControl sets the IP_TRANSPARENT socket option on the
+// socket, to accept connections and packets redirected with TPROXY and
+// to send packets from non local addresses. It also sets the
+// IP_RECVORIGDSTADDR socket option for UDP sockets.
+func transparentControl(network, _ string, rawConn syscall.RawConn) (err error) {
+	ipv6 := strings.HasSuffix(network, "6")
+	udp := strings.HasPrefix(network, "udp")
+	type option struct {
+		name  string
+		level int
+		opt   int
+	}
+	options := []option{
+		{name: "SO_REUSEADDR", level: unix.SOL_SOCKET, opt: unix.SO_REUSEADDR},
+		{name: "IP_TRANSPARENT", level: unix.SOL_IP, opt: unix.IP_TRANSPARENT},
+	}
+	if ipv6 {
+		options = append(options,
+			option{name: "IPV6_TRANSPARENT", level: unix.SOL_IPV6, opt: unix.IPV6_TRANSPARENT})
+	}
+	if udp {
+		options = append(options,
+			option{name: "IP_RECVORIGDSTADDR", level: unix.SOL_IP, opt: unix.IP_RECVORIGDSTADDR})
+		if ipv6 {
+			options = append(options,
+				option{name: "IPV6_RECVORIGDSTADDR", level: unix.SOL_IPV6, opt: unix.IPV6_RECVORIGDSTADDR})
+		}
+	}
+
+	controlErr := rawConn.Control(func(fd uintptr) {
+		for _, option := range options {
+			err = unix.SetsockoptInt(int(fd), option.level, option.opt, 1)
+			if err != nil {
+				err = fmt.Errorf("setting %s: %w", option.name, err)
+				return
+			}
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+var ErrConnectionNotTCP = errors.New("connection is not TCP")
+
+// originalDestination returns the original destination of the
+// TCP connection redirected with the redir method given.
+func originalDestination(connection net.Conn, method string) (
+	destination net.Addr, err error) {
+	if method == RedirTProxy {
+		// The transparent socket is bound to the original destination.
+		return connection.LocalAddr(), nil
+	}
+
+	tcpConnection, ok := connection.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrConnectionNotTCP, connection)
+	}
+	rawConn, err := tcpConnection.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	localAddress, _ := connection.LocalAddr().(*net.TCPAddr)
+	ipv4 := localAddress == nil || localAddress.IP.To4() != nil
+
+	var tcpDestination *net.TCPAddr
+	controlErr := rawConn.Control(func(fd uintptr) {
+		tcpDestination, err = getOriginalDestination(int(fd), ipv4)
+	})
+	switch {
+	case controlErr != nil:
+		return nil, controlErr
+	case err != nil:
+		return nil, err
+	}
+	return tcpDestination, nil
+}
+
+// getOriginalDestination returns the original destination set by
+// netfilter using the SO_ORIGINAL_DST socket option for IPv4, or the
+// IP6T_SO_ORIGINAL_DST socket option for IPv6, which have the same value.
+func getOriginalDestination(fd int, ipv4 bool) (destination *net.TCPAddr, err error) {
+	level, size, name := unix.SOL_IPV6, uint32(unix.SizeofSockaddrInet6), "IP6T_SO_ORIGINAL_DST"
+	if ipv4 {
+		level, size, name = unix.SOL_IP, unix.SizeofSockaddrInet4, "SO_ORIGINAL_DST"
+	}
+	sockaddr := make([]byte, size)
+	err = getsockopt(fd, level, unix.SO_ORIGINAL_DST, unsafe.Pointer(&sockaddr[0]), &size)
+	if err != nil {
+		return nil, fmt.Errorf("getting %s: %w", name, err)
+	}
+	ip, port, err := parseSockaddr(sockaddr[:size], ipv4)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+var ErrSockaddrTooShort = errors.New("sockaddr is too short")
+
+// parseSockaddr parses the IP address and port of the raw sockaddr_in
+// structure if ipv4 is true, and of the raw sockaddr_in6 otherwise.
+// The IP address returned is a copy of the bytes of the structure.
+func parseSockaddr(sockaddr []byte, ipv4 bool) (ip net.IP, port int, err error) {
+	// skip the address family field
+	const portStart = 2
+	// skip the IPv6 flow information field after the port
+	ipStart, ipLength := portStart+2+4, net.IPv6len
+	if ipv4 {
+		ipStart, ipLength = portStart+2, net.IPv4len
+	}
+	if len(sockaddr) < ipStart+ipLength {
+		return nil, 0, fmt.Errorf("%w: %d bytes instead of at least %d bytes",
+			ErrSockaddrTooShort, len(sockaddr), ipStart+ipLength)
+	}
+	port = int(binary.BigEndian.Uint16(sockaddr[portStart:]))
+	ip = make(net.IP, ipLength)
+	copy(ip, sockaddr[ipStart:])
+	return ip, port, nil
+}
+
+func getsockopt(fd, level, name int, value unsafe.Pointer, size *uint32) error {
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level),
+		uintptr(name), uintptr(value), uintptr(unsafe.Pointer(size)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+var ErrOriginalDestinationNotFound = errors.New("original destination not found")
+
+// parseOriginalDestination parses the original destination from the
+// IP_ORIGDSTADDR or IPV6_ORIGDSTADDR control message of a UDP packet.
+func parseOriginalDestination(oob []byte) (destination *net.UDPAddr, err error) {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("parsing socket control messages: %w", err)
+	}
+
+	for _, message := range messages {
+		header := message.Header
+		var ipv4 bool
+		var name string
+		switch {
+		case header.Level == unix.SOL_IP && header.Type == unix.IP_ORIGDSTADDR:
+			ipv4, name = true, "IP_ORIGDSTADDR"
+		case header.Level == unix.SOL_IPV6 && header.Type == unix.IPV6_ORIGDSTADDR:
+			name = "IPV6_ORIGDSTADDR"
+		default:
+			continue
+		}
+		ip, port, err := parseSockaddr(message.Data, ipv4)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", name, err)
+		}
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	return nil, ErrOriginalDestinationNotFound
+}
@@ -0,0 +1,289 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func sockaddrInet4(ip [4]byte, port uint16) []byte {
+	sockaddr := make([]byte, unix.SizeofSockaddrInet4)
+	*(*uint16)(unsafe.Pointer(&sockaddr[0])) = unix.AF_INET
+	sockaddr[2], sockaddr[3] = byte(port>>8), byte(port) //nolint:gomnd
+	copy(sockaddr[4:], ip[:])
+	return sockaddr
+}
+
+func sockaddrInet6(ip [16]byte, port uint16) []byte {
+	sockaddr := make([]byte, unix.SizeofSockaddrInet6)
+	*(*uint16)(unsafe.Pointer(&sockaddr[0])) = unix.AF_INET6
+	sockaddr[2], sockaddr[3] = byte(port>>8), byte(port) //nolint:gomnd
+	// flow information set to check it is skipped
+	copy(sockaddr[4:8], []byte{0xff, 0xff, 0xff, 0xff})
+	copy(sockaddr[8:], ip[:])
+	return sockaddr
+}
+
+func controlMessage(level, messageType int32, data []byte) []byte {
+	message := make([]byte, unix.CmsgSpace(len(data)))
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&message[0]))
+	header.Level = level
+	header.Type = messageType
+	header.SetLen(unix.CmsgLen(len(data)))
+	copy(message[unix.CmsgLen(0):], data)
+	return message
+}
+
+func Test_parseSockaddr(t *testing.T) {
+	t.Parallel()
+
+	ipv6 := [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}
+
+	testCases := map[string]struct {
+		sockaddr   []byte
+		ipv4       bool
+		ip         net.IP
+		port       int
+		errWrapped error
+		errMessage string
+	}{
+		"ipv4": {
+			sockaddr: sockaddrInet4([4]byte{10, 0, 0, 1}, 8388),
+			ipv4:     true,
+			ip:       net.IP{10, 0, 0, 1},
+			port:     8388,
+		},
+		"ipv6": {
+			sockaddr: sockaddrInet6(ipv6, 443),
+			ip:       net.IP(ipv6[:]),
+			port:     443,
+		},
+		"ipv4_truncated": {
+			sockaddr:   sockaddrInet4([4]byte{10, 0, 0, 1}, 8388)[:7],
+			ipv4:       true,
+			errWrapped: ErrSockaddrTooShort,
+			errMessage: "sockaddr is too short: 7 bytes instead of at least 8 bytes",
+		},
+		"ipv6_truncated": {
+			sockaddr:   sockaddrInet6(ipv6, 443)[:23],
+			errWrapped: ErrSockaddrTooShort,
+			errMessage: "sockaddr is too short: 23 bytes instead of at least 24 bytes",
+		},
+		"empty": {
+			ipv4:       true,
+			errWrapped: ErrSockaddrTooShort,
+			errMessage: "sockaddr is too short: 0 bytes instead of at least 8 bytes",
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			ip, port, err := parseSockaddr(testCase.sockaddr, testCase.ipv4)
+
+			assert.ErrorIs(t, err, testCase.errWrapped)
+			if testCase.errWrapped != nil {
+				assert.EqualError(t, err, testCase.errMessage)
+			}
+			assert.Equal(t, testCase.ip, ip)
+			assert.Equal(t, testCase.port, port)
+		})
+	}
+}
+
+func Test_parseOriginalDestination(t *testing.T) {
+	t.Parallel()
+
+	ipv4Message := controlMessage(unix.SOL_IP, unix.IP_ORIGDSTADDR,
+		sockaddrInet4([4]byte{1, 2, 3, 4}, 53))
+	ipv6 := [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 2}
+	ipv6Message := controlMessage(unix.SOL_IPV6, unix.IPV6_ORIGDSTADDR,
+		sockaddrInet6(ipv6, 853))
+	otherMessage := controlMessage(unix.SOL_IP, unix.IP_TTL, []byte{64, 0, 0, 0})
+
+	testCases := map[string]struct {
+		oob         []byte
+		destination *net.UDPAddr
+		errWrapped  error
+		errMessage  string
+	}{
+		"ipv4": {
+			oob:         ipv4Message,
+			destination: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 53},
+		},
+		"ipv6": {
+			oob:         ipv6Message,
+			destination: &net.UDPAddr{IP: net.IP(ipv6[:]), Port: 853},
+		},
+		"after_other_message": {
+			oob:         append(append([]byte{}, otherMessage...), ipv4Message...),
+			destination: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 53},
+		},
+		"no_message": {
+			errWrapped: ErrOriginalDestinationNotFound,
+			errMessage: "original destination not found",
+		},
+		"other_message_only": {
+			oob:        otherMessage,
+			errWrapped: ErrOriginalDestinationNotFound,
+			errMessage: "original destination not found",
+		},
+		"ipv4_sockaddr_truncated": {
+			oob: controlMessage(unix.SOL_IP, unix.IP_ORIGDSTADDR,
+				sockaddrInet4([4]byte{1, 2, 3, 4}, 53)[:6]),
+			errWrapped: ErrSockaddrTooShort,
+			errMessage: "parsing IP_ORIGDSTADDR: sockaddr is too short: 6 bytes instead of at least 8 bytes",
+		},
+		"ipv6_sockaddr_truncated": {
+			oob: controlMessage(unix.SOL_IPV6, unix.IPV6_ORIGDSTADDR,
+				sockaddrInet6(ipv6, 853)[:12]),
+			errWrapped: ErrSockaddrTooShort,
+			errMessage: "parsing IPV6_ORIGDSTADDR: sockaddr is too short: 12 bytes instead of at least 24 bytes",
+		},
+		"header_truncated": {
+			// trailing bytes shorter than a header are ignored
+			oob:        ipv4Message[:unix.SizeofCmsghdr-1],
+			errWrapped: ErrOriginalDestinationNotFound,
+			errMessage: "original destination not found",
+		},
+		"data_truncated": {
+			oob:        ipv6Message[:unix.CmsgLen(0)+4],
+			errWrapped: unix.EINVAL,
+			errMessage: "parsing socket control messages: invalid argument",
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			destination, err := parseOriginalDestination(testCase.oob)
+
+			assert.ErrorIs(t, err, testCase.errWrapped)
+			if testCase.errWrapped != nil {
+				assert.EqualError(t, err, testCase.errMessage)
+			}
+			assert.Equal(t, testCase.destination, destination)
+		})
+	}
+}
+
+// netnsEnv is set for the test process re-run in its own network namespace.
+const netnsEnv = "SS_SERVER_TEST_NETNS"
+
+// runInNetns re-runs the calling test in a new network namespace, since
+// it changes firewall rules, and returns true if the caller is that
+// re-run. The test is skipped if the programs given are not found or
+// if it lacks the privileges to create a network namespace.
+func runInNetns(t *testing.T, programs ...string) (inNetns bool) {
+	t.Helper()
+	if os.Getenv(netnsEnv) != "" {
+		return true
+	}
+
+	for _, program := range programs {
+		if _, err := exec.LookPath(program); err != nil {
+			t.Skipf("%s is required: %s", program, err)
+		}
+	}
+
+	command := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v") //nolint:gosec
+	command.Env = append(os.Environ(), netnsEnv+"=1")
+	command.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	output, err := command.CombinedOutput()
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("creating a network namespace requires CAP_SYS_ADMIN")
+	}
+	require.NoError(t, err, string(output))
+	if strings.Contains(string(output), "--- SKIP") {
+		t.Skip(string(output))
+	}
+	return false
+}
+
+func runCommand(t *testing.T, name string, args ...string) {
+	t.Helper()
+	output, err := exec.Command(name, args...).CombinedOutput()
+	require.NoError(t, err, string(output))
+}
+
+func Test_Client_redirRedirect(t *testing.T) {
+	t.Parallel()
+
+	if !runInNetns(t, "ip", "iptables") {
+		return
+	}
+	runCommand(t, "ip", "link", "set", "lo", "up")
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = echoListener.Close() })
+	echoRemoteAddresses := make(chan net.Addr, 1)
+	go func() {
+		for {
+			connection, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			echoRemoteAddresses <- connection.RemoteAddr()
+			go func() {
+				defer connection.Close()
+				_, _ = io.Copy(connection, connection)
+			}()
+		}
+	}()
+	echoAddress := echoListener.Addr().(*net.TCPAddr) //nolint:forcetypeassert
+
+	serverAddress := startServer(t)
+	clientAddress, _ := serveClient(t, Settings{
+		ServerAddress: serverAddress,
+		Redir:         RedirRedirect,
+	}, false)
+	clientPort := clientAddress.(*net.TCPAddr).Port //nolint:forcetypeassert
+
+	// Only connections from 127.0.0.2 are redirected, so the
+	// server can still connect to the echo server from 127.0.0.1.
+	runCommand(t, "iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp",
+		"-s", "127.0.0.2", "-d", echoAddress.IP.String(),
+		"--dport", strconv.Itoa(echoAddress.Port),
+		"-j", "REDIRECT", "--to-ports", strconv.Itoa(clientPort))
+
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)},
+		Timeout:   5 * time.Second,
+	}
+	connection, err := dialer.Dial("tcp", echoAddress.String())
+	require.NoError(t, err)
+	defer connection.Close()
+	err = connection.SetDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, err)
+
+	for _, message := range []string{"hello", "world"} {
+		_, err = connection.Write([]byte(message))
+		require.NoError(t, err)
+		echoed := make([]byte, len(message))
+		_, err = io.ReadFull(connection, echoed)
+		require.NoError(t, err)
+		assert.Equal(t, message, string(echoed))
+	}
+
+	// The echo server is reached through the
+	// server and not directly from 127.0.0.2.
+	remoteAddress := (<-echoRemoteAddresses).(*net.TCPAddr) //nolint:forcetypeassert
+	assert.Equal(t, "127.0.0.1", remoteAddress.IP.String())
+}
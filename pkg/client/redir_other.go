@@ -0,0 +1,20 @@
+//go:build !linux
+
+package client
+
+import (
+	"net"
+	"syscall"
+)
+
+func transparentControl(string, string, syscall.RawConn) error {
+	return ErrRedirNotSupported
+}
+
+func originalDestination(net.Conn, string) (net.Addr, error) {
+	return nil, ErrRedirNotSupported
+}
+
+func parseOriginalDestination([]byte) (*net.UDPAddr, error) {
+	return nil, ErrRedirNotSupported
+}
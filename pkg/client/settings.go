@@ -0,0 +1,172 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+
+	"github.com/qdm12/gosettings"
+	"github.com/qdm12/gosettings/validate"
+	"github.com/qdm12/ss-server/internal/core"
+)
+
+type Settings struct {
+	// Address is the listening address of the local SOCKS5 server.
+	// It defaults to "127.0.0.1:1080".
+	// It cannot be nil in the internal state.
+	Address *string
+	// HTTPAddress is the listening address of the local HTTP proxy
+	// server, handling CONNECT tunnels and plain HTTP requests with
+	// an absolute URI. It defaults to the empty string to disable
+	// the HTTP proxy server.
+	HTTPAddress string
+	// TunnelAddress is the fixed target address, in the form host:port,
+	// to forward all TCP connections and UDP packets received on Address
+	// to through the remote server, instead of running a SOCKS5 server.
+	// It cannot be set together with HTTPAddress. It defaults to the
+	// empty string to disable the tunnel mode.
+	TunnelAddress string
+	// Redir is the redirection method, and can be "redirect" or "tproxy"
+	// to forward TCP connections, and UDP packets for "tproxy", redirected
+	// by the firewall to their original destination through the remote
+	// server, instead of running a SOCKS5 server. It is only supported
+	// on Linux, and "tproxy" requires the CAP_NET_ADMIN capability.
+	// It cannot be set together with TunnelAddress or HTTPAddress.
+	// It defaults to the empty string to disable the redir mode.
+	Redir string
+	// ServerAddress is the address of the remote Shadowsocks
+	// server, in the form host:port.
+	// It must be set.
+	ServerAddress string
+	// LogAddresses can be set to true to log
+	// addresses proxied though the client.
+	// It defaults to false.
+	// It cannot be nil in the internal state.
+	LogAddresses *bool
+	// CipherName is the cipher to use to communicate with the
+	// remote server. Shadowsocks 2022 ciphers are not supported.
+	// It defaults to "chacha20-ietf-poly1305".
+	// It cannot be empty in the internal state.
+	CipherName string
+	// Password to communicate with the remote server.
+	// It defaults to the empty string.
+	// It cannot be nil in the internal state.
+	Password *string
+	// Key is the base64 encoded key of the cipher key size, used
+	// directly instead of deriving the key from Password.
+	// It defaults to the empty string, meaning the key is derived
+	// from Password.
+	// It cannot be nil in the internal state.
+	Key *string
+}
+
+// SetDefaults sets default values for all unset field
+// in the settings.
+func (s *Settings) SetDefaults() {
+	s.Address = gosettings.DefaultPointer(s.Address, "127.0.0.1:1080")
+	s.LogAddresses = gosettings.DefaultPointer(s.LogAddresses, false)
+	s.CipherName = gosettings.DefaultComparable(s.CipherName, core.Chacha20IetfPoly1305)
+	s.Password = gosettings.DefaultPointer(s.Password, "")
+	s.Key = gosettings.DefaultPointer(s.Key, "")
+}
+
+// Copy returns a deep copy of the settings.
+func (s Settings) Copy() (copied Settings) {
+	copied.Address = gosettings.CopyPointer(s.Address)
+	copied.HTTPAddress = s.HTTPAddress
+	copied.TunnelAddress = s.TunnelAddress
+	copied.Redir = s.Redir
+	copied.ServerAddress = s.ServerAddress
+	copied.LogAddresses = gosettings.CopyPointer(s.LogAddresses)
+	copied.CipherName = s.CipherName
+	copied.Password = gosettings.CopyPointer(s.Password)
+	copied.Key = gosettings.CopyPointer(s.Key)
+	return copied
+}
+
+// OverrideWith sets any field of the receiving settings
+// with the field value of any set field from the other settings.
+func (s *Settings) OverrideWith(other Settings) {
+	s.Address = gosettings.OverrideWithPointer(s.Address, other.Address)
+	s.HTTPAddress = gosettings.OverrideWithComparable(s.HTTPAddress, other.HTTPAddress)
+	s.TunnelAddress = gosettings.OverrideWithComparable(s.TunnelAddress, other.TunnelAddress)
+	s.Redir = gosettings.OverrideWithComparable(s.Redir, other.Redir)
+	s.ServerAddress = gosettings.OverrideWithComparable(s.ServerAddress, other.ServerAddress)
+	s.LogAddresses = gosettings.OverrideWithPointer(s.LogAddresses, other.LogAddresses)
+	s.CipherName = gosettings.OverrideWithComparable(s.CipherName, other.CipherName)
+	s.Password = gosettings.OverrideWithPointer(s.Password, other.Password)
+	s.Key = gosettings.OverrideWithPointer(s.Key, other.Key)
+}
+
+var (
+	ErrTunnelWithHTTP       = errors.New("tunnel mode cannot be used with the HTTP proxy")
+	ErrRedirWithTunnel      = errors.New("redir mode cannot be used with the tunnel mode")
+	ErrRedirWithHTTP        = errors.New("redir mode cannot be used with the HTTP proxy")
+	ErrServerAddressMissing = errors.New("server address is missing")
+)
+
+func (s *Settings) Validate() (err error) {
+	err = validate.ListeningAddress(*s.Address, os.Getuid())
+	if err != nil {
+		return fmt.Errorf("listening address: %w", err)
+	}
+
+	if s.HTTPAddress != "" {
+		err = validate.ListeningAddress(s.HTTPAddress, os.Getuid())
+		if err != nil {
+			return fmt.Errorf("HTTP listening address: %w", err)
+		}
+	}
+
+	if s.TunnelAddress != "" {
+		if s.HTTPAddress != "" {
+			return ErrTunnelWithHTTP
+		}
+		_, _, err = net.SplitHostPort(s.TunnelAddress)
+		if err != nil {
+			return fmt.Errorf("tunnel address: %w", err)
+		}
+	}
+
+	if s.Redir != "" {
+		err = validate.IsOneOf(s.Redir, RedirRedirect, RedirTProxy)
+		if err != nil {
+			return fmt.Errorf("redir: %w", err)
+		}
+		switch {
+		case runtime.GOOS != "linux":
+			return ErrRedirNotSupported
+		case s.TunnelAddress != "":
+			return ErrRedirWithTunnel
+		case s.HTTPAddress != "":
+			return ErrRedirWithHTTP
+		}
+	}
+
+	if s.ServerAddress == "" {
+		return ErrServerAddressMissing
+	}
+	_, _, err = net.SplitHostPort(s.ServerAddress)
+	if err != nil {
+		return fmt.Errorf("server address: %w", err)
+	}
+
+	// Shadowsocks 2022 ciphers are only implemented server side.
+	err = validate.IsOneOf(s.CipherName,
+		core.AES128gcm, core.AES192gcm, core.AES256gcm,
+		core.Chacha20IetfPoly1305, core.XChacha20IetfPoly1305)
+	if err != nil {
+		return fmt.Errorf("cipher: %w", err)
+	}
+
+	if s.Key != nil && *s.Key != "" {
+		err = core.CheckPreSharedKey(*s.Key, s.CipherName)
+		if err != nil {
+			return fmt.Errorf("key: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,283 @@
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qdm12/gosettings/validate"
+	"github.com/qdm12/ss-server/internal/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ptrTo[T any](x T) *T { return &x }
+
+func Test_Settings_SetDefaults(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		initial  Settings
+		expected Settings
+	}{
+		"empty settings": {
+			expected: Settings{
+				Address:      ptrTo("127.0.0.1:1080"),
+				LogAddresses: ptrTo(false),
+				CipherName:   core.Chacha20IetfPoly1305,
+				Password:     ptrTo(""),
+				Key:          ptrTo(""),
+			},
+		},
+		"already set settings": {
+			initial: Settings{
+				Address:       ptrTo(":0"),
+				ServerAddress: "1.2.3.4:8388",
+				LogAddresses:  ptrTo(true),
+				CipherName:    core.AES128gcm,
+				Password:      ptrTo("password"),
+				Key:           ptrTo(""),
+			},
+			expected: Settings{
+				Address:       ptrTo(":0"),
+				ServerAddress: "1.2.3.4:8388",
+				LogAddresses:  ptrTo(true),
+				CipherName:    core.AES128gcm,
+				Password:      ptrTo("password"),
+				Key:           ptrTo(""),
+			},
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			settings := testCase.initial
+
+			settings.SetDefaults()
+
+			assert.Equal(t, testCase.expected, settings)
+		})
+	}
+}
+
+func Test_Settings_Copy(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		original Settings
+		copied   Settings
+	}{
+		"empty settings": {},
+		"non empty settings": {
+			original: Settings{
+				Address:       ptrTo(":0"),
+				ServerAddress: "1.2.3.4:8388",
+				LogAddresses:  ptrTo(true),
+				CipherName:    core.AES128gcm,
+				Password:      ptrTo("password"),
+			},
+			copied: Settings{
+				Address:       ptrTo(":0"),
+				ServerAddress: "1.2.3.4:8388",
+				LogAddresses:  ptrTo(true),
+				CipherName:    core.AES128gcm,
+				Password:      ptrTo("password"),
+			},
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			settings := testCase.original
+
+			copied := settings.Copy()
+
+			assert.Equal(t, testCase.copied, copied)
+
+			// Check pointers are deep copied
+			if copied.Address != nil {
+				*copied.Address += "x"
+				assert.NotEqual(t, copied.Address, settings.Address)
+			}
+			if copied.Password != nil {
+				*copied.Password += "x"
+				assert.NotEqual(t, copied.Password, settings.Password)
+			}
+		})
+	}
+}
+
+func Test_Settings_OverrideWith(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		original  Settings
+		other     Settings
+		overidden Settings
+	}{
+		"empty settings with empty other": {},
+		"settings with other": {
+			original: Settings{
+				Address:       ptrTo(":0"),
+				ServerAddress: "1.2.3.4:8388",
+				CipherName:    core.AES128gcm,
+				Password:      ptrTo("password"),
+			},
+			other: Settings{
+				Address:       ptrTo(":1"),
+				ServerAddress: "5.6.7.8:8388",
+				CipherName:    core.AES256gcm,
+			},
+			overidden: Settings{
+				Address:       ptrTo(":1"),
+				ServerAddress: "5.6.7.8:8388",
+				CipherName:    core.AES256gcm,
+				Password:      ptrTo("password"),
+			},
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			settings := testCase.original
+
+			settings.OverrideWith(testCase.other)
+
+			assert.Equal(t, testCase.overidden, settings)
+		})
+	}
+}
+
+func Test_Settings_Validate(t *testing.T) {
+	t.Parallel()
+
+	errNothingWrapped := errors.New("")
+
+	testCases := map[string]struct {
+		settings   Settings
+		errWrapped error
+		errMessage string
+	}{
+		"invalid address": {
+			settings: Settings{
+				Address: ptrTo("x"),
+			},
+			errWrapped: errNothingWrapped,
+			errMessage: "listening address: splitting host and port: " +
+				"address x: missing port in address",
+		},
+		"invalid HTTP address": {
+			settings: Settings{
+				Address:     ptrTo(":0"),
+				HTTPAddress: "x",
+			},
+			errWrapped: errNothingWrapped,
+			errMessage: "HTTP listening address: splitting host and port: " +
+				"address x: missing port in address",
+		},
+		"tunnel with HTTP": {
+			settings: Settings{
+				Address:       ptrTo(":0"),
+				HTTPAddress:   ":0",
+				TunnelAddress: "1.1.1.1:53",
+			},
+			errWrapped: ErrTunnelWithHTTP,
+			errMessage: "tunnel mode cannot be used with the HTTP proxy",
+		},
+		"invalid tunnel address": {
+			settings: Settings{
+				Address:       ptrTo(":0"),
+				TunnelAddress: "1.1.1.1",
+			},
+			errWrapped: errNothingWrapped,
+			errMessage: "tunnel address: address 1.1.1.1: missing port in address",
+		},
+		"invalid redir": {
+			settings: Settings{
+				Address: ptrTo(":0"),
+				Redir:   "garbage",
+			},
+			errWrapped: validate.ErrValueNotOneOf,
+			errMessage: "redir: value is not one of the possible choices: " +
+				"garbage must be one of redirect or tproxy",
+		},
+		"server address missing": {
+			settings: Settings{
+				Address: ptrTo(":0"),
+			},
+			errWrapped: ErrServerAddressMissing,
+			errMessage: "server address is missing",
+		},
+		"invalid server address": {
+			settings: Settings{
+				Address:       ptrTo(":0"),
+				ServerAddress: "1.2.3.4",
+			},
+			errWrapped: errNothingWrapped,
+			errMessage: "server address: address 1.2.3.4: missing port in address",
+		},
+		"2022 cipher not supported": {
+			settings: Settings{
+				Address:       ptrTo(":0"),
+				ServerAddress: "1.2.3.4:8388",
+				CipherName:    core.Blake3AES128gcm,
+			},
+			errWrapped: validate.ErrValueNotOneOf,
+			errMessage: "cipher: value is not one of the possible choices: " +
+				"2022-blake3-aes-128-gcm must be one of aes-128-gcm, aes-192-gcm, aes-256-gcm, " +
+				"chacha20-ietf-poly1305 or xchacha20-ietf-poly1305",
+		},
+		"invalid key": {
+			settings: Settings{
+				Address:       ptrTo(":0"),
+				ServerAddress: "1.2.3.4:8388",
+				CipherName:    core.AES128gcm,
+				Key:           ptrTo("AAAA"),
+			},
+			errWrapped: core.ErrPreSharedKeyBadSize,
+			errMessage: "key: pre-shared key has a bad size: 3 bytes instead of 16 bytes",
+		},
+		"valid tunnel settings": {
+			settings: Settings{
+				Address:       ptrTo(":0"),
+				TunnelAddress: "1.1.1.1:53",
+				ServerAddress: "example.com:8388",
+				CipherName:    core.AES128gcm,
+			},
+		},
+		"valid settings": {
+			settings: Settings{
+				Address:       ptrTo(":0"),
+				HTTPAddress:   ":0",
+				ServerAddress: "example.com:8388",
+				CipherName:    core.AES128gcm,
+			},
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			settings := testCase.settings
+
+			err := settings.Validate()
+
+			if !errors.Is(testCase.errWrapped, errNothingWrapped) {
+				require.ErrorIs(t, err, testCase.errWrapped)
+			}
+			if testCase.errWrapped != nil {
+				require.EqualError(t, err, testCase.errMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/qdm12/ss-server/internal/relay"
+	"github.com/qdm12/ss-server/internal/socks"
+)
+
+func (c *Client) serveTCP(ctx context.Context, listener net.Listener,
+	udpAddress net.Addr) (err error) {
+	c.logger.Info("listening " + c.mode + " on " + listener.Addr().String())
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			c.logger.Error("cannot accept connection on " + c.mode + " listener: " + err.Error())
+			continue
+		}
+		go c.handleConnectionAsync(ctx, connection, udpAddress)
+	}
+}
+
+func (c *Client) handleConnectionAsync(ctx context.Context, connection net.Conn,
+	udpAddress net.Addr) {
+	errs := c.handleConnection(ctx, connection, udpAddress)
+	for _, err := range errs {
+		c.logger.Error(fmt.Sprintf("connection from %s: %s", connection.RemoteAddr(), err))
+	}
+}
+
+func (c *Client) handleConnection(ctx context.Context, connection net.Conn,
+	udpAddress net.Addr) (errs []error) {
+	defer closeConnection(c.mode+" connection", connection, &errs)
+
+	targetAddress := c.tunnelAddress
+	switch {
+	case targetAddress != nil:
+	case c.redir != "":
+		var err error
+		targetAddress, err = redirTargetAddress(connection, c.redir)
+		if err != nil {
+			errs = append(errs, err)
+			return errs
+		}
+	default:
+		var err error
+		targetAddress, err = c.socksHandshake(connection, udpAddress)
+		if err != nil {
+			errs = append(errs, err)
+			return errs
+		} else if targetAddress == nil { // UDP association ended
+			return errs
+		}
+	}
+
+	shadowedConnection, err := c.dialServer(ctx, targetAddress)
+	if err != nil {
+		errs = append(errs, err)
+		return errs
+	}
+	defer closeConnection("shadowed TCP connection", shadowedConnection, &errs)
+
+	if c.logAddresses {
+		c.logger.Info("TCP proxying " + connection.RemoteAddr().String() +
+			" to " + targetAddress.String())
+	}
+
+	_, _, err = relay.Copy(ctx, connection, shadowedConnection, c.timeNow,
+		relay.WriteHooks{}, relay.WriteHooks{})
+	if err != nil {
+		var netErr net.Error
+		if ok := errors.As(err, &netErr); ok && netErr.Timeout() {
+			c.logger.Debug("TCP relay error: " + err.Error())
+			return errs // ignore i/o timeout
+		}
+		errs = append(errs, fmt.Errorf("TCP relay error: %w", err))
+	}
+
+	return errs
+}
+
+// socksHandshake performs the SOCKS5 handshake on the connection
+// and returns the target address to connect to. For UDP associations,
+// it blocks until the connection is closed and returns a nil address,
+// and the UDP relay only relays packets of the client meanwhile.
+// UDP associations are refused if the UDP address is nil.
+func (c *Client) socksHandshake(connection net.Conn, udpAddress net.Addr) (
+	targetAddress socks.Address, err error) {
+	var udpRelayAddress socks.Address
+	if udpAddress != nil {
+		udpRelayAddress, err = relayAddress(connection.LocalAddr(), udpAddress)
+		if err != nil {
+			return nil, fmt.Errorf("UDP relay address: %w", err)
+		}
+	}
+
+	command, targetAddress, err := socks.Handshake(connection, udpRelayAddress)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS5 handshake: %w", err)
+	}
+
+	if command != socks.CommandUDPAssociate {
+		return targetAddress, nil
+	}
+
+	association, err := c.associate(connection.RemoteAddr(), targetAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer c.associations.remove(association)
+
+	if c.logAddresses {
+		c.logger.Info("UDP association from " + connection.RemoteAddr().String())
+	}
+	// The UDP association lasts as long as the TCP connection.
+	_, err = io.Copy(io.Discard, connection)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for UDP association end: %w", err)
+	}
+	return nil, nil //nolint:nilnil
+}
+
+var ErrClientAddressNotTCP = errors.New("client address is not a TCP address")
+
+// associate adds a UDP association for the IP address of the TCP
+// connection of the client, and for the UDP port the client gave in
+// its request, which is zero if the client does not know it yet.
+func (c *Client) associate(tcpClientAddress net.Addr, requestAddress socks.Address) (
+	association *udpAssociation, err error) {
+	tcpAddress, ok := tcpClientAddress.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrClientAddressNotTCP, tcpClientAddress)
+	}
+	var clientPort int
+	if udpAddress, ok := requestAddress.UDPAddr().(*net.UDPAddr); ok {
+		clientPort = udpAddress.Port
+	}
+	return c.associations.add(tcpAddress.IP, clientPort), nil
+}
+
+// relayAddress returns the SOCKS address of the UDP relay to send to
+// the client, using the local IP address of the TCP connection if the
+// UDP relay listens on all interfaces.
+func relayAddress(tcpLocalAddress, udpAddress net.Addr) (socks.Address, error) {
+	tcpAddress, tcpOK := tcpLocalAddress.(*net.TCPAddr)
+	udpRelayAddress, udpOK := udpAddress.(*net.UDPAddr)
+	if tcpOK && udpOK && udpRelayAddress.IP.IsUnspecified() {
+		udpAddress = &net.UDPAddr{IP: tcpAddress.IP, Port: udpRelayAddress.Port}
+	}
+	return socks.ParseAddress(udpAddress)
+}
+
+// dialServer connects to the remote server and sends it the target
+// address, returning the shadowed connection to the server.
+func (c *Client) dialServer(ctx context.Context, targetAddress socks.Address) (
+	shadowedConnection net.Conn, err error) {
+	dialer := net.Dialer{}
+	serverConnection, err := dialer.DialContext(ctx, "tcp", c.serverAddress)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to server: %w", err)
+	}
+	// Note closing the shadowed TCP connection closes the original
+	// TCP connection to the server.
+	shadowedConnection = c.shadower.Shadow(serverConnection)
+
+	_, err = shadowedConnection.Write(targetAddress)
+	if err != nil {
+		_ = shadowedConnection.Close()
+		return nil, fmt.Errorf("writing target address: %w", err)
+	}
+	return shadowedConnection, nil
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/qdm12/ss-server/internal/nat"
+	"github.com/qdm12/ss-server/internal/socks"
+)
+
+// serveUDP relays SOCKS5 UDP packets, or raw packets in tunnel mode,
+// from local clients to the remote server, and replies from the remote
+// server back to the local clients.
+func (c *Client) serveUDP(ctx context.Context, packetConnection net.PacketConn) {
+	natMap := nat.New(c.timeNow)
+
+	// In tunnel mode, the tunnel address is prepended in the buffer
+	// to the packet read.
+	headRoom := len(c.tunnelAddress)
+	buffer := make([]byte, headRoom+bufferSize)
+
+	c.logger.Info("listening " + c.mode + " UDP on " + packetConnection.LocalAddr().String())
+	for {
+		bytesRead, clientAddress, err := packetConnection.ReadFrom(buffer[headRoom:])
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			err = fmt.Errorf("reading packet: %w", err)
+			if clientAddress != nil {
+				err = fmt.Errorf("connection from %s: %w", clientAddress, err)
+			}
+			c.logger.Error(err.Error())
+			continue
+		}
+
+		err = c.handleUDPPacket(packetConnection, clientAddress,
+			buffer[:headRoom+bytesRead], natMap)
+		if err != nil {
+			c.logger.Error(fmt.Sprintf("connection from %s: %s", clientAddress, err))
+		}
+	}
+}
+
+var (
+	ErrPacketTooShort            = errors.New("packet is too short")
+	ErrFragmentationNotSupported = errors.New("SOCKS5 UDP fragmentation is not supported")
+	ErrNoUDPAssociation          = errors.New("no UDP association for client address")
+)
+
+// socksUDPHeaderSize is the size of the RSV and FRAG fields
+// of the SOCKS5 UDP request header.
+const socksUDPHeaderSize = 3
+
+func (c *Client) handleUDPPacket(packetConnection net.PacketConn,
+	clientAddress net.Addr, packet []byte, natMap *nat.Map) (err error) {
+	// In SOCKS5 mode, only the clients of active UDP associations
+	// can send packets through the relay.
+	socksMode := c.tunnelAddress == nil
+	if socksMode && !c.associations.allowed(clientAddress) {
+		return ErrNoUDPAssociation
+	}
+
+	payload, err := c.udpPayload(packet)
+	if err != nil {
+		return err
+	}
+
+	targetAddress, err := socks.ExtractAddress(payload)
+	if err != nil {
+		return fmt.Errorf("extracting SOCKS target address: %w", err)
+	}
+
+	connection := natMap.Get(clientAddress.String())
+	if connection == nil {
+		if c.logAddresses {
+			c.logger.Info("UDP proxying " + clientAddress.String() +
+				" to " + targetAddress.String())
+		}
+
+		connection, err = c.listenServerUDP()
+		if err != nil {
+			return err
+		}
+		if socksMode && !c.associations.attach(clientAddress, connection) {
+			// the association ended since the check above
+			_ = connection.Close()
+			return ErrNoUDPAssociation
+		}
+		natMap.Set(clientAddress.String(), connection)
+		translate := addSOCKSUDPHeader
+		if c.tunnelAddress != nil {
+			translate = removeSourceAddress
+		}
+		go natMap.Handle(clientAddress, packetConnection, connection, translate)
+	}
+
+	_, err = connection.WriteTo(payload, nil)
+	if err != nil {
+		return fmt.Errorf("writing payload to server: %w", err)
+	}
+
+	return nil
+}
+
+// listenServerUDP returns a shadowed packet connection
+// sending to and receiving from the remote server only.
+func (c *Client) listenServerUDP() (connection net.PacketConn, err error) {
+	serverAddress, err := net.ResolveUDPAddr("udp", c.serverAddress)
+	if err != nil {
+		return nil, fmt.Errorf("resolving server address: %w", err)
+	}
+
+	serverConnection, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, fmt.Errorf("creating packet listener: %w", err)
+	}
+	return c.packetShadower.Shadow(&serverPacketConn{
+		PacketConn:    serverConnection,
+		serverAddress: serverAddress,
+	}), nil
+}
+
+// udpPayload returns the Shadowsocks UDP payload starting with the target
+// address from the packet given. In tunnel mode, the packet has head room
+// for the tunnel address. Otherwise, it is a SOCKS5 UDP request.
+func (c *Client) udpPayload(packet []byte) (payload []byte, err error) {
+	if c.tunnelAddress != nil {
+		copy(packet, c.tunnelAddress)
+		return packet, nil
+	}
+
+	if len(packet) < socksUDPHeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrPacketTooShort, len(packet))
+	}
+	if fragment := packet[2]; fragment != 0 {
+		return nil, fmt.Errorf("%w: fragment %d", ErrFragmentationNotSupported, fragment)
+	}
+	// The Shadowsocks UDP payload is the SOCKS5 UDP
+	// request without its RSV and FRAG fields.
+	return packet[socksUDPHeaderSize:], nil
+}
+
+// removeSourceAddress removes the source address from the packet
+// decrypted from the server, for the tunnel mode.
+func removeSourceAddress(buffer []byte, n int, _ net.Addr) (packet []byte, err error) {
+	packet = buffer[nat.HeadRoom : nat.HeadRoom+n]
+	sourceAddress, err := socks.ExtractAddress(packet)
+	if err != nil {
+		return nil, fmt.Errorf("extracting SOCKS source address: %w", err)
+	}
+	return packet[len(sourceAddress):], nil
+}
+
+// addSOCKSUDPHeader prepends the RSV and FRAG fields of the
+// SOCKS5 UDP header to the packet decrypted from the server,
+// which already starts with the source address.
+func addSOCKSUDPHeader(buffer []byte, n int, _ net.Addr) (packet []byte, err error) {
+	start := nat.HeadRoom - socksUDPHeaderSize
+	copy(buffer[start:], []byte{0, 0, 0})
+	return buffer[start : nat.HeadRoom+n], nil
+}
+
+// serverPacketConn is a packet connection writing
+// to and reading from the remote server only.
+type serverPacketConn struct {
+	net.PacketConn
+	serverAddress *net.UDPAddr
+}
+
+// WriteTo writes the packet to the server, ignoring the address given.
+func (s *serverPacketConn) WriteTo(packet []byte, _ net.Addr) (int, error) {
+	return s.PacketConn.WriteTo(packet, s.serverAddress)
+}
+
+// ReadFrom reads a packet from the server, ignoring
+// packets received from other addresses.
+func (s *serverPacketConn) ReadFrom(buffer []byte) (n int, address net.Addr, err error) {
+	for {
+		n, address, err = s.PacketConn.ReadFrom(buffer)
+		if err != nil {
+			return n, address, err
+		}
+		udpAddress, ok := address.(*net.UDPAddr)
+		if ok && udpAddress.IP.Equal(s.serverAddress.IP) &&
+			udpAddress.Port == s.serverAddress.Port {
+			return n, address, nil
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Package ratelimit implements token bucket bandwidth limits
+// of sessions, at the connection, user and server-wide levels,
+// separately for upload and download. Limits can be changed
+// at runtime, including for sessions already running.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Limits are bandwidth limits in bytes per second,
+// where 0 means no limit.
+type Limits struct {
+	// Up is the limit from clients to target addresses.
+	Up uint64
+	// Down is the limit from target addresses to clients.
+	Down uint64
+}
+
+// Settings are the initial limits of a Limiter.
+type Settings struct {
+	// Global are the server-wide limits shared by all sessions.
+	Global Limits
+	// Connection are the limits of each TCP connection
+	// and of each UDP NAT entry.
+	Connection Limits
+	// User are the limits of each user, shared by all the
+	// sessions of the user, unless set for the user in Users.
+	// Note sessions of servers without users all belong to the
+	// user with the empty name.
+	User Limits
+	// Users maps user names to their own user limits,
+	// overriding User.
+	Users map[string]Limits
+}
+
+// Limiter limits the bandwidth of sessions. It is safe for concurrent
+// use, and can be shared by TCP and UDP servers so user and global
+// limits apply across both protocols. A nil *Limiter does not limit.
+type Limiter struct {
+	mutex      sync.Mutex
+	global     *bucket
+	connection Limits
+	user       Limits
+	users      map[string]Limits
+	// userBuckets maps user names to their buckets,
+	// created on the first session of each user.
+	userBuckets map[string]*bucket
+	// sessions are the sessions not closed yet, to update
+	// their connection bucket when connection limits change.
+	sessions map[*Session]struct{}
+}
+
+// New creates a limiter with the initial limits given.
+func New(settings Settings) *Limiter {
+	users := make(map[string]Limits, len(settings.Users))
+	for user, limits := range settings.Users {
+		users[user] = limits
+	}
+	return &Limiter{
+		global:      newBucket(settings.Global),
+		connection:  settings.Connection,
+		user:        settings.User,
+		users:       users,
+		userBuckets: make(map[string]*bucket),
+		sessions:    make(map[*Session]struct{}),
+	}
+}
+
+// SetGlobal sets the server-wide limits.
+func (l *Limiter) SetGlobal(limits Limits) {
+	l.global.set(limits)
+}
+
+// SetConnection sets the limits of each connection,
+// including connections already running.
+func (l *Limiter) SetConnection(limits Limits) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.connection = limits
+	for session := range l.sessions {
+		session.connection.set(limits)
+	}
+}
+
+// SetUsersDefault sets the limits of each user
+// without its own limits set.
+func (l *Limiter) SetUsersDefault(limits Limits) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.user = limits
+	for user, userBucket := range l.userBuckets {
+		if _, ok := l.users[user]; !ok {
+			userBucket.set(limits)
+		}
+	}
+}
+
+// SetUser sets the limits of the user given,
+// overriding the default user limits.
+func (l *Limiter) SetUser(user string, limits Limits) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.users[user] = limits
+	if userBucket, ok := l.userBuckets[user]; ok {
+		userBucket.set(limits)
+	}
+}
+
+// UnsetUser removes the limits of the user given,
+// so the default user limits apply to the user.
+func (l *Limiter) UnsetUser(user string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.users, user)
+	if userBucket, ok := l.userBuckets[user]; ok {
+		userBucket.set(l.user)
+	}
+}
+
+// NewSession returns the limiter of a new session of the user
+// given, which must be closed when the session ends. It returns
+// nil if the limiter is nil.
+func (l *Limiter) NewSession(user string) *Session {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	userBucket, ok := l.userBuckets[user]
+	if !ok {
+		limits, ok := l.users[user]
+		if !ok {
+			limits = l.user
+		}
+		userBucket = newBucket(limits)
+		l.userBuckets[user] = userBucket
+	}
+
+	session := &Session{
+		limiter:    l,
+		connection: newBucket(l.connection),
+		user:       userBucket,
+	}
+	l.sessions[session] = struct{}{}
+	return session
+}
+
+func (l *Limiter) removeSession(session *Session) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.sessions, session)
+}
+
+// bucket holds the upload and download token buckets of a level.
+type bucket struct {
+	up   *rate.Limiter
+	down *rate.Limiter
+}
+
+func newBucket(limits Limits) *bucket {
+	return &bucket{
+		up:   rate.NewLimiter(toLimit(limits.Up), toBurst(limits.Up)),
+		down: rate.NewLimiter(toLimit(limits.Down), toBurst(limits.Down)),
+	}
+}
+
+func (b *bucket) set(limits Limits) {
+	b.up.SetBurst(toBurst(limits.Up))
+	b.up.SetLimit(toLimit(limits.Up))
+	b.down.SetBurst(toBurst(limits.Down))
+	b.down.SetLimit(toLimit(limits.Down))
+}
+
+func toLimit(bytesPerSecond uint64) rate.Limit {
+	if bytesPerSecond == 0 {
+		return rate.Inf
+	}
+	return rate.Limit(bytesPerSecond)
+}
+
+// minBurst is the minimum burst size in bytes, large enough
+// for any UDP packet to be allowed at low limits.
+const minBurst = 64 * 1024
+
+// toBurst returns the burst size in bytes for the limit given,
+// which is one second of traffic with a minimum of minBurst.
+func toBurst(bytesPerSecond uint64) int {
+	switch {
+	case bytesPerSecond < minBurst:
+		return minBurst
+	case bytesPerSecond > math.MaxInt32:
+		return math.MaxInt32
+	default:
+		return int(bytesPerSecond)
+	}
+}
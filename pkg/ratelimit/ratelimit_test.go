@@ -0,0 +1,90 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_nilLimiter(t *testing.T) {
+	t.Parallel()
+
+	var limiter *Limiter
+	session := limiter.NewSession("alice")
+	assert.Nil(t, session)
+
+	assert.True(t, session.AllowUp(1<<30))
+	assert.True(t, session.AllowDown(1<<30))
+	assert.NoError(t, session.WaitUp(context.Background(), 1<<30))
+	assert.NoError(t, session.WaitDown(context.Background(), 1<<30))
+	session.Close()
+}
+
+func Test_Session_Allow(t *testing.T) {
+	t.Parallel()
+
+	limiter := New(Settings{
+		User: Limits{Up: minBurst},
+	})
+
+	alice := limiter.NewSession("alice")
+	defer alice.Close()
+	otherAlice := limiter.NewSession("alice")
+	defer otherAlice.Close()
+	bob := limiter.NewSession("bob")
+	defer bob.Close()
+
+	assert.True(t, alice.AllowUp(minBurst))
+	// the bucket of alice is shared by her sessions
+	assert.False(t, otherAlice.AllowUp(1000))
+	assert.True(t, bob.AllowUp(minBurst))
+	assert.True(t, alice.AllowDown(1<<30), "download is not limited")
+
+	// Setting a user limit applies to running sessions.
+	limiter.SetUser("bob", Limits{})
+	assert.True(t, bob.AllowUp(1<<30))
+}
+
+func Test_allow_allOrNothing(t *testing.T) {
+	t.Parallel()
+
+	limiter := New(Settings{
+		Connection: Limits{Up: minBurst},
+		Global:     Limits{Up: 2 * minBurst},
+	})
+	first := limiter.NewSession("")
+	defer first.Close()
+	second := limiter.NewSession("")
+	defer second.Close()
+
+	assert.True(t, first.AllowUp(minBurst))
+	assert.True(t, second.AllowUp(minBurst/2))
+	// The global bucket has minBurst/2 left, so the packet is refused,
+	// and the connection bucket of the second session is not consumed.
+	assert.False(t, second.AllowUp(minBurst))
+	limiter.SetGlobal(Limits{})
+	assert.True(t, second.AllowUp(minBurst/2))
+}
+
+func Test_Session_WaitUp(t *testing.T) {
+	t.Parallel()
+
+	limiter := New(Settings{})
+	session := limiter.NewSession("")
+	defer session.Close()
+
+	// Lower the connection limit of the running session.
+	limiter.SetConnection(Limits{Up: minBurst})
+	ctx := context.Background()
+	err := session.WaitUp(ctx, minBurst)
+	require.NoError(t, err)
+
+	// The bucket is empty, so waiting times out.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err = session.WaitUp(ctx, minBurst)
+	assert.Error(t, err)
+}
@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Session is the limiter of a session, limited by its
+// connection limits, its user limits and the global limits.
+// A nil *Session does not limit.
+type Session struct {
+	limiter    *Limiter
+	connection *bucket
+	user       *bucket
+}
+
+// WaitUp blocks until n bytes can be sent from the client
+// to the target, or until the context is canceled.
+func (s *Session) WaitUp(ctx context.Context, n int) error {
+	if s == nil {
+		return nil
+	}
+	return wait(ctx, n, s.connection.up, s.user.up, s.limiter.global.up)
+}
+
+// WaitDown blocks until n bytes can be sent from the
+// target to the client, or until the context is canceled.
+func (s *Session) WaitDown(ctx context.Context, n int) error {
+	if s == nil {
+		return nil
+	}
+	return wait(ctx, n, s.connection.down, s.user.down, s.limiter.global.down)
+}
+
+// AllowUp returns true and consumes n bytes if n bytes can be
+// sent from the client to the target now, and returns false
+// without consuming anything otherwise. It is used to drop
+// packets exceeding the limits.
+func (s *Session) AllowUp(n int) bool {
+	if s == nil {
+		return true
+	}
+	return allow(n, s.connection.up, s.user.up, s.limiter.global.up)
+}
+
+// AllowDown returns true and consumes n bytes if n bytes can be
+// sent from the target to the client now, and returns false
+// without consuming anything otherwise.
+func (s *Session) AllowDown(n int) bool {
+	if s == nil {
+		return true
+	}
+	return allow(n, s.connection.down, s.user.down, s.limiter.global.down)
+}
+
+// Close releases the session from its limiter.
+func (s *Session) Close() {
+	if s == nil {
+		return
+	}
+	s.limiter.removeSession(s)
+}
+
+// wait waits for n bytes on each of the limiters given, in
+// chunks not larger than the burst size of each limiter.
+func wait(ctx context.Context, n int, limiters ...*rate.Limiter) (err error) {
+	for _, limiter := range limiters {
+		if limiter.Limit() == rate.Inf {
+			continue
+		}
+		for remaining := n; remaining > 0; {
+			chunk := min(remaining, limiter.Burst())
+			err = limiter.WaitN(ctx, chunk)
+			if err != nil {
+				return err
+			}
+			remaining -= chunk
+		}
+	}
+	return nil
+}
+
+// allow consumes n bytes on all the limiters given only
+// if all of them allow n bytes now.
+func allow(n int, limiters ...*rate.Limiter) bool {
+	now := time.Now()
+	reservations := make([]*rate.Reservation, 0, len(limiters))
+	for _, limiter := range limiters {
+		reservation := limiter.ReserveN(now, n)
+		if !reservation.OK() || reservation.DelayFrom(now) > 0 {
+			reservation.CancelAt(now)
+			for _, previous := range reservations {
+				previous.CancelAt(now)
+			}
+			return false
+		}
+		reservations = append(reservations, reservation)
+	}
+	return true
+}
@@ -1,7 +1,113 @@
 package tcp
 
+import (
+	"context"
+	"net"
+	"time"
+)
+
 type Logger interface {
 	Debug(s string)
 	Info(s string)
 	Error(s string)
 }
+
+// Dialer dials connections to target addresses.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Metrics records metrics of the TCP server. The user argument
+// is the name of the user of the connection, or the empty
+// string if the server has no users.
+type Metrics interface {
+	// ConnectionStarted is called when a connection is
+	// decrypted successfully, before dialing its target.
+	ConnectionStarted(user string)
+	// ConnectionEnded is called when a started connection ends,
+	// with the duration since the connection started.
+	ConnectionEnded(user string, duration time.Duration)
+	// BytesUp is called with the number of plaintext bytes
+	// relayed from the client to the target.
+	BytesUp(user string, n int)
+	// BytesDown is called with the number of plaintext bytes
+	// relayed from the target to the client.
+	BytesDown(user string, n int)
+	// DialFailed is called when dialing the target fails,
+	// with a short reason such as "refused" or "timeout".
+	DialFailed(user, reason string)
+	// DecryptionFailed is called when data from a client
+	// cannot be authenticated and decrypted.
+	DecryptionFailed()
+	// SaltRepeated is called when a client salt was already
+	// seen, which can be a replay attack.
+	SaltRepeated()
+}
+
+// Accounting receives the accounting record of each session
+// once it ends. It must be safe for concurrent use.
+type Accounting interface {
+	SessionEnded(session Session)
+}
+
+// Session is the accounting record of a TCP connection
+// relayed to a target address.
+type Session struct {
+	// ClientAddress is the remote address of the client connection.
+	ClientAddress net.Addr
+	// User is the name of the user of the connection, or the
+	// empty string if the server has no users.
+	User string
+	// TargetAddress is the target address requested by the client.
+	TargetAddress string
+	// Start is the time the target address was received.
+	Start time.Time
+	// Duration is the duration from Start to the end of the session.
+	Duration time.Duration
+	// BytesUp is the number of plaintext bytes relayed
+	// from the client to the target.
+	BytesUp int64
+	// BytesDown is the number of plaintext bytes relayed
+	// from the target to the client.
+	BytesDown int64
+	// Err is the error which ended the session, such as a dial error,
+	// or nil if the session ended with one of the sides closing.
+	Err error
+}
+
+// Quota enforces data quotas of users, counting the bytes
+// relayed in both directions. It must be safe for concurrent use.
+type Quota interface {
+	// Exceeded returns true if the user has exceeded its
+	// quota, in which case new sessions are refused.
+	Exceeded(user string) bool
+	// Consume records n bytes relayed for the user, and returns
+	// false if the user has exceeded its quota, in which case the
+	// session is closed.
+	Consume(user string, n int) (ok bool)
+	// Track registers an active session of the user, which the
+	// quota closes with the closeSession function given once the
+	// user exceeds its quota. The untrack function returned is
+	// called once the session ends.
+	Track(user string, closeSession func()) (untrack func())
+}
+
+type noopQuota struct{}
+
+func (noopQuota) Exceeded(string) bool        { return false }
+func (noopQuota) Consume(string, int) bool    { return true }
+func (noopQuota) Track(string, func()) func() { return func() {} }
+
+type noopAccounting struct{}
+
+func (noopAccounting) SessionEnded(Session) {}
+
+type noopMetrics struct{}
+
+func (noopMetrics) ConnectionStarted(string)              {}
+func (noopMetrics) ConnectionEnded(string, time.Duration) {}
+func (noopMetrics) BytesUp(string, int)                   {}
+func (noopMetrics) BytesDown(string, int)                 {}
+func (noopMetrics) DialFailed(string, string)             {}
+func (noopMetrics) DecryptionFailed()                     {}
+func (noopMetrics) SaltRepeated()                         {}
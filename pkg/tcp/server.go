@@ -2,49 +2,140 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/qdm12/ss-server/internal/certificate"
 	"github.com/qdm12/ss-server/internal/core"
+	"github.com/qdm12/ss-server/internal/failure"
 	"github.com/qdm12/ss-server/internal/filter"
+	"github.com/qdm12/ss-server/internal/obfs"
+	"github.com/qdm12/ss-server/internal/outbound"
+	"github.com/qdm12/ss-server/internal/relay"
 	"github.com/qdm12/ss-server/internal/socks"
+	"github.com/qdm12/ss-server/internal/upstream"
+	"github.com/qdm12/ss-server/internal/websocket"
+	"github.com/qdm12/ss-server/pkg/ratelimit"
 )
 
 func NewServer(settings Settings, logger Logger) (s *Server, err error) {
 	settings.SetDefaults()
 
-	tcpStreamCipher, err := core.NewTCPStreamCipher(
-		settings.CipherName, *settings.Password, filter.NewBloomRing())
+	tcpStreamCipher, err := core.NewTCPStreamCipher(settings.CipherName,
+		*settings.Password, *settings.Key, toCoreUsers(settings.Users), filter.NewBloomRing())
 	if err != nil {
 		return nil, err
 	}
+	wrapTransport, err := newTransportWrapper(settings)
+	if err != nil {
+		return nil, err
+	}
+	dialer := settings.Dialer
+	if settings.UpstreamProxy != "" {
+		// The packet listener is only used for UDP associations.
+		dialer, err = upstream.New(settings.UpstreamProxy, dialer, nil)
+		if err != nil {
+			return nil, fmt.Errorf("creating upstream proxy: %w", err)
+		}
+	}
+	if settings.Outbound.Address != "" {
+		outboundCipher, err := core.NewTCPStreamCipher(settings.Outbound.CipherName,
+			*settings.Outbound.Password, *settings.Outbound.Key, nil, filter.NewBloomRing())
+		if err != nil {
+			return nil, fmt.Errorf("creating outbound cipher: %w", err)
+		}
+		dialer = outbound.NewStreamDialer(settings.Outbound.Address, outboundCipher, dialer)
+	}
+	var tlsConfig *tls.Config
+	if settings.TLSCertFile != "" {
+		reloader, err := certificate.NewReloader(settings.TLSCertFile, settings.TLSKeyFile, logger)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
+	}
 	return &Server{
-		address:      *settings.Address,
-		logAddresses: *settings.LogAddresses,
-		logger:       logger,
-		timeNow:      time.Now,
-		shadower:     tcpStreamCipher,
+		address:       *settings.Address,
+		logAddresses:  *settings.LogAddresses,
+		logger:        logger,
+		timeNow:       time.Now,
+		tlsConfig:     tlsConfig,
+		wrapTransport: wrapTransport,
+		shadower:      tcpStreamCipher,
+		dialer:        dialer,
+		metrics:       settings.Metrics,
+		accounting:    settings.Accounting,
+		quota:         settings.Quota,
+		rateLimiter:   settings.RateLimiter,
 	}, nil
 }
 
+// newTransportWrapper returns the function wrapping connections with the
+// WebSocket or obfuscation transport, or nil if no transport is set.
+func newTransportWrapper(settings Settings) (wrap func(net.Conn) net.Conn, err error) {
+	if settings.WebSocketPath != "" {
+		path, host := settings.WebSocketPath, settings.WebSocketHost
+		return func(connection net.Conn) net.Conn {
+			return websocket.NewServerConn(connection, path, host)
+		}, nil
+	}
+	return obfs.ServerConnWrapper(settings.Obfs)
+}
+
 type Server struct {
 	address      string
 	logAddresses bool
 	logger       Logger
 	timeNow      func() time.Time
-	shadower     *core.TCPStreamCipher
+	// tlsConfig is the TLS configuration to terminate TLS
+	// connections, and is nil if TLS is not used.
+	tlsConfig *tls.Config
+	// wrapTransport wraps the connection with a WebSocket or
+	// obfuscation transport, and is nil if no transport is used.
+	wrapTransport func(net.Conn) net.Conn
+	shadower      *core.TCPStreamCipher
+	// dialer dials connections to target addresses, directly or
+	// through an upstream proxy and/or a next Shadowsocks server.
+	dialer     Dialer
+	metrics    Metrics
+	accounting Accounting
+	quota      Quota
+	// rateLimiter limits the bandwidth of connections,
+	// and is nil if the bandwidth is not limited.
+	rateLimiter *ratelimit.Limiter
+	// addr is the address of the listener being served,
+	// and is nil if the server is not serving.
+	addr      net.Addr
+	addrMutex sync.RWMutex
 }
 
-// Listen listens for incoming connections.
+// Listen listens for incoming connections on the
+// listening address, see Serve for more details.
 func (s *Server) Listen(ctx context.Context) (err error) {
 	listenConfig := net.ListenConfig{}
 	listener, err := listenConfig.Listen(ctx, "tcp", s.address)
 	if err != nil {
 		return err
 	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve accepts and handles incoming connections on the listener
+// given, until the context is canceled. The listener is closed
+// when the context is canceled. This can be used to serve on a
+// pre-opened socket, or on an in-memory listener for tests.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) (err error) {
+	s.setAddr(listener.Addr())
+	defer s.setAddr(nil)
 	go func() {
 		<-ctx.Done()
 		if err := listener.Close(); err != nil {
@@ -58,39 +149,65 @@ func (s *Server) Listen(ctx context.Context) (err error) {
 			if ctxErr := ctx.Err(); ctxErr != nil {
 				return ctxErr
 			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			s.logger.Error("cannot accept connection on TCP listener: " + err.Error())
 			continue
 		}
 		tcpConnection, ok := connection.(*net.TCPConn)
-		if !ok {
-			s.logger.Error(fmt.Sprintf("connection from %s is not TCP: %s",
-				connection.RemoteAddr(), connection))
-			continue
+		if ok {
+			if err := tcpConnection.SetKeepAlive(true); err != nil {
+				s.logger.Error(fmt.Sprintf("cannot set keep-alive for TCP connection from %s: %s",
+					connection.RemoteAddr(), err))
+				_ = connection.Close()
+				continue
+			}
 		}
-		if err := tcpConnection.SetKeepAlive(true); err != nil {
-			s.logger.Error(fmt.Sprintf("cannot set keep-alive for TCP connection from %s: %s",
-				connection.RemoteAddr(), err))
-			continue
+		if s.tlsConfig != nil {
+			// The TLS handshake is done on the first read or write,
+			// in the connection goroutine.
+			connection = tls.Server(connection, s.tlsConfig)
 		}
-		go s.handleConnectionAsync(connection)
+		go s.handleConnectionAsync(ctx, connection)
 	}
 }
 
-func (s *Server) handleConnectionAsync(connection net.Conn) {
-	errs := s.handleConnection(connection)
+// Addr returns the address the server is listening on, which is
+// useful when listening on port 0. It returns nil if the server
+// is not listening.
+func (s *Server) Addr() net.Addr {
+	s.addrMutex.RLock()
+	defer s.addrMutex.RUnlock()
+	return s.addr
+}
+
+func (s *Server) setAddr(addr net.Addr) {
+	s.addrMutex.Lock()
+	defer s.addrMutex.Unlock()
+	s.addr = addr
+}
+
+func (s *Server) handleConnectionAsync(ctx context.Context, connection net.Conn) {
+	errs := s.handleConnection(ctx, connection)
 	for _, err := range errs {
 		s.logger.Error(fmt.Sprintf("connection from %s: %s", connection.RemoteAddr(), err))
 	}
 }
 
-func (s *Server) handleConnection(connection net.Conn) (errs []error) {
-	shadowedConnection := s.shadower.Shadow(connection)
+func (s *Server) handleConnection(ctx context.Context, connection net.Conn) (errs []error) {
+	transportConnection := connection
+	if s.wrapTransport != nil {
+		transportConnection = s.wrapTransport(connection)
+	}
+	shadowedConnection := s.shadower.Shadow(transportConnection)
 	// Note closing the shadowed TCP connection closes the original
 	// TCP connection `connection`, so no need to close `connection` twice.
 	defer closeConnection("shadowed TCP connection", shadowedConnection, &errs)
 
 	targetAddress, err := socks.ReadAddress(shadowedConnection)
 	if err != nil {
+		s.recordDecryptionError(err)
 		errs = append(errs, fmt.Errorf("reading target address: %w", err))
 		if _, err := io.Copy(io.Discard, connection); err != nil {
 			errs = append(errs, fmt.Errorf("discarding connection data: %w", err))
@@ -98,29 +215,123 @@ func (s *Server) handleConnection(connection net.Conn) (errs []error) {
 		return errs
 	}
 
-	rightConnection, err := net.Dial("tcp", targetAddress.String())
+	session := Session{
+		ClientAddress: connection.RemoteAddr(),
+		User:          userOf(shadowedConnection),
+		TargetAddress: targetAddress.String(),
+		Start:         s.timeNow(),
+	}
+	user := session.User
+	s.metrics.ConnectionStarted(user)
+	defer func() {
+		session.Duration = s.timeNow().Sub(session.Start)
+		s.metrics.ConnectionEnded(user, session.Duration)
+		s.accounting.SessionEnded(session)
+	}()
+
+	if s.quota.Exceeded(user) {
+		session.Err = fmt.Errorf("%w: for user %s", ErrQuotaExceeded, user)
+		errs = append(errs, session.Err)
+		return errs
+	}
+
+	rightConnection, err := s.dialer.DialContext(ctx, "tcp", targetAddress.String())
 	if err != nil {
-		errs = append(errs, fmt.Errorf("connecting to target address %s: %w", targetAddress, err))
+		s.metrics.DialFailed(user, failure.Reason(err))
+		err = fmt.Errorf("connecting to target address %s: %w", targetAddress, err)
+		session.Err = err
+		errs = append(errs, err)
 		return errs
 	}
 	defer closeConnection("TCP connection to target address", rightConnection, &errs)
 
 	if s.logAddresses {
-		s.logger.Info("TCP proxying " + connection.RemoteAddr().String() + " to " + targetAddress.String())
+		client := connection.RemoteAddr().String()
+		if user != "" {
+			client += " (user " + user + ")"
+		}
+		s.logger.Info("TCP proxying " + client + " to " + targetAddress.String())
 	}
 
-	if err := relay(shadowedConnection, rightConnection, s.timeNow); err != nil {
+	var quotaExceeded atomic.Bool
+	untrack := s.quota.Track(user, func() {
+		quotaExceeded.Store(true)
+		// wake up the relay blocked on reads from both connections
+		_ = connection.SetDeadline(s.timeNow())
+		_ = rightConnection.SetDeadline(s.timeNow())
+	})
+	defer untrack()
+
+	rateLimiter := s.rateLimiter.NewSession(user)
+	defer rateLimiter.Close()
+	upHooks := relay.WriteHooks{
+		Before: rateLimiter.WaitUp,
+		After: func(n int) error {
+			s.metrics.BytesUp(user, n)
+			return s.consumeQuota(user, n)
+		},
+	}
+	downHooks := relay.WriteHooks{
+		Before: rateLimiter.WaitDown,
+		After: func(n int) error {
+			s.metrics.BytesDown(user, n)
+			return s.consumeQuota(user, n)
+		},
+	}
+	session.BytesUp, session.BytesDown, err = relay.Copy(ctx, shadowedConnection, rightConnection,
+		s.timeNow, upHooks, downHooks)
+	if quotaExceeded.Load() {
+		session.Err = fmt.Errorf("%w: for user %s", ErrQuotaExceeded, user)
+		errs = append(errs, session.Err)
+		return errs
+	}
+	if err != nil {
+		s.recordDecryptionError(err)
 		var netErr net.Error
 		if ok := errors.As(err, &netErr); ok && netErr.Timeout() {
 			s.logger.Debug("TCP relay error: " + err.Error())
 			return errs // ignore i/o timeout
 		}
-		errs = append(errs, fmt.Errorf("TCP relay error: %w", err))
+		err = fmt.Errorf("TCP relay error: %w", err)
+		session.Err = err
+		errs = append(errs, err)
 	}
 
 	return errs
 }
 
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// consumeQuota consumes n bytes of the user quota, and returns
+// an error if the user has exceeded its quota.
+func (s *Server) consumeQuota(user string, n int) error {
+	if !s.quota.Consume(user, n) {
+		return fmt.Errorf("%w: for user %s", ErrQuotaExceeded, user)
+	}
+	return nil
+}
+
+// recordDecryptionError records the error given in the metrics
+// if it is a decryption error or a repeated salt error.
+func (s *Server) recordDecryptionError(err error) {
+	switch {
+	case errors.Is(err, core.ErrRepeatedSalt):
+		s.metrics.SaltRepeated()
+	case errors.Is(err, core.ErrDecryption):
+		s.metrics.DecryptionFailed()
+	}
+}
+
+// userOf returns the name of the user of the shadowed connection
+// given, or the empty string if the user is not identified.
+func userOf(shadowedConnection net.Conn) string {
+	userConnection, ok := shadowedConnection.(interface{ User() string })
+	if !ok {
+		return ""
+	}
+	return userConnection.User()
+}
+
 func closeConnection(name string, conn io.Closer, errs *[]error) {
 	err := conn.Close()
 	if err != nil {
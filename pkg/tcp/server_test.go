@@ -1,10 +1,19 @@
 package tcp
 
 import (
+	"context"
 	"errors"
+	"io"
+	"net"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/qdm12/ss-server/internal/core"
+	"github.com/qdm12/ss-server/internal/filter"
+	"github.com/qdm12/ss-server/internal/quota"
+	"github.com/qdm12/ss-server/internal/socks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -24,3 +33,162 @@ func Test_closeConnection(t *testing.T) {
 	assert.Len(t, errs, 1)
 	require.EqualError(t, errs[0], "closing XYZ: test error")
 }
+
+type noopLogger struct{}
+
+func (noopLogger) Debug(string) {}
+func (noopLogger) Info(string)  {}
+func (noopLogger) Error(string) {}
+
+type channelAccounting chan Session
+
+func (c channelAccounting) SessionEnded(session Session) { c <- session }
+
+func Test_Server_Serve(t *testing.T) {
+	t.Parallel()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = echoListener.Close() })
+	go func() {
+		connection, err := echoListener.Accept()
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		_, _ = io.Copy(connection, connection)
+	}()
+
+	accounting := make(channelAccounting, 1)
+	settings := Settings{
+		CipherName: core.AES128gcm,
+		Password:   ptrTo("password"),
+		Accounting: accounting,
+	}
+	server, err := NewServer(settings, noopLogger{})
+	require.NoError(t, err)
+	assert.Nil(t, server.Addr())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		errCh <- server.Serve(ctx, listener)
+	}()
+
+	clientCipher, err := core.NewTCPStreamCipher(core.AES128gcm,
+		"password", "", nil, filter.NewBloomRing())
+	require.NoError(t, err)
+	connection, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	shadowedConnection := clientCipher.Shadow(connection)
+
+	targetAddress, err := socks.ParseAddress(echoListener.Addr())
+	require.NoError(t, err)
+	_, err = shadowedConnection.Write(targetAddress)
+	require.NoError(t, err)
+	_, err = shadowedConnection.Write([]byte("hello"))
+	require.NoError(t, err)
+	echoed := make([]byte, len("hello"))
+	_, err = io.ReadFull(shadowedConnection, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(echoed))
+
+	assert.Equal(t, listener.Addr(), server.Addr())
+
+	err = shadowedConnection.Close()
+	require.NoError(t, err)
+	session := <-accounting
+	assert.Equal(t, connection.LocalAddr().String(), session.ClientAddress.String())
+	assert.Equal(t, echoListener.Addr().String(), session.TargetAddress)
+	assert.Equal(t, int64(len("hello")), session.BytesUp)
+	assert.Equal(t, int64(len("hello")), session.BytesDown)
+	assert.NoError(t, session.Err)
+
+	cancel()
+	err = <-errCh
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, server.Addr())
+}
+
+func Test_Server_Serve_quotaExceeded(t *testing.T) {
+	t.Parallel()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = echoListener.Close() })
+	go func() {
+		for {
+			connection, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer connection.Close()
+				_, _ = io.Copy(connection, connection)
+			}()
+		}
+	}()
+
+	// the user is the empty string without users
+	quotaManager, err := quota.New(map[string]uint64{"": 1000}, quota.PeriodDaily, 1,
+		filepath.Join(t.TempDir(), "quotas.json"))
+	require.NoError(t, err)
+	const sessions = 2
+	accounting := make(channelAccounting, sessions)
+	settings := Settings{
+		CipherName: core.AES128gcm,
+		Password:   ptrTo("password"),
+		Accounting: accounting,
+		Quota:      quotaManager,
+	}
+	server, err := NewServer(settings, noopLogger{})
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		errCh <- server.Serve(ctx, listener)
+	}()
+
+	clientCipher, err := core.NewTCPStreamCipher(core.AES128gcm,
+		"password", "", nil, filter.NewBloomRing())
+	require.NoError(t, err)
+	targetAddress, err := socks.ParseAddress(echoListener.Addr())
+	require.NoError(t, err)
+	shadowedConnections := make([]net.Conn, sessions)
+	for i := range shadowedConnections {
+		connection, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		shadowedConnection := clientCipher.Shadow(connection)
+		defer shadowedConnection.Close()
+		_, err = shadowedConnection.Write(append(targetAddress, "hello"...))
+		require.NoError(t, err)
+		echoed := make([]byte, len("hello"))
+		_, err = io.ReadFull(shadowedConnection, echoed)
+		require.NoError(t, err)
+		shadowedConnections[i] = shadowedConnection
+	}
+
+	// another session of the user exceeds the quota
+	assert.False(t, quotaManager.Consume("", 1000))
+
+	for range shadowedConnections {
+		session := <-accounting
+		assert.ErrorIs(t, session.Err, ErrQuotaExceeded)
+	}
+	for _, shadowedConnection := range shadowedConnections {
+		err = shadowedConnection.SetReadDeadline(time.Now().Add(5 * time.Second))
+		require.NoError(t, err)
+		_, err = shadowedConnection.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	}
+
+	cancel()
+	err = <-errCh
+	assert.ErrorIs(t, err, context.Canceled)
+}
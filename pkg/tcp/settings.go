@@ -1,12 +1,18 @@
 package tcp
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"strings"
 
 	"github.com/qdm12/gosettings"
 	"github.com/qdm12/gosettings/validate"
 	"github.com/qdm12/ss-server/internal/core"
+	"github.com/qdm12/ss-server/internal/obfs"
+	"github.com/qdm12/ss-server/internal/upstream"
+	"github.com/qdm12/ss-server/pkg/ratelimit"
 )
 
 type Settings struct {
@@ -23,10 +29,174 @@ type Settings struct {
 	// It defaults to "chacha20-ietf-poly1305".
 	// It cannot be empty in the internal state.
 	CipherName string
-	// Password for the TCP server.
+	// Password for the TCP server. For Shadowsocks 2022
+	// ciphers, it must be the base64 encoded pre-shared key
+	// of the cipher key size.
 	// It defaults to the empty string.
 	// It cannot be nil in the internal state.
 	Password *string
+	// Key is the base64 encoded key of the cipher key size, used
+	// directly instead of deriving the key from Password.
+	// It defaults to the empty string, meaning the key is derived
+	// from Password.
+	// It cannot be nil in the internal state.
+	Key *string
+	// Users can be set to serve multiple users on the same
+	// listener. For the 2022-blake3-aes-* ciphers, Password is the
+	// identity pre-shared key and each user is identified using
+	// extensible identity headers. For the aes-*-gcm and
+	// (x)chacha20-ietf-poly1305 ciphers, Password is not used and each
+	// user is identified by trying each user cipher, which gets
+	// slower as the number of users grows. Users are not supported
+	// for the 2022-blake3-chacha20-poly1305 cipher.
+	// It defaults to an empty slice.
+	Users []User
+	// Obfs is the simple-obfs obfuscation mode of the connections,
+	// and can be "http", "tls" or the empty string to disable it.
+	// It defaults to the empty string.
+	Obfs string
+	// WebSocketPath is the HTTP path of the WebSocket upgrade requests,
+	// where each Shadowsocks stream is carried in WebSocket binary
+	// frames. This is compatible with v2ray-plugin clients without TLS
+	// and with multiplexing disabled. It cannot be set together with
+	// Obfs. It defaults to the empty string to disable WebSocket.
+	WebSocketPath string
+	// WebSocketHost is the host the WebSocket upgrade requests must
+	// have in their Host header. It defaults to the empty string to
+	// accept any host.
+	WebSocketHost string
+	// TLSCertFile is the path to the PEM encoded TLS certificate
+	// file. If set together with TLSKeyFile, connections are
+	// TLS terminated, and the certificate and key are reloaded
+	// when their files change. It defaults to the empty string
+	// to disable TLS.
+	TLSCertFile string
+	// TLSKeyFile is the path to the PEM encoded TLS private key
+	// file, and must be set together with TLSCertFile.
+	// It defaults to the empty string to disable TLS.
+	TLSKeyFile string
+	// UpstreamProxy is the URL of the proxy to connect to target
+	// addresses through, in the form socks5://[user:password@]host:port
+	// or http://[user:password@]host:port for an HTTP CONNECT proxy.
+	// It defaults to the empty string to connect directly.
+	UpstreamProxy string
+	// Outbound can be set to relay connections to another Shadowsocks
+	// server instead of sending them to target addresses directly.
+	// Note the UpstreamProxy, if set, is used to reach this server.
+	Outbound Outbound
+	// Dialer is used to dial connections to target addresses, or
+	// to the upstream proxy or next Shadowsocks server if set.
+	// It can be set to route connections through a userspace
+	// network stack for example. It defaults to a net.Dialer.
+	// It cannot be nil in the internal state.
+	Dialer Dialer
+	// Metrics is used to record metrics of the server, such as
+	// connections, bytes relayed and errors. It defaults to a
+	// no-op implementation. It cannot be nil in the internal state.
+	Metrics Metrics
+	// Accounting receives the accounting record of each connection
+	// relayed once it ends, with its byte counts, duration and close
+	// error. It defaults to a no-op implementation.
+	// It cannot be nil in the internal state.
+	Accounting Accounting
+	// Quota can be set to enforce data quotas of users, refusing
+	// new sessions and closing existing sessions of users who
+	// exceeded their quota. It defaults to a no-op implementation.
+	// It cannot be nil in the internal state.
+	Quota Quota
+	// RateLimiter can be set to limit the bandwidth of sessions at
+	// the connection, user and global levels, and its limits can be
+	// changed at runtime. It can be shared with another server so
+	// user and global limits apply across servers. It defaults to
+	// nil to not limit the bandwidth.
+	RateLimiter *ratelimit.Limiter
+}
+
+// User is a user with its own password, identified using
+// Shadowsocks 2022 extensible identity headers, or by trial
+// decryption for the other ciphers.
+type User struct {
+	// Name is the user name, used in logs.
+	Name string
+	// CipherName is the cipher of the user. It defaults to the
+	// server cipher, and can only be set to another cipher for
+	// the aes-*-gcm and (x)chacha20-ietf-poly1305 ciphers.
+	CipherName string
+	// Password is the user password, or the base64 encoded
+	// user pre-shared key for Shadowsocks 2022 ciphers.
+	Password string
+}
+
+// Outbound is a next Shadowsocks server to relay connections to,
+// to chain Shadowsocks servers together.
+type Outbound struct {
+	// Address is the address of the next Shadowsocks server.
+	// It defaults to the empty string to not relay connections
+	// to another Shadowsocks server.
+	Address string
+	// CipherName is the cipher to use with the next server. It can
+	// only be one of the aes-*-gcm and (x)chacha20-ietf-poly1305
+	// ciphers, and defaults to "chacha20-ietf-poly1305".
+	// It cannot be empty in the internal state.
+	CipherName string
+	// Password is the password of the next server.
+	// It defaults to the empty string.
+	// It cannot be nil in the internal state.
+	Password *string
+	// Key is the base64 encoded key of the cipher key size, used
+	// directly instead of deriving the key from Password.
+	// It defaults to the empty string.
+	// It cannot be nil in the internal state.
+	Key *string
+}
+
+func (o *Outbound) setDefaults() {
+	o.CipherName = gosettings.DefaultComparable(o.CipherName, core.Chacha20IetfPoly1305)
+	o.Password = gosettings.DefaultPointer(o.Password, "")
+	o.Key = gosettings.DefaultPointer(o.Key, "")
+}
+
+func (o Outbound) copy() (copied Outbound) {
+	copied.Address = o.Address
+	copied.CipherName = o.CipherName
+	copied.Password = gosettings.CopyPointer(o.Password)
+	copied.Key = gosettings.CopyPointer(o.Key)
+	return copied
+}
+
+func (o *Outbound) overrideWith(other Outbound) {
+	o.Address = gosettings.OverrideWithComparable(o.Address, other.Address)
+	o.CipherName = gosettings.OverrideWithComparable(o.CipherName, other.CipherName)
+	o.Password = gosettings.OverrideWithPointer(o.Password, other.Password)
+	o.Key = gosettings.OverrideWithPointer(o.Key, other.Key)
+}
+
+func (o *Outbound) validate() (err error) {
+	if o.Address == "" {
+		return nil
+	}
+
+	_, _, err = net.SplitHostPort(o.Address)
+	if err != nil {
+		return fmt.Errorf("address: %w", err)
+	}
+
+	// Shadowsocks 2022 ciphers are only implemented server side.
+	err = validate.IsOneOf(o.CipherName,
+		core.AES128gcm, core.AES192gcm, core.AES256gcm,
+		core.Chacha20IetfPoly1305, core.XChacha20IetfPoly1305)
+	if err != nil {
+		return fmt.Errorf("cipher: %w", err)
+	}
+
+	if o.Key != nil && *o.Key != "" {
+		err = core.CheckPreSharedKey(*o.Key, o.CipherName)
+		if err != nil {
+			return fmt.Errorf("key: %w", err)
+		}
+	}
+
+	return nil
 }
 
 // SetDefaults sets default values for all unset field
@@ -36,6 +206,12 @@ func (s *Settings) SetDefaults() {
 	s.LogAddresses = gosettings.DefaultPointer(s.LogAddresses, false)
 	s.CipherName = gosettings.DefaultComparable(s.CipherName, core.Chacha20IetfPoly1305)
 	s.Password = gosettings.DefaultPointer(s.Password, "")
+	s.Key = gosettings.DefaultPointer(s.Key, "")
+	s.Outbound.setDefaults()
+	s.Dialer = gosettings.DefaultComparable[Dialer](s.Dialer, &net.Dialer{})
+	s.Metrics = gosettings.DefaultComparable[Metrics](s.Metrics, noopMetrics{})
+	s.Accounting = gosettings.DefaultComparable[Accounting](s.Accounting, noopAccounting{})
+	s.Quota = gosettings.DefaultComparable[Quota](s.Quota, noopQuota{})
 }
 
 // Copy returns a deep copy of the settings.
@@ -44,6 +220,20 @@ func (s Settings) Copy() (copied Settings) {
 	copied.LogAddresses = gosettings.CopyPointer(s.LogAddresses)
 	copied.CipherName = s.CipherName
 	copied.Password = gosettings.CopyPointer(s.Password)
+	copied.Key = gosettings.CopyPointer(s.Key)
+	copied.Users = gosettings.CopySlice(s.Users)
+	copied.Obfs = s.Obfs
+	copied.WebSocketPath = s.WebSocketPath
+	copied.WebSocketHost = s.WebSocketHost
+	copied.TLSCertFile = s.TLSCertFile
+	copied.TLSKeyFile = s.TLSKeyFile
+	copied.UpstreamProxy = s.UpstreamProxy
+	copied.Outbound = s.Outbound.copy()
+	copied.Dialer = s.Dialer
+	copied.Metrics = s.Metrics
+	copied.Accounting = s.Accounting
+	copied.Quota = s.Quota
+	copied.RateLimiter = s.RateLimiter
 	return copied
 }
 
@@ -54,8 +244,28 @@ func (s *Settings) OverrideWith(other Settings) {
 	s.LogAddresses = gosettings.OverrideWithPointer(s.LogAddresses, other.LogAddresses)
 	s.CipherName = gosettings.OverrideWithComparable(s.CipherName, other.CipherName)
 	s.Password = gosettings.OverrideWithPointer(s.Password, other.Password)
+	s.Key = gosettings.OverrideWithPointer(s.Key, other.Key)
+	s.Users = gosettings.OverrideWithSlice(s.Users, other.Users)
+	s.Obfs = gosettings.OverrideWithComparable(s.Obfs, other.Obfs)
+	s.WebSocketPath = gosettings.OverrideWithComparable(s.WebSocketPath, other.WebSocketPath)
+	s.WebSocketHost = gosettings.OverrideWithComparable(s.WebSocketHost, other.WebSocketHost)
+	s.TLSCertFile = gosettings.OverrideWithComparable(s.TLSCertFile, other.TLSCertFile)
+	s.TLSKeyFile = gosettings.OverrideWithComparable(s.TLSKeyFile, other.TLSKeyFile)
+	s.UpstreamProxy = gosettings.OverrideWithComparable(s.UpstreamProxy, other.UpstreamProxy)
+	s.Outbound.overrideWith(other.Outbound)
+	s.Dialer = gosettings.OverrideWithComparable(s.Dialer, other.Dialer)
+	s.Metrics = gosettings.OverrideWithComparable(s.Metrics, other.Metrics)
+	s.Accounting = gosettings.OverrideWithComparable(s.Accounting, other.Accounting)
+	s.Quota = gosettings.OverrideWithComparable(s.Quota, other.Quota)
+	s.RateLimiter = gosettings.OverrideWithComparable(s.RateLimiter, other.RateLimiter)
 }
 
+var (
+	ErrWebSocketWithObfs = errors.New("WebSocket cannot be used with obfuscation")
+	ErrPathNotAbsolute   = errors.New("path is not absolute")
+	ErrTLSFileMissing    = errors.New("TLS certificate or key file is missing")
+)
+
 func (s *Settings) Validate() (err error) {
 	err = validate.ListeningAddress(*s.Address, os.Getuid())
 	if err != nil {
@@ -63,10 +273,78 @@ func (s *Settings) Validate() (err error) {
 	}
 
 	err = validate.IsOneOf(s.CipherName,
-		core.AES128gcm, core.AES256gcm, core.Chacha20IetfPoly1305)
+		core.AES128gcm, core.AES192gcm, core.AES256gcm,
+		core.Chacha20IetfPoly1305, core.XChacha20IetfPoly1305,
+		core.Blake3AES128gcm, core.Blake3AES256gcm, core.Blake3Chacha20Poly1305)
 	if err != nil {
 		return fmt.Errorf("cipher: %w", err)
 	}
 
+	switch {
+	case s.Key != nil && *s.Key != "":
+		err = core.CheckPreSharedKey(*s.Key, s.CipherName)
+		if err != nil {
+			return fmt.Errorf("key: %w", err)
+		}
+	case core.Is2022(s.CipherName):
+		err = core.CheckPreSharedKey(*s.Password, s.CipherName)
+		if err != nil {
+			return fmt.Errorf("password: %w", err)
+		}
+	}
+
+	err = core.CheckUsers(s.CipherName, toCoreUsers(s.Users))
+	if err != nil {
+		return fmt.Errorf("users: %w", err)
+	}
+
+	if s.Obfs != "" {
+		err = validate.IsOneOf(s.Obfs, obfs.HTTP, obfs.TLS)
+		if err != nil {
+			return fmt.Errorf("obfs: %w", err)
+		}
+	}
+
+	if s.WebSocketPath != "" {
+		if s.Obfs != "" {
+			return ErrWebSocketWithObfs
+		}
+		if !strings.HasPrefix(s.WebSocketPath, "/") {
+			return fmt.Errorf("WebSocket path: %w: %s", ErrPathNotAbsolute, s.WebSocketPath)
+		}
+	}
+
+	if (s.TLSCertFile == "") != (s.TLSKeyFile == "") {
+		return fmt.Errorf("%w: certificate file %q and key file %q",
+			ErrTLSFileMissing, s.TLSCertFile, s.TLSKeyFile)
+	}
+
+	if s.UpstreamProxy != "" {
+		err = upstream.Check(s.UpstreamProxy, false)
+		if err != nil {
+			return fmt.Errorf("upstream proxy: %w", err)
+		}
+	}
+
+	err = s.Outbound.validate()
+	if err != nil {
+		return fmt.Errorf("outbound: %w", err)
+	}
+
 	return nil
 }
+
+func toCoreUsers(users []User) (coreUsers []core.User) {
+	if len(users) == 0 {
+		return nil
+	}
+	coreUsers = make([]core.User, len(users))
+	for i, user := range users {
+		coreUsers[i] = core.User{
+			Name:       user.Name,
+			CipherName: user.CipherName,
+			Password:   user.Password,
+		}
+	}
+	return coreUsers
+}
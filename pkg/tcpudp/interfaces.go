@@ -1,7 +1,40 @@
 package tcpudp
 
+import (
+	"context"
+	"net"
+)
+
 type Logger interface {
 	Debug(s string)
 	Info(s string)
 	Error(s string)
 }
+
+// Dialer dials connections to target addresses.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// PacketListener creates packet connections
+// to send packets to target addresses.
+type PacketListener interface {
+	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
+// Quota enforces data quotas of users, counting the bytes
+// relayed in both directions. It must be safe for concurrent use.
+type Quota interface {
+	// Exceeded returns true if the user has exceeded its
+	// quota, in which case new sessions are refused.
+	Exceeded(user string) bool
+	// Consume records n bytes relayed for the user, and returns
+	// false if the user has exceeded its quota, in which case the
+	// session is closed.
+	Consume(user string, n int) (ok bool)
+	// Track registers an active session of the user, which the
+	// quota closes with the closeSession function given once the
+	// user exceeds its quota. The untrack function returned is
+	// called once the session ends.
+	Track(user string, closeSession func()) (untrack func())
+}
@@ -3,6 +3,7 @@ package tcpudp
 import (
 	"context"
 	"errors"
+	"net"
 	"time"
 
 	"github.com/qdm12/ss-server/pkg/tcp"
@@ -40,7 +41,42 @@ var (
 	ErrTCPServer = errors.New("TCP server crashed")
 )
 
+// Listen listens for TCP connections and UDP packets on the
+// listening address, until the context is canceled or one
+// of the TCP and UDP servers exits.
 func (s *Server) Listen(ctx context.Context) (err error) {
+	return s.run(ctx, s.tcpServer.Listen, s.udpServer.Listen)
+}
+
+// Serve serves TCP connections accepted on the listener given and
+// UDP packets read from the packet connection given, until the context
+// is canceled or one of the TCP and UDP servers exits. The listener
+// and the packet connection are closed when the context is canceled.
+func (s *Server) Serve(ctx context.Context, listener net.Listener,
+	packetConnection net.PacketConn) (err error) {
+	serveTCP := func(ctx context.Context) error {
+		return s.tcpServer.Serve(ctx, listener)
+	}
+	serveUDP := func(ctx context.Context) error {
+		return s.udpServer.ServePacket(ctx, packetConnection)
+	}
+	return s.run(ctx, serveTCP, serveUDP)
+}
+
+// TCPAddr returns the address the TCP server is listening on,
+// or nil if it is not listening.
+func (s *Server) TCPAddr() net.Addr {
+	return s.tcpServer.Addr()
+}
+
+// UDPAddr returns the address the UDP server is listening on,
+// or nil if it is not listening.
+func (s *Server) UDPAddr() net.Addr {
+	return s.udpServer.Addr()
+}
+
+func (s *Server) run(ctx context.Context,
+	runTCP, runUDP func(ctx context.Context) error) (err error) {
 	ctx, cancel := context.WithCancel(ctx)
 
 	tcpErrorCh := make(chan error)
@@ -48,10 +84,10 @@ func (s *Server) Listen(ctx context.Context) (err error) {
 
 	// Launch TCP and UDP servers
 	go func() {
-		udpErrorCh <- s.udpServer.Listen(ctx)
+		udpErrorCh <- runUDP(ctx)
 	}()
 	go func() {
-		tcpErrorCh <- s.tcpServer.Listen(ctx)
+		tcpErrorCh <- runTCP(ctx)
 	}()
 
 	select {
@@ -0,0 +1,96 @@
+package tcpudp
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/qdm12/ss-server/internal/core"
+	"github.com/qdm12/ss-server/internal/filter"
+	"github.com/qdm12/ss-server/internal/socks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type errorsLogger struct {
+	errors chan string
+}
+
+func (l *errorsLogger) Debug(string)   {}
+func (l *errorsLogger) Info(string)    {}
+func (l *errorsLogger) Error(s string) { l.errors <- s }
+
+func Test_Server_httpUpstreamProxyRefusesUDP(t *testing.T) {
+	t.Parallel()
+
+	targetConnection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = targetConnection.Close() })
+	targetPort := targetConnection.LocalAddr().(*net.UDPAddr).Port //nolint:forcetypeassert
+
+	// The proxy is not used for UDP, so it only needs to listen.
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = proxyListener.Close() })
+
+	settings := Settings{
+		CipherName:    core.AES128gcm,
+		Password:      ptrTo("password"),
+		UpstreamProxy: "http://" + proxyListener.Addr().String(),
+	}
+	logger := &errorsLogger{errors: make(chan string, 10)}
+	server, err := NewServer(settings, logger)
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	packetConnection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		errCh <- server.Serve(ctx, listener, packetConnection)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-errCh
+	})
+
+	clientCipher, err := core.NewUDPPacketCipher(core.AES128gcm,
+		"password", "", nil, filter.NewBloomRing())
+	require.NoError(t, err)
+	clientConnection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	shadowedConnection := clientCipher.Shadow(clientConnection)
+	defer shadowedConnection.Close()
+
+	// Targets given as IP address and as domain name
+	// are neither reached nor resolved directly.
+	targets := []string{
+		"127.0.0.1:" + strconv.Itoa(targetPort),
+		"localhost:" + strconv.Itoa(targetPort),
+	}
+	for _, target := range targets {
+		targetAddress, err := socks.ParseHostPort(target)
+		require.NoError(t, err)
+		packet := append([]byte(targetAddress), "hello"...)
+		_, err = shadowedConnection.WriteTo(packet, packetConnection.LocalAddr())
+		require.NoError(t, err)
+
+		select {
+		case message := <-logger.errors:
+			assert.Contains(t, message, "UDP is not supported by the proxy scheme: http")
+		case <-time.After(time.Second):
+			t.Fatal("packet was not refused")
+		}
+	}
+
+	err = targetConnection.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	require.NoError(t, err)
+	_, _, err = targetConnection.ReadFrom(make([]byte, 1024))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+}
@@ -1,12 +1,16 @@
 package tcpudp
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"os"
 
 	"github.com/qdm12/gosettings"
 	"github.com/qdm12/gosettings/validate"
 	"github.com/qdm12/ss-server/internal/core"
+	"github.com/qdm12/ss-server/internal/upstream"
+	"github.com/qdm12/ss-server/pkg/ratelimit"
 	"github.com/qdm12/ss-server/pkg/tcp"
 	"github.com/qdm12/ss-server/pkg/udp"
 )
@@ -25,9 +29,74 @@ type Settings struct {
 	// It defaults to chacha20-ietf-poly1305. It cannot be empty in the
 	// internal state.
 	CipherName string
-	// Password for the TCP and UDP servers. It cannot be nil in the
-	// internal state.
+	// Password for the TCP and UDP servers. For Shadowsocks 2022
+	// ciphers, it must be the base64 encoded pre-shared key of the
+	// cipher key size. It cannot be nil in the internal state.
 	Password *string
+	// Key is the base64 encoded key of the cipher key size, used
+	// directly instead of deriving the key from Password. It
+	// defaults to the empty string, meaning the key is derived
+	// from Password. It cannot be nil in the internal state.
+	Key *string
+	// Users can be set to serve multiple users on the same
+	// listener. For the 2022-blake3-aes-* ciphers, Password is the
+	// identity pre-shared key and each user is identified using
+	// extensible identity headers. For the aes-*-gcm and
+	// (x)chacha20-ietf-poly1305 ciphers, Password is not used and each
+	// user is identified by trying each user cipher, which gets
+	// slower as the number of users grows. Users are not supported
+	// for the 2022-blake3-chacha20-poly1305 cipher. Note it
+	// overrides the Users for both the TCP and the UDP servers.
+	Users []User
+	// TLSCertFile is the path to the PEM encoded TLS certificate
+	// file for the TCP server. If set together with TLSKeyFile,
+	// TCP connections are TLS terminated, and the certificate and
+	// key are reloaded when their files change. Note it overrides
+	// the TLSCertFile of the TCP server.
+	TLSCertFile string
+	// TLSKeyFile is the path to the PEM encoded TLS private key
+	// file for the TCP server. Note it overrides the TLSKeyFile
+	// of the TCP server.
+	TLSKeyFile string
+	// UpstreamProxy is the URL of the proxy to connect to target
+	// addresses through, in the form scheme://[user:password@]host:port
+	// where scheme is socks5 or http. TCP connections go through the
+	// proxy, and UDP packets go through it using UDP associations for
+	// socks5 proxies. For http proxies, which cannot relay UDP, UDP
+	// packets are refused instead of being sent directly to their
+	// targets. Note it overrides the UpstreamProxy for both the TCP
+	// and the UDP servers, and the PacketListener of the UDP server
+	// for http proxies.
+	UpstreamProxy string
+	// Outbound can be set to relay TCP connections and UDP packets
+	// to another Shadowsocks server instead of sending them to target
+	// addresses directly. Note it overrides the Outbound for both the
+	// TCP and the UDP servers.
+	Outbound Outbound
+	// Dialer is used to dial TCP connections to target addresses, or
+	// to the upstream proxy or next Shadowsocks server if set. It
+	// defaults to a net.Dialer. It cannot be nil in the internal state.
+	// Note it overrides the Dialer for both the TCP and the UDP servers.
+	Dialer Dialer
+	// PacketListener is used to create packet connections to send UDP
+	// packets to target addresses, or to the upstream proxy UDP relay
+	// or next Shadowsocks server if set. It defaults to a
+	// net.ListenConfig. It cannot be nil in the internal state.
+	// Note it overrides the PacketListener of the UDP server.
+	PacketListener PacketListener
+	// Quota can be set to enforce data quotas of users across TCP
+	// and UDP, refusing new sessions and closing existing sessions
+	// of users who exceeded their quota. It defaults to nil to not
+	// enforce quotas. Note it overrides the Quota for both the TCP
+	// and the UDP servers.
+	Quota Quota
+	// RateLimiter can be set to limit the bandwidth of sessions at
+	// the connection, user and global levels, with user and global
+	// limits applying across TCP and UDP. Its limits can be changed
+	// at runtime. It defaults to nil to not limit the bandwidth.
+	// Note it overrides the RateLimiter for both the TCP and the
+	// UDP servers.
+	RateLimiter *ratelimit.Limiter
 
 	// TCP can be used to set specific settings for the TCP server.
 	TCP tcp.Settings
@@ -35,6 +104,38 @@ type Settings struct {
 	UDP udp.Settings
 }
 
+// User is a user with its own password, identified using
+// Shadowsocks 2022 extensible identity headers, or by trial
+// decryption for the other ciphers.
+type User struct {
+	// Name is the user name, used in logs.
+	Name string
+	// CipherName is the cipher of the user. It defaults to the
+	// server cipher, and can only be set to another cipher for
+	// the aes-*-gcm and (x)chacha20-ietf-poly1305 ciphers.
+	CipherName string
+	// Password is the user password, or the base64 encoded
+	// user pre-shared key for Shadowsocks 2022 ciphers.
+	Password string
+}
+
+// Outbound is a next Shadowsocks server to relay TCP connections
+// and UDP packets to, to chain Shadowsocks servers together.
+type Outbound struct {
+	// Address is the address of the next Shadowsocks server,
+	// for both TCP and UDP.
+	Address string
+	// CipherName is the cipher to use with the next server. It can
+	// only be one of the aes-*-gcm and (x)chacha20-ietf-poly1305
+	// ciphers.
+	CipherName string
+	// Password is the password of the next server.
+	Password *string
+	// Key is the base64 encoded key of the cipher key size, used
+	// directly instead of deriving the key from Password.
+	Key *string
+}
+
 // SetDefaults sets default values for all unset field
 // in the settings.
 func (s *Settings) SetDefaults() {
@@ -42,6 +143,9 @@ func (s *Settings) SetDefaults() {
 	s.LogAddresses = gosettings.DefaultPointer(s.LogAddresses, false)
 	s.CipherName = gosettings.DefaultComparable(s.CipherName, core.Chacha20IetfPoly1305)
 	s.Password = gosettings.DefaultPointer(s.Password, "")
+	s.Key = gosettings.DefaultPointer(s.Key, "")
+	s.Dialer = gosettings.DefaultComparable[Dialer](s.Dialer, &net.Dialer{})
+	s.PacketListener = gosettings.DefaultComparable[PacketListener](s.PacketListener, &net.ListenConfig{})
 
 	inheritedTCPSettings := s.toTCP()
 	inheritedTCPSettings.OverrideWith(s.TCP)
@@ -60,6 +164,21 @@ func (s Settings) Copy() (copied Settings) {
 	copied.LogAddresses = gosettings.CopyPointer(s.LogAddresses)
 	copied.CipherName = s.CipherName
 	copied.Password = gosettings.CopyPointer(s.Password)
+	copied.Key = gosettings.CopyPointer(s.Key)
+	copied.Users = gosettings.CopySlice(s.Users)
+	copied.TLSCertFile = s.TLSCertFile
+	copied.TLSKeyFile = s.TLSKeyFile
+	copied.UpstreamProxy = s.UpstreamProxy
+	copied.Outbound = Outbound{
+		Address:    s.Outbound.Address,
+		CipherName: s.Outbound.CipherName,
+		Password:   gosettings.CopyPointer(s.Outbound.Password),
+		Key:        gosettings.CopyPointer(s.Outbound.Key),
+	}
+	copied.Dialer = s.Dialer
+	copied.PacketListener = s.PacketListener
+	copied.Quota = s.Quota
+	copied.RateLimiter = s.RateLimiter
 	copied.TCP = s.TCP.Copy()
 	copied.UDP = s.UDP.Copy()
 	return copied
@@ -70,6 +189,26 @@ func (s Settings) toTCP() (settings tcp.Settings) {
 	settings.LogAddresses = gosettings.OverrideWithPointer(settings.LogAddresses, s.LogAddresses)
 	settings.CipherName = s.CipherName
 	settings.Password = gosettings.OverrideWithPointer(settings.Password, s.Password)
+	settings.Key = gosettings.OverrideWithPointer(settings.Key, s.Key)
+	for _, user := range s.Users {
+		settings.Users = append(settings.Users, tcp.User{
+			Name:       user.Name,
+			CipherName: user.CipherName,
+			Password:   user.Password,
+		})
+	}
+	settings.TLSCertFile = s.TLSCertFile
+	settings.TLSKeyFile = s.TLSKeyFile
+	settings.UpstreamProxy = s.UpstreamProxy
+	settings.Outbound = tcp.Outbound{
+		Address:    s.Outbound.Address,
+		CipherName: s.Outbound.CipherName,
+		Password:   gosettings.CopyPointer(s.Outbound.Password),
+		Key:        gosettings.CopyPointer(s.Outbound.Key),
+	}
+	settings.Dialer = s.Dialer
+	settings.Quota = s.Quota
+	settings.RateLimiter = s.RateLimiter
 	return settings
 }
 
@@ -78,9 +217,43 @@ func (s Settings) toUDP() (settings udp.Settings) {
 	settings.LogAddresses = gosettings.OverrideWithPointer(settings.LogAddresses, s.LogAddresses)
 	settings.CipherName = s.CipherName
 	settings.Password = gosettings.OverrideWithPointer(settings.Password, s.Password)
+	settings.Key = gosettings.OverrideWithPointer(settings.Key, s.Key)
+	for _, user := range s.Users {
+		settings.Users = append(settings.Users, udp.User{
+			Name:       user.Name,
+			CipherName: user.CipherName,
+			Password:   user.Password,
+		})
+	}
+	switch {
+	case s.UpstreamProxy == "":
+		settings.PacketListener = s.PacketListener
+	case upstream.SupportsUDP(s.UpstreamProxy):
+		settings.UpstreamProxy = s.UpstreamProxy
+		settings.PacketListener = s.PacketListener
+	default:
+		settings.PacketListener = udpRefuser{}
+	}
+	settings.Outbound = udp.Outbound{
+		Address:    s.Outbound.Address,
+		CipherName: s.Outbound.CipherName,
+		Password:   gosettings.CopyPointer(s.Outbound.Password),
+		Key:        gosettings.CopyPointer(s.Outbound.Key),
+	}
+	settings.Dialer = s.Dialer
+	settings.Quota = s.Quota
+	settings.RateLimiter = s.RateLimiter
 	return settings
 }
 
+// udpRefuser is the packet listener of the UDP server for upstream
+// proxies not supporting UDP, so UDP packets do not bypass the proxy.
+type udpRefuser struct{}
+
+func (udpRefuser) ListenPacket(context.Context, string, string) (net.PacketConn, error) {
+	return nil, fmt.Errorf("%w: %s", upstream.ErrUDPNotSupported, upstream.SchemeHTTP)
+}
+
 // OverrideWith sets any field of the receiving settings
 // with the field value of any set field from the other settings.
 func (s *Settings) OverrideWith(other Settings) {
@@ -88,6 +261,19 @@ func (s *Settings) OverrideWith(other Settings) {
 	s.LogAddresses = gosettings.OverrideWithPointer(s.LogAddresses, other.LogAddresses)
 	s.CipherName = gosettings.OverrideWithComparable(s.CipherName, other.CipherName)
 	s.Password = gosettings.OverrideWithPointer(s.Password, other.Password)
+	s.Key = gosettings.OverrideWithPointer(s.Key, other.Key)
+	s.Users = gosettings.OverrideWithSlice(s.Users, other.Users)
+	s.TLSCertFile = gosettings.OverrideWithComparable(s.TLSCertFile, other.TLSCertFile)
+	s.TLSKeyFile = gosettings.OverrideWithComparable(s.TLSKeyFile, other.TLSKeyFile)
+	s.UpstreamProxy = gosettings.OverrideWithComparable(s.UpstreamProxy, other.UpstreamProxy)
+	s.Outbound.Address = gosettings.OverrideWithComparable(s.Outbound.Address, other.Outbound.Address)
+	s.Outbound.CipherName = gosettings.OverrideWithComparable(s.Outbound.CipherName, other.Outbound.CipherName)
+	s.Outbound.Password = gosettings.OverrideWithPointer(s.Outbound.Password, other.Outbound.Password)
+	s.Outbound.Key = gosettings.OverrideWithPointer(s.Outbound.Key, other.Outbound.Key)
+	s.Dialer = gosettings.OverrideWithComparable(s.Dialer, other.Dialer)
+	s.PacketListener = gosettings.OverrideWithComparable(s.PacketListener, other.PacketListener)
+	s.Quota = gosettings.OverrideWithComparable(s.Quota, other.Quota)
+	s.RateLimiter = gosettings.OverrideWithComparable(s.RateLimiter, other.RateLimiter)
 	s.TCP.OverrideWith(other.TCP)
 	s.UDP.OverrideWith(other.UDP)
 }
@@ -100,11 +286,26 @@ func (s *Settings) Validate() (err error) {
 	}
 
 	err = validate.IsOneOf(s.CipherName,
-		core.AES128gcm, core.AES256gcm, core.Chacha20IetfPoly1305)
+		core.AES128gcm, core.AES192gcm, core.AES256gcm,
+		core.Chacha20IetfPoly1305, core.XChacha20IetfPoly1305,
+		core.Blake3AES128gcm, core.Blake3AES256gcm, core.Blake3Chacha20Poly1305)
 	if err != nil {
 		return fmt.Errorf("cipher: %w", err)
 	}
 
+	switch {
+	case s.Key != nil && *s.Key != "":
+		err = core.CheckPreSharedKey(*s.Key, s.CipherName)
+		if err != nil {
+			return fmt.Errorf("key: %w", err)
+		}
+	case core.Is2022(s.CipherName):
+		err = core.CheckPreSharedKey(*s.Password, s.CipherName)
+		if err != nil {
+			return fmt.Errorf("password: %w", err)
+		}
+	}
+
 	err = s.TCP.Validate()
 	if err != nil {
 		return fmt.Errorf("TCP server settings: %w", err)
@@ -2,6 +2,7 @@ package tcpudp
 
 import (
 	"errors"
+	"net"
 	"testing"
 
 	"github.com/qdm12/gosettings/validate"
@@ -14,6 +15,16 @@ import (
 
 func ptrTo[T any](x T) *T { return &x }
 
+func defaultTCPSettings() (settings tcp.Settings) {
+	settings.SetDefaults()
+	return settings
+}
+
+func defaultUDPSettings() (settings udp.Settings) {
+	settings.SetDefaults()
+	return settings
+}
+
 func Test_Settings_SetDefaults(t *testing.T) {
 	t.Parallel()
 
@@ -23,21 +34,45 @@ func Test_Settings_SetDefaults(t *testing.T) {
 	}{
 		"empty settings": {
 			expected: Settings{
-				Address:      ptrTo(":8388"),
-				LogAddresses: ptrTo(false),
-				CipherName:   core.Chacha20IetfPoly1305,
-				Password:     ptrTo(""),
+				Address:        ptrTo(":8388"),
+				LogAddresses:   ptrTo(false),
+				CipherName:     core.Chacha20IetfPoly1305,
+				Password:       ptrTo(""),
+				Key:            ptrTo(""),
+				Dialer:         &net.Dialer{},
+				PacketListener: &net.ListenConfig{},
 				TCP: tcp.Settings{
 					Address:      ptrTo(":8388"),
 					LogAddresses: ptrTo(false),
 					CipherName:   core.Chacha20IetfPoly1305,
 					Password:     ptrTo(""),
+					Key:          ptrTo(""),
+					Outbound: tcp.Outbound{
+						CipherName: core.Chacha20IetfPoly1305,
+						Password:   ptrTo(""),
+						Key:        ptrTo(""),
+					},
+					Dialer:     &net.Dialer{},
+					Metrics:    defaultTCPSettings().Metrics,
+					Accounting: defaultTCPSettings().Accounting,
+					Quota:      defaultTCPSettings().Quota,
 				},
 				UDP: udp.Settings{
 					Address:      ptrTo(":8388"),
 					LogAddresses: ptrTo(false),
 					CipherName:   core.Chacha20IetfPoly1305,
 					Password:     ptrTo(""),
+					Key:          ptrTo(""),
+					Outbound: udp.Outbound{
+						CipherName: core.Chacha20IetfPoly1305,
+						Password:   ptrTo(""),
+						Key:        ptrTo(""),
+					},
+					PacketListener: &net.ListenConfig{},
+					Dialer:         &net.Dialer{},
+					Metrics:        defaultUDPSettings().Metrics,
+					Accounting:     defaultUDPSettings().Accounting,
+					Quota:          defaultUDPSettings().Quota,
 				},
 			},
 		},
@@ -47,35 +82,62 @@ func Test_Settings_SetDefaults(t *testing.T) {
 				LogAddresses: ptrTo(true),
 				CipherName:   core.AES128gcm,
 				Password:     ptrTo("password"),
+				Key:          ptrTo(""),
 				TCP: tcp.Settings{
 					Address:      ptrTo(":8388"),
 					LogAddresses: ptrTo(true),
 					CipherName:   core.Chacha20IetfPoly1305,
 					Password:     ptrTo("tcp"),
+					Key:          ptrTo(""),
 				},
 				UDP: udp.Settings{
 					Address:      ptrTo(":8388"),
 					LogAddresses: ptrTo(false),
 					CipherName:   core.Chacha20IetfPoly1305,
 					Password:     ptrTo("udp"),
+					Key:          ptrTo(""),
 				},
 			},
 			expected: Settings{
-				Address:      ptrTo(":0"),
-				LogAddresses: ptrTo(true),
-				CipherName:   core.AES128gcm,
-				Password:     ptrTo("password"),
+				Address:        ptrTo(":0"),
+				LogAddresses:   ptrTo(true),
+				CipherName:     core.AES128gcm,
+				Password:       ptrTo("password"),
+				Key:            ptrTo(""),
+				Dialer:         &net.Dialer{},
+				PacketListener: &net.ListenConfig{},
 				TCP: tcp.Settings{
 					Address:      ptrTo(":8388"),
 					LogAddresses: ptrTo(true),
 					CipherName:   core.Chacha20IetfPoly1305,
 					Password:     ptrTo("tcp"),
+					Key:          ptrTo(""),
+					Outbound: tcp.Outbound{
+						CipherName: core.Chacha20IetfPoly1305,
+						Password:   ptrTo(""),
+						Key:        ptrTo(""),
+					},
+					Dialer:     &net.Dialer{},
+					Metrics:    defaultTCPSettings().Metrics,
+					Accounting: defaultTCPSettings().Accounting,
+					Quota:      defaultTCPSettings().Quota,
 				},
 				UDP: udp.Settings{
 					Address:      ptrTo(":8388"),
 					LogAddresses: ptrTo(false),
 					CipherName:   core.Chacha20IetfPoly1305,
 					Password:     ptrTo("udp"),
+					Key:          ptrTo(""),
+					Outbound: udp.Outbound{
+						CipherName: core.Chacha20IetfPoly1305,
+						Password:   ptrTo(""),
+						Key:        ptrTo(""),
+					},
+					PacketListener: &net.ListenConfig{},
+					Dialer:         &net.Dialer{},
+					Metrics:        defaultUDPSettings().Metrics,
+					Accounting:     defaultUDPSettings().Accounting,
+					Quota:          defaultUDPSettings().Quota,
 				},
 			},
 		},
@@ -313,7 +375,9 @@ func Test_Settings_Validate(t *testing.T) {
 			},
 			errWrapped: validate.ErrValueNotOneOf,
 			errMessage: "cipher: value is not one of the possible choices: " +
-				"garbage must be one of aes-128-gcm, aes-256-gcm or chacha20-ietf-poly1305",
+				"garbage must be one of aes-128-gcm, aes-192-gcm, aes-256-gcm, " +
+				"chacha20-ietf-poly1305, xchacha20-ietf-poly1305, " +
+				"2022-blake3-aes-128-gcm, 2022-blake3-aes-256-gcm or 2022-blake3-chacha20-poly1305",
 		},
 		"invalid TCP": {
 			settings: Settings{
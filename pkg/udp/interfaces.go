@@ -1,6 +1,124 @@
 package udp
 
+import (
+	"context"
+	"net"
+	"time"
+)
+
 type Logger interface {
 	Info(s string)
 	Error(s string)
 }
+
+// Dialer dials connections, to the upstream
+// proxy for UDP associations.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// PacketListener creates packet connections
+// to send packets to target addresses.
+type PacketListener interface {
+	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
+// Metrics records metrics of the UDP server. The user argument
+// is the name of the user of the client, or the empty string
+// if the server has no users.
+type Metrics interface {
+	// NATEntryAdded is called when a NAT entry is
+	// created for a new client address.
+	NATEntryAdded(user string)
+	// NATEntryRemoved is called when a NAT entry is removed,
+	// with the duration since the entry was added.
+	NATEntryRemoved(user string, duration time.Duration)
+	// BytesUp is called with the number of payload bytes
+	// relayed from the client to a target.
+	BytesUp(user string, n int)
+	// BytesDown is called with the number of payload bytes
+	// relayed from a target to the client.
+	BytesDown(user string, n int)
+	// DialFailed is called when creating the packet connection
+	// of a NAT entry fails, with a short reason such as "resolve".
+	// Failures to resolve or write to a target address for each
+	// packet are not dial failures, and are only logged.
+	DialFailed(user, reason string)
+	// DecryptionFailed is called when a packet from a client
+	// cannot be authenticated and decrypted.
+	DecryptionFailed()
+	// SaltRepeated is called when a client salt was already
+	// seen, which can be a replay attack.
+	SaltRepeated()
+}
+
+// Accounting receives the accounting record of each session
+// once it ends. It must be safe for concurrent use.
+type Accounting interface {
+	SessionEnded(session Session)
+}
+
+// Session is the accounting record of a UDP NAT entry,
+// relaying packets of a client address to target addresses.
+type Session struct {
+	// ClientAddress is the address of the client.
+	ClientAddress net.Addr
+	// User is the name of the user of the client, or the
+	// empty string if the server has no users.
+	User string
+	// TargetAddresses are the distinct target addresses the client
+	// sent packets to, in the order they were first used, and limited
+	// to the first 256 addresses.
+	TargetAddresses []string
+	// Start is the time the NAT entry was created.
+	Start time.Time
+	// Duration is the duration from Start to the end of the session.
+	Duration time.Duration
+	// BytesUp is the number of payload bytes relayed
+	// from the client to the targets.
+	BytesUp int64
+	// BytesDown is the number of payload bytes relayed
+	// from the targets to the client.
+	BytesDown int64
+	// Err is the error which ended the session, or nil if
+	// the session ended because no packet was received from
+	// the targets during the NAT entry idle timeout.
+	Err error
+}
+
+// Quota enforces data quotas of users, counting the bytes
+// relayed in both directions. It must be safe for concurrent use.
+type Quota interface {
+	// Exceeded returns true if the user has exceeded its
+	// quota, in which case new sessions are refused.
+	Exceeded(user string) bool
+	// Consume records n bytes relayed for the user, and returns
+	// false if the user has exceeded its quota, in which case the
+	// session is closed.
+	Consume(user string, n int) (ok bool)
+	// Track registers an active session of the user, which the
+	// quota closes with the closeSession function given once the
+	// user exceeds its quota. The untrack function returned is
+	// called once the session ends.
+	Track(user string, closeSession func()) (untrack func())
+}
+
+type noopQuota struct{}
+
+func (noopQuota) Exceeded(string) bool        { return false }
+func (noopQuota) Consume(string, int) bool    { return true }
+func (noopQuota) Track(string, func()) func() { return func() {} }
+
+type noopAccounting struct{}
+
+func (noopAccounting) SessionEnded(Session) {}
+
+type noopMetrics struct{}
+
+func (noopMetrics) NATEntryAdded(string)                  {}
+func (noopMetrics) NATEntryRemoved(string, time.Duration) {}
+func (noopMetrics) BytesUp(string, int)                   {}
+func (noopMetrics) BytesDown(string, int)                 {}
+func (noopMetrics) DialFailed(string, string)             {}
+func (noopMetrics) DecryptionFailed()                     {}
+func (noopMetrics) SaltRepeated()                         {}
@@ -2,29 +2,61 @@ package udp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/qdm12/ss-server/internal/core"
+	"github.com/qdm12/ss-server/internal/failure"
 	"github.com/qdm12/ss-server/internal/filter"
+	"github.com/qdm12/ss-server/internal/nat"
+	"github.com/qdm12/ss-server/internal/outbound"
 	"github.com/qdm12/ss-server/internal/socks"
+	"github.com/qdm12/ss-server/internal/upstream"
+	"github.com/qdm12/ss-server/pkg/ratelimit"
 )
 
 func NewServer(settings Settings, logger Logger) (s *Server, err error) {
 	settings.SetDefaults()
 
-	udpPacketCipher, err := core.NewUDPPacketCipher(
-		settings.CipherName, *settings.Password, filter.NewBloomRing())
+	udpPacketCipher, err := core.NewUDPPacketCipher(settings.CipherName,
+		*settings.Password, *settings.Key, toCoreUsers(settings.Users), filter.NewBloomRing())
 	if err != nil {
 		return nil, err
 	}
+	packetListener := settings.PacketListener
+	if settings.UpstreamProxy != "" {
+		packetListener, err = upstream.New(settings.UpstreamProxy,
+			settings.Dialer, packetListener)
+		if err != nil {
+			return nil, fmt.Errorf("creating upstream proxy: %w", err)
+		}
+	}
+	if settings.Outbound.Address != "" {
+		outboundCipher, err := core.NewUDPPacketCipher(settings.Outbound.CipherName,
+			*settings.Outbound.Password, *settings.Outbound.Key, nil, filter.NewBloomRing())
+		if err != nil {
+			return nil, fmt.Errorf("creating outbound cipher: %w", err)
+		}
+		packetListener = outbound.NewPacketRelayer(settings.Outbound.Address,
+			outboundCipher, packetListener)
+	}
 	return &Server{
-		address:      *settings.Address,
-		logAddresses: *settings.LogAddresses,
-		logger:       logger,
-		timeNow:      time.Now,
-		shadower:     udpPacketCipher,
+		address:        *settings.Address,
+		logAddresses:   *settings.LogAddresses,
+		logger:         logger,
+		timeNow:        time.Now,
+		shadower:       udpPacketCipher,
+		packetListener: packetListener,
+		// Target addresses are resolved by the upstream
+		// proxy or by the next server if any.
+		resolveTargets: settings.UpstreamProxy == "" && settings.Outbound.Address == "",
+		metrics:        settings.Metrics,
+		accounting:     settings.Accounting,
+		quota:          settings.Quota,
+		rateLimiter:    settings.RateLimiter,
 	}, nil
 }
 
@@ -34,37 +66,83 @@ type Server struct {
 	logger       Logger
 	timeNow      func() time.Time
 	shadower     *core.UDPPacketCipher
+	// packetListener creates the packet connections to send packets
+	// to target addresses, directly or through an upstream proxy
+	// and/or a next Shadowsocks server.
+	packetListener PacketListener
+	// resolveTargets is true if target addresses must be resolved
+	// before sending packets to them.
+	resolveTargets bool
+	metrics        Metrics
+	accounting     Accounting
+	quota          Quota
+	// rateLimiter limits the bandwidth of NAT entries,
+	// and is nil if the bandwidth is not limited.
+	rateLimiter *ratelimit.Limiter
+	// addr is the address of the packet connection being
+	// served, and is nil if the server is not serving.
+	addr      net.Addr
+	addrMutex sync.RWMutex
 }
 
-// Listen listens for encrypted packets and does UDP NATing.
+// Addr returns the address the server is listening on, which is
+// useful when listening on port 0. It returns nil if the server
+// is not listening.
+func (s *Server) Addr() net.Addr {
+	s.addrMutex.RLock()
+	defer s.addrMutex.RUnlock()
+	return s.addr
+}
+
+func (s *Server) setAddr(addr net.Addr) {
+	s.addrMutex.Lock()
+	defer s.addrMutex.Unlock()
+	s.addr = addr
+}
+
+// Listen listens for encrypted packets on the listening
+// address and does UDP NATing, see ServePacket for more details.
 func (s *Server) Listen(ctx context.Context) (err error) {
 	listenConfig := net.ListenConfig{}
 	packetConnection, err := listenConfig.ListenPacket(ctx, "udp", s.address)
 	if err != nil {
 		return err
 	}
+	return s.ServePacket(ctx, packetConnection)
+}
+
+// ServePacket reads encrypted packets from the packet connection
+// given and does UDP NATing, until the context is canceled. The
+// packet connection is closed when the context is canceled. This
+// can be used to serve on a pre-opened socket, or on an in-memory
+// packet connection for tests.
+func (s *Server) ServePacket(ctx context.Context, packetConnection net.PacketConn) (err error) {
+	s.setAddr(packetConnection.LocalAddr())
+	defer s.setAddr(nil)
 	go func() {
 		<-ctx.Done()
 		if err := packetConnection.Close(); err != nil {
 			s.logger.Error(err.Error())
 		}
 	}()
-	packetConnection = s.shadower.Shadow(packetConnection)
+	shadowedConnection := s.shadower.Shadow(packetConnection)
 
-	NATMap := natmap{
-		remoteAddressToConnection: make(map[string]net.PacketConn),
-		timeNow:                   s.timeNow,
-	}
+	natMap := nat.New(s.timeNow)
+	refusals := newQuotaRefusals(s.timeNow)
 
 	buffer := make([]byte, bufferSize)
 
-	s.logger.Info("listening UDP on " + packetConnection.LocalAddr().String())
+	s.logger.Info("listening UDP on " + shadowedConnection.LocalAddr().String())
 	for {
-		bytesRead, remoteAddress, err := packetConnection.ReadFrom(buffer)
+		bytesRead, remoteAddress, err := shadowedConnection.ReadFrom(buffer)
 		if err != nil {
 			if ctxErr := ctx.Err(); ctxErr != nil {
 				return ctxErr
 			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			s.recordDecryptionError(err)
 
 			err = fmt.Errorf("reading packet: %w", err)
 			if remoteAddress != nil {
@@ -74,8 +152,8 @@ func (s *Server) Listen(ctx context.Context) (err error) {
 			continue
 		}
 
-		err = handleIncomingData(packetConnection, remoteAddress,
-			buffer, bytesRead, &NATMap, s.logger, s.logAddresses)
+		err = s.handleIncomingData(ctx, shadowedConnection, remoteAddress,
+			buffer, bytesRead, natMap, refusals)
 		if err != nil {
 			if ctxErr := ctx.Err(); ctxErr != nil {
 				return ctxErr
@@ -90,40 +168,148 @@ func (s *Server) Listen(ctx context.Context) (err error) {
 	}
 }
 
-func handleIncomingData(packetConnection net.PacketConn, remoteAddress net.Addr,
-	buffer []byte, bytesRead int, natMap *natmap, logger Logger,
-	logAddresses bool) (err error) {
+func (s *Server) handleIncomingData(ctx context.Context, packetConnection net.PacketConn,
+	remoteAddress net.Addr, buffer []byte, bytesRead int, natMap *nat.Map,
+	refusals *quotaRefusals) (err error) {
 	targetAddress, err := socks.ExtractAddress(buffer[:bytesRead])
 	if err != nil {
 		return fmt.Errorf("extracting SOCKS target address: %w", err)
 	}
 
-	targetUDPAddress, err := net.ResolveUDPAddr("udp", targetAddress.String())
-	if err != nil {
-		return fmt.Errorf("resolving target address: %w", err)
+	user := userOf(packetConnection, remoteAddress)
+	if s.quota.Exceeded(user) {
+		if !refusals.first(remoteAddress.String()) {
+			return nil // refusal already logged for the client session
+		}
+		return fmt.Errorf("%w: for user %s", ErrQuotaExceeded, user)
 	}
 
 	payload := buffer[len(targetAddress):bytesRead]
 
-	connection := natMap.Get(remoteAddress.String())
-	if connection == nil {
-		if logAddresses {
-			logger.Info("UDP proxying " + remoteAddress.String() + " to " + targetAddress.String())
+	var connection *sessionPacketConn
+	if natConnection := natMap.Get(remoteAddress.String()); natConnection != nil {
+		connection = natConnection.(*sessionPacketConn) //nolint:forcetypeassert
+	} else {
+		if s.logAddresses {
+			client := remoteAddress.String()
+			if user != "" {
+				client += " (user " + user + ")"
+			}
+			s.logger.Info("UDP proxying " + client + " to " + targetAddress.String())
 		}
 
-		connection, err = net.ListenPacket("udp", "")
+		targetConnection, err := s.packetListener.ListenPacket(ctx, "udp", "")
 		if err != nil {
+			s.metrics.DialFailed(user, failure.Reason(err))
 			return fmt.Errorf("creating packet listener: %w", err)
 		}
+		connection = newSessionPacketConn(targetConnection, s.rateLimiter.NewSession(user))
 		natMap.Set(remoteAddress.String(), connection)
-		go natMap.Handle(remoteAddress, packetConnection, connection)
+		s.metrics.NATEntryAdded(user)
+		go s.handleNATEntry(natMap, remoteAddress, packetConnection, connection, user)
+	}
+
+	// Target addresses are resolved once the packet connection is
+	// created, so nothing is sent if the packet listener refuses to.
+	var targetUDPAddress net.Addr = socks.UnresolvedUDPAddress(targetAddress.String())
+	if s.resolveTargets {
+		targetUDPAddress, err = net.ResolveUDPAddr("udp", targetAddress.String())
+		if err != nil {
+			return fmt.Errorf("resolving target address: %w", err)
+		}
 	}
 
-	_, err = connection.WriteTo(payload, targetUDPAddress)
+	if !connection.rateLimiter.AllowUp(len(payload)) {
+		return nil // drop the packet
+	}
+
+	_, err = connection.writeTo(payload, targetUDPAddress, targetAddress.String())
 	if err != nil {
 		// accept only UDPAddr despite the signature
 		return fmt.Errorf("writing payload to address %s: %w", targetUDPAddress, err)
 	}
+	s.metrics.BytesUp(user, len(payload))
+	// Sessions of the user are closed by the quota once it is
+	// exceeded, and its next packets are refused.
+	_ = s.quota.Consume(user, len(payload))
 
 	return nil
 }
+
+// handleNATEntry relays packets from the targets back to the client
+// until the NAT entry expires, and records metrics and the accounting
+// session for the entry.
+func (s *Server) handleNATEntry(natMap *nat.Map, remoteAddress net.Addr,
+	packetConnection net.PacketConn, connection *sessionPacketConn, user string) {
+	session := Session{
+		ClientAddress: remoteAddress,
+		User:          user,
+		Start:         s.timeNow(),
+	}
+	untrack := s.quota.Track(user, func() {
+		connection.quotaExceeded.Store(true)
+		// stop relaying packets from the targets
+		_ = connection.Close()
+	})
+	defer untrack()
+	translate := func(buffer []byte, n int, source net.Addr) (packet []byte, err error) {
+		if !connection.rateLimiter.AllowDown(n) {
+			return nil, nil //nolint:nilnil // drop the packet
+		}
+		s.metrics.BytesDown(user, n)
+		if !s.quota.Consume(user, n) {
+			return nil, fmt.Errorf("%w: for user %s", ErrQuotaExceeded, user)
+		}
+		return addSourceAddress(buffer, n, source)
+	}
+	bytesDown, err := natMap.Handle(remoteAddress, packetConnection, connection, translate)
+	connection.rateLimiter.Close()
+	session.Duration = s.timeNow().Sub(session.Start)
+	session.BytesUp, session.TargetAddresses = connection.stats()
+	session.BytesDown = bytesDown
+	var netErr net.Error
+	switch {
+	case connection.quotaExceeded.Load():
+		session.Err = fmt.Errorf("%w: for user %s", ErrQuotaExceeded, user)
+	case !errors.As(err, &netErr) || !netErr.Timeout():
+		session.Err = err
+	}
+	s.metrics.NATEntryRemoved(user, session.Duration)
+	s.accounting.SessionEnded(session)
+}
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// recordDecryptionError records the error given in the metrics
+// if it is a decryption error or a repeated salt error.
+func (s *Server) recordDecryptionError(err error) {
+	switch {
+	case errors.Is(err, core.ErrRepeatedSalt):
+		s.metrics.SaltRepeated()
+	case errors.Is(err, core.ErrDecryption):
+		s.metrics.DecryptionFailed()
+	}
+}
+
+// userOf returns the name of the user of the remote address on
+// the shadowed packet connection given, or the empty string if
+// the user is not identified.
+func userOf(shadowedConnection net.PacketConn, remoteAddress net.Addr) string {
+	userConnection, ok := shadowedConnection.(interface{ User(address net.Addr) string })
+	if !ok {
+		return ""
+	}
+	return userConnection.User(remoteAddress)
+}
+
+// addSourceAddress prepends the SOCKS address of the source
+// of the packet from the target, as expected by the client.
+func addSourceAddress(buffer []byte, n int, source net.Addr) (packet []byte, err error) {
+	sourceAddress, err := socks.ParseAddress(source)
+	if err != nil {
+		return nil, err
+	}
+	start := nat.HeadRoom - len(sourceAddress)
+	copy(buffer[start:], sourceAddress)
+	return buffer[start : nat.HeadRoom+n], nil
+}
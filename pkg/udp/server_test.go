@@ -0,0 +1,287 @@
+package udp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qdm12/ss-server/internal/core"
+	"github.com/qdm12/ss-server/internal/filter"
+	"github.com/qdm12/ss-server/internal/nat"
+	"github.com/qdm12/ss-server/internal/quota"
+	"github.com/qdm12/ss-server/internal/socks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type noopLogger struct{}
+
+func (noopLogger) Info(string)  {}
+func (noopLogger) Error(string) {}
+
+func Test_Server_ServePacket(t *testing.T) {
+	t.Parallel()
+
+	echoConnection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = echoConnection.Close() })
+	go func() {
+		buffer := make([]byte, bufferSize)
+		n, address, err := echoConnection.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		_, _ = echoConnection.WriteTo(buffer[:n], address)
+	}()
+
+	settings := Settings{
+		CipherName: core.AES128gcm,
+		Password:   ptrTo("password"),
+	}
+	server, err := NewServer(settings, noopLogger{})
+	require.NoError(t, err)
+
+	packetConnection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		errCh <- server.ServePacket(ctx, packetConnection)
+	}()
+
+	clientCipher, err := core.NewUDPPacketCipher(core.AES128gcm,
+		"password", "", nil, filter.NewBloomRing())
+	require.NoError(t, err)
+	clientConnection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	shadowedConnection := clientCipher.Shadow(clientConnection)
+	defer shadowedConnection.Close()
+
+	targetAddress, err := socks.ParseAddress(echoConnection.LocalAddr())
+	require.NoError(t, err)
+	packet := append([]byte(targetAddress), "hello"...)
+	_, err = shadowedConnection.WriteTo(packet, packetConnection.LocalAddr())
+	require.NoError(t, err)
+
+	err = shadowedConnection.SetReadDeadline(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	buffer := make([]byte, bufferSize)
+	n, _, err := shadowedConnection.ReadFrom(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, packet, buffer[:n])
+
+	assert.Equal(t, packetConnection.LocalAddr(), server.Addr())
+
+	cancel()
+	err = <-errCh
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, server.Addr())
+}
+
+func Test_sessionPacketConn(t *testing.T) {
+	t.Parallel()
+
+	packetConnection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	connection := newSessionPacketConn(packetConnection, nil)
+	defer connection.Close()
+
+	address := packetConnection.LocalAddr()
+	for _, target := range []string{"example.com:53", "1.2.3.4:53", "example.com:53"} {
+		_, err = connection.writeTo([]byte("hello"), address, target)
+		require.NoError(t, err)
+	}
+
+	bytesWritten, targets := connection.stats()
+	assert.Equal(t, int64(3*len("hello")), bytesWritten)
+	assert.Equal(t, []string{"example.com:53", "1.2.3.4:53"}, targets)
+}
+
+type dialFailuresMetrics struct {
+	noopMetrics
+	mutex   sync.Mutex
+	reasons []string
+}
+
+func (m *dialFailuresMetrics) DialFailed(_, reason string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.reasons = append(m.reasons, reason)
+}
+
+type packetListenerFunc func() (net.PacketConn, error)
+
+func (f packetListenerFunc) ListenPacket(context.Context, string, string) (net.PacketConn, error) {
+	return f()
+}
+
+func Test_Server_handleIncomingData_dialFailures(t *testing.T) {
+	t.Parallel()
+
+	errTest := errors.New("test error")
+
+	testCases := map[string]struct {
+		packetListener packetListenerFunc
+		reasons        []string
+		errWrapped     error
+	}{
+		"listen failure": {
+			packetListener: func() (net.PacketConn, error) {
+				return nil, errTest
+			},
+			reasons:    []string{"other"},
+			errWrapped: errTest,
+		},
+		"write failure": {
+			packetListener: func() (net.PacketConn, error) {
+				packetConnection, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					return nil, err
+				}
+				_ = packetConnection.Close()
+				return packetConnection, nil
+			},
+			errWrapped: net.ErrClosed,
+		},
+	}
+
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			metrics := &dialFailuresMetrics{}
+			settings := Settings{
+				Password:       ptrTo("password"),
+				PacketListener: testCase.packetListener,
+				Metrics:        metrics,
+			}
+			server, err := NewServer(settings, noopLogger{})
+			require.NoError(t, err)
+
+			packet := []byte{1, 127, 0, 0, 1, 0, 53, 'h', 'i'}
+			clientAddress := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+			err = server.handleIncomingData(context.Background(), nil, clientAddress,
+				packet, len(packet), nat.New(time.Now), newQuotaRefusals(time.Now))
+
+			assert.ErrorIs(t, err, testCase.errWrapped)
+			metrics.mutex.Lock()
+			defer metrics.mutex.Unlock()
+			assert.Equal(t, testCase.reasons, metrics.reasons)
+		})
+	}
+}
+
+type errorsLogger struct {
+	noopLogger
+	errors chan string
+}
+
+func (l *errorsLogger) Error(s string) { l.errors <- s }
+
+type channelAccounting chan Session
+
+func (c channelAccounting) SessionEnded(session Session) { c <- session }
+
+func Test_Server_ServePacket_quotaExceeded(t *testing.T) {
+	t.Parallel()
+
+	echoConnection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = echoConnection.Close() })
+	go func() {
+		buffer := make([]byte, bufferSize)
+		for {
+			n, address, err := echoConnection.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = echoConnection.WriteTo(buffer[:n], address)
+		}
+	}()
+
+	// the user is the empty string without users
+	quotaManager, err := quota.New(map[string]uint64{"": 1000}, quota.PeriodDaily, 1,
+		filepath.Join(t.TempDir(), "quotas.json"))
+	require.NoError(t, err)
+	accounting := make(channelAccounting, 1)
+	settings := Settings{
+		CipherName: core.AES128gcm,
+		Password:   ptrTo("password"),
+		Accounting: accounting,
+		Quota:      quotaManager,
+	}
+	logger := &errorsLogger{errors: make(chan string, 10)}
+	server, err := NewServer(settings, logger)
+	require.NoError(t, err)
+
+	packetConnection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		errCh <- server.ServePacket(ctx, packetConnection)
+	}()
+
+	clientCipher, err := core.NewUDPPacketCipher(core.AES128gcm,
+		"password", "", nil, filter.NewBloomRing())
+	require.NoError(t, err)
+	clientConnection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	shadowedConnection := clientCipher.Shadow(clientConnection)
+	defer shadowedConnection.Close()
+
+	targetAddress, err := socks.ParseAddress(echoConnection.LocalAddr())
+	require.NoError(t, err)
+	packet := append([]byte(targetAddress), "hello"...)
+	_, err = shadowedConnection.WriteTo(packet, packetConnection.LocalAddr())
+	require.NoError(t, err)
+	err = shadowedConnection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, err)
+	_, _, err = shadowedConnection.ReadFrom(make([]byte, bufferSize))
+	require.NoError(t, err)
+
+	// another session of the user exceeds the quota
+	assert.False(t, quotaManager.Consume("", 1000))
+	session := <-accounting
+	assert.ErrorIs(t, session.Err, ErrQuotaExceeded)
+
+	const refusedPackets = 3
+	for i := 0; i < refusedPackets; i++ {
+		_, err = shadowedConnection.WriteTo(packet, packetConnection.LocalAddr())
+		require.NoError(t, err)
+	}
+
+	// the refusal is logged once for the client session
+	assert.Equal(t, "connection from "+clientConnection.LocalAddr().String()+
+		": quota exceeded: for user ", <-logger.errors)
+
+	cancel()
+	err = <-errCh
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, logger.errors)
+}
+
+func Test_quotaRefusals(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	refusals := newQuotaRefusals(func() time.Time { return now })
+
+	assert.True(t, refusals.first("1.2.3.4:5000"))
+	assert.False(t, refusals.first("1.2.3.4:5000"))
+	assert.True(t, refusals.first("1.2.3.4:6000"))
+
+	now = now.Add(refusalTimeout - time.Second)
+	assert.False(t, refusals.first("1.2.3.4:5000"))
+
+	// a new client session starts after the timeout without packets
+	now = now.Add(refusalTimeout)
+	assert.True(t, refusals.first("1.2.3.4:5000"))
+	assert.Len(t, refusals.lastSeen, 1, "expired addresses are pruned")
+}
@@ -0,0 +1,106 @@
+package udp
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qdm12/ss-server/pkg/ratelimit"
+)
+
+// maxSessionTargets is the maximum number of distinct
+// target addresses recorded for a session.
+const maxSessionTargets = 256
+
+// sessionPacketConn is the packet connection of a NAT entry,
+// counting the bytes written and recording the target
+// addresses written to with its writeTo method.
+type sessionPacketConn struct {
+	net.PacketConn
+	// rateLimiter limits the bandwidth of the session,
+	// and is nil if the bandwidth is not limited.
+	rateLimiter *ratelimit.Session
+	// quotaExceeded is set when the session is
+	// closed because its user exceeded its quota.
+	quotaExceeded atomic.Bool
+	mutex         sync.Mutex
+	bytesWritten  int64
+	targets       []string
+	seenTargets   map[string]struct{}
+}
+
+func newSessionPacketConn(packetConnection net.PacketConn,
+	rateLimiter *ratelimit.Session) *sessionPacketConn {
+	return &sessionPacketConn{
+		PacketConn:  packetConnection,
+		rateLimiter: rateLimiter,
+		seenTargets: make(map[string]struct{}),
+	}
+}
+
+// writeTo writes the packet to the address given, and records the
+// bytes written and the target address as requested by the client,
+// which can be a domain name address not resolved.
+func (s *sessionPacketConn) writeTo(packet []byte, address net.Addr, target string) (
+	n int, err error) {
+	n, err = s.PacketConn.WriteTo(packet, address)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.bytesWritten += int64(n)
+	_, seen := s.seenTargets[target]
+	if !seen && len(s.targets) < maxSessionTargets {
+		s.seenTargets[target] = struct{}{}
+		s.targets = append(s.targets, target)
+	}
+	return n, err
+}
+
+// stats returns the number of bytes written and
+// the target addresses written to.
+func (s *sessionPacketConn) stats() (bytesWritten int64, targets []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.bytesWritten, append([]string(nil), s.targets...)
+}
+
+// refusalTimeout is the duration without refused packets from a
+// client address after which its client session is considered ended,
+// like the idle timeout of NAT entries.
+const refusalTimeout = time.Minute
+
+// quotaRefusals records the client addresses whose packets are
+// refused because their user exceeded its quota, to log a refusal
+// once per client session instead of once per packet. It is only
+// used by the goroutine serving packets, so it is not locked.
+type quotaRefusals struct {
+	timeNow   func() time.Time
+	lastSeen  map[string]time.Time
+	lastPrune time.Time
+}
+
+func newQuotaRefusals(timeNow func() time.Time) *quotaRefusals {
+	return &quotaRefusals{
+		timeNow:   timeNow,
+		lastSeen:  make(map[string]time.Time),
+		lastPrune: timeNow(),
+	}
+}
+
+// first records a refused packet from the client address given, and
+// returns true if it is the first refused packet of the client session.
+func (q *quotaRefusals) first(address string) bool {
+	now := q.timeNow()
+	if now.Sub(q.lastPrune) >= refusalTimeout {
+		for seenAddress, lastSeen := range q.lastSeen {
+			if now.Sub(lastSeen) >= refusalTimeout {
+				delete(q.lastSeen, seenAddress)
+			}
+		}
+		q.lastPrune = now
+	}
+
+	lastSeen, seen := q.lastSeen[address]
+	q.lastSeen[address] = now
+	return !seen || now.Sub(lastSeen) >= refusalTimeout
+}
@@ -2,10 +2,12 @@ package udp
 
 import (
 	"errors"
+	"net"
 	"testing"
 
 	"github.com/qdm12/gosettings/validate"
 	"github.com/qdm12/ss-server/internal/core"
+	"github.com/qdm12/ss-server/internal/upstream"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -25,6 +27,17 @@ func Test_Settings_SetDefaults(t *testing.T) {
 				LogAddresses: ptrTo(false),
 				CipherName:   core.Chacha20IetfPoly1305,
 				Password:     ptrTo(""),
+				Key:          ptrTo(""),
+				Outbound: Outbound{
+					CipherName: core.Chacha20IetfPoly1305,
+					Password:   ptrTo(""),
+					Key:        ptrTo(""),
+				},
+				PacketListener: &net.ListenConfig{},
+				Dialer:         &net.Dialer{},
+				Metrics:        noopMetrics{},
+				Accounting:     noopAccounting{},
+				Quota:          noopQuota{},
 			},
 		},
 		"already set settings": {
@@ -33,12 +46,24 @@ func Test_Settings_SetDefaults(t *testing.T) {
 				LogAddresses: ptrTo(true),
 				CipherName:   core.AES128gcm,
 				Password:     ptrTo("password"),
+				Key:          ptrTo(""),
 			},
 			expected: Settings{
 				Address:      ptrTo(":0"),
 				LogAddresses: ptrTo(true),
 				CipherName:   core.AES128gcm,
 				Password:     ptrTo("password"),
+				Key:          ptrTo(""),
+				Outbound: Outbound{
+					CipherName: core.Chacha20IetfPoly1305,
+					Password:   ptrTo(""),
+					Key:        ptrTo(""),
+				},
+				PacketListener: &net.ListenConfig{},
+				Dialer:         &net.Dialer{},
+				Metrics:        noopMetrics{},
+				Accounting:     noopAccounting{},
+				Quota:          noopQuota{},
 			},
 		},
 	}
@@ -209,7 +234,123 @@ func Test_Settings_Validate(t *testing.T) {
 			},
 			errWrapped: validate.ErrValueNotOneOf,
 			errMessage: "cipher: value is not one of the possible choices: " +
-				"garbage must be one of aes-128-gcm, aes-256-gcm or chacha20-ietf-poly1305",
+				"garbage must be one of aes-128-gcm, aes-192-gcm, aes-256-gcm, " +
+				"chacha20-ietf-poly1305, xchacha20-ietf-poly1305, " +
+				"2022-blake3-aes-128-gcm, 2022-blake3-aes-256-gcm or 2022-blake3-chacha20-poly1305",
+		},
+		"invalid 2022 pre-shared key": {
+			settings: Settings{
+				Address:    ptrTo(":0"),
+				CipherName: core.Blake3AES128gcm,
+				Password:   ptrTo("AAAA"),
+			},
+			errWrapped: core.ErrPreSharedKeyBadSize,
+			errMessage: "password: pre-shared key has a bad size: 3 bytes instead of 16 bytes",
+		},
+		"users not supported": {
+			settings: Settings{
+				Address:    ptrTo(":0"),
+				CipherName: core.Blake3Chacha20Poly1305,
+				Password:   ptrTo("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="),
+				Users: []User{
+					{Name: "alice", Password: "AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="},
+				},
+			},
+			errWrapped: core.ErrUsersNotSupported,
+			errMessage: "users: users are not supported: for cipher 2022-blake3-chacha20-poly1305",
+		},
+		"user cipher not legacy": {
+			settings: Settings{
+				Address:    ptrTo(":0"),
+				CipherName: core.AES128gcm,
+				Users: []User{
+					{Name: "alice", CipherName: core.Blake3AES128gcm, Password: "password"},
+				},
+			},
+			errWrapped: core.ErrUserCipherNotLegacy,
+			errMessage: "users: user alice: user cipher is not a legacy AEAD cipher: 2022-blake3-aes-128-gcm",
+		},
+		"duplicate user name": {
+			settings: Settings{
+				Address:    ptrTo(":0"),
+				CipherName: core.Blake3AES128gcm,
+				Password:   ptrTo("AAAAAAAAAAAAAAAAAAAAAA=="),
+				Users: []User{
+					{Name: "alice", Password: "AQAAAAAAAAAAAAAAAAAAAA=="},
+					{Name: "alice", Password: "AgAAAAAAAAAAAAAAAAAAAA=="},
+				},
+			},
+			errWrapped: core.ErrUserNameDuplicate,
+			errMessage: "users: user name is duplicated: alice",
+		},
+		"invalid key": {
+			settings: Settings{
+				Address:    ptrTo(":0"),
+				CipherName: core.AES128gcm,
+				Key:        ptrTo("AAAA"),
+			},
+			errWrapped: core.ErrPreSharedKeyBadSize,
+			errMessage: "key: pre-shared key has a bad size: 3 bytes instead of 16 bytes",
+		},
+		"valid settings with key": {
+			settings: Settings{
+				Address:    ptrTo(":0"),
+				CipherName: core.AES128gcm,
+				Key:        ptrTo("AAAAAAAAAAAAAAAAAAAAAA=="),
+			},
+		},
+		"upstream HTTP proxy without UDP": {
+			settings: Settings{
+				Address:       ptrTo(":0"),
+				CipherName:    core.AES128gcm,
+				UpstreamProxy: "http://127.0.0.1:3128",
+			},
+			errWrapped: upstream.ErrUDPNotSupported,
+			errMessage: "upstream proxy: UDP is not supported by the proxy scheme: http",
+		},
+		"valid settings with SOCKS5 upstream proxy": {
+			settings: Settings{
+				Address:       ptrTo(":0"),
+				CipherName:    core.AES128gcm,
+				UpstreamProxy: "socks5://127.0.0.1:1080",
+			},
+		},
+		"outbound address without port": {
+			settings: Settings{
+				Address:    ptrTo(":0"),
+				CipherName: core.AES128gcm,
+				Outbound: Outbound{
+					Address: "1.2.3.4",
+				},
+			},
+			errWrapped: errNothingWrapped,
+			errMessage: "outbound: address: address 1.2.3.4: missing port in address",
+		},
+		"outbound 2022 cipher": {
+			settings: Settings{
+				Address:    ptrTo(":0"),
+				CipherName: core.AES128gcm,
+				Outbound: Outbound{
+					Address:    "1.2.3.4:8388",
+					CipherName: core.Blake3AES128gcm,
+				},
+			},
+			errWrapped: validate.ErrValueNotOneOf,
+			errMessage: "outbound: cipher: value is not one of the possible choices: " +
+				"2022-blake3-aes-128-gcm must be one of aes-128-gcm, aes-192-gcm, aes-256-gcm, " +
+				"chacha20-ietf-poly1305 or xchacha20-ietf-poly1305",
+		},
+		"valid settings with outbound": {
+			settings: Settings{
+				Address:    ptrTo(":0"),
+				CipherName: core.Blake3AES128gcm,
+				Password:   ptrTo("AAAAAAAAAAAAAAAAAAAAAA=="),
+				Outbound: Outbound{
+					Address:    "1.2.3.4:8388",
+					CipherName: core.AES256gcm,
+					Password:   ptrTo("password"),
+				},
+			},
 		},
 		"valid settings": {
 			settings: Settings{
@@ -217,6 +358,34 @@ func Test_Settings_Validate(t *testing.T) {
 				CipherName: core.AES128gcm,
 			},
 		},
+		"valid settings with users": {
+			settings: Settings{
+				Address:    ptrTo(":0"),
+				CipherName: core.AES128gcm,
+				Users: []User{
+					{Name: "alice", Password: "password1"},
+					{Name: "bob", CipherName: core.Chacha20IetfPoly1305, Password: "password2"},
+				},
+			},
+		},
+		"valid 2022 settings": {
+			settings: Settings{
+				Address:    ptrTo(":0"),
+				CipherName: core.Blake3AES128gcm,
+				Password:   ptrTo("AAAAAAAAAAAAAAAAAAAAAA=="),
+			},
+		},
+		"valid 2022 settings with users": {
+			settings: Settings{
+				Address:    ptrTo(":0"),
+				CipherName: core.Blake3AES128gcm,
+				Password:   ptrTo("AAAAAAAAAAAAAAAAAAAAAA=="),
+				Users: []User{
+					{Name: "alice", Password: "AQAAAAAAAAAAAAAAAAAAAA=="},
+					{Name: "bob", Password: "AgAAAAAAAAAAAAAAAAAAAA=="},
+				},
+			},
+		},
 	}
 
 	for name, testCase := range testCases {